@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminHandler serves the app's operational endpoints:
+//
+//	/healthz     liveness, no database round trip
+//	/readyz      readiness, pings the database
+//	/metrics     per-statement latency, temp spills, per-caller load and TTL expiry in the Prometheus format
+//	/debug/pool  pool counters as JSON, streamed with ?interval=1s
+//	/debug/jobs  job queue listing, with POST /debug/jobs/{retry,requeue,purge}
+//	/debug/scheduler  scheduled jobs with their next, last and ?n= upcoming runs as JSON
+//	/debug/vars  expvar, including the crash dump bundle as "pgxpool"
+//
+// Requests other than GET and HEAD change data, so they need
+// "Authorization: Bearer <AdminToken>" and are refused while AdminToken is
+// empty.
+func (app *App) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", LivenessHandler())
+	mux.Handle("/readyz", app.ReadinessHandler(1, 2*time.Second))
+	mux.Handle("/debug/pool", app.PoolStatsHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	if app.Jobs != nil {
+		jobs := requireAdminToken(app.AdminToken, app.Jobs.AdminHandler("/debug/jobs"))
+		mux.Handle("/debug/jobs", jobs)
+		mux.Handle("/debug/jobs/", jobs)
+	}
+	if app.Scheduler != nil {
+		mux.Handle("/debug/scheduler", app.Scheduler)
+	}
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if app.Statements != nil {
+			app.Statements.ServeHTTP(w, r)
+		}
+		if app.Spills != nil {
+			app.Spills.ServeHTTP(w, r)
+		}
+		if app.Callers != nil {
+			app.Callers.ServeHTTP(w, r)
+		}
+		if app.TTL != nil {
+			app.TTL.ServeHTTP(w, r)
+		}
+	})
+	return mux
+}
+
+// requireAdminToken passes reads to h and only lets writes through with
+// the bearer token
+func requireAdminToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if token == "" {
+			http.Error(w, "admin writes are disabled, set PG_ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin serves the admin endpoints on addr until ctx is cancelled. An
+// addr without a host, such as ":9090", listens on 127.0.0.1 only.
+func (app *App) serveAdmin(ctx context.Context, addr string) error {
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           app.AdminHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving admin endpoints", slog.String("addr", addr))
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
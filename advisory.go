@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AdvisoryKey derives a lock key from a name such as a job's, so callers
+// need not coordinate numeric keys
+func AdvisoryKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// WithAdvisoryLock runs fn while holding the session-level advisory lock
+// key, waiting for it while another session holds it, so a job scheduled
+// on every replica runs on one at a time. The lock is taken and released
+// on one connection pinned for the duration; fn uses the pool as usual.
+//
+// The lock needs a session, so it does not work through PgBouncer in
+// transaction pooling mode. If the pinned connection is lost while fn
+// runs, the server releases the lock early.
+func WithAdvisoryLock(ctx context.Context, db *pgxpool.Pool, key int64, fn func(ctx context.Context) error) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		conn.Release()
+		return fmt.Errorf("error taking advisory lock %d: %w", key, err)
+	}
+	defer advisoryUnlock(ctx, conn, key)
+	return fn(ctx)
+}
+
+// TryAdvisoryLock runs fn if the advisory lock key is free, returning
+// false without running it when another session holds the lock
+func TryAdvisoryLock(ctx context.Context, db *pgxpool.Pool, key int64, fn func(ctx context.Context) error) (bool, error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		conn.Release()
+		return false, fmt.Errorf("error taking advisory lock %d: %w", key, err)
+	}
+	if !locked {
+		conn.Release()
+		return false, nil
+	}
+	defer advisoryUnlock(ctx, conn, key)
+	return true, fn(ctx)
+}
+
+// advisoryUnlock releases key and returns conn to the pool. A connection
+// that cannot confirm the unlock is closed instead, which releases every
+// lock its session holds, so a lock never stays behind on a pooled
+// connection.
+func advisoryUnlock(ctx context.Context, conn *pgxpool.Conn, key int64) {
+	ctx = context.WithoutCancel(ctx)
+	var unlocked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_advisory_unlock($1)", key).Scan(&unlocked); err != nil || !unlocked {
+		if err != nil {
+			slog.Error("Error releasing advisory lock", slog.Int64("key", key), slog.String("error", err.Error()))
+		}
+		_ = conn.Conn().Close(ctx)
+	}
+	conn.Release()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WithAnalytics builds a pool for reporting queries. Statements use the
+// simple protocol, since ad hoc reports rarely repeat and would only fill
+// the statement cache, and run with statementTimeout instead of the
+// session default meant for OLTP traffic.
+func WithAnalytics(statementTimeout time.Duration) PoolOption {
+	return func(s *poolSettings) {
+		cc := s.config.ConnConfig
+		cc.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+		cc.StatementCacheCapacity = 0
+		if statementTimeout > 0 {
+			cc.RuntimeParams["statement_timeout"] = fmt.Sprint(statementTimeout.Milliseconds())
+		}
+	}
+}
+
+// analyticsConfig returns the settings of the analytics pool, or nil when
+// PG_ANALYTICS_MAX_CONNS is unset. It connects like the primary unless
+// PG_ANALYTICS_URL names another server, such as a replica.
+func (c *DBConfig) analyticsConfig() (*DBConfig, error) {
+	if c.AnalyticsMaxConns <= 0 {
+		return nil, nil
+	}
+	cfg := *c
+	if c.AnalyticsURL != "" {
+		parsed, err := ConfigFromURL(c.AnalyticsURL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing analytics url: %w", err)
+		}
+		parsed.LazyConnect = c.LazyConnect
+		cfg = *parsed
+	}
+	cfg.MaxConns = c.AnalyticsMaxConns
+	cfg.MinConns = 0
+	cfg.MaxConnLifeTime = c.AnalyticsMaxConnLifeTime
+	if cfg.MaxConnLifeTime <= 0 {
+		cfg.MaxConnLifeTime = 4 * time.Hour
+	}
+	return &cfg, nil
+}
+
+// Analytics returns the pool for reporting queries, so long scans do not
+// take connections from OLTP traffic. It is the main pool when no
+// analytics pool is configured.
+func (app *App) Analytics() *pgxpool.Pool {
+	if app.analytics != nil {
+		return app.analytics
+	}
+	return app.primary()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ArgArray passes s as an array parameter such as text[], int8[] or
+// uuid[]. pgx sends a nil slice as NULL, which matches nothing under = ANY
+// and fails NOT NULL array columns; ArgArray sends it as an empty array.
+func ArgArray[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// ScanArray is a pgx.RowToFunc reading a row's single array column into a
+// slice. A NULL array gives a nil slice.
+//
+//	tags, err := pgx.CollectOneRow(rows, ScanArray[string])
+func ScanArray[T any](row pgx.CollectableRow) ([]T, error) {
+	var s []T
+	err := row.Scan(&s)
+	return s, err
+}
+
+// AnyOf builds a "column = ANY($n::type[])" condition and its argument to
+// replace a long IN list: the statement keeps one parameter and one cached
+// plan however many values there are, and never nears the 65535 parameter
+// limit. The array type comes from T, so it also resolves under the simple
+// protocol; named types such as enums, and types it does not know, are
+// left for the server to infer. column is written as given, so it may be
+// qualified but must not come from user input.
+//
+//	cond, ids := AnyOf("id", 1, userIDs)
+//	rows, err := db.Query(ctx, "SELECT id, name FROM users WHERE "+cond, ids)
+func AnyOf[T any](column string, param int, values []T) (string, []T) {
+	cond := fmt.Sprintf("%s = ANY($%d", column, param)
+	if typ := arrayElemType(reflect.TypeFor[T]()); typ != "" {
+		cond += "::" + typ + "[]"
+	}
+	return cond + ")", ArgArray(values)
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// arrayElemType returns the Postgres type for elements of Go type t
+func arrayElemType(t reflect.Type) string {
+	if t == timeType {
+		return "timestamptz"
+	}
+	// uuid.UUID and pgtype.UUID's byte form
+	if t.Kind() == reflect.Array && t.Len() == 16 && t.Elem().Kind() == reflect.Uint8 {
+		return "uuid"
+	}
+	if t.PkgPath() != "" {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "text"
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return "int8"
+	case reflect.Int32, reflect.Uint16:
+		return "int4"
+	case reflect.Int16, reflect.Int8:
+		return "int2"
+	case reflect.Float64:
+		return "float8"
+	case reflect.Float32:
+		return "float4"
+	case reflect.Bool:
+		return "bool"
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AsRole runs fn in a transaction under SET LOCAL ROLE role, for least
+// privilege paths such as reports run as a read-only role over the same
+// pool and credentials. The pool's login role must be a member of role;
+// dbctx.WithPool picks another of the app's pools.
+// It commits when fn returns nil and rolls back otherwise.
+//
+// The role ends with the transaction. In case fn ran a plain SET ROLE,
+// which would outlive it, the connection is also reset with RESET ROLE
+// before going back to the pool, and closed if that fails.
+func (app *App) AsRole(ctx context.Context, role string, fn func(tx pgx.Tx) error) error {
+	if role == "" {
+		return errors.New("no role to run as")
+	}
+	conn, err := app.Pool(ctx).Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, resetErr := conn.Exec(context.WithoutCancel(ctx), "RESET ROLE"); resetErr != nil {
+			_ = conn.Conn().Close(context.WithoutCancel(ctx))
+		}
+		conn.Release()
+	}()
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{role}.Sanitize()); err != nil {
+			return fmt.Errorf("error setting role %s: %w", role, err)
+		}
+		return fn(tx)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AuditEvent is one statement that changed rows
+type AuditEvent struct {
+	At        time.Time `json:"at"`
+	Actor     string    `json:"actor,omitempty"` // From dbctx.WithActor
+	Caller    string    `json:"caller,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Verb      string    `json:"verb"`
+	Tables    []string  `json:"tables"`
+	Statement string    `json:"statement"` // Normalized, so values are not recorded
+	Rows      int64     `json:"rows"`
+}
+
+// AuditLog is a query tracer recording every INSERT, UPDATE, DELETE and
+// MERGE that affected rows, with who ran it, for compliance. Statements
+// are recorded normalized, without their values. Batches and CopyFrom are
+// not traced as queries and so are not recorded.
+//
+// Events go to the audit table when DB is set, written in batches by Run
+// with COPY so they are not audited themselves; otherwise, and for events
+// that cannot be queued, they are logged at Info as "Audit" records.
+// Events are recorded after the statement, so one whose transaction later
+// rolls back is still logged.
+type AuditLog struct {
+	DB            *pgxpool.Pool
+	Table         string
+	Logger        *slog.Logger  // Default slog.Default()
+	FlushInterval time.Duration // How often Run writes queued events, default 1s
+	MaxPending    int           // Events queued before further ones are logged instead, default 10000
+	Clock         Clock
+
+	mu      sync.Mutex
+	pending []AuditEvent
+}
+
+// NewAuditLog creates an audit log writing to table, creating it if needed
+func NewAuditLog(ctx context.Context, db *pgxpool.Pool, table string) (*AuditLog, error) {
+	a := &AuditLog{DB: db, Table: table, FlushInterval: time.Second}
+	_, err := db.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(table)+` (
+		at timestamptz NOT NULL,
+		actor text NOT NULL,
+		caller text NOT NULL,
+		request_id text NOT NULL,
+		verb text NOT NULL,
+		tables text[] NOT NULL,
+		statement text NOT NULL,
+		rows bigint NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", table, err)
+	}
+	return a, nil
+}
+
+type auditQueryKey struct{}
+
+func (a *AuditLog) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, auditQueryKey{}, data.SQL)
+}
+
+func (a *AuditLog) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	sql, ok := ctx.Value(auditQueryKey{}).(string)
+	if !ok || data.Err != nil || data.CommandTag.RowsAffected() == 0 {
+		return
+	}
+	tag := data.CommandTag
+	if !tag.Insert() && !tag.Update() && !tag.Delete() && !strings.HasPrefix(tag.String(), "MERGE") {
+		return
+	}
+
+	st := ParseStatement(sql)
+	a.record(AuditEvent{
+		At:        clockOr(a.Clock).Now(),
+		Actor:     dbctx.Actor(ctx),
+		Caller:    dbctx.Caller(ctx),
+		RequestID: dbctx.RequestID(ctx),
+		Verb:      strings.Fields(tag.String())[0],
+		Tables:    st.Tables,
+		Statement: NormalizeSQL(sql),
+		Rows:      tag.RowsAffected(),
+	})
+}
+
+// record queues ev for the audit table, or logs it
+func (a *AuditLog) record(ev AuditEvent) {
+	if a.DB != nil {
+		maxPending := a.MaxPending
+		if maxPending <= 0 {
+			maxPending = 10000
+		}
+		a.mu.Lock()
+		queued := len(a.pending) < maxPending
+		if queued {
+			a.pending = append(a.pending, ev)
+		}
+		a.mu.Unlock()
+		if queued {
+			return
+		}
+	}
+	a.log(ev)
+}
+
+func (a *AuditLog) log(ev AuditEvent) {
+	logger := a.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Info("Audit",
+		slog.Time("at", ev.At),
+		slog.String("actor", ev.Actor),
+		slog.String("caller", ev.Caller),
+		slog.String("request_id", ev.RequestID),
+		slog.String("verb", ev.Verb),
+		slog.Any("tables", ev.Tables),
+		slog.String("statement", ev.Statement),
+		slog.Int64("rows", ev.Rows),
+	)
+}
+
+// Flush writes the queued events to the audit table. Events that fail to
+// write are queued again for the next flush.
+func (a *AuditLog) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	rows := make([][]any, len(pending))
+	for i, ev := range pending {
+		tables := ev.Tables
+		if tables == nil {
+			tables = []string{}
+		}
+		rows[i] = []any{ev.At, ev.Actor, ev.Caller, ev.RequestID, ev.Verb, tables, ev.Statement, ev.Rows}
+	}
+	_, err := a.DB.CopyFrom(ctx, pgx.Identifier(strings.Split(a.Table, ".")),
+		[]string{"at", "actor", "caller", "request_id", "verb", "tables", "statement", "rows"},
+		pgx.CopyFromRows(rows))
+	if err != nil {
+		a.mu.Lock()
+		a.pending = append(pending, a.pending...)
+		a.mu.Unlock()
+		return fmt.Errorf("error writing audit events: %w", err)
+	}
+	return nil
+}
+
+// Run writes queued events every FlushInterval until ctx is cancelled,
+// then once more. Events still queued when the last write fails are
+// logged so they are not lost.
+func (a *AuditLog) Run(ctx context.Context) error {
+	interval := a.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	clock := clockOr(a.Clock)
+	for {
+		if err := clock.Sleep(ctx, interval); err != nil {
+			err := a.Flush(context.WithoutCancel(ctx))
+			if err != nil {
+				a.mu.Lock()
+				pending := a.pending
+				a.pending = nil
+				a.mu.Unlock()
+				for _, ev := range pending {
+					a.log(ev)
+				}
+			}
+			return err
+		}
+		if err := a.Flush(ctx); err != nil {
+			slog.Error("Error writing audit events", slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BackfillFunc processes one batch and returns the number of rows it
+// touched. Returning zero rows ends the backfill.
+type BackfillFunc func(ctx context.Context, db *pgxpool.Pool) (int64, error)
+
+// Backfill runs a batch function repeatedly, slowing down when the primary
+// pool or a replica is under pressure and pausing entirely past the hard
+// limits until things recover
+type Backfill struct {
+	Name    string
+	DB      *pgxpool.Pool // Pool the batches run on, monitored for saturation
+	Replica *pgxpool.Pool // Optional pool on a replica, monitored for replication lag
+	Batch   BackfillFunc
+
+	Interval      time.Duration // Delay between batches when healthy, default 100ms
+	MaxInterval   time.Duration // Upper bound for the delay while slowed down, default 10s
+	CheckInterval time.Duration // How often to re-check health while paused, default 5s
+	MaxReplicaLag time.Duration // Pause above this lag, default 30s; slow down above half of it
+	MaxPoolUsage  float64       // Pause above this fraction of MaxConns in use, default 0.8; slow down above half of it
+	Clock         Clock         // Default SystemClock
+}
+
+// BackfillStats summarizes a finished or interrupted backfill
+type BackfillStats struct {
+	Batches  int
+	Rows     int64
+	Paused   time.Duration
+	Duration time.Duration
+}
+
+type backfillHealth int
+
+const (
+	backfillHealthy backfillHealth = iota
+	backfillSlow
+	backfillPause
+)
+
+func (b *Backfill) withDefaults() Backfill {
+	c := *b
+	if c.Name == "" {
+		c.Name = "backfill"
+	}
+	if c.Interval <= 0 {
+		c.Interval = 100 * time.Millisecond
+	}
+	if c.MaxInterval <= 0 {
+		c.MaxInterval = 10 * time.Second
+	}
+	if c.MaxInterval < c.Interval {
+		c.MaxInterval = c.Interval
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = 5 * time.Second
+	}
+	if c.MaxReplicaLag <= 0 {
+		c.MaxReplicaLag = 30 * time.Second
+	}
+	if c.MaxPoolUsage <= 0 {
+		c.MaxPoolUsage = 0.8
+	}
+	c.Clock = clockOr(c.Clock)
+	return c
+}
+
+// Run executes batches until one reports zero rows, a batch fails, or ctx
+// is cancelled
+func (b *Backfill) Run(ctx context.Context) (BackfillStats, error) {
+	if b.DB == nil || b.Batch == nil {
+		return BackfillStats{}, errors.New("backfill requires DB and Batch")
+	}
+	cfg := b.withDefaults()
+	log := slog.With(slog.String("backfill", cfg.Name))
+
+	var stats BackfillStats
+	clock := cfg.Clock
+	start := clock.Now()
+	delay := cfg.Interval
+	paused := false
+
+	for {
+		health, reason, err := cfg.health(ctx)
+		if err != nil {
+			stats.Duration = clock.Now().Sub(start)
+			return stats, err
+		}
+
+		switch health {
+		case backfillPause:
+			if !paused {
+				log.Warn("Backfill paused", slog.String("reason", reason))
+				paused = true
+			}
+			pauseStart := clock.Now()
+			if err := clock.Sleep(ctx, cfg.CheckInterval); err != nil {
+				stats.Duration = clock.Now().Sub(start)
+				return stats, err
+			}
+			stats.Paused += clock.Now().Sub(pauseStart)
+			continue
+		case backfillSlow:
+			delay = min(delay*2, cfg.MaxInterval)
+		default:
+			delay = max(delay/2, cfg.Interval)
+		}
+		if paused {
+			log.Info("Backfill resumed", slog.Duration("paused_for", stats.Paused))
+			paused = false
+		}
+
+		rows, err := cfg.Batch(ctx, cfg.DB)
+		if err != nil {
+			stats.Duration = clock.Now().Sub(start)
+			return stats, fmt.Errorf("backfill batch %d failed: %w", stats.Batches+1, err)
+		}
+		stats.Batches++
+		stats.Rows += rows
+		if rows == 0 {
+			stats.Duration = clock.Now().Sub(start)
+			log.Info("Backfill complete",
+				slog.Int("batches", stats.Batches),
+				slog.Int64("rows", stats.Rows),
+				slog.Duration("duration", stats.Duration))
+			return stats, nil
+		}
+
+		if err := clock.Sleep(ctx, delay); err != nil {
+			stats.Duration = clock.Now().Sub(start)
+			return stats, err
+		}
+	}
+}
+
+// health classifies current pool usage and replica lag against the limits
+func (b *Backfill) health(ctx context.Context) (backfillHealth, string, error) {
+	state := backfillHealthy
+	reason := ""
+
+	stat := b.DB.Stat()
+	if stat.MaxConns() > 0 {
+		usage := float64(stat.AcquiredConns()) / float64(stat.MaxConns())
+		switch {
+		case usage >= b.MaxPoolUsage:
+			return backfillPause, fmt.Sprintf("pool usage %.0f%%", usage*100), nil
+		case usage >= b.MaxPoolUsage/2:
+			state, reason = backfillSlow, fmt.Sprintf("pool usage %.0f%%", usage*100)
+		}
+	}
+
+	if b.Replica != nil {
+		lag, err := ReplicaLag(ctx, b.Replica)
+		if err != nil {
+			if ctx.Err() != nil {
+				return state, reason, ctx.Err()
+			}
+			// An unreachable replica is treated as maximally lagging
+			return backfillPause, "replica lag unknown: " + err.Error(), nil
+		}
+		switch {
+		case lag >= b.MaxReplicaLag:
+			return backfillPause, "replica lag " + lag.String(), nil
+		case lag >= b.MaxReplicaLag/2:
+			state, reason = backfillSlow, "replica lag "+lag.String()
+		}
+	}
+
+	return state, reason, nil
+}
+
+// ReplicaLag reports how far a standby is behind its primary. A standby that
+// has replayed everything it received reports zero even if the primary has
+// been idle for a while.
+func ReplicaLag(ctx context.Context, replica *pgxpool.Pool) (time.Duration, error) {
+	var seconds float64
+	err := replica.QueryRow(ctx, `
+		SELECT CASE
+			WHEN NOT pg_is_in_recovery() THEN 0
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END::float8`).Scan(&seconds)
+	if err != nil {
+		return 0, fmt.Errorf("error reading replica lag: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
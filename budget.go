@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrBudgetExceeded is matched by errors.Is on every *BudgetError
+var ErrBudgetExceeded = errors.New("query budget exceeded")
+
+// BudgetStatement is one normalized statement run by a request over budget
+type BudgetStatement struct {
+	SQL       string        `json:"sql"`
+	Count     int           `json:"count"`
+	QueryTime time.Duration `json:"query_time_ns"`
+}
+
+// BudgetError describes a request that ran more queries or spent more
+// time in the database than its QueryBudget allows
+type BudgetError struct {
+	Queries      int               `json:"queries"`
+	QueryTime    time.Duration     `json:"query_time_ns"`
+	MaxQueries   int               `json:"max_queries,omitempty"`
+	MaxQueryTime time.Duration     `json:"max_query_time_ns,omitempty"`
+	Statements   []BudgetStatement `json:"statements"` // Most frequent first, at most 10
+}
+
+func (e *BudgetError) Error() string {
+	queries := fmt.Sprintf("%d queries", e.Queries)
+	if e.MaxQueries > 0 {
+		queries += fmt.Sprintf(" (max %d)", e.MaxQueries)
+	}
+	queryTime := fmt.Sprintf("%s of query time", e.QueryTime)
+	if e.MaxQueryTime > 0 {
+		queryTime += fmt.Sprintf(" (max %s)", e.MaxQueryTime)
+	}
+	return fmt.Sprintf("%s: %s, %s", ErrBudgetExceeded, queries, queryTime)
+}
+
+func (e *BudgetError) Is(target error) bool { return target == ErrBudgetExceeded }
+
+// QueryBudget caps the database work of one HTTP request, to catch N+1
+// loops and other pathological endpoints in staging before they reach
+// production. Its Middleware tracks each request and, as a query tracer on
+// the pool, counts the queries run with the request's context.
+//
+// Once a request goes over MaxQueries or MaxQueryTime its context is
+// cancelled with a *BudgetError as the cause, so its remaining queries
+// fail, and it is answered 500 with the statements it ran unless the
+// handler already wrote a response. Query time is checked as queries
+// finish. With LogOnly, requests over budget are only logged.
+type QueryBudget struct {
+	MaxQueries   int           // Zero is unlimited
+	MaxQueryTime time.Duration // Cumulative time in queries, zero is unlimited
+	LogOnly      bool          // Log requests over budget without failing them, for production
+	Clock        Clock         // Default SystemClock
+}
+
+type budgetKey struct{}
+
+type budgetStartKey struct{}
+
+type budgetStart struct {
+	at        time.Time
+	statement *BudgetStatement
+}
+
+// budgetUsage is the work done so far by one request
+type budgetUsage struct {
+	cancel context.CancelCauseFunc
+
+	mu         sync.Mutex
+	queries    int
+	queryTime  time.Duration
+	statements map[string]*BudgetStatement
+	exceeded   *BudgetError
+}
+
+// Middleware enforces the budget on every request served by next
+func (b *QueryBudget) Middleware(next http.Handler) http.Handler {
+	if b.MaxQueries <= 0 && b.MaxQueryTime <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		usage := &budgetUsage{cancel: cancel, statements: make(map[string]*BudgetStatement)}
+		bw := &budgetWriter{ResponseWriter: w}
+
+		next.ServeHTTP(bw, r.WithContext(context.WithValue(ctx, budgetKey{}, usage)))
+
+		usage.mu.Lock()
+		var exceeded *BudgetError
+		if usage.exceeded != nil {
+			exceeded = usage.report(b) // Totals at the end of the request
+		}
+		usage.mu.Unlock()
+		if exceeded == nil {
+			return
+		}
+		attrs := []any{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("queries", exceeded.Queries),
+			slog.Duration("query_time", exceeded.QueryTime),
+		}
+		if len(exceeded.Statements) > 0 {
+			attrs = append(attrs, slog.String("top_statement", summarizeSQL(exceeded.Statements[0].SQL, 200)))
+		}
+		slog.Warn("Request exceeded query budget", attrs...)
+
+		if b.LogOnly || bw.wrote {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+			*BudgetError
+		}{exceeded.Error(), exceeded})
+	})
+}
+
+func (b *QueryBudget) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	usage, ok := ctx.Value(budgetKey{}).(*budgetUsage)
+	if !ok {
+		return ctx
+	}
+	sql := NormalizeSQL(data.SQL)
+
+	usage.mu.Lock()
+	usage.queries++
+	st, ok := usage.statements[sql]
+	if !ok {
+		st = &BudgetStatement{SQL: sql}
+		usage.statements[sql] = st
+	}
+	st.Count++
+	b.check(usage)
+	usage.mu.Unlock()
+
+	return context.WithValue(ctx, budgetStartKey{}, budgetStart{at: clockOr(b.Clock).Now(), statement: st})
+}
+
+func (b *QueryBudget) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryEndData) {
+	usage, ok := ctx.Value(budgetKey{}).(*budgetUsage)
+	if !ok {
+		return
+	}
+	start, ok := ctx.Value(budgetStartKey{}).(budgetStart)
+	if !ok {
+		return
+	}
+	elapsed := clockOr(b.Clock).Now().Sub(start.at)
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.queryTime += elapsed
+	start.statement.QueryTime += elapsed
+	b.check(usage)
+}
+
+// check records the first time usage goes over budget and cancels the
+// request. The caller holds usage.mu.
+func (b *QueryBudget) check(usage *budgetUsage) {
+	if usage.exceeded != nil {
+		return
+	}
+	if (b.MaxQueries <= 0 || usage.queries <= b.MaxQueries) && (b.MaxQueryTime <= 0 || usage.queryTime <= b.MaxQueryTime) {
+		return
+	}
+	usage.exceeded = usage.report(b)
+	if !b.LogOnly {
+		usage.cancel(usage.exceeded)
+	}
+}
+
+// report describes the usage so far. The caller holds u.mu.
+func (u *budgetUsage) report(b *QueryBudget) *BudgetError {
+	stmts := make([]BudgetStatement, 0, len(u.statements))
+	for _, st := range u.statements {
+		stmts = append(stmts, *st)
+	}
+	sort.Slice(stmts, func(i, j int) bool { return stmts[i].Count > stmts[j].Count })
+	return &BudgetError{
+		Queries:      u.queries,
+		QueryTime:    u.queryTime,
+		MaxQueries:   b.MaxQueries,
+		MaxQueryTime: b.MaxQueryTime,
+		Statements:   stmts[:min(len(stmts), 10)],
+	}
+}
+
+// budgetWriter notes whether the handler started its response
+type budgetWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *budgetWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *budgetWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// queryBudget builds the budget from PG_QUERY_BUDGET_*
+func (c *DBConfig) queryBudget() (*QueryBudget, error) {
+	b := &QueryBudget{MaxQueries: c.QueryBudgetQueries, MaxQueryTime: c.QueryBudgetTime}
+	switch c.QueryBudgetMode {
+	case "", "enforce":
+	case "log":
+		b.LogOnly = true
+	default:
+		return nil, fmt.Errorf("invalid query budget mode %q: expected enforce or log", c.QueryBudgetMode)
+	}
+	return b, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Sqlizer is a statement or condition that renders to SQL with ?
+// placeholders and its arguments. The method set is squirrel's, so
+// squirrel builders can be passed to QueryBuilder as they are.
+type Sqlizer interface {
+	ToSql() (string, []any, error)
+}
+
+// Expr is a raw SQL fragment with ? placeholders
+func Expr(sql string, args ...any) Sqlizer {
+	return expr{sql: sql, args: args}
+}
+
+type expr struct {
+	sql  string
+	args []any
+}
+
+func (e expr) ToSql() (string, []any, error) { return e.sql, e.args, nil }
+
+// Eq is column = value for each entry, ANDed. A nil value gives IS NULL and
+// a slice gives = ANY(?). Columns are written as given and must not come
+// from user input.
+type Eq map[string]any
+
+func (eq Eq) ToSql() (string, []any, error) {
+	cols := make([]string, 0, len(eq))
+	for col := range eq {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	var (
+		conds []string
+		args  []any
+	)
+	for _, col := range cols {
+		v := eq[col]
+		switch {
+		case v == nil:
+			conds = append(conds, col+" IS NULL")
+		case reflect.TypeOf(v).Kind() == reflect.Slice && reflect.TypeOf(v).Elem().Kind() != reflect.Uint8:
+			conds = append(conds, col+" = ANY(?)")
+			args = append(args, v)
+		default:
+			conds = append(conds, col+" = ?")
+			args = append(args, v)
+		}
+	}
+	if len(conds) == 0 {
+		return "TRUE", nil, nil
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// And joins conditions with AND, true when empty
+type And []Sqlizer
+
+func (a And) ToSql() (string, []any, error) { return joinSqlizers(a, " AND ", "TRUE") }
+
+// Or joins conditions with OR, false when empty
+type Or []Sqlizer
+
+func (o Or) ToSql() (string, []any, error) { return joinSqlizers(o, " OR ", "FALSE") }
+
+func joinSqlizers(parts []Sqlizer, sep, empty string) (string, []any, error) {
+	if len(parts) == 0 {
+		return empty, nil, nil
+	}
+	var (
+		sqls []string
+		args []any
+	)
+	for _, p := range parts {
+		sql, a, err := p.ToSql()
+		if err != nil {
+			return "", nil, err
+		}
+		sqls = append(sqls, "("+sql+")")
+		args = append(args, a...)
+	}
+	return strings.Join(sqls, sep), args, nil
+}
+
+// SelectBuilder composes a SELECT from optional parts, so filters can be
+// added conditionally without concatenating SQL. Methods return a new
+// builder and leave the receiver unchanged.
+//
+//	q := Select("id", "name").From("users").OrderBy("id")
+//	if name != "" {
+//		q = q.Where("name ILIKE ?", name+"%")
+//	}
+//	rows, err := QueryBuilder(ctx, db, q.Limit(50))
+type SelectBuilder struct {
+	columns []string
+	from    string
+	where   []Sqlizer
+	orderBy []string
+	limit   uint64
+	offset  uint64
+	suffix  string
+	err     error
+}
+
+// Select starts a SELECT of columns
+func Select(columns ...string) SelectBuilder {
+	return SelectBuilder{columns: columns}
+}
+
+func (b SelectBuilder) From(table string) SelectBuilder {
+	b.from = table
+	return b
+}
+
+// Where adds a condition, ANDed with the others: a string with ?
+// placeholders for args, an Eq, or any Sqlizer
+func (b SelectBuilder) Where(pred any, args ...any) SelectBuilder {
+	var cond Sqlizer
+	switch p := pred.(type) {
+	case string:
+		cond = Expr(p, args...)
+	case Sqlizer:
+		cond = p
+	default:
+		b.err = fmt.Errorf("unsupported where predicate %T", pred)
+		return b
+	}
+	b.where = append(b.where[:len(b.where):len(b.where)], cond)
+	return b
+}
+
+func (b SelectBuilder) OrderBy(exprs ...string) SelectBuilder {
+	b.orderBy = append(b.orderBy[:len(b.orderBy):len(b.orderBy)], exprs...)
+	return b
+}
+
+func (b SelectBuilder) Limit(n uint64) SelectBuilder {
+	b.limit = n
+	return b
+}
+
+func (b SelectBuilder) Offset(n uint64) SelectBuilder {
+	b.offset = n
+	return b
+}
+
+// Suffix appends raw SQL, e.g. "FOR UPDATE SKIP LOCKED"
+func (b SelectBuilder) Suffix(sql string) SelectBuilder {
+	b.suffix = sql
+	return b
+}
+
+func (b SelectBuilder) ToSql() (string, []any, error) {
+	if len(b.columns) == 0 {
+		return "", nil, errors.New("select has no columns")
+	}
+	if b.err != nil {
+		return "", nil, b.err
+	}
+
+	var sql strings.Builder
+	sql.WriteString("SELECT " + strings.Join(b.columns, ", "))
+	if b.from != "" {
+		sql.WriteString(" FROM " + b.from)
+	}
+	var args []any
+	if len(b.where) > 0 {
+		cond, a, err := And(b.where).ToSql()
+		if err != nil {
+			return "", nil, err
+		}
+		sql.WriteString(" WHERE " + cond)
+		args = a
+	}
+	if len(b.orderBy) > 0 {
+		sql.WriteString(" ORDER BY " + strings.Join(b.orderBy, ", "))
+	}
+	if b.limit > 0 {
+		sql.WriteString(" LIMIT " + strconv.FormatUint(b.limit, 10))
+	}
+	if b.offset > 0 {
+		sql.WriteString(" OFFSET " + strconv.FormatUint(b.offset, 10))
+	}
+	if b.suffix != "" {
+		sql.WriteString(" " + b.suffix)
+	}
+	return sql.String(), args, nil
+}
+
+// buildSQL renders b with its ? placeholders numbered as $1, $2... A
+// doubled ?? is a literal ?, for the jsonb operators. SQL already using
+// $n placeholders, as from squirrel's Dollar format, is passed through.
+// opts, such as SimpleProtocol(), go before the arguments.
+func buildSQL(b Sqlizer, opts []any) (string, []any, error) {
+	sql, args, err := b.ToSql()
+	if err != nil {
+		return "", nil, fmt.Errorf("error building query: %w", err)
+	}
+	var (
+		out strings.Builder
+		n   int
+	)
+	for i := 0; i < len(sql); i++ {
+		if sql[i] != '?' {
+			out.WriteByte(sql[i])
+			continue
+		}
+		if i+1 < len(sql) && sql[i+1] == '?' {
+			out.WriteByte('?')
+			i++
+			continue
+		}
+		n++
+		out.WriteString("$" + strconv.Itoa(n))
+	}
+	if n > 0 && n != len(args) {
+		return "", nil, fmt.Errorf("error building query: %d placeholders for %d arguments", n, len(args))
+	}
+	return out.String(), append(opts[:len(opts):len(opts)], args...), nil
+}
+
+// QueryBuilder runs the statement b builds. opts are pgx query options
+// such as SimpleProtocol().
+func QueryBuilder(ctx context.Context, db DBTX, b Sqlizer, opts ...any) (pgx.Rows, error) {
+	sql, args, err := buildSQL(b, opts)
+	if err != nil {
+		return nil, err
+	}
+	return db.Query(ctx, sql, args...)
+}
+
+// QueryRowBuilder runs the statement b builds for a single row
+func QueryRowBuilder(ctx context.Context, db DBTX, b Sqlizer, opts ...any) pgx.Row {
+	sql, args, err := buildSQL(b, opts)
+	if err != nil {
+		return errRow{err}
+	}
+	return db.QueryRow(ctx, sql, args...)
+}
+
+// ExecBuilder executes the statement b builds
+func ExecBuilder(ctx context.Context, db DBTX, b Sqlizer, opts ...any) (pgconn.CommandTag, error) {
+	sql, args, err := buildSQL(b, opts)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return db.Exec(ctx, sql, args...)
+}
+
+// CollectBuilder runs the statement b builds and scans every row
+//
+//	users, err := CollectBuilder(ctx, db, q, pgx.RowToStructByName[User])
+func CollectBuilder[T any](ctx context.Context, db DBTX, b Sqlizer, scan pgx.RowToFunc[T], opts ...any) ([]T, error) {
+	rows, err := QueryBuilder(ctx, db, b, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scan)
+}
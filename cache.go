@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// CachedQuery memoizes the results of read queries for TTL, keyed by the
+// statement, with whitespace normalized, and its arguments.
+// It suits hot reference data and counters that may be slightly stale:
+//
+//	userCount := NewCachedQuery(app.DBClient, pgx.RowTo[int], time.Minute)
+//	n, err := userCount.QueryOne(ctx, "SELECT count(*) FROM users")
+//
+// Errors are not cached. Writes made through Exec, or followed by
+// Invalidate, are seen by the next read.
+type CachedQuery[T any] struct {
+	DB         DBTX
+	Scan       pgx.RowToFunc[T]
+	TTL        time.Duration // How long results are reused, default 1 minute
+	MaxEntries int           // Least recently used results are evicted beyond this, default 1000
+	Clock      Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Of *cacheEntry[T], most recently used first
+}
+
+type cacheEntry[T any] struct {
+	key     string
+	rows    []T
+	expires time.Time
+	tables  []string // Read by the statement, for InvalidateTable
+	args    []string // Printed arguments, matched against invalidation keys
+}
+
+// NewCachedQuery creates a cache running its queries on db
+func NewCachedQuery[T any](db DBTX, scan pgx.RowToFunc[T], ttl time.Duration) *CachedQuery[T] {
+	return &CachedQuery[T]{DB: db, Scan: scan, TTL: ttl}
+}
+
+// Query returns every row of sql, from the cache when it has them
+func (c *CachedQuery[T]) Query(ctx context.Context, sql string, args ...any) ([]T, error) {
+	key := cacheKey(sql, args)
+	if rows, ok := c.get(key); ok {
+		return rows, nil
+	}
+
+	rows, err := c.DB.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := pgx.CollectRows(rows, c.Scan)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, sql, args, out)
+	return slices.Clone(out), nil
+}
+
+// QueryOne returns the single row of sql, or pgx.ErrNoRows or
+// pgx.ErrTooManyRows like pgx.CollectExactlyOneRow
+func (c *CachedQuery[T]) QueryOne(ctx context.Context, sql string, args ...any) (T, error) {
+	var zero T
+	rows, err := c.Query(ctx, sql, args...)
+	switch {
+	case err != nil:
+		return zero, err
+	case len(rows) == 0:
+		return zero, pgx.ErrNoRows
+	case len(rows) > 1:
+		return zero, pgx.ErrTooManyRows
+	}
+	return rows[0], nil
+}
+
+// Exec runs a write on DB and, when it succeeds, drops every cached result
+func (c *CachedQuery[T]) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	tag, err := c.DB.Exec(ctx, sql, args...)
+	if err == nil {
+		c.InvalidateAll()
+	}
+	return tag, err
+}
+
+// Invalidate drops the cached result of one query
+func (c *CachedQuery[T]) Invalidate(sql string, args ...any) {
+	key := cacheKey(sql, args)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// InvalidateAll drops every cached result. It fits as a hook for writers
+// and change notifications.
+func (c *CachedQuery[T]) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.lru.Init()
+}
+
+// InvalidateTable drops the cached results of statements reading table,
+// only those with an argument printing as key when key is set, or every
+// result when table is empty
+func (c *CachedQuery[T]) InvalidateTable(_ context.Context, table, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, el := range c.entries {
+		entry := el.Value.(*cacheEntry[T])
+		if table != "" && !slices.ContainsFunc(entry.tables, func(t string) bool { return sameTable(t, table) }) {
+			continue
+		}
+		if table != "" && key != "" && !slices.Contains(entry.args, key) {
+			continue
+		}
+		c.lru.Remove(el)
+		delete(c.entries, k)
+	}
+	return nil
+}
+
+// Len returns the number of cached results, including expired ones not
+// yet evicted
+func (c *CachedQuery[T]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *CachedQuery[T]) get(key string) ([]T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry[T])
+	if !clockOr(c.Clock).Now().Before(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return slices.Clone(entry.rows), true
+}
+
+func (c *CachedQuery[T]) put(key, sql string, args []any, rows []T) {
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	max := c.MaxEntries
+	if max <= 0 {
+		max = 1000
+	}
+	entry := &cacheEntry[T]{key: key, rows: rows, expires: clockOr(c.Clock).Now().Add(ttl), tables: ParseStatement(sql).Tables}
+	for _, a := range args {
+		entry.args = append(entry.args, fmt.Sprint(a))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[T]).key)
+	}
+}
+
+// cacheKey identifies a query by its statement, with whitespace outside
+// quotes collapsed, and the type and value of each argument
+func cacheKey(sql string, args []any) string {
+	var key strings.Builder
+	key.WriteString(collapseSpace(sql))
+	for _, a := range args {
+		fmt.Fprintf(&key, "\x00%T:%v", a, a)
+	}
+	return key.String()
+}
+
+// collapseSpace trims sql and turns each run of whitespace outside quoted
+// strings and identifiers into one space. Statements with dollar quoting
+// are returned as they are.
+func collapseSpace(sql string) string {
+	if dollarQuoteRe.MatchString(sql) {
+		return sql
+	}
+	var (
+		out   strings.Builder
+		quote byte
+		space bool
+	)
+	for i := 0; i < len(sql); i++ {
+		ch := sql[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			space = true
+			continue
+		}
+		if space && out.Len() > 0 {
+			out.WriteByte(' ')
+		}
+		space = false
+		out.WriteByte(ch)
+	}
+	return out.String()
+}
+
+var dollarQuoteRe = regexp.MustCompile(`\$[A-Za-z_]*\$`)
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CallerStats is the load one caller put on the pool
+type CallerStats struct {
+	Caller      string
+	Queries     int64
+	Errors      int64
+	QueryTime   time.Duration
+	Acquires    int64
+	AcquireWait time.Duration
+}
+
+// CallerMetrics is a query and acquire tracer totalling load per caller
+// label, so teams sharing a pool can see which component is responsible.
+// Queries without a label are counted as "unknown". It serves its totals
+// in the Prometheus text format.
+type CallerMetrics struct {
+	MaxCallers int   // Distinct callers tracked before new ones are grouped as "other", default 100
+	Clock      Clock // Default SystemClock
+
+	mu      sync.Mutex
+	callers map[string]*CallerStats
+}
+
+// NewCallerMetrics creates an empty registry
+func NewCallerMetrics() *CallerMetrics {
+	return &CallerMetrics{MaxCallers: 100, callers: make(map[string]*CallerStats)}
+}
+
+type callerQueryKey struct{}
+
+type callerAcquireKey struct{}
+
+func (m *CallerMetrics) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, callerQueryKey{}, clockOr(m.Clock).Now())
+}
+
+func (m *CallerMetrics) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(callerQueryKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	elapsed := clockOr(m.Clock).Now().Sub(start)
+	m.update(dbctx.Caller(ctx), func(st *CallerStats) {
+		st.Queries++
+		st.QueryTime += elapsed
+		if data.Err != nil {
+			st.Errors++
+		}
+	})
+}
+
+func (m *CallerMetrics) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	return context.WithValue(ctx, callerAcquireKey{}, clockOr(m.Clock).Now())
+}
+
+func (m *CallerMetrics) TraceAcquireEnd(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireEndData) {
+	start, ok := ctx.Value(callerAcquireKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	wait := clockOr(m.Clock).Now().Sub(start)
+	m.update(dbctx.Caller(ctx), func(st *CallerStats) {
+		st.Acquires++
+		st.AcquireWait += wait
+	})
+}
+
+func (m *CallerMetrics) update(caller string, fn func(*CallerStats)) {
+	if caller == "" {
+		caller = "unknown"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.callers[caller]
+	if !ok {
+		if m.MaxCallers > 0 && len(m.callers) >= m.MaxCallers {
+			caller = "other"
+			st, ok = m.callers[caller]
+		}
+		if !ok {
+			st = &CallerStats{Caller: caller}
+			m.callers[caller] = st
+		}
+	}
+	fn(st)
+}
+
+// Snapshot returns the stats of every caller, most query time first
+func (m *CallerMetrics) Snapshot() []CallerStats {
+	m.mu.Lock()
+	stats := make([]CallerStats, 0, len(m.callers))
+	for _, st := range m.callers {
+		stats = append(stats, *st)
+	}
+	m.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].QueryTime > stats[j].QueryTime })
+	return stats
+}
+
+// ServeHTTP writes the stats as Prometheus counters
+func (m *CallerMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	stats := m.Snapshot()
+	var b strings.Builder
+	for _, metric := range []struct {
+		name, help string
+		value      func(CallerStats) string
+	}{
+		{"pgx_caller_queries_total", "Queries by caller.", func(st CallerStats) string { return fmt.Sprint(st.Queries) }},
+		{"pgx_caller_errors_total", "Failed queries by caller.", func(st CallerStats) string { return fmt.Sprint(st.Errors) }},
+		{"pgx_caller_query_seconds_total", "Time spent in queries by caller.", func(st CallerStats) string { return fmt.Sprint(st.QueryTime.Seconds()) }},
+		{"pgx_caller_acquires_total", "Connection acquires by caller.", func(st CallerStats) string { return fmt.Sprint(st.Acquires) }},
+		{"pgx_caller_acquire_wait_seconds_total", "Time spent waiting for a connection by caller.", func(st CallerStats) string { return fmt.Sprint(st.AcquireWait.Seconds()) }},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, st := range stats {
+			fmt.Fprintf(&b, "%s{caller=%s} %s\n", metric.name, promLabel(st.Caller), metric.value(st))
+		}
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// NamedPool is the app's pool with every query and acquire attributed to
+// one caller in metrics and slow query logs. It is cheap to create and
+// safe to share between goroutines.
+type NamedPool struct {
+	Caller string
+	DB     *pgxpool.Pool
+	Active *ActivePool // Optional, used instead of DB once set
+}
+
+// Named returns the app's pool labelled for caller, e.g. a package or team
+// name
+func (app *App) Named(caller string) *NamedPool {
+	return &NamedPool{Caller: caller, DB: app.DBClient, Active: app.active()}
+}
+
+func (p *NamedPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return p.Active.Or(p.DB).Exec(dbctx.WithCaller(ctx, p.Caller), sql, args...)
+}
+
+func (p *NamedPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return p.Active.Or(p.DB).Query(dbctx.WithCaller(ctx, p.Caller), sql, args...)
+}
+
+func (p *NamedPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return p.Active.Or(p.DB).QueryRow(dbctx.WithCaller(ctx, p.Caller), sql, args...)
+}
+
+func (p *NamedPool) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return p.Active.Or(p.DB).SendBatch(dbctx.WithCaller(ctx, p.Caller), b)
+}
+
+// Begin starts a transaction whose statements are attributed to the caller
+func (p *NamedPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := p.Active.Or(p.DB).Begin(dbctx.WithCaller(ctx, p.Caller))
+	if err != nil {
+		return nil, err
+	}
+	return namedTx{Tx: tx, caller: p.Caller}, nil
+}
+
+// Acquire gets a connection. Its methods take their own contexts, so pass
+// ones from Context to attribute what runs on it.
+func (p *NamedPool) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	return p.Active.Or(p.DB).Acquire(dbctx.WithCaller(ctx, p.Caller))
+}
+
+// Context returns ctx labelled with the pool's caller
+func (p *NamedPool) Context(ctx context.Context) context.Context {
+	return dbctx.WithCaller(ctx, p.Caller)
+}
+
+// namedTx labels the contexts passed to a transaction's statements
+type namedTx struct {
+	pgx.Tx
+	caller string
+}
+
+func (tx namedTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return tx.Tx.Exec(dbctx.WithCaller(ctx, tx.caller), sql, args...)
+}
+
+func (tx namedTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return tx.Tx.Query(dbctx.WithCaller(ctx, tx.caller), sql, args...)
+}
+
+func (tx namedTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return tx.Tx.QueryRow(dbctx.WithCaller(ctx, tx.caller), sql, args...)
+}
+
+func (tx namedTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return tx.Tx.SendBatch(dbctx.WithCaller(ctx, tx.caller), b)
+}
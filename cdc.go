@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ChangeOp is the kind of row change in a ChangeEvent
+type ChangeOp string
+
+const (
+	ChangeInsert   ChangeOp = "insert"
+	ChangeUpdate   ChangeOp = "update"
+	ChangeDelete   ChangeOp = "delete"
+	ChangeTruncate ChangeOp = "truncate"
+)
+
+// ChangeEvent is one row change read from logical replication
+type ChangeEvent struct {
+	Op     ChangeOp
+	Schema string
+	Table  string
+	New    map[string]any // Row after an insert or update; unchanged TOASTed columns are absent
+	Old    map[string]any // Replica identity before an update or delete, nil when the key did not change
+	XID    uint32
+	LSN    pglogrepl.LSN // Position of the change in the WAL
+}
+
+// ChangeStream delivers committed row changes of a database through a
+// logical replication slot, so downstream systems can follow writes
+// without polling. The slot is created on first use and keeps WAL until a
+// change is acknowledged, which happens once Handle has returned nil for
+// every change of its transaction. Delivery is therefore at least once: a
+// reconnect, or a Handle error, replays from the last acknowledged
+// transaction.
+//
+// With the default pgoutput plugin, changes come from Publication, created
+// for Tables, or for all tables, if it does not exist. wal2json (format
+// version 2) needs the plugin installed on the server. The server needs
+// wal_level=logical, and an abandoned slot keeps WAL forever, so drop it
+// with DropSlot when the consumer is retired.
+type ChangeStream struct {
+	Conn           *pgconn.Config
+	Slot           string
+	Plugin         string   // pgoutput (default) or wal2json
+	Publication    string   // pgoutput publication, default Slot
+	Tables         []string // Tables to deliver, e.g. "public.orders"; empty delivers every table
+	Handle         func(ctx context.Context, ev ChangeEvent) error
+	StatusInterval time.Duration // How often progress is reported to the server, default 10s
+	RetryInterval  time.Duration // Wait before reconnecting, default 5s
+	Clock          Clock
+}
+
+// NewChangeStream creates a stream reading slot with the connection
+// settings of conn, such as WithPgxConfig's
+func NewChangeStream(conn *pgx.ConnConfig, slot string, handle func(ctx context.Context, ev ChangeEvent) error, tables ...string) *ChangeStream {
+	return &ChangeStream{Conn: &conn.Config, Slot: slot, Tables: tables, Handle: handle,
+		StatusInterval: 10 * time.Second, RetryInterval: 5 * time.Second}
+}
+
+func (s *ChangeStream) plugin() string {
+	if s.Plugin == "" {
+		return "pgoutput"
+	}
+	return s.Plugin
+}
+
+func (s *ChangeStream) publication() string {
+	if s.Publication == "" {
+		return s.Slot
+	}
+	return s.Publication
+}
+
+// connect opens a replication connection
+func (s *ChangeStream) connect(ctx context.Context) (*pgconn.PgConn, error) {
+	cfg := s.Conn.Copy()
+	if cfg.RuntimeParams == nil {
+		cfg.RuntimeParams = make(map[string]string)
+	}
+	cfg.RuntimeParams["replication"] = "database"
+	return pgconn.ConnectConfig(ctx, cfg)
+}
+
+// Run streams changes until ctx is cancelled, reconnecting after errors
+func (s *ChangeStream) Run(ctx context.Context) error {
+	interval := s.RetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	clock := clockOr(s.Clock)
+	for {
+		err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Error("Change stream interrupted", slog.String("slot", s.Slot), slog.String("error", err.Error()))
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// DropSlot drops the replication slot, releasing the WAL it retains
+func (s *ChangeStream) DropSlot(ctx context.Context) error {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+	return pglogrepl.DropReplicationSlot(ctx, conn, s.Slot, pglogrepl.DropReplicationSlotOptions{})
+}
+
+// setup creates the publication and the slot when they do not exist
+func (s *ChangeStream) setup(ctx context.Context, conn *pgconn.PgConn) error {
+	if s.plugin() == "pgoutput" {
+		rows, err := conn.Exec(ctx, "SELECT 1 FROM pg_publication WHERE pubname = "+quoteLiteral(s.publication())).ReadAll()
+		if err != nil {
+			return err
+		}
+		if len(rows[0].Rows) == 0 {
+			target := "ALL TABLES"
+			if len(s.Tables) > 0 {
+				tables := make([]string, len(s.Tables))
+				for i, t := range s.Tables {
+					tables[i] = pgx.Identifier(strings.Split(t, ".")).Sanitize()
+				}
+				target = "TABLE " + strings.Join(tables, ", ")
+			}
+			if _, err := conn.Exec(ctx, "CREATE PUBLICATION "+pgx.Identifier{s.publication()}.Sanitize()+" FOR "+target).ReadAll(); err != nil {
+				return fmt.Errorf("error creating publication %s: %w", s.publication(), err)
+			}
+		}
+	}
+
+	_, err := pglogrepl.CreateReplicationSlot(ctx, conn, s.Slot, s.plugin(), pglogrepl.CreateReplicationSlotOptions{})
+	var pgErr *pgconn.PgError
+	if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == "42710") { // duplicate_object
+		return fmt.Errorf("error creating replication slot %s: %w", s.Slot, err)
+	}
+	return nil
+}
+
+func (s *ChangeStream) pluginArgs() []string {
+	if s.plugin() == "wal2json" {
+		args := []string{`"format-version" '2'`, `"include-xids" '1'`}
+		if len(s.Tables) > 0 {
+			args = append(args, `"add-tables" `+quoteLiteral(strings.Join(s.Tables, ",")))
+		}
+		return args
+	}
+	return []string{"proto_version '1'", "publication_names " + quoteLiteral(s.publication())}
+}
+
+// wanted reports whether changes to schema.table are delivered
+func (s *ChangeStream) wanted(schema, table string) bool {
+	return len(s.Tables) == 0 || slices.ContainsFunc(s.Tables, func(t string) bool { return sameTable(t, schema+"."+table) })
+}
+
+// stream runs one replication connection until it fails
+func (s *ChangeStream) stream(ctx context.Context) error {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if err := s.setup(ctx, conn); err != nil {
+		return err
+	}
+	// Starting at zero resumes after the slot's last acknowledged position
+	if err := pglogrepl.StartReplication(ctx, conn, s.Slot, 0, pglogrepl.StartReplicationOptions{PluginArgs: s.pluginArgs()}); err != nil {
+		return fmt.Errorf("error starting replication on %s: %w", s.Slot, err)
+	}
+	slog.Info("Change stream started", slog.String("slot", s.Slot), slog.String("plugin", s.plugin()))
+
+	statusInterval := s.StatusInterval
+	if statusInterval <= 0 {
+		statusInterval = 10 * time.Second
+	}
+	var decode changeDecoder = &pgoutputDecoder{relations: make(map[uint32]*pglogrepl.RelationMessage), types: pgtype.NewMap()}
+	if s.plugin() == "wal2json" {
+		decode = &wal2jsonDecoder{}
+	}
+
+	clock := clockOr(s.Clock)
+	var acked pglogrepl.LSN
+	var nextStatus time.Time
+	for {
+		now := clock.Now()
+		if !now.Before(nextStatus) {
+			if err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: acked}); err != nil {
+				return fmt.Errorf("error reporting replication progress: %w", err)
+			}
+			nextStatus = now.Add(statusInterval)
+		}
+
+		recvCtx, cancel := context.WithTimeout(ctx, nextStatus.Sub(now))
+		raw, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return err
+		}
+
+		var data []byte
+		switch msg := raw.(type) {
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyData:
+			data = msg.Data
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			ka, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+			if err != nil {
+				return err
+			}
+			// Between transactions everything up to the server's position is handled
+			if !decode.inTransaction() && ka.ServerWALEnd > acked {
+				acked = ka.ServerWALEnd
+			}
+			if ka.ReplyRequested {
+				nextStatus = time.Time{}
+			}
+
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(data[1:])
+			if err != nil {
+				return err
+			}
+			events, commit, err := decode.decode(xld)
+			if err != nil {
+				return fmt.Errorf("error decoding change at %s: %w", xld.WALStart, err)
+			}
+			for _, ev := range events {
+				if !s.wanted(ev.Schema, ev.Table) {
+					continue
+				}
+				if err := s.Handle(ctx, ev); err != nil {
+					return fmt.Errorf("error handling %s on %s.%s at %s: %w", ev.Op, ev.Schema, ev.Table, ev.LSN, err)
+				}
+			}
+			if commit > acked {
+				acked = commit
+			}
+		}
+	}
+}
+
+// changeDecoder turns the plugin's WAL messages into change events
+type changeDecoder interface {
+	// decode returns the changes in xld and, for a commit, the position
+	// acknowledging its transaction
+	decode(xld pglogrepl.XLogData) ([]ChangeEvent, pglogrepl.LSN, error)
+	inTransaction() bool
+}
+
+type pgoutputDecoder struct {
+	relations map[uint32]*pglogrepl.RelationMessage
+	types     *pgtype.Map
+	xid       uint32
+	inTx      bool
+}
+
+func (d *pgoutputDecoder) inTransaction() bool { return d.inTx }
+
+func (d *pgoutputDecoder) decode(xld pglogrepl.XLogData) ([]ChangeEvent, pglogrepl.LSN, error) {
+	msg, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ev := ChangeEvent{XID: d.xid, LSN: xld.WALStart}
+	var relationID uint32
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		d.relations[m.RelationID] = m
+		return nil, 0, nil
+	case *pglogrepl.BeginMessage:
+		d.xid, d.inTx = m.Xid, true
+		return nil, 0, nil
+	case *pglogrepl.CommitMessage:
+		d.inTx = false
+		return nil, m.TransactionEndLSN, nil
+	case *pglogrepl.InsertMessage:
+		ev.Op, relationID = ChangeInsert, m.RelationID
+		ev.New, err = d.row(m.RelationID, m.Tuple)
+	case *pglogrepl.UpdateMessage:
+		ev.Op, relationID = ChangeUpdate, m.RelationID
+		if ev.New, err = d.row(m.RelationID, m.NewTuple); err == nil {
+			ev.Old, err = d.row(m.RelationID, m.OldTuple)
+		}
+	case *pglogrepl.DeleteMessage:
+		ev.Op, relationID = ChangeDelete, m.RelationID
+		ev.Old, err = d.row(m.RelationID, m.OldTuple)
+	case *pglogrepl.TruncateMessage:
+		var events []ChangeEvent
+		for _, id := range m.RelationIDs {
+			rel, ok := d.relations[id]
+			if !ok {
+				return nil, 0, fmt.Errorf("unknown relation %d", id)
+			}
+			events = append(events, ChangeEvent{Op: ChangeTruncate, Schema: rel.Namespace, Table: rel.RelationName, XID: d.xid, LSN: xld.WALStart})
+		}
+		return events, 0, nil
+	default:
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	rel := d.relations[relationID]
+	ev.Schema, ev.Table = rel.Namespace, rel.RelationName
+	return []ChangeEvent{ev}, 0, nil
+}
+
+// row decodes a tuple of the relation, or returns nil for a missing one
+func (d *pgoutputDecoder) row(relationID uint32, tuple *pglogrepl.TupleData) (map[string]any, error) {
+	rel, ok := d.relations[relationID]
+	if !ok {
+		return nil, fmt.Errorf("unknown relation %d", relationID)
+	}
+	if tuple == nil {
+		return nil, nil
+	}
+	row := make(map[string]any, len(tuple.Columns))
+	for i, col := range tuple.Columns {
+		if i >= len(rel.Columns) {
+			break
+		}
+		name, oid := rel.Columns[i].Name, rel.Columns[i].DataType
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			row[name] = nil
+		case pglogrepl.TupleDataTypeText:
+			row[name] = string(col.Data)
+			if dt, ok := d.types.TypeForOID(oid); ok {
+				if v, err := dt.Codec.DecodeValue(d.types, oid, pgtype.TextFormatCode, col.Data); err == nil {
+					row[name] = v
+				}
+			}
+		}
+	}
+	return row, nil
+}
+
+type wal2jsonDecoder struct {
+	inTx bool
+}
+
+func (d *wal2jsonDecoder) inTransaction() bool { return d.inTx }
+
+type wal2jsonColumn struct {
+	Name  string `json:"name"`
+	Value any    `json:"value"`
+}
+
+func (d *wal2jsonDecoder) decode(xld pglogrepl.XLogData) ([]ChangeEvent, pglogrepl.LSN, error) {
+	var msg struct {
+		Action   string           `json:"action"`
+		XID      uint32           `json:"xid"`
+		Schema   string           `json:"schema"`
+		Table    string           `json:"table"`
+		Columns  []wal2jsonColumn `json:"columns"`
+		Identity []wal2jsonColumn `json:"identity"`
+	}
+	if err := json.Unmarshal(xld.WALData, &msg); err != nil {
+		return nil, 0, err
+	}
+
+	ev := ChangeEvent{Schema: msg.Schema, Table: msg.Table, XID: msg.XID, LSN: xld.WALStart,
+		New: wal2jsonRow(msg.Columns), Old: wal2jsonRow(msg.Identity)}
+	switch msg.Action {
+	case "B":
+		d.inTx = true
+		return nil, 0, nil
+	case "C":
+		d.inTx = false
+		return nil, xld.WALStart, nil
+	case "I":
+		ev.Op = ChangeInsert
+	case "U":
+		ev.Op = ChangeUpdate
+	case "D":
+		ev.Op = ChangeDelete
+	case "T":
+		ev.Op = ChangeTruncate
+	default:
+		return nil, 0, nil
+	}
+	return []ChangeEvent{ev}, 0, nil
+}
+
+func wal2jsonRow(cols []wal2jsonColumn) map[string]any {
+	if cols == nil {
+		return nil
+	}
+	row := make(map[string]any, len(cols))
+	for _, c := range cols {
+		row[c.Name] = c.Value
+	}
+	return row
+}
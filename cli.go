@@ -0,0 +1,540 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/pflag"
+)
+
+// commands are the subcommands main dispatches on its first argument
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"migrate":   runMigrate,
+	"dualwrite": runDualWrite,
+	"wait":      runWait,
+	"ping":      runPing,
+	"stats":     runStats,
+	"shell":     runShell,
+	"roles":     runRoles,
+	"scaffold":  runScaffold,
+	"jobs":      runJobs,
+}
+
+// ErrDualWriteBacklog is returned by the dualwrite report command when
+// failures are waiting to be replayed
+var ErrDualWriteBacklog = errors.New("unreplayed dual write failures")
+
+const dualWriteUsage = `usage: go-pgxpool dualwrite <report|replay|verify> --new-url postgres://... [--query sql] [config flags for the old database]`
+
+const rolesUsage = `usage: go-pgxpool roles <apply|diff> --spec roles.json [config flags]`
+
+const jobsUsage = `usage: go-pgxpool jobs <list|retry|requeue|purge> [id...] [--table name] [--queue name | --all] [--dead] [--limit n] [--yes] [config flags]`
+
+const migrateUsage = `usage: go-pgxpool migrate <up|down|plan|status|verify|squash> [--all | --target name] [--steps n] [--dry-run] [config flags]`
+
+// runMigrate implements the migrate command
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(migrateUsage)
+	}
+	action := args[0]
+
+	flags := pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+	all := flags.Bool("all", false, "run against every migration target")
+	target := flags.String("target", "", "migration target (schema) to run against")
+	steps := flags.Int("steps", 1, "migrations to roll back with down")
+	dryRun := flags.Bool("dry-run", false, "print the SQL instead of running it")
+
+	loader := &ConfigLoader{File: ".env", Args: args[1:], Flags: flags}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	if dbConfig.PgBouncerMode {
+		// The migration lock is session-level and would not hold
+		return errors.New("migrations need a direct connection; point the migrate command past PgBouncer and unset PG_PGBOUNCER_MODE")
+	}
+
+	db, err := newPool(ctx, dbConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	targets, err := selectTargets(dbConfig.migrationTargets(db), *all, *target)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		t.Migrator.DryRun = *dryRun
+	}
+
+	switch action {
+	case "up":
+		return targets.Up(ctx)
+	case "down":
+		for _, t := range targets {
+			if err := t.Migrator.Down(ctx, *steps); err != nil {
+				return fmt.Errorf("error rolling back %s: %w", t.Name, err)
+			}
+		}
+		return nil
+	case "plan":
+		for _, t := range targets {
+			plan, err := t.Migrator.Plan(ctx)
+			if err != nil {
+				return fmt.Errorf("error planning %s: %w", t.Name, err)
+			}
+			if _, err := plan.WriteTo(os.Stdout); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "verify":
+		var errs []error
+		for _, t := range targets {
+			if err := t.Migrator.Verify(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+			}
+		}
+		return errors.Join(errs...)
+	case "squash":
+		for _, t := range targets {
+			baseline, squashed, err := t.Migrator.Squash(ctx, filepath.Join(dbConfig.MigrationsDir, t.Migrator.Dir))
+			if err != nil {
+				return fmt.Errorf("error squashing %s: %w", t.Name, err)
+			}
+			fmt.Printf("%s: wrote %s; remove the files of migrations %d..%d\n", t.Name, baseline, squashed[0], squashed[len(squashed)-1])
+		}
+		return nil
+	case "status":
+		statuses := targets.Status(ctx)
+		if err := WriteMigrationStatus(os.Stdout, statuses); err != nil {
+			return err
+		}
+		for _, ts := range statuses {
+			if ts.Err != nil {
+				return errors.New("could not read the status of every target")
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", action, migrateUsage)
+	}
+}
+
+// migrationTargets builds a target per configured schema, or a single
+// "default" target when none are configured. A schema with its own
+// subdirectory of MigrationsDir uses it; otherwise schemas share the
+// top-level files.
+func (c *DBConfig) migrationTargets(db *pgxpool.Pool) MigrationTargets {
+	fsys := os.DirFS(c.MigrationsDir)
+
+	var schemas []string
+	for _, s := range strings.Split(c.MigrationSchemas, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			schemas = append(schemas, s)
+		}
+	}
+	if len(schemas) == 0 {
+		return MigrationTargets{{Name: "default", Migrator: NewMigrator(db, fsys)}}
+	}
+
+	targets := make(MigrationTargets, 0, len(schemas))
+	for _, schema := range schemas {
+		m := NewMigrator(db, fsys)
+		m.Schema = schema
+		if info, err := os.Stat(filepath.Join(c.MigrationsDir, schema)); err == nil && info.IsDir() {
+			m.Dir = schema
+		}
+		targets = append(targets, MigrationTarget{Name: schema, Migrator: m})
+	}
+	return targets
+}
+
+// selectTargets narrows targets to the one named, or keeps all of them.
+// With several targets configured one of the two must be chosen.
+func selectTargets(targets MigrationTargets, all bool, name string) (MigrationTargets, error) {
+	switch {
+	case all && name != "":
+		return nil, errors.New("--all and --target are mutually exclusive")
+	case all:
+		return targets, nil
+	case name != "":
+		t, ok := targets.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown migration target %q", name)
+		}
+		return MigrationTargets{t}, nil
+	case len(targets) > 1:
+		return nil, errors.New("several migration targets are configured; pass --target or --all")
+	default:
+		return targets, nil
+	}
+}
+
+// runDualWrite implements the dualwrite command, which reports and replays
+// writes that failed on the new database
+func runDualWrite(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(dualWriteUsage)
+	}
+	action := args[0]
+
+	flags := pflag.NewFlagSet("dualwrite", pflag.ContinueOnError)
+	newURL := flags.String("new-url", "", "connection URL of the new database")
+	table := flags.String("table", "dual_write_failures", "reconciliation table on the old database")
+	query := flags.String("query", "", "read to compare on both databases with verify, keyed on its first column")
+
+	loader := &ConfigLoader{File: ".env", Args: args[1:], Flags: flags}
+	oldConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	if *newURL == "" {
+		return errors.New(dualWriteUsage)
+	}
+	newConfig, err := ConfigFromURL(*newURL)
+	if err != nil {
+		return err
+	}
+
+	oldDB, err := newPool(ctx, oldConfig)
+	if err != nil {
+		return err
+	}
+	defer oldDB.Close()
+	newDB, err := newPool(ctx, newConfig)
+	if err != nil {
+		return err
+	}
+	defer newDB.Close()
+
+	w := &DualWriter{Old: oldDB, New: newDB, Table: *table}
+	switch action {
+	case "report":
+		failures, err := w.Report(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tRECORDED AT\tKIND\tOLD ROWS\tNEW ROWS\tSQL\tERROR")
+		for _, f := range failures {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\t%s\n",
+				f.ID, f.RecordedAt.Format(time.RFC3339), f.Kind, f.OldRows, f.NewRows, summarizeSQL(f.SQL, 60), f.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("%w: %d", ErrDualWriteBacklog, len(failures))
+		}
+		return nil
+	case "replay":
+		n, err := w.Replay(ctx)
+		slog.Info("Replayed dual writes", slog.Int("replayed", n))
+		return err
+	case "verify":
+		if *query == "" {
+			return errors.New(dualWriteUsage)
+		}
+		diff, err := w.Verify(ctx, *query)
+		if diff != nil {
+			if _, err := diff.WriteTo(os.Stdout); err != nil {
+				return err
+			}
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown dualwrite command %q\n%s", action, dualWriteUsage)
+	}
+}
+
+// runWait implements the wait command, which exits once the database is
+// ready or fails after --timeout
+func runWait(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("wait", pflag.ContinueOnError)
+	timeout := flags.Duration("timeout", time.Minute, "how long to wait for the database")
+
+	loader := &ConfigLoader{File: ".env", Args: args, Flags: flags}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	return WaitForDB(ctx, dbConfig, *timeout)
+}
+
+// runPing implements the ping command, which connects once and prints what
+// the server reports, for debugging deployment environments
+func runPing(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("ping", pflag.ContinueOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "how long to wait for the connection")
+
+	loader := &ConfigLoader{File: ".env", Args: args, Flags: flags}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	db, _, err := newLazyPool(ctx, dbConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error connecting: %w", err)
+	}
+	defer conn.Release()
+	connectTime := time.Since(start)
+
+	start = time.Now()
+	if err := conn.Ping(ctx); err != nil {
+		return fmt.Errorf("error pinging: %w", err)
+	}
+	rtt := time.Since(start)
+
+	pgConn := conn.Conn().PgConn()
+	tlsStatus := "off"
+	if tc, ok := pgConn.Conn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		tlsStatus = tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "address\t%s\n", pgConn.Conn().RemoteAddr())
+	fmt.Fprintf(tw, "server version\t%s\n", pgConn.ParameterStatus("server_version"))
+	fmt.Fprintf(tw, "user\t%s\n", conn.Conn().Config().User)
+	fmt.Fprintf(tw, "database\t%s\n", conn.Conn().Config().Database)
+	fmt.Fprintf(tw, "backend pid\t%d\n", pgConn.PID())
+	fmt.Fprintf(tw, "connect time\t%s\n", connectTime.Round(time.Microsecond))
+	fmt.Fprintf(tw, "ping latency\t%s\n", rtt.Round(time.Microsecond))
+	fmt.Fprintf(tw, "tls\t%s\n", tlsStatus)
+	return tw.Flush()
+}
+
+// runStats implements the stats command, which follows the pool counters
+// of a running app through its admin endpoint
+func runStats(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("stats", pflag.ContinueOnError)
+	url := flags.String("url", "", "pool stats endpoint, default /debug/pool on PG_ADMIN_ADDR")
+	interval := flags.Duration("interval", time.Second, "time between samples")
+	asJSON := flags.Bool("json", false, "print newline-delimited JSON instead of a table")
+
+	loader := &ConfigLoader{File: ".env", Args: args, Flags: flags}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	if *url == "" {
+		if dbConfig.AdminAddr == "" {
+			return errors.New("pass --url or set PG_ADMIN_ADDR to the running app's admin address")
+		}
+		addr := dbConfig.AdminAddr
+		if strings.HasPrefix(addr, ":") {
+			addr = "127.0.0.1" + addr
+		}
+		*url = "http://" + addr + "/debug/pool"
+	}
+	return StreamPoolStats(ctx, *url, *interval, os.Stdout, *asJSON)
+}
+
+// runShell implements the shell command, an interactive prompt on a
+// connection built exactly like the app's
+func runShell(ctx context.Context, args []string) error {
+	loader := &ConfigLoader{File: ".env", Args: args}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	db, _, err := newLazyPool(ctx, dbConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error connecting: %w", err)
+	}
+	defer conn.Release()
+
+	config := conn.Conn().Config()
+	shell := &Shell{
+		Conn:     conn.Conn().PgConn(),
+		Database: config.Database,
+		User:     config.User,
+		In:       os.Stdin,
+		Out:      os.Stdout,
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		shell.HistoryFile = filepath.Join(home, ".pgxpool_history")
+	}
+	return shell.Run(ctx)
+}
+
+// runRoles implements the roles command, which applies a roles spec or with
+// diff reports how the database has drifted from it
+func runRoles(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(rolesUsage)
+	}
+	action := args[0]
+	if action != "apply" && action != "diff" {
+		return fmt.Errorf("unknown roles command %q\n%s", action, rolesUsage)
+	}
+
+	flags := pflag.NewFlagSet("roles", pflag.ContinueOnError)
+	specFile := flags.String("spec", "roles.json", "JSON file declaring the roles")
+
+	loader := &ConfigLoader{File: ".env", Args: args[1:], Flags: flags}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*specFile)
+	if err != nil {
+		return fmt.Errorf("error reading roles spec: %w", err)
+	}
+	var spec RolesSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("error parsing %s: %w", *specFile, err)
+	}
+	spec.DiffOnly = action == "diff"
+
+	db, err := newPool(ctx, dbConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	drift, err := EnsureRoles(ctx, db, spec)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tCHANGE\tSQL")
+	for _, d := range drift {
+		sql := d.SQL
+		if strings.HasPrefix(sql, "CREATE ROLE") {
+			sql, _, _ = strings.Cut(sql, " PASSWORD ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Role, d.Change, sql)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if spec.DiffOnly && len(drift) > 0 {
+		return fmt.Errorf("%w: %d changes", ErrRoleDrift, len(drift))
+	}
+	return nil
+}
+
+// runJobs implements the jobs command, which lists stuck and dead-lettered
+// jobs and retries, requeues or purges them
+func runJobs(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(jobsUsage)
+	}
+	action := args[0]
+
+	flags := pflag.NewFlagSet("jobs", pflag.ContinueOnError)
+	table := flags.String("table", "", "job queue table, default PG_JOBS_TABLE or jobs")
+	queue := flags.String("queue", "", "only jobs of this queue, default every queue")
+	dead := flags.Bool("dead", false, "list or purge the dead-letter table")
+	limit := flags.Int("limit", 100, "jobs to list")
+	all := flags.Bool("all", false, "purge every queue")
+	yes := flags.Bool("yes", false, "confirm a purge")
+
+	loader := &ConfigLoader{File: ".env", Args: args[1:], Flags: flags}
+	dbConfig, _, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	if *table == "" {
+		*table = cmp.Or(dbConfig.JobsTable, "jobs")
+	}
+	var ids []int64
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid job id %q\n%s", arg, jobsUsage)
+		}
+		ids = append(ids, id)
+	}
+	// Purge deletes jobs for good, so its scope and intent are spelled out
+	if action == "purge" {
+		switch {
+		case *queue == "" && !*all:
+			return fmt.Errorf("purge needs --queue or --all\n%s", jobsUsage)
+		case *queue != "" && *all:
+			return fmt.Errorf("purge takes --queue or --all, not both\n%s", jobsUsage)
+		case !*yes:
+			return errors.New("purge deletes jobs; pass --yes to confirm")
+		}
+	}
+
+	db, err := newPool(ctx, dbConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	q := &Queue{DB: db, Table: *table}
+
+	switch action {
+	case "list":
+		jobs, err := q.List(ctx, *queue, *dead, *limit)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tQUEUE\tATTEMPTS\tENQUEUED AT\tRUN AT\tERROR")
+		for _, j := range jobs {
+			at := "dead"
+			if j.RunAt != nil {
+				at = j.RunAt.Format(time.RFC3339)
+			}
+			var lastError string
+			if j.LastError != nil {
+				lastError = summarizeSQL(*j.LastError, 60)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%s\n", j.ID, j.Queue, j.Attempts, j.EnqueuedAt.Format(time.RFC3339), at, lastError)
+		}
+		return tw.Flush()
+	case "retry", "requeue":
+		if len(ids) == 0 {
+			return errors.New(jobsUsage)
+		}
+		fn := q.Retry
+		if action == "requeue" {
+			fn = q.Requeue
+		}
+		var errs []error
+		for _, id := range ids {
+			errs = append(errs, fn(ctx, id))
+		}
+		return errors.Join(errs...)
+	case "purge":
+		n, err := q.Purge(ctx, *queue, *dead)
+		slog.Info("Purged jobs", slog.String("table", *table), slog.Bool("dead", *dead), slog.Int64("purged", n))
+		return err
+	default:
+		return fmt.Errorf("unknown jobs command %q\n%s", action, jobsUsage)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDatabaseURL parses a postgres:// or postgresql:// URL into a
+// DBConfig. Query parameters prefixed with pool_ (pool_max_conns,
+// pool_min_conns, pool_max_conn_lifetime, pool_max_conn_idle_time,
+// pool_health_check_period) configure the pool; everything else, such as
+// sslmode, is kept in Params and passed through to the connection.
+func ParseDatabaseURL(raw string) (*DBConfig, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database url: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("invalid database url scheme %q", u.Scheme)
+	}
+
+	cfg := &DBConfig{
+		Host:   u.Hostname(),
+		DBName: strings.TrimPrefix(u.Path, "/"),
+	}
+	if u.User != nil {
+		cfg.UserName = u.User.Username()
+		cfg.Password, _ = u.User.Password()
+	}
+	if strings.Contains(u.Host, ",") {
+		// Multiple hosts keep their ports inline, e.g. a:5432,b:5433
+		cfg.Host = u.Host
+	} else if p := u.Port(); p != "" {
+		if cfg.Port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid database url port %q", p)
+		}
+	}
+
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		if err := cfg.setURLParam(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func (c *DBConfig) setURLParam(key, value string) error {
+	var err error
+	switch key {
+	// libpq allows connection fields as query parameters, e.g. a unix
+	// socket directory in ?host=
+	case "host":
+		c.Host = value
+	case "port":
+		c.Port, err = strconv.Atoi(value)
+	case "user":
+		c.UserName = value
+	case "password":
+		c.Password = value
+	case "dbname":
+		c.DBName = value
+	case "target_session_attrs":
+		c.TargetSessionAttrs = value
+	case "pool_max_conns":
+		c.MaxConns, err = parseInt32(value)
+	case "pool_min_conns":
+		c.MinConns, err = parseInt32(value)
+	case "pool_max_conn_lifetime":
+		c.MaxConnLifeTime, err = time.ParseDuration(value)
+	case "pool_max_conn_idle_time":
+		c.MaxConnIdleTime, err = time.ParseDuration(value)
+	case "pool_health_check_period":
+		c.HealthCheckPeriod, err = time.ParseDuration(value)
+	default:
+		if c.Params == nil {
+			c.Params = make(map[string]string)
+		}
+		c.Params[key] = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid database url parameter %s=%q: %w", key, value, err)
+	}
+	return nil
+}
+
+func parseInt32(s string) (int32, error) {
+	n, err := strconv.ParseInt(s, 10, 32)
+	return int32(n), err
+}
+
+// connString renders the config as a keyword/value DSN, omitting unset
+// fields so pgx defaults apply
+func (c *DBConfig) connString() string {
+	var b strings.Builder
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(dsnQuote(value))
+	}
+
+	add("user", c.UserName)
+	add("password", c.Password)
+	add("dbname", c.DBName)
+	hosts, ports := c.hostsAndPorts()
+	add("host", hosts)
+	add("port", ports)
+	add("target_session_attrs", c.TargetSessionAttrs)
+
+	keys := make([]string, 0, len(c.Params))
+	for k := range c.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(k, c.Params[k])
+	}
+	// RDS only accepts IAM tokens over TLS
+	if _, ok := c.Params["sslmode"]; !ok && c.AuthMode == AuthModeRDSIAM {
+		add("sslmode", "require")
+	}
+
+	return b.String()
+}
+
+// hostsAndPorts splits a Host such as "db:5433" or "a,b:5433" into the
+// host and port lists libpq expects. Hosts without their own port use Port;
+// IPv6 addresses need brackets to carry one, e.g. "[::1]:5433".
+func (c *DBConfig) hostsAndPorts() (string, string) {
+	var hosts, ports []string
+	explicit := false
+	for _, h := range strings.Split(c.Host, ",") {
+		host, port := strings.TrimSpace(h), ""
+		hasPort := strings.Count(host, ":") == 1 || strings.HasPrefix(host, "[") && !strings.HasSuffix(host, "]")
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && hasPort {
+			host, port = host[:i], host[i+1:]
+			explicit = true
+		} else if c.Port != 0 {
+			port = strconv.Itoa(c.Port)
+		}
+		hosts = append(hosts, strings.Trim(host, "[]"))
+		ports = append(ports, port)
+	}
+	if !explicit && c.Port == 0 {
+		return strings.Join(hosts, ","), ""
+	}
+	for i, p := range ports {
+		if p == "" {
+			ports[i] = "5432"
+		}
+	}
+	return strings.Join(hosts, ","), strings.Join(ports, ",")
+}
+
+// dsnQuote quotes a DSN value when it contains characters the keyword/value
+// format treats specially
+func dsnQuote(v string) string {
+	if !strings.ContainsAny(v, " '\\") {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// dsnParams parses the settings of a keyword/value or postgres:// URL
+// connection string. Later keywords override earlier ones, as in libpq.
+func dsnParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	if strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection url: %w", err)
+		}
+		for k, v := range u.Query() {
+			params[k] = v[len(v)-1]
+		}
+		return params, nil
+	}
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid connection string: expected key=value at %q", s)
+		}
+		rest = strings.TrimLeft(rest, " \t\n")
+		var value strings.Builder
+		quoted := strings.HasPrefix(rest, "'")
+		if quoted {
+			rest = rest[1:]
+		}
+		i := 0
+		for ; i < len(rest); i++ {
+			c := rest[i]
+			if quoted && c == '\'' || !quoted && strings.IndexByte(" \t\n", c) >= 0 {
+				break
+			}
+			if c == '\\' && i+1 < len(rest) {
+				i++
+				c = rest[i]
+			}
+			value.WriteByte(c)
+		}
+		if quoted {
+			if i == len(rest) {
+				return nil, fmt.Errorf("invalid connection string: unterminated quote in %s", strings.TrimSpace(key))
+			}
+			i++
+		}
+		params[strings.TrimSpace(key)] = value.String()
+		s = rest[i:]
+	}
+	return params, nil
+}
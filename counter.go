@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CounterMode selects how a Counter avoids contention on its rows
+type CounterMode int
+
+const (
+	// CounterBatched accumulates increments in memory and flushes them
+	// every FlushInterval in one statement. Unflushed increments are lost if
+	// the process dies.
+	CounterBatched CounterMode = iota
+
+	// CounterSharded writes every increment straight away to one of Shards
+	// rows picked at random; reads sum the shards
+	CounterSharded
+)
+
+// Counter keeps named counters that are incremented far more often than a
+// single row can be updated, such as view or like counts. Values live in
+// Table as (name, shard, value) rows.
+type Counter struct {
+	DB            *pgxpool.Pool
+	Table         string
+	Mode          CounterMode
+	Shards        int           // Rows per counter in sharded mode, default 16
+	FlushInterval time.Duration // How often Run flushes in batched mode, default 1s
+	Clock         Clock         // Default SystemClock
+
+	mu      sync.Mutex
+	pending map[string]int64
+}
+
+// NewCounter creates a batched Counter and its table
+func NewCounter(ctx context.Context, db *pgxpool.Pool, table string) (*Counter, error) {
+	c := &Counter{DB: db, Table: table, Shards: 16, FlushInterval: time.Second, pending: make(map[string]int64)}
+	_, err := db.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(table)+` (
+		name text NOT NULL,
+		shard int NOT NULL,
+		value bigint NOT NULL DEFAULT 0,
+		PRIMARY KEY (name, shard)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", table, err)
+	}
+	return c, nil
+}
+
+// Add increments a counter by n
+func (c *Counter) Add(ctx context.Context, name string, n int64) error {
+	if c.Mode == CounterSharded {
+		shards := c.Shards
+		if shards <= 0 {
+			shards = 16
+		}
+		_, err := c.DB.Exec(ctx, `INSERT INTO `+sanitizeTable(c.Table)+` AS t (name, shard, value) VALUES ($1, $2, $3)
+			ON CONFLICT (name, shard) DO UPDATE SET value = t.value + EXCLUDED.value`,
+			name, rand.IntN(shards), n)
+		if err != nil {
+			return fmt.Errorf("error incrementing counter %s: %w", name, err)
+		}
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[string]int64)
+	}
+	c.pending[name] += n
+	return nil
+}
+
+// Get returns a counter's value, including increments this process has not
+// flushed yet
+func (c *Counter) Get(ctx context.Context, name string) (int64, error) {
+	var value int64
+	err := c.DB.QueryRow(ctx, `SELECT COALESCE(sum(value), 0) FROM `+sanitizeTable(c.Table)+` WHERE name = $1`, name).Scan(&value)
+	if err != nil {
+		return 0, fmt.Errorf("error reading counter %s: %w", name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return value + c.pending[name], nil
+}
+
+// Flush writes the pending increments in one statement. Increments that
+// fail to write are kept for the next flush.
+func (c *Counter) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]int64)
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(pending))
+	deltas := make([]int64, 0, len(pending))
+	for name, n := range pending {
+		names = append(names, name)
+		deltas = append(deltas, n)
+	}
+	_, err := c.DB.Exec(ctx, `INSERT INTO `+sanitizeTable(c.Table)+` AS t (name, shard, value)
+		SELECT name, 0, delta FROM unnest($1::text[], $2::bigint[]) AS d(name, delta)
+		ON CONFLICT (name, shard) DO UPDATE SET value = t.value + EXCLUDED.value`, names, deltas)
+	if err != nil {
+		c.mu.Lock()
+		for name, n := range pending {
+			c.pending[name] += n
+		}
+		c.mu.Unlock()
+		return fmt.Errorf("error flushing counters: %w", err)
+	}
+	return nil
+}
+
+// Run flushes every FlushInterval until ctx is cancelled, then flushes once
+// more
+func (c *Counter) Run(ctx context.Context) error {
+	interval := c.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	clock := clockOr(c.Clock)
+	for {
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return c.Flush(context.WithoutCancel(ctx))
+		}
+		if err := c.Flush(ctx); err != nil {
+			slog.Error("Error flushing counters", slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CrashDump is the diagnostic bundle written when the application dies,
+// and published through expvar while it runs
+type CrashDump struct {
+	At         time.Time           `json:"at"`
+	Reason     string              `json:"reason"`
+	Config     *DBConfig           `json:"config"` // Redacted
+	Stats      []PoolStatsSnapshot `json:"stats"`  // Oldest first, ending with one taken for the dump
+	Errors     []RecentError       `json:"errors"` // Oldest first
+	Acquired   []AcquiredConn      `json:"acquired"`
+	Goroutines int                 `json:"goroutines"`
+}
+
+// RecentError is a failed query or acquire
+type RecentError struct {
+	At     time.Time `json:"at"`
+	SQL    string    `json:"sql,omitempty"` // Empty for acquire errors
+	Caller string    `json:"caller,omitempty"`
+	Error  string    `json:"error"`
+}
+
+// AcquiredConn is a connection held out of the pool, with the stack that
+// acquired it
+type AcquiredConn struct {
+	Since  time.Time `json:"since"`
+	Caller string    `json:"caller,omitempty"`
+	Stack  []string  `json:"stack"`
+}
+
+// Diagnostics keeps recent pool history for postmortems: a ring of pool
+// stats, the latest query and acquire errors, and every acquired
+// connection with its acquiring stack. Add it to the pool with WithTracer
+// and start Run to sample the stats.
+type Diagnostics struct {
+	Stats     func() PoolStatsSnapshot // Sampled by Run, and once more for each dump
+	Config    *DBConfig                // Included redacted
+	Path      string                   // File written by Dump, stderr when empty
+	Interval  time.Duration            // Between stats samples, default 10s
+	History   int                      // Stats samples kept, default 60
+	MaxErrors int                      // Errors kept, default 50
+	Clock     Clock
+
+	mu       sync.Mutex
+	stats    []PoolStatsSnapshot
+	errors   []RecentError
+	acquired map[*pgx.Conn]acquisition
+}
+
+type acquisition struct {
+	since  time.Time
+	caller string
+	pcs    []uintptr
+}
+
+// NewDiagnostics creates diagnostics reporting cfg
+func NewDiagnostics(cfg *DBConfig) *Diagnostics {
+	return &Diagnostics{
+		Config:   cfg,
+		acquired: make(map[*pgx.Conn]acquisition),
+	}
+}
+
+type diagnosticsSQLKey struct{}
+
+func (d *Diagnostics) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, diagnosticsSQLKey{}, data.SQL)
+}
+
+func (d *Diagnostics) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	if data.Err == nil {
+		return
+	}
+	sql, _ := ctx.Value(diagnosticsSQLKey{}).(string)
+	d.addError(ctx, summarizeSQL(sql, 200), data.Err)
+}
+
+func (d *Diagnostics) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	return ctx
+}
+
+func (d *Diagnostics) TraceAcquireEnd(ctx context.Context, _ *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	if data.Err != nil {
+		d.addError(ctx, "", data.Err)
+		return
+	}
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.acquired[data.Conn] = acquisition{since: clockOr(d.Clock).Now(), caller: dbctx.Caller(ctx), pcs: pcs}
+}
+
+func (d *Diagnostics) TraceRelease(_ *pgxpool.Pool, data pgxpool.TraceReleaseData) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.acquired, data.Conn)
+}
+
+func (d *Diagnostics) addError(ctx context.Context, sql string, err error) {
+	max := d.MaxErrors
+	if max <= 0 {
+		max = 50
+	}
+	e := RecentError{At: clockOr(d.Clock).Now(), SQL: sql, Caller: dbctx.Caller(ctx), Error: err.Error()}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors = append(d.errors, e)
+	if len(d.errors) > max {
+		d.errors = d.errors[len(d.errors)-max:]
+	}
+}
+
+// Run samples Stats every Interval until ctx is cancelled
+func (d *Diagnostics) Run(ctx context.Context) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	history := d.History
+	if history <= 0 {
+		history = 60
+	}
+	clock := clockOr(d.Clock)
+	for {
+		if d.Stats != nil {
+			s := d.Stats()
+			d.mu.Lock()
+			d.stats = append(d.stats, s)
+			if len(d.stats) > history {
+				d.stats = d.stats[len(d.stats)-history:]
+			}
+			d.mu.Unlock()
+		}
+		if clock.Sleep(ctx, interval) != nil {
+			return
+		}
+	}
+}
+
+// Snapshot builds the bundle without writing it
+func (d *Diagnostics) Snapshot(reason string) CrashDump {
+	dump := CrashDump{
+		At:         clockOr(d.Clock).Now(),
+		Reason:     reason,
+		Config:     redactConfig(d.Config),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	var current []PoolStatsSnapshot
+	if d.Stats != nil {
+		current = append(current, d.Stats())
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dump.Stats = append(append(dump.Stats, d.stats...), current...)
+	dump.Errors = append(dump.Errors, d.errors...)
+	for _, a := range d.acquired {
+		dump.Acquired = append(dump.Acquired, AcquiredConn{Since: a.since, Caller: a.caller, Stack: formatStack(a.pcs)})
+	}
+	return dump
+}
+
+// formatStack renders program counters as "function file:line" frames
+func formatStack(pcs []uintptr) []string {
+	var stack []string
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if f.Function != "" {
+			stack = append(stack, fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line))
+		}
+		if !more {
+			return stack
+		}
+	}
+}
+
+// WriteDump writes the bundle to w as indented JSON
+func (d *Diagnostics) WriteDump(w io.Writer, reason string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d.Snapshot(reason))
+}
+
+// Dump writes the bundle to Path, or to stderr when Path is empty or
+// cannot be created
+func (d *Diagnostics) Dump(reason string) {
+	var w io.Writer = os.Stderr
+	if d.Path != "" {
+		f, err := os.Create(d.Path)
+		if err != nil {
+			slog.Error("Error creating crash dump", slog.String("path", d.Path), slog.String("error", err.Error()))
+		} else {
+			defer f.Close()
+			w = f
+		}
+	}
+	if err := d.WriteDump(w, reason); err != nil {
+		slog.Error("Error writing crash dump", slog.String("error", err.Error()))
+		return
+	}
+	slog.Error("Wrote crash dump", slog.String("reason", reason), slog.String("path", d.Path))
+}
+
+// DumpOnPanic dumps and re-panics. Defer it at the top of goroutines,
+// whose panics Run cannot see.
+func (d *Diagnostics) DumpOnPanic() {
+	if r := recover(); r != nil {
+		d.Dump(fmt.Sprintf("panic: %v", r))
+		panic(r)
+	}
+}
+
+var (
+	publishedMu sync.Mutex
+	published   = make(map[string]*atomic.Pointer[Diagnostics])
+)
+
+// Publish serves snapshots as the expvar name, on /debug/vars. Publishing
+// again under the same name replaces the earlier diagnostics.
+func (d *Diagnostics) Publish(name string) {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+	if p, ok := published[name]; ok {
+		p.Store(d)
+		return
+	}
+	p := new(atomic.Pointer[Diagnostics])
+	p.Store(d)
+	published[name] = p
+	expvar.Publish(name, expvar.Func(func() any { return p.Load().Snapshot("expvar") }))
+}
+
+// redactConfig copies cfg without its password, URL credentials or
+// password-like parameters
+func redactConfig(cfg *DBConfig) *DBConfig {
+	if cfg == nil {
+		return nil
+	}
+	c := *cfg
+	if c.Password != "" {
+		c.Password = "xxxxx"
+	}
+	c.URL = redactURL(c.URL)
+	c.ReplicaURL = redactURL(c.ReplicaURL)
+	c.AnalyticsURL = redactURL(c.AnalyticsURL)
+	c.CacheRedisURL = redactURL(c.CacheRedisURL)
+	c.Params = redactParams(c.Params)
+	c.RuntimeParams = redactParams(c.RuntimeParams)
+	if c.AdminToken != "" {
+		c.AdminToken = "xxxxx"
+	}
+	c.Credentials = nil
+	return &c
+}
+
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "xxxxx"
+	}
+	q := u.Query()
+	for k := range q {
+		if strings.Contains(strings.ToLower(k), "password") {
+			q.Set(k, "xxxxx")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.Redacted()
+}
+
+func redactParams(params map[string]string) map[string]string {
+	if params == nil {
+		return nil
+	}
+	out := make(map[string]string, len(params))
+	for k, v := range params {
+		if strings.Contains(strings.ToLower(k), "password") {
+			v = "xxxxx"
+		}
+		out[k] = v
+	}
+	return out
+}
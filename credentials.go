@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/jackc/pgx/v5"
+)
+
+// Credentials is a database user name and password. An empty UserName
+// keeps the configured one.
+type Credentials struct {
+	UserName string
+	Password string
+}
+
+// CredentialProvider fetches database credentials from an external secret store
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialProviderFunc adapts a function to CredentialProvider
+type CredentialProviderFunc func(ctx context.Context) (Credentials, error)
+
+func (f CredentialProviderFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// NewCredentialProvider builds a provider by name: "vault" (secret is the
+// API path, e.g. secret/data/app/db), "aws-secretsmanager" (secret ID or
+// ARN) or "gcp-secretmanager" (projects/.../secrets/.../versions/latest)
+func NewCredentialProvider(kind, secret string) (CredentialProvider, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("credential provider %q requires a secret name", kind)
+	}
+
+	switch kind {
+	case "vault":
+		return &VaultProvider{Address: os.Getenv("VAULT_ADDR"), Token: os.Getenv("VAULT_TOKEN"), Path: secret}, nil
+	case "aws-secretsmanager":
+		return &AWSSecretsManagerProvider{SecretID: secret}, nil
+	case "gcp-secretmanager":
+		return &GCPSecretManagerProvider{Name: secret}, nil
+	default:
+		return nil, fmt.Errorf("unknown credential provider %q", kind)
+	}
+}
+
+// credentialProvider returns the provider configured on c, if any
+func (c *DBConfig) credentialProvider() (CredentialProvider, error) {
+	if c.Credentials != nil {
+		return c.Credentials, nil
+	}
+	if c.CredentialsProvider == "" {
+		return nil, nil
+	}
+	p, err := NewCredentialProvider(c.CredentialsProvider, c.CredentialsSecret)
+	if err != nil {
+		return nil, err
+	}
+	// Cache the built provider so the initial fetch and later refreshes share it
+	c.Credentials = p
+	return p, nil
+}
+
+// parseSecret reads credentials from a secret payload. JSON payloads use
+// username/password keys (the RDS and Vault database engine format); any
+// other payload is taken as the password alone.
+func parseSecret(payload []byte) (Credentials, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return Credentials{Password: strings.TrimSpace(string(payload))}, nil
+	}
+	return credentialsFromMap(fields)
+}
+
+func credentialsFromMap(fields map[string]any) (Credentials, error) {
+	var creds Credentials
+	for _, key := range []string{"username", "user"} {
+		if v, ok := fields[key].(string); ok {
+			creds.UserName = v
+			break
+		}
+	}
+	creds.Password, _ = fields["password"].(string)
+	if creds.Password == "" {
+		return Credentials{}, errors.New("secret has no password field")
+	}
+	return creds, nil
+}
+
+// VaultProvider reads credentials from HashiCorp Vault, supporting KV v1,
+// KV v2 and database secrets engine responses
+type VaultProvider struct {
+	Address string // e.g. https://vault.internal:8200
+	Token   string
+	Path    string // e.g. secret/data/app/db or database/creds/app
+	Client  *http.Client
+}
+
+func (v *VaultProvider) Credentials(ctx context.Context) (Credentials, error) {
+	url := strings.TrimRight(v.Address, "/") + "/v1/" + strings.TrimLeft(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	body, err := doSecretRequest(v.Client, req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading vault secret %s: %w", v.Path, err)
+	}
+
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return Credentials{}, fmt.Errorf("error decoding vault secret %s: %w", v.Path, err)
+	}
+	data := resp.Data
+	// KV v2 nests the secret under data.data
+	if inner, ok := data["data"].(map[string]any); ok {
+		data = inner
+	}
+	return credentialsFromMap(data)
+}
+
+// AWSSecretsManagerProvider reads credentials from AWS Secrets Manager using
+// the default AWS credential chain
+type AWSSecretsManagerProvider struct {
+	SecretID string
+
+	config awsConfigLoader
+}
+
+func (a *AWSSecretsManagerProvider) Credentials(ctx context.Context) (Credentials, error) {
+	cfg, err := a.config.load(ctx)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error loading aws config: %w", err)
+	}
+
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(a.SecretID)})
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading aws secret %s: %w", a.SecretID, err)
+	}
+	if out.SecretString != nil {
+		return parseSecret([]byte(*out.SecretString))
+	}
+	return parseSecret(out.SecretBinary)
+}
+
+// awsConfigLoader loads the default AWS configuration once it first
+// succeeds. A failed load is retried by the next caller instead of being
+// kept, and the load outlives the cancellation of the caller that starts it.
+type awsConfigLoader struct {
+	mu     sync.Mutex
+	cfg    aws.Config
+	loaded bool
+}
+
+func (l *awsConfigLoader) load(ctx context.Context) (aws.Config, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.loaded {
+		return l.cfg, nil
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.WithoutCancel(ctx))
+	if err != nil {
+		return aws.Config{}, err
+	}
+	l.cfg, l.loaded = cfg, true
+	return cfg, nil
+}
+
+// GCPSecretManagerProvider reads credentials from GCP Secret Manager. The
+// access token comes from GOOGLE_OAUTH_ACCESS_TOKEN or the metadata server.
+type GCPSecretManagerProvider struct {
+	Name   string // projects/<project>/secrets/<secret>/versions/<version>
+	Client *http.Client
+}
+
+func (g *GCPSecretManagerProvider) Credentials(ctx context.Context) (Credentials, error) {
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	url := "https://secretmanager.googleapis.com/v1/" + strings.TrimLeft(g.Name, "/") + ":access"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	body, err := doSecretRequest(g.Client, req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading gcp secret %s: %w", g.Name, err)
+	}
+
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return Credentials{}, fmt.Errorf("error decoding gcp secret %s: %w", g.Name, err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error decoding gcp secret %s: %w", g.Name, err)
+	}
+	return parseSecret(payload)
+}
+
+func (g *GCPSecretManagerProvider) accessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	body, err := doSecretRequest(g.Client, req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching gcp access token: %w", err)
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("error decoding gcp access token: %w", err)
+	}
+	return resp.AccessToken, nil
+}
+
+func doSecretRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, nil
+}
+
+// credentialCache memoizes a provider for ttl. When a refresh fails the
+// last good credentials keep being used so a secret store outage does not
+// stop new connections. One caller fetches at a time, outside the lock;
+// the others keep using the stale credentials meanwhile, or wait when
+// there are none yet.
+type credentialCache struct {
+	provider CredentialProvider
+	ttl      time.Duration
+	clock    Clock // Default SystemClock
+
+	mu       sync.Mutex
+	creds    Credentials
+	fetched  time.Time
+	fetching chan struct{} // Closed when the running fetch returns, nil when none runs
+}
+
+func (c *credentialCache) get(ctx context.Context) (Credentials, error) {
+	clock := clockOr(c.clock)
+	c.mu.Lock()
+	for {
+		if !c.fetched.IsZero() && (c.fetching != nil || clock.Now().Sub(c.fetched) < c.ttl) {
+			creds := c.creds
+			c.mu.Unlock()
+			return creds, nil
+		}
+		if c.fetching == nil {
+			break
+		}
+		fetching := c.fetching
+		c.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return Credentials{}, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	fetching := make(chan struct{})
+	c.fetching = fetching
+	c.mu.Unlock()
+
+	creds, err := c.fetch(ctx, fetching)
+	if err != nil {
+		c.mu.Lock()
+		cached, ok := c.creds, !c.fetched.IsZero()
+		c.mu.Unlock()
+		if !ok {
+			return Credentials{}, err
+		}
+		slog.Warn("Credential refresh failed, using cached credentials", slog.String("error", err.Error()))
+		return cached, nil
+	}
+	return creds, nil
+}
+
+// fetch asks the provider and stores a good answer, then wakes the callers
+// waiting on fetching
+func (c *credentialCache) fetch(ctx context.Context, fetching chan struct{}) (Credentials, error) {
+	defer func() {
+		c.mu.Lock()
+		c.fetching = nil
+		c.mu.Unlock()
+		close(fetching)
+	}()
+	creds, err := c.provider.Credentials(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+	c.mu.Lock()
+	c.creds, c.fetched = creds, clockOr(c.clock).Now()
+	c.mu.Unlock()
+	return creds, nil
+}
+
+// WithCredentialRefresh consults provider before every new connection,
+// caching its answer for ttl, so rotated secrets are picked up without
+// restarting the pool
+func WithCredentialRefresh(provider CredentialProvider, ttl time.Duration) PoolOption {
+	cache := &credentialCache{provider: provider, ttl: ttl}
+
+	return func(s *poolSettings) {
+		prev := s.config.BeforeConnect
+		s.config.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+			if prev != nil {
+				if err := prev(ctx, cc); err != nil {
+					return err
+				}
+			}
+
+			creds, err := cache.get(ctx)
+			if err != nil {
+				return fmt.Errorf("error fetching database credentials: %w", err)
+			}
+			if creds.UserName != "" {
+				cc.User = creds.UserName
+			}
+			cc.Password = creds.Password
+			return nil
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed five-field cron expression bound to a time zone.
+//
+// DST semantics follow classic cron: a fixed-hour job whose wall time falls
+// into a spring-forward gap runs once at the transition, and a fixed-hour job
+// inside a repeated fall-back hour runs only on the first occurrence. Jobs
+// with a wildcard hour field keep their wall-clock cadence: gap times are
+// skipped and repeated times run on both occurrences.
+type CronSchedule struct {
+	expr     string
+	loc      *time.Location
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	domStar  bool
+	dowStar  bool
+	hourStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}}
+	// Day of week accepts 0-7 where both 0 and 7 are Sunday
+	cronDow = cronField{min: 0, max: 7, names: map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSearchDays bounds how far ahead Next looks before giving up, long
+// enough to find expressions like "0 0 29 2 *"
+const cronSearchDays = 366 * 8
+
+// ParseCron parses a cron expression. The time zone can be given with a
+// CRON_TZ= or TZ= prefix (e.g. "CRON_TZ=Europe/Berlin 0 3 * * *"); without
+// one the schedule is evaluated in UTC.
+func ParseCron(expr string) (*CronSchedule, error) {
+	loc := time.UTC
+	spec := strings.TrimSpace(expr)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		name, rest, _ := strings.Cut(spec, " ")
+		_, zone, _ := strings.Cut(name, "=")
+		var err error
+		loc, err = time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron time zone %q: %w", zone, err)
+		}
+		spec = strings.TrimSpace(rest)
+	}
+
+	return parseCron(expr, spec, loc)
+}
+
+// ParseCronInLocation parses a cron expression evaluated in loc
+func ParseCronInLocation(expr string, loc *time.Location) (*CronSchedule, error) {
+	if loc == nil {
+		return nil, fmt.Errorf("cron location must not be nil")
+	}
+	return parseCron(expr, strings.TrimSpace(expr), loc)
+}
+
+func parseCron(expr, spec string, loc *time.Location) (*CronSchedule, error) {
+	if d, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &CronSchedule{expr: expr, loc: loc}
+	var err error
+	if s.minute, _, err = parseCronField(fields[0], cronMinute); err != nil {
+		return nil, fmt.Errorf("invalid cron minute field: %w", err)
+	}
+	if s.hour, s.hourStar, err = parseCronField(fields[1], cronHour); err != nil {
+		return nil, fmt.Errorf("invalid cron hour field: %w", err)
+	}
+	if s.dom, s.domStar, err = parseCronField(fields[2], cronDom); err != nil {
+		return nil, fmt.Errorf("invalid cron day-of-month field: %w", err)
+	}
+	if s.month, _, err = parseCronField(fields[3], cronMonth); err != nil {
+		return nil, fmt.Errorf("invalid cron month field: %w", err)
+	}
+	if s.dow, s.dowStar, err = parseCronField(fields[4], cronDow); err != nil {
+		return nil, fmt.Errorf("invalid cron day-of-week field: %w", err)
+	}
+	// Fold Sunday=7 onto Sunday=0
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	// Reject dates that never exist, such as "0 0 30 2 *". The search starts
+	// at a fixed leap year so the answer does not depend on today's date.
+	if s.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("invalid cron expression %q: never matches", expr)
+	}
+
+	return s, nil
+}
+
+// parseCronField returns the bitset of allowed values and whether the field
+// was an unrestricted "*"
+func parseCronField(field string, f cronField) (uint64, bool, error) {
+	var set uint64
+	star := false
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, false, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			lo, hi = f.min, f.max
+			if !hasStep {
+				star = true
+			}
+		case strings.Contains(rangePart, "-"):
+			a, b, _ := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = f.value(a); err != nil {
+				return 0, false, err
+			}
+			if hi, err = f.value(b); err != nil {
+				return 0, false, err
+			}
+			if lo > hi {
+				return 0, false, fmt.Errorf("invalid range %q", rangePart)
+			}
+		default:
+			v, err := f.value(rangePart)
+			if err != nil {
+				return 0, false, err
+			}
+			lo, hi = v, v
+			// "5/15" means starting at 5 through the end of the range
+			if hasStep {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	if set == 0 {
+		return 0, false, fmt.Errorf("field %q matches nothing", field)
+	}
+	return set, star, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d]", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *CronSchedule) String() string {
+	return s.expr
+}
+
+// Location returns the time zone the schedule is evaluated in
+func (s *CronSchedule) Location() *time.Location {
+	return s.loc
+}
+
+// Next returns the first run time strictly after the given time, or the zero
+// time if the expression never matches within the search horizon
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	local := after.In(s.loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+
+	// Gap and fall-back handling can move a run onto a neighbouring
+	// calendar day, so start one day early
+	day = day.AddDate(0, 0, -1)
+	for i := 0; i < cronSearchDays; i++ {
+		for _, t := range s.runsOn(day) {
+			if t.After(after) {
+				return t
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// Upcoming returns the next n run times after the given time
+func (s *CronSchedule) Upcoming(after time.Time, n int) []time.Time {
+	if n <= 0 {
+		return nil
+	}
+	runs := make([]time.Time, 0, n)
+	for len(runs) < n {
+		next := s.Next(after)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+		after = next
+	}
+	return runs
+}
+
+// runsOn returns the sorted run instants for a local calendar day, given as
+// midnight UTC carrying the local date
+func (s *CronSchedule) runsOn(day time.Time) []time.Time {
+	if !s.matchesDay(day) {
+		return nil
+	}
+
+	var runs []time.Time
+	for h := 0; h < 24; h++ {
+		if s.hour&(1<<uint(h)) == 0 {
+			continue
+		}
+		for m := 0; m < 60; m++ {
+			if s.minute&(1<<uint(m)) == 0 {
+				continue
+			}
+			runs = append(runs, s.resolve(day.Year(), day.Month(), day.Day(), h, m)...)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Before(runs[j]) })
+	return dedupeTimes(runs)
+}
+
+func (s *CronSchedule) matchesDay(day time.Time) bool {
+	if s.month&(1<<uint(day.Month())) == 0 {
+		return false
+	}
+	domMatch := s.dom&(1<<uint(day.Day())) != 0
+	dowMatch := s.dow&(1<<uint(day.Weekday())) != 0
+
+	// Standard cron: when both fields are restricted either may match
+	if !s.domStar && !s.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// resolve maps a wall-clock time in the schedule's zone onto the instants
+// it should run at, applying the DST rules described on CronSchedule
+func (s *CronSchedule) resolve(year int, month time.Month, day, hour, min int) []time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, s.loc)
+	want := time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+
+	if !got.Equal(want) {
+		// Wall time does not exist (spring-forward gap)
+		if s.hourStar {
+			return nil
+		}
+		start, end := t.ZoneBounds()
+		if got.After(want) {
+			return []time.Time{start}
+		}
+		return []time.Time{end}
+	}
+
+	// Look for a second instant with the same wall time (fall-back overlap)
+	_, offset := t.Zone()
+	start, end := t.ZoneBounds()
+	var other time.Time
+	if !start.IsZero() {
+		_, prevOffset := start.Add(-time.Nanosecond).Zone()
+		if alt := t.Add(time.Duration(offset-prevOffset) * time.Second); alt.Before(start) {
+			other = alt
+		}
+	}
+	if other.IsZero() && !end.IsZero() {
+		_, nextOffset := end.Zone()
+		if alt := t.Add(time.Duration(offset-nextOffset) * time.Second); !alt.Before(end) {
+			other = alt
+		}
+	}
+
+	if other.IsZero() {
+		return []time.Time{t}
+	}
+	if s.hourStar {
+		return []time.Time{t, other}
+	}
+	if other.Before(t) {
+		return []time.Time{other}
+	}
+	return []time.Time{t}
+}
+
+func dedupeTimes(ts []time.Time) []time.Time {
+	out := ts[:0]
+	for i, t := range ts {
+		if i > 0 && t.Equal(ts[i-1]) {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ExportOption customizes ExportCSV
+type ExportOption func(*exportSettings)
+
+type exportSettings struct {
+	header    bool
+	delimiter rune
+	gzipLevel int // Zero writes plain CSV
+}
+
+// WithCSVHeader sets whether the first line names the columns, default true
+func WithCSVHeader(on bool) ExportOption {
+	return func(s *exportSettings) { s.header = on }
+}
+
+// WithCSVDelimiter separates fields with r instead of a comma
+func WithCSVDelimiter(r rune) ExportOption {
+	return func(s *exportSettings) { s.delimiter = r }
+}
+
+// WithCSVGzip compresses the output at level, e.g. gzip.DefaultCompression
+func WithCSVGzip(level int) ExportOption {
+	return func(s *exportSettings) { s.gzipLevel = level }
+}
+
+// ExportCSV streams the result of query to w as CSV using COPY TO STDOUT,
+// which the server formats far faster than scanning rows one by one. It
+// returns the number of rows written. COPY takes no parameters, so build
+// query only from trusted input. Empty strings and NULLs are told apart
+// as in COPY's CSV format: NULL is an empty unquoted field.
+//
+//	f, _ := os.Create("orders.csv.gz")
+//	n, err := ExportCSV(ctx, app.DBClient, "SELECT * FROM orders WHERE created_at > now() - interval '1 day'", f, WithCSVGzip(gzip.BestSpeed))
+func ExportCSV(ctx context.Context, db *pgxpool.Pool, query string, w io.Writer, opts ...ExportOption) (int64, error) {
+	s := exportSettings{header: true, delimiter: ','}
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	out := w
+	var zw *gzip.Writer
+	if s.gzipLevel != 0 {
+		var err error
+		if zw, err = gzip.NewWriterLevel(w, s.gzipLevel); err != nil {
+			return 0, err
+		}
+		out = zw
+	}
+
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	copySQL := fmt.Sprintf("COPY (%s) TO STDOUT WITH (FORMAT csv, HEADER %t, DELIMITER %s)",
+		query, s.header, quoteLiteral(string(s.delimiter)))
+	tag, err := conn.Conn().PgConn().CopyTo(ctx, out, copySQL)
+	if err != nil {
+		return 0, fmt.Errorf("error exporting csv: %w", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return tag.RowsAffected(), err
+		}
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ImportOptions customizes ImportCSV
+type ImportOptions struct {
+	Fields     []string          // Names of the CSV fields when the file has no header line
+	Columns    map[string]string // CSV field to table column; fields left out are skipped. Unset loads every field into the column of its name.
+	Delimiter  rune              // Field separator, default a comma
+	BatchSize  int               // Rows per COPY, default 10000
+	MaxBadRows int               // Rejected rows tolerated before the import fails, zero tolerates none
+	UpsertKey  []string          // Load through a staging table and upsert on these columns instead of inserting
+}
+
+// ImportResult is the outcome of ImportCSV
+type ImportResult struct {
+	Rows    int64    // Rows inserted or, with UpsertKey, inserted or updated
+	BadRows []BadRow // Rows rejected, in file order
+}
+
+// BadRow is a CSV row ImportCSV rejected
+type BadRow struct {
+	Line   int      // Line of the row in the file
+	Record []string // Fields as read
+	Err    error
+}
+
+// ErrTooManyBadRows is returned when more rows are rejected than
+// ImportOptions.MaxBadRows allows
+var ErrTooManyBadRows = errors.New("too many bad rows in csv import")
+
+// copyLineRe finds the failing line in a COPY error's context
+var copyLineRe = regexp.MustCompile(`\bline (\d+)\b`)
+
+// ImportCSV streams CSV from r into table with COPY FROM STDIN, in one
+// transaction. Rows with the wrong number of fields, or that the server
+// rejects for a data or constraint error, are collected as BadRows rather
+// than failing the import, up to MaxBadRows; each server-side rejection
+// re-sends the rest of its batch. Empty fields load as NULL.
+//
+// With UpsertKey set, rows go into a temporary staging table shaped like
+// table and are then merged with INSERT ... ON CONFLICT, updating the
+// mapped columns of existing rows. When the file repeats a key, its last
+// row wins.
+func ImportCSV(ctx context.Context, db *pgxpool.Pool, table string, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	cr := csv.NewReader(r)
+	if opts.Delimiter != 0 {
+		cr.Comma = opts.Delimiter
+	}
+	fields := opts.Fields
+	if fields == nil {
+		header, err := cr.Read()
+		if err != nil {
+			return ImportResult{}, fmt.Errorf("error reading csv header: %w", err)
+		}
+		fields = slices.Clone(header)
+	}
+	cr.FieldsPerRecord = len(fields)
+
+	var keep []int
+	var columns []string
+	for i, f := range fields {
+		col := f
+		if opts.Columns != nil {
+			var ok bool
+			if col, ok = opts.Columns[f]; !ok {
+				continue
+			}
+		}
+		keep = append(keep, i)
+		columns = append(columns, col)
+	}
+	if len(columns) == 0 {
+		return ImportResult{}, errors.New("csv import maps no fields to columns")
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 10000
+	}
+
+	imp := &csvImport{columns: columns, maxBad: opts.MaxBadRows}
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		imp.tx = tx
+		imp.target = pgx.Identifier(strings.Split(table, ".")).Sanitize()
+		if len(opts.UpsertKey) > 0 {
+			imp.target = "pgxpool_import_staging"
+			if _, err := tx.Exec(ctx, "CREATE TEMPORARY TABLE "+imp.target+" (LIKE "+pgx.Identifier(strings.Split(table, ".")).Sanitize()+
+				" INCLUDING DEFAULTS) ON COMMIT DROP"); err != nil {
+				return fmt.Errorf("error creating staging table: %w", err)
+			}
+		}
+
+		var batch []csvRow
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				if err := imp.reject(BadRow{Line: parseErr.StartLine, Record: record, Err: err}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error reading csv: %w", err)
+			}
+
+			line, _ := cr.FieldPos(0)
+			values := make([]string, len(keep))
+			for i, idx := range keep {
+				values[i] = record[idx]
+			}
+			batch = append(batch, csvRow{line: line, record: record, values: values})
+			if len(batch) >= batchSize {
+				if err := imp.copy(ctx, batch); err != nil {
+					return err
+				}
+				batch = nil
+			}
+		}
+		if err := imp.copy(ctx, batch); err != nil {
+			return err
+		}
+
+		if len(opts.UpsertKey) > 0 {
+			return imp.upsert(ctx, table, opts.UpsertKey)
+		}
+		return nil
+	})
+	if err != nil {
+		// Nothing was committed
+		return ImportResult{BadRows: imp.bad}, err
+	}
+	return ImportResult{Rows: imp.rows, BadRows: imp.bad}, nil
+}
+
+type csvRow struct {
+	line   int
+	record []string
+	values []string // Mapped fields, in column order
+}
+
+type csvImport struct {
+	tx      pgx.Tx
+	target  string // Sanitized table COPY writes to
+	columns []string
+	maxBad  int
+	rows    int64
+	bad     []BadRow
+}
+
+func (imp *csvImport) reject(row BadRow) error {
+	imp.bad = append(imp.bad, row)
+	if len(imp.bad) > imp.maxBad {
+		return fmt.Errorf("%w: line %d: %w", ErrTooManyBadRows, row.Line, row.Err)
+	}
+	return nil
+}
+
+// copy loads batch in a savepoint, dropping rows the server rejects and
+// retrying without them
+func (imp *csvImport) copy(ctx context.Context, batch []csvRow) error {
+	sql := "COPY " + imp.target + " (" + sanitizeColumns(imp.columns) + ") FROM STDIN WITH (FORMAT csv)"
+	for len(batch) > 0 {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		for _, row := range batch {
+			_ = w.Write(row.values)
+		}
+		w.Flush()
+
+		sp, err := imp.tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		tag, err := sp.Conn().PgConn().CopyFrom(ctx, &buf, sql)
+		if err == nil {
+			if err := sp.Commit(ctx); err != nil {
+				return err
+			}
+			imp.rows += tag.RowsAffected()
+			return nil
+		}
+		_ = sp.Rollback(ctx)
+
+		n, ok := copyErrorLine(err)
+		if !ok || n > len(batch) {
+			return fmt.Errorf("error importing csv: %w", err)
+		}
+		if err := imp.reject(BadRow{Line: batch[n-1].line, Record: batch[n-1].record, Err: err}); err != nil {
+			return err
+		}
+		batch = slices.Delete(slices.Clone(batch), n-1, n)
+	}
+	return nil
+}
+
+// copyErrorLine returns the 1-based line of the COPY input a data or
+// constraint error refers to
+func copyErrorLine(err error) (int, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || !strings.HasPrefix(pgErr.Code, "22") && !strings.HasPrefix(pgErr.Code, "23") {
+		return 0, false
+	}
+	m := copyLineRe.FindStringSubmatch(pgErr.Where)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(m[1])
+	return n, err == nil && n > 0
+}
+
+// upsert merges the staging table into table, keeping the last staged row
+// of each key
+func (imp *csvImport) upsert(ctx context.Context, table string, key []string) error {
+	cols, keys := sanitizeColumns(imp.columns), sanitizeColumns(key)
+	var set []string
+	for _, c := range imp.columns {
+		if !slices.Contains(key, c) {
+			ident := pgx.Identifier{c}.Sanitize()
+			set = append(set, ident+" = excluded."+ident)
+		}
+	}
+	action := "DO NOTHING"
+	if len(set) > 0 {
+		action = "DO UPDATE SET " + strings.Join(set, ", ")
+	}
+
+	tag, err := imp.tx.Exec(ctx, "INSERT INTO "+pgx.Identifier(strings.Split(table, ".")).Sanitize()+" ("+cols+")"+
+		" SELECT DISTINCT ON ("+keys+") "+cols+" FROM "+imp.target+" ORDER BY "+keys+", ctid DESC"+
+		" ON CONFLICT ("+keys+") "+action)
+	if err != nil {
+		return fmt.Errorf("error upserting csv rows into %s: %w", table, err)
+	}
+	imp.rows = tag.RowsAffected()
+	return nil
+}
+
+func sanitizeColumns(cols []string) string {
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// cursorSeq makes cursor names unique within the process
+var cursorSeq atomic.Int64
+
+// Cursor reads the rows of a query through a server-side cursor, a batch
+// at a time, so scanning millions of rows holds only one batch in memory:
+//
+//	c, err := OpenCursor(ctx, tx, pgx.RowToStructByName[Event], 5000, "SELECT * FROM events")
+//	defer c.Close(ctx)
+//	for c.Next(ctx) {
+//		process(c.Value())
+//	}
+//	err = c.Err()
+//
+// The cursor lives in the transaction that opened it and is gone once it
+// ends.
+type Cursor[T any] struct {
+	tx        pgx.Tx
+	name      string
+	scan      pgx.RowToFunc[T]
+	batchSize int
+
+	batch []T
+	pos   int
+	done  bool
+	err   error
+}
+
+// OpenCursor declares a cursor for sql in tx, fetching batchSize rows at a
+// time, default 1000
+func OpenCursor[T any](ctx context.Context, tx pgx.Tx, scan pgx.RowToFunc[T], batchSize int, sql string, args ...any) (*Cursor[T], error) {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	name := fmt.Sprintf("pgxpool_cursor_%d", cursorSeq.Add(1))
+	if _, err := tx.Exec(ctx, "DECLARE "+name+" NO SCROLL CURSOR FOR "+sql, args...); err != nil {
+		return nil, fmt.Errorf("error declaring cursor: %w", err)
+	}
+	return &Cursor[T]{tx: tx, name: name, scan: scan, batchSize: batchSize}, nil
+}
+
+// Batch fetches the next batch of rows, returning none once the cursor is
+// exhausted
+func (c *Cursor[T]) Batch(ctx context.Context) ([]T, error) {
+	if c.done || c.err != nil {
+		return nil, c.err
+	}
+	rows, err := c.tx.Query(ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", c.batchSize, c.name))
+	if err != nil {
+		c.err = fmt.Errorf("error fetching from cursor: %w", err)
+		return nil, c.err
+	}
+	batch, err := SafeCollectRows(rows, c.scan)
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	c.done = len(batch) < c.batchSize
+	return batch, nil
+}
+
+// Next advances to the next row, fetching a batch when the current one is
+// used up. It returns false at the end of the rows or on an error.
+func (c *Cursor[T]) Next(ctx context.Context) bool {
+	c.pos++
+	for c.pos >= len(c.batch) {
+		batch, err := c.Batch(ctx)
+		if err != nil || len(batch) == 0 {
+			c.batch = nil
+			return false
+		}
+		c.batch, c.pos = batch, 0
+	}
+	return true
+}
+
+// Value returns the row Next advanced to
+func (c *Cursor[T]) Value() T {
+	return c.batch[c.pos]
+}
+
+// Err returns the error that stopped Next or Batch
+func (c *Cursor[T]) Err() error {
+	return c.err
+}
+
+// Close closes the cursor, releasing its resources before the transaction
+// ends
+func (c *Cursor[T]) Close(ctx context.Context) error {
+	c.done, c.batch = true, nil
+	// In a failed transaction the cursor is already unusable
+	if _, err := c.tx.Exec(ctx, "CLOSE "+c.name); err != nil && c.tx.Conn().PgConn().TxStatus() == 'T' {
+		return fmt.Errorf("error closing cursor: %w", err)
+	}
+	return nil
+}
+
+// ForEachBatch runs sql through a cursor in a read-only transaction on db
+// and calls fn with each batch of up to batchSize rows, stopping at the
+// first error fn returns
+func ForEachBatch[T any](ctx context.Context, db *pgxpool.Pool, scan pgx.RowToFunc[T], batchSize int, fn func([]T) error, sql string, args ...any) error {
+	return pgx.BeginTxFunc(ctx, db, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		c, err := OpenCursor(ctx, tx, scan, batchSize, sql, args...)
+		if err != nil {
+			return err
+		}
+		for {
+			batch, err := c.Batch(ctx)
+			if err != nil || len(batch) == 0 {
+				return err
+			}
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+	})
+}
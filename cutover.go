@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrCutoverTimeout is returned when the new database does not catch up
+// with the old one in time. Writes are resumed against the old database.
+var ErrCutoverTimeout = errors.New("timed out waiting for replication catch-up")
+
+// ActivePool is the pool the application uses, swappable at runtime. Writes
+// go through Write so a cutover can pause them while databases switch.
+type ActivePool struct {
+	current atomic.Pointer[pgxpool.Pool]
+	gate    writeGate
+}
+
+// NewActivePool creates an ActivePool serving db
+func NewActivePool(db *pgxpool.Pool) *ActivePool {
+	p := &ActivePool{}
+	p.current.Store(db)
+	return p
+}
+
+// Pool returns the pool currently serving the application
+func (p *ActivePool) Pool() *pgxpool.Pool {
+	return p.current.Load()
+}
+
+// Or returns the pool p serves, or db when p is nil. Components built on
+// a fixed pool resolve it this way on each use, so an optional ActivePool
+// lets them follow a PoolSupervisor's rebuilds.
+func (p *ActivePool) Or(db *pgxpool.Pool) *pgxpool.Pool {
+	if p == nil {
+		return db
+	}
+	return p.Pool()
+}
+
+// Write runs fn against the current pool, waiting while writes are paused
+func (p *ActivePool) Write(ctx context.Context, fn func(db *pgxpool.Pool) error) error {
+	if err := p.gate.enter(ctx); err != nil {
+		return err
+	}
+	defer p.gate.exit()
+	return fn(p.Pool())
+}
+
+// writeGate blocks new writes while paused and tracks the ones in flight
+type writeGate struct {
+	mu       sync.Mutex
+	paused   bool
+	resumed  chan struct{} // Closed on resume
+	inflight int
+	drained  chan struct{} // Closed when the last in-flight write finishes during a pause
+}
+
+func (g *writeGate) enter(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		if !g.paused {
+			g.inflight++
+			g.mu.Unlock()
+			return nil
+		}
+		resumed := g.resumed
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resumed:
+		}
+	}
+}
+
+func (g *writeGate) exit() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.inflight--
+	if g.inflight == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+// pause blocks new writes and waits for in-flight ones to finish
+func (g *writeGate) pause(ctx context.Context) error {
+	g.mu.Lock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+	if g.inflight == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.drained == nil {
+		g.drained = make(chan struct{})
+	}
+	drained := g.drained
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("error draining in-flight writes: %w", ctx.Err())
+	case <-drained:
+		return nil
+	}
+}
+
+func (g *writeGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+// CutoverPhase names a step of a cutover
+type CutoverPhase string
+
+const (
+	CutoverPausingWrites CutoverPhase = "pausing_writes"
+	CutoverWaitingLag    CutoverPhase = "waiting_for_catchup"
+	CutoverCaughtUp      CutoverPhase = "caught_up"
+	CutoverVerifying     CutoverPhase = "verifying"
+	CutoverPromoting     CutoverPhase = "promoting"
+	CutoverSwapped       CutoverPhase = "swapped"
+	CutoverResumed       CutoverPhase = "writes_resumed"
+	CutoverRolledBack    CutoverPhase = "rolled_back"
+)
+
+// CutoverEvent is reported to Cutover.OnEvent as a cutover progresses
+type CutoverEvent struct {
+	Phase    CutoverPhase
+	At       time.Time
+	LagBytes int64 // Replication lag, for CutoverWaitingLag and CutoverCaughtUp
+	Err      error // Why the cutover rolled back
+}
+
+// Cutover moves an ActivePool from Old to New: it pauses writes, waits for
+// New to replay everything Old has written, optionally promotes New, swaps
+// the pool and resumes writes. Any failure before the swap resumes writes
+// against Old. Writes are only paused within this process.
+type Cutover struct {
+	Active *ActivePool
+	Old    *pgxpool.Pool // Current primary
+	New    *pgxpool.Pool // Physical standby or logical replication subscriber
+
+	MaxLagBytes  int64         // Lag accepted as caught up, default 0
+	Timeout      time.Duration // How long to wait for catch-up, default 30 seconds
+	PollInterval time.Duration // How often lag is checked, default 100ms
+	Clock        Clock         // Default SystemClock
+
+	// Verify lists reads compared on both databases with DiffQueries once
+	// New has caught up; any difference rolls the cutover back
+	Verify []string
+
+	// Promote is called after catch-up, before the swap, e.g. to promote a
+	// physical standby. New must accept writes once it returns.
+	Promote func(ctx context.Context) error
+
+	OnEvent func(CutoverEvent)
+}
+
+// Run performs the cutover
+func (c *Cutover) Run(ctx context.Context) error {
+	if c.Active.Pool() != c.Old {
+		return errors.New("active pool is not the old database")
+	}
+
+	c.emit(CutoverEvent{Phase: CutoverPausingWrites})
+	if err := c.Active.gate.pause(ctx); err != nil {
+		return c.rollback(err)
+	}
+
+	lag, err := c.waitForCatchUp(ctx)
+	if err != nil {
+		return c.rollback(err)
+	}
+	c.emit(CutoverEvent{Phase: CutoverCaughtUp, LagBytes: lag})
+
+	if len(c.Verify) > 0 {
+		c.emit(CutoverEvent{Phase: CutoverVerifying})
+		for _, sql := range c.Verify {
+			diff, err := DiffQueries(ctx, c.Old, c.New, sql)
+			if err != nil {
+				return c.rollback(fmt.Errorf("error verifying new database: %w", err))
+			}
+			if !diff.Equal() {
+				return c.rollback(&QueryDiffError{Diff: diff})
+			}
+		}
+	}
+
+	if c.Promote != nil {
+		c.emit(CutoverEvent{Phase: CutoverPromoting})
+		if err := c.Promote(ctx); err != nil {
+			return c.rollback(fmt.Errorf("error promoting new database: %w", err))
+		}
+	}
+	var inRecovery bool
+	if err := c.New.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return c.rollback(fmt.Errorf("error checking new database: %w", err))
+	}
+	if inRecovery {
+		return c.rollback(errors.New("new database is still in recovery; promote it first"))
+	}
+
+	c.Active.current.Store(c.New)
+	c.emit(CutoverEvent{Phase: CutoverSwapped})
+	c.Active.gate.resume()
+	c.emit(CutoverEvent{Phase: CutoverResumed})
+	return nil
+}
+
+// Rollback switches a completed cutover back to Old, pausing writes while
+// the pool swaps. Changes written to New since the cutover are not copied
+// back.
+func (c *Cutover) Rollback(ctx context.Context) error {
+	if err := c.Active.gate.pause(ctx); err != nil {
+		c.Active.gate.resume()
+		return err
+	}
+	c.Active.current.Store(c.Old)
+	c.Active.gate.resume()
+	c.emit(CutoverEvent{Phase: CutoverRolledBack})
+	return nil
+}
+
+// rollback resumes writes against Old after a failed cutover
+func (c *Cutover) rollback(err error) error {
+	c.Active.current.Store(c.Old)
+	c.Active.gate.resume()
+	c.emit(CutoverEvent{Phase: CutoverRolledBack, Err: err})
+	return fmt.Errorf("cutover rolled back: %w", err)
+}
+
+// waitForCatchUp records Old's WAL position once writes are paused and polls
+// until New has replayed up to it
+func (c *Cutover) waitForCatchUp(ctx context.Context) (int64, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var target string
+	if err := c.Old.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&target); err != nil {
+		return 0, fmt.Errorf("error reading old database wal position: %w", err)
+	}
+
+	clock := clockOr(c.Clock)
+	lastLog := time.Time{}
+	for {
+		lag, err := c.lag(ctx, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("%w after %s", ErrCutoverTimeout, timeout)
+			}
+			return 0, err
+		}
+		if lag <= c.MaxLagBytes {
+			return lag, nil
+		}
+		if now := clock.Now(); now.Sub(lastLog) >= time.Second {
+			lastLog = now
+			c.emit(CutoverEvent{Phase: CutoverWaitingLag, LagBytes: lag})
+		}
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return 0, fmt.Errorf("%w after %s (lag %d bytes)", ErrCutoverTimeout, timeout, lag)
+		}
+	}
+}
+
+// lag returns how many bytes of WAL New is behind target. A physical standby
+// reports its replay position; a logical subscriber the position its
+// subscriptions have confirmed.
+func (c *Cutover) lag(ctx context.Context, target string) (int64, error) {
+	var lag *int64
+	err := c.New.QueryRow(ctx, `
+		SELECT pg_wal_lsn_diff($1::pg_lsn, COALESCE(
+			pg_last_wal_replay_lsn(),
+			(SELECT min(latest_end_lsn) FROM pg_stat_subscription)))::bigint`, target).Scan(&lag)
+	if err != nil {
+		return 0, fmt.Errorf("error reading replication position: %w", err)
+	}
+	if lag == nil {
+		return 0, errors.New("new database is neither a standby nor a subscriber")
+	}
+	return max(*lag, 0), nil
+}
+
+func (c *Cutover) emit(ev CutoverEvent) {
+	ev.At = clockOr(c.Clock).Now()
+	attrs := []any{slog.String("phase", string(ev.Phase))}
+	if ev.LagBytes > 0 {
+		attrs = append(attrs, slog.Int64("lag_bytes", ev.LagBytes))
+	}
+	if ev.Err != nil {
+		attrs = append(attrs, slog.String("error", ev.Err.Error()))
+		slog.Warn("Database cutover", attrs...)
+	} else {
+		slog.Info("Database cutover", attrs...)
+	}
+
+	if c.OnEvent != nil {
+		c.OnEvent(ev)
+	}
+}
@@ -0,0 +1,145 @@
+// Package dbctx carries request-scoped database settings in a context:
+// the tenant, query priority, caller label, request ID, acting user, query
+// tags, pool overrides and an ambient transaction. Each value has its own
+// unexported key, so they cannot collide with each other or with other
+// packages.
+package dbctx
+
+import (
+	"context"
+	"maps"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type (
+	tenantKey    struct{}
+	priorityKey  struct{}
+	callerKey    struct{}
+	requestIDKey struct{}
+	actorKey     struct{}
+	poolKey      struct{}
+	primaryKey   struct{}
+	tagsKey      struct{}
+	txKey        struct{}
+)
+
+// WithTenant scopes the queries run with ctx to tenantID
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// Tenant returns the tenant set by WithTenant
+func Tenant(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tenantKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Priority ranks queries for load shedding
+type Priority int
+
+const (
+	PriorityLow      Priority = iota - 1 // Shed first: reports, prefetches, background work
+	PriorityNormal                       // Default
+	PriorityCritical                     // Never shed
+)
+
+// WithPriority tags the queries run with ctx
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// QueryPriority returns the priority set by WithPriority, or PriorityNormal
+func QueryPriority(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// WithCaller attributes the queries run with ctx to caller
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Caller returns the caller label, or "" when there is none
+func Caller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// WithRequestID records the ID of the request the queries belong to, for
+// logs
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID, or "" when there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithActor records who the queries run with ctx act for, such as the
+// signed-in user, for audit logs
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Actor returns the actor set by WithActor, or "" when there is none
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// WithTags adds key/value tags describing the queries run with ctx, such
+// as the route or job name. Tags already set are kept unless overridden.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := maps.Clone(Tags(ctx))
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	maps.Copy(merged, tags)
+	return context.WithValue(ctx, tagsKey{}, merged)
+}
+
+// Tags returns the tags set by WithTags. The map must not be modified.
+func Tags(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
+
+// WithPool overrides the pool chosen for the queries run with ctx, by the
+// name the app gives it, e.g. "analytics"
+func WithPool(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, poolKey{}, name)
+}
+
+// Pool returns the pool name set by WithPool, or "" for default routing
+func Pool(ctx context.Context) string {
+	name, _ := ctx.Value(poolKey{}).(string)
+	return name
+}
+
+// ForcePrimary sends the queries run with ctx to the primary, overriding
+// routing to replicas or other pools, e.g. to read back a write
+func ForcePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// PrimaryForced reports whether ForcePrimary was applied to ctx
+func PrimaryForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(primaryKey{}).(bool)
+	return forced
+}
+
+// WithTx makes tx the ambient transaction for code called with ctx
+func WithTx(ctx context.Context, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// Tx returns the ambient transaction set by WithTx
+func Tx(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(pgx.Tx)
+	return tx, ok && tx != nil
+}
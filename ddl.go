@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/shopspring/decimal"
+)
+
+// TableOptions controls CreateTableFor
+type TableOptions struct {
+	DB          DBTX   // Runs the DDL; unused with PrintOnly
+	Name        string // Table name, overriding the table tag
+	PrintOnly   bool   // Return the DDL for review without running it
+	IfNotExists bool
+	Temporary   bool // Dropped at the end of the session, for tests and scratch work
+}
+
+// CreateTableFor derives CREATE TABLE DDL from the tags Repository reads,
+// for prototypes, tests and ephemeral tables rather than managed schemas,
+// which belong in migrations. It returns the statements and, unless
+// PrintOnly is set, runs them in order.
+//
+// Column types follow the Go types: pointers, sql.Null* and pgtype values
+// are nullable, other fields NOT NULL unless tagged null. A sqltype tag
+// sets the type explicitly, e.g. sqltype:"numeric(12,2)". An integer pk
+// becomes an identity column and a uuid pk defaults to gen_random_uuid(),
+// so Repository.Create can leave them to the database; readonly times
+// default to now(). unique and index tags add a constraint or an index.
+func CreateTableFor[T any](ctx context.Context, opts TableOptions) ([]string, error) {
+	t := reflect.TypeFor[T]()
+	e, err := parseEntity(t)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name != "" {
+		e.table = opts.Name
+	}
+	if e.table == "" {
+		return nil, fmt.Errorf("entity %s has no table tag or name", t)
+	}
+	table := e.sanitizedTable()
+
+	var defs, indexes []string
+	for _, col := range e.columns {
+		typ, nullable := col.sqlType, col.null
+		if typ == "" {
+			var ok bool
+			typ, nullable, ok = ddlType(col.field.Type)
+			if !ok {
+				return nil, fmt.Errorf("no column type for %s.%s; set a sqltype tag", t, col.field.Name)
+			}
+			nullable = nullable || col.null
+		}
+
+		name := pgx.Identifier{col.name}.Sanitize()
+		def := name + " " + typ
+		switch {
+		case col.pk && isIntegerType(typ):
+			def += " GENERATED BY DEFAULT AS IDENTITY"
+		case col.pk && typ == "uuid":
+			def += " DEFAULT gen_random_uuid()"
+		case col.readonly && typ == "timestamptz":
+			def += " DEFAULT now()"
+		}
+		if col.pk {
+			def += " PRIMARY KEY"
+		} else if !nullable {
+			def += " NOT NULL"
+		}
+		if col.unique {
+			def += " UNIQUE"
+		}
+		defs = append(defs, def)
+
+		if col.indexed {
+			last := e.table[strings.LastIndex(e.table, ".")+1:]
+			index := pgx.Identifier{last + "_" + col.name + "_idx"}.Sanitize()
+			exists := ""
+			if opts.IfNotExists {
+				exists = "IF NOT EXISTS "
+			}
+			indexes = append(indexes, fmt.Sprintf("CREATE INDEX %s%s ON %s (%s)", exists, index, table, name))
+		}
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("entity %s has no columns", t)
+	}
+
+	create := "CREATE TABLE "
+	if opts.Temporary {
+		create = "CREATE TEMPORARY TABLE "
+	}
+	if opts.IfNotExists {
+		create += "IF NOT EXISTS "
+	}
+	stmts := append([]string{create + table + " (\n    " + strings.Join(defs, ",\n    ") + "\n)"}, indexes...)
+
+	if opts.PrintOnly {
+		return stmts, nil
+	}
+	if opts.DB == nil {
+		return stmts, fmt.Errorf("no database to create %s in", table)
+	}
+	for _, stmt := range stmts {
+		if _, err := opts.DB.Exec(ctx, stmt); err != nil {
+			return stmts, fmt.Errorf("error creating %s: %w", table, err)
+		}
+	}
+	return stmts, nil
+}
+
+func isIntegerType(typ string) bool {
+	return typ == "int2" || typ == "int4" || typ == "int8"
+}
+
+// nullTypes are the wrapper types whose Valid field makes them nullable
+var nullTypes = map[reflect.Type]string{
+	reflect.TypeFor[sql.NullString]():      "text",
+	reflect.TypeFor[sql.NullInt64]():       "int8",
+	reflect.TypeFor[sql.NullInt32]():       "int4",
+	reflect.TypeFor[sql.NullInt16]():       "int2",
+	reflect.TypeFor[sql.NullFloat64]():     "float8",
+	reflect.TypeFor[sql.NullBool]():        "bool",
+	reflect.TypeFor[sql.NullTime]():        "timestamptz",
+	reflect.TypeFor[pgtype.Text]():         "text",
+	reflect.TypeFor[pgtype.Int8]():         "int8",
+	reflect.TypeFor[pgtype.Int4]():         "int4",
+	reflect.TypeFor[pgtype.Int2]():         "int2",
+	reflect.TypeFor[pgtype.Float8]():       "float8",
+	reflect.TypeFor[pgtype.Float4]():       "float4",
+	reflect.TypeFor[pgtype.Bool]():         "bool",
+	reflect.TypeFor[pgtype.Numeric]():      "numeric",
+	reflect.TypeFor[pgtype.Timestamptz]():  "timestamptz",
+	reflect.TypeFor[pgtype.Timestamp]():    "timestamp",
+	reflect.TypeFor[pgtype.Date]():         "date",
+	reflect.TypeFor[pgtype.Interval]():     "interval",
+	reflect.TypeFor[pgtype.UUID]():         "uuid",
+	reflect.TypeFor[decimal.NullDecimal](): "numeric",
+}
+
+// ddlType returns the column type for Go type t and whether it holds NULL
+func ddlType(t reflect.Type) (typ string, nullable, ok bool) {
+	if t.Kind() == reflect.Pointer {
+		typ, _, ok = ddlType(t.Elem())
+		return typ, true, ok
+	}
+	if typ, ok := nullTypes[t]; ok {
+		return typ, true, true
+	}
+	switch t {
+	case reflect.TypeFor[time.Duration]():
+		return "interval", false, true
+	case reflect.TypeFor[json.RawMessage]():
+		return "jsonb", true, true
+	case reflect.TypeFor[decimal.Decimal]():
+		return "numeric", false, true
+	}
+	if typ := arrayElemType(t); typ != "" {
+		return typ, false, true
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "text", false, true // Also named string types such as enums
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return "int8", false, true
+	case reflect.Int32, reflect.Uint16:
+		return "int4", false, true
+	case reflect.Int16, reflect.Int8:
+		return "int2", false, true
+	case reflect.Float64:
+		return "float8", false, true
+	case reflect.Float32:
+		return "float4", false, true
+	case reflect.Bool:
+		return "bool", false, true
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytea", false, true
+		}
+		if elem, _, ok := ddlType(t.Elem()); ok && elem != "jsonb" && !strings.HasSuffix(elem, "[]") {
+			return elem + "[]", false, true
+		}
+		return "jsonb", false, true
+	case reflect.Map, reflect.Struct:
+		return "jsonb", false, true
+	}
+	return "", false, false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// QueryDeduper collapses identical read queries running at the same time
+// into one database call whose result every caller receives, so a burst
+// of requests for the same hot value costs one connection. Queries are
+// identical when their tag, SQL and arguments match.
+type QueryDeduper struct {
+	DB       DBTX
+	Disabled map[string]bool // Tags whose queries always run on their own, e.g. reads that must see the caller's own writes
+	Timeout  time.Duration   // Bound on a shared query when the caller that starts it has no deadline, default 30s
+
+	group  singleflight.Group
+	shared atomic.Int64
+}
+
+// NewQueryDeduper creates a deduper running queries on db
+func NewQueryDeduper(db DBTX) *QueryDeduper {
+	return &QueryDeduper{DB: db}
+}
+
+// Shared returns how many calls got a result shared with other callers
+func (d *QueryDeduper) Shared() int64 {
+	return d.shared.Load()
+}
+
+// SharedQuery runs sql once for all concurrent callers with the same tag,
+// SQL and arguments, and returns each of them its own copy of the rows.
+// The shared query is not cancelled when one caller gives up; each caller
+// stops waiting when its own ctx is done. It runs until the deadline of
+// the caller that started it, or for Timeout without one, so a hung query
+// cannot hold up later callers of the same key.
+//
+//	counts, err := SharedQuery(ctx, dedupe, "user_count", "SELECT count(*) FROM users", pgx.RowTo[int])
+func SharedQuery[T any](ctx context.Context, d *QueryDeduper, tag, sql string, scan pgx.RowToFunc[T], args ...any) ([]T, error) {
+	run := func(ctx context.Context) ([]T, error) {
+		rows, err := d.DB.Query(ctx, sql, args...)
+		if err != nil {
+			return nil, err
+		}
+		return pgx.CollectRows(rows, scan)
+	}
+	if d.Disabled[tag] {
+		return run(ctx)
+	}
+
+	key := tag + "\x00" + reflect.TypeFor[T]().String() + "\x00" + cacheKey(sql, args)
+	ch := d.group.DoChan(key, func() (any, error) {
+		shared, cancel := d.sharedContext(ctx)
+		defer cancel()
+		return run(shared)
+	})
+	select {
+	case res := <-ch:
+		if res.Shared {
+			d.shared.Add(1)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return slices.Clone(res.Val.([]T)), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sharedContext detaches ctx from its caller's cancellation but keeps a
+// deadline on it
+func (d *QueryDeduper) sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout)
+}
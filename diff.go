@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RowDiffKind says how a row differs between two result sets
+type RowDiffKind string
+
+const (
+	RowMissing RowDiffKind = "missing" // Only in A
+	RowExtra   RowDiffKind = "extra"   // Only in B
+	RowChanged RowDiffKind = "changed" // In both with different columns
+)
+
+// ColumnDiff is one column of a changed row
+type ColumnDiff struct {
+	Column string
+	A, B   any
+}
+
+// RowDiff is one row that differs between the result sets
+type RowDiff struct {
+	Kind    RowDiffKind
+	Key     any
+	Columns []ColumnDiff // Set for RowChanged
+}
+
+// QueryDiff is a keyed comparison of the same query on two pools
+type QueryDiff struct {
+	SQL     string
+	Columns []string
+	RowsA   int
+	RowsB   int
+	Rows    []RowDiff // In A's row order, then extra rows in B's
+}
+
+// Equal reports whether the result sets matched
+func (d *QueryDiff) Equal() bool {
+	return len(d.Rows) == 0
+}
+
+// WriteTo prints the differences one per line
+func (d *QueryDiff) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	write := func(format string, args ...any) error {
+		m, err := fmt.Fprintf(w, format, args...)
+		n += int64(m)
+		return err
+	}
+	if err := write("%d rows in A, %d in B, %d differ\n", d.RowsA, d.RowsB, len(d.Rows)); err != nil {
+		return n, err
+	}
+	for _, r := range d.Rows {
+		if err := write("%s %s = %v\n", r.Kind, d.Columns[0], r.Key); err != nil {
+			return n, err
+		}
+		for _, c := range r.Columns {
+			if err := write("  %s: %v -> %v\n", c.Column, c.A, c.B); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// DiffQueries runs sql on both pools and compares the results row by row,
+// keyed on the first column; select a ROW(...) first to key on several.
+// Duplicate keys keep their last row.
+func DiffQueries(ctx context.Context, a, b *pgxpool.Pool, sql string, args ...any) (*QueryDiff, error) {
+	colsA, rowsA, err := diffRows(ctx, a, sql, args)
+	if err != nil {
+		return nil, fmt.Errorf("error querying A: %w", err)
+	}
+	colsB, rowsB, err := diffRows(ctx, b, sql, args)
+	if err != nil {
+		return nil, fmt.Errorf("error querying B: %w", err)
+	}
+	if !reflect.DeepEqual(colsA, colsB) {
+		return nil, fmt.Errorf("result columns differ: %v and %v", colsA, colsB)
+	}
+	return diffResults(sql, colsA, rowsA, rowsB), nil
+}
+
+func diffRows(ctx context.Context, db *pgxpool.Pool, sql string, args []any) ([]string, [][]any, error) {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	if len(fields) == 0 {
+		return nil, nil, errors.New("query returns no columns")
+	}
+	cols := make([]string, len(fields))
+	for i, fd := range fields {
+		cols[i] = fd.Name
+	}
+	var out [][]any
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, values)
+	}
+	return cols, out, rows.Err()
+}
+
+// diffKey makes a comparable map key from a key column value
+func diffKey(v any) string {
+	return fmt.Sprintf("%T:%#v", v, v)
+}
+
+func diffResults(sql string, cols []string, rowsA, rowsB [][]any) *QueryDiff {
+	d := &QueryDiff{SQL: sql, Columns: cols, RowsA: len(rowsA), RowsB: len(rowsB)}
+
+	keysA, byKeyA := keyRows(rowsA)
+	keysB, byKeyB := keyRows(rowsB)
+	for _, k := range keysA {
+		row := byKeyA[k]
+		other, ok := byKeyB[k]
+		if !ok {
+			d.Rows = append(d.Rows, RowDiff{Kind: RowMissing, Key: row[0]})
+			continue
+		}
+		var changed []ColumnDiff
+		for i := 1; i < len(cols); i++ {
+			if !reflect.DeepEqual(row[i], other[i]) {
+				changed = append(changed, ColumnDiff{Column: cols[i], A: row[i], B: other[i]})
+			}
+		}
+		if len(changed) > 0 {
+			d.Rows = append(d.Rows, RowDiff{Kind: RowChanged, Key: row[0], Columns: changed})
+		}
+	}
+	for _, k := range keysB {
+		if _, ok := byKeyA[k]; !ok {
+			d.Rows = append(d.Rows, RowDiff{Kind: RowExtra, Key: byKeyB[k][0]})
+		}
+	}
+	return d
+}
+
+// keyRows indexes rows by key, keeping the keys in first-seen order
+func keyRows(rows [][]any) ([]string, map[string][]any) {
+	var keys []string
+	byKey := make(map[string][]any, len(rows))
+	for _, row := range rows {
+		k := diffKey(row[0])
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = row
+	}
+	return keys, byKey
+}
+
+// QueryDiffError is returned when a verification query differs
+type QueryDiffError struct {
+	Diff *QueryDiff
+}
+
+func (e *QueryDiffError) Error() string {
+	return fmt.Sprintf("%d rows differ for %s", len(e.Diff.Rows), summarizeSQL(e.Diff.SQL, 80))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DualWriteMode selects how failures on the new database are handled
+type DualWriteMode int
+
+const (
+	// DualWriteBestEffort applies writes to the old database and then the
+	// new one; failures on the new side are recorded but not returned
+	DualWriteBestEffort DualWriteMode = iota
+
+	// DualWriteStrict applies writes in a transaction on each side and
+	// rolls both back unless both succeed
+	DualWriteStrict
+)
+
+// DualWriter applies writes to both an old and a new database during a live
+// migration. The old database stays the source of truth: its result is
+// returned, and failures or row-count divergences on the new side are
+// recorded in a reconciliation table on the old database for Replay.
+type DualWriter struct {
+	Old  *pgxpool.Pool
+	New  *pgxpool.Pool
+	Mode DualWriteMode
+
+	Table string // Reconciliation table on Old, default dual_write_failures
+}
+
+// DualWriteFailure is a write that did not apply cleanly to the new database
+type DualWriteFailure struct {
+	ID         int64
+	RecordedAt time.Time
+	Kind       string // "error" or "divergence"
+	SQL        string
+	Args       []*string
+	Error      string
+	OldRows    int64
+	NewRows    int64
+}
+
+// NewDualWriter creates a best-effort DualWriter and its reconciliation table
+func NewDualWriter(ctx context.Context, oldDB, newDB *pgxpool.Pool) (*DualWriter, error) {
+	w := &DualWriter{Old: oldDB, New: newDB, Table: "dual_write_failures"}
+	_, err := oldDB.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(w.Table)+` (
+		id bigserial PRIMARY KEY,
+		recorded_at timestamptz NOT NULL DEFAULT now(),
+		kind text NOT NULL,
+		sql text NOT NULL,
+		args text[] NOT NULL,
+		error text NOT NULL DEFAULT '',
+		old_rows bigint NOT NULL,
+		new_rows bigint NOT NULL,
+		replayed_at timestamptz
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", w.Table, err)
+	}
+	return w, nil
+}
+
+// Exec runs a write on both databases and returns the old database's result
+func (w *DualWriter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if w.Mode == DualWriteStrict {
+		return w.execStrict(ctx, sql, args)
+	}
+
+	tag, err := w.Old.Exec(ctx, sql, args...)
+	if err != nil {
+		return tag, err
+	}
+	newTag, newErr := w.New.Exec(ctx, sql, args...)
+	w.check(ctx, sql, args, tag, newTag, newErr)
+	return tag, nil
+}
+
+// execStrict holds a transaction open on each side and commits only when
+// both statements succeed. A failed commit on the new side after the old
+// one committed is recorded.
+func (w *DualWriter) execStrict(ctx context.Context, sql string, args []any) (pgconn.CommandTag, error) {
+	oldTx, err := w.Old.Begin(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer oldTx.Rollback(ctx)
+	newTx, err := w.New.Begin(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("error starting transaction on new database: %w", err)
+	}
+	defer newTx.Rollback(ctx)
+
+	tag, err := oldTx.Exec(ctx, sql, args...)
+	if err != nil {
+		return tag, err
+	}
+	newTag, err := newTx.Exec(ctx, sql, args...)
+	if err != nil {
+		return tag, fmt.Errorf("error writing to new database: %w", err)
+	}
+
+	if err := oldTx.Commit(ctx); err != nil {
+		return tag, err
+	}
+	err = newTx.Commit(ctx)
+	w.check(ctx, sql, args, tag, newTag, err)
+	return tag, nil
+}
+
+// check records a failure or divergence on the new side
+func (w *DualWriter) check(ctx context.Context, sql string, args []any, oldTag, newTag pgconn.CommandTag, newErr error) {
+	f := DualWriteFailure{SQL: sql, OldRows: oldTag.RowsAffected(), NewRows: newTag.RowsAffected()}
+	switch {
+	case newErr != nil:
+		f.Kind, f.Error = "error", newErr.Error()
+	case f.OldRows != f.NewRows:
+		f.Kind = "divergence"
+	default:
+		return
+	}
+
+	slog.Warn("Dual write did not match",
+		slog.String("kind", f.Kind),
+		slog.String("sql", summarizeSQL(sql, 120)),
+		slog.Int64("old_rows", f.OldRows),
+		slog.Int64("new_rows", f.NewRows),
+		slog.String("error", f.Error))
+
+	_, args = splitQueryOptions(args)
+	texts := make([]*string, len(args))
+	for i, a := range args {
+		texts[i] = argText(a)
+	}
+	_, err := w.Old.Exec(context.WithoutCancel(ctx),
+		"INSERT INTO "+sanitizeTable(w.Table)+" (kind, sql, args, error, old_rows, new_rows) VALUES ($1, $2, $3, $4, $5, $6)",
+		f.Kind, f.SQL, texts, f.Error, f.OldRows, f.NewRows)
+	if err != nil {
+		slog.Error("Error recording dual write failure", slog.String("error", err.Error()))
+	}
+}
+
+// Report returns the recorded failures that have not been replayed, oldest
+// first
+func (w *DualWriter) Report(ctx context.Context) ([]DualWriteFailure, error) {
+	rows, err := w.Old.Query(ctx, `
+		SELECT id, recorded_at, kind, sql, args, error, old_rows, new_rows
+		FROM `+sanitizeTable(w.Table)+` WHERE replayed_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", w.Table, err)
+	}
+	failures, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DualWriteFailure, error) {
+		var f DualWriteFailure
+		err := row.Scan(&f.ID, &f.RecordedAt, &f.Kind, &f.SQL, &f.Args, &f.Error, &f.OldRows, &f.NewRows)
+		return f, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", w.Table, err)
+	}
+	return failures, nil
+}
+
+// Replay re-applies recorded failures to the new database in order,
+// stopping at the first one that fails again. Divergences are only marked
+// replayed, since the write did apply. Arguments were stored as text, so
+// statements are replayed with the simple protocol and the server converts
+// each value to its parameter's type.
+func (w *DualWriter) Replay(ctx context.Context) (int, error) {
+	failures, err := w.Report(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, f := range failures {
+		if f.Kind == "error" {
+			args := make([]any, 0, len(f.Args)+1)
+			args = append(args, pgx.QueryExecModeSimpleProtocol)
+			for _, a := range f.Args {
+				if a == nil {
+					args = append(args, nil)
+				} else {
+					args = append(args, *a)
+				}
+			}
+			if _, err := w.New.Exec(ctx, f.SQL, args...); err != nil {
+				return i, fmt.Errorf("error replaying dual write %d: %w", f.ID, err)
+			}
+		}
+		if _, err := w.Old.Exec(ctx, "UPDATE "+sanitizeTable(w.Table)+" SET replayed_at = now() WHERE id = $1", f.ID); err != nil {
+			return i, fmt.Errorf("error marking dual write %d replayed: %w", f.ID, err)
+		}
+	}
+	return len(failures), nil
+}
+
+// Verify compares a read on both databases, keyed on its first column,
+// and returns a *QueryDiffError when they differ
+func (w *DualWriter) Verify(ctx context.Context, sql string, args ...any) (*QueryDiff, error) {
+	diff, err := DiffQueries(ctx, w.Old, w.New, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying dual writes: %w", err)
+	}
+	if !diff.Equal() {
+		return diff, &QueryDiffError{Diff: diff}
+	}
+	return diff, nil
+}
+
+// argText renders a query argument as a Postgres text literal, or nil for
+// NULL
+func argText(v any) *string {
+	var s string
+	switch a := v.(type) {
+	case nil:
+		return nil
+	case string:
+		s = a
+	case []byte:
+		s = `\x` + hex.EncodeToString(a)
+	case time.Time:
+		s = a.Format(time.RFC3339Nano)
+	case bool:
+		s = strconv.FormatBool(a)
+	case driver.Valuer:
+		val, err := a.Value()
+		if err != nil {
+			s = fmt.Sprint(v)
+			break
+		}
+		return argText(val)
+	case fmt.Stringer:
+		s = a.String()
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Pointer:
+			if rv.IsNil() {
+				return nil
+			}
+			return argText(rv.Elem().Interface())
+		case reflect.Slice, reflect.Array:
+			s = arrayLiteral(rv)
+		case reflect.Map, reflect.Struct:
+			b, err := json.Marshal(v)
+			if err != nil {
+				s = fmt.Sprint(v)
+			} else {
+				s = string(b)
+			}
+		default:
+			s = fmt.Sprint(v)
+		}
+	}
+	return &s
+}
+
+// arrayLiteral renders a slice as a Postgres array literal such as {"a",NULL}
+func arrayLiteral(rv reflect.Value) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < rv.Len(); i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		elem := argText(rv.Index(i).Interface())
+		if elem == nil {
+			b.WriteString("NULL")
+			continue
+		}
+		b.WriteByte('"')
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(*elem))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RegisterEnum loads the Postgres enum typeName and its array type into
+// conn's type map and makes T encode as that enum. T is a Go string type
+// such as
+//
+//	type OrderStatus string
+//
+// so columns scan straight into it and it can be passed where the server
+// could not otherwise infer the type, without casts. It returns the
+// enum's labels.
+func RegisterEnum[T ~string](ctx context.Context, conn *pgx.Conn, typeName string) ([]string, error) {
+	t, err := conn.LoadType(ctx, typeName)
+	if err != nil {
+		return nil, fmt.Errorf("error loading enum %s: %w", typeName, err)
+	}
+	m := conn.TypeMap()
+	m.RegisterType(t)
+
+	// Ask for the array type rather than deriving its name, which Postgres
+	// truncates or changes for long or quoted type names
+	var arrayName string
+	if err := conn.QueryRow(ctx, "SELECT typarray::regtype::text FROM pg_type WHERE oid = $1", t.OID).Scan(&arrayName); err != nil {
+		return nil, fmt.Errorf("error finding array type of enum %s: %w", typeName, err)
+	}
+	at, err := conn.LoadType(ctx, arrayName)
+	if err != nil {
+		return nil, fmt.Errorf("error loading enum array %s: %w", arrayName, err)
+	}
+	m.RegisterType(at)
+
+	m.RegisterDefaultPgType(T(""), t.Name)
+	m.RegisterDefaultPgType(new(T), t.Name)
+	m.RegisterDefaultPgType([]T(nil), at.Name)
+
+	var labels []string
+	err = conn.QueryRow(ctx, "SELECT coalesce(array_agg(enumlabel::text ORDER BY enumsortorder), '{}') FROM pg_enum WHERE enumtypid = $1",
+		t.OID).Scan(&labels)
+	if err != nil {
+		return nil, fmt.Errorf("error reading labels of enum %s: %w", typeName, err)
+	}
+	return labels, nil
+}
+
+// WithEnum registers the Go enum type T as Postgres enum typeName on every
+// connection; see RegisterEnum. values are the Go constants: any missing
+// from the database, e.g. before the migration adding them has run, are
+// logged once at Warn, since writing them would fail.
+func WithEnum[T ~string](typeName string, values ...T) PoolOption {
+	var once sync.Once
+	return withConnTypes(func(ctx context.Context, conn *pgx.Conn) error {
+		labels, err := RegisterEnum[T](ctx, conn, typeName)
+		if err != nil {
+			return err
+		}
+		once.Do(func() {
+			for _, v := range values {
+				if !slices.Contains(labels, string(v)) {
+					slog.Warn("Enum value missing from database", slog.String("type", typeName), slog.String("value", string(v)))
+				}
+			}
+		})
+		return nil
+	})
+}
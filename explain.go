@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ExplainPlan is a statement's plan as EXPLAIN (FORMAT JSON) reports it
+type ExplainPlan struct {
+	Plan PlanNode        `json:"Plan"`
+	Raw  json.RawMessage `json:"-"` // The full EXPLAIN output, for fields PlanNode leaves out
+}
+
+// PlanNode is one node of a plan
+type PlanNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name,omitempty"`
+	Alias        string     `json:"Alias,omitempty"`
+	IndexName    string     `json:"Index Name,omitempty"`
+	JoinType     string     `json:"Join Type,omitempty"`
+	StartupCost  float64    `json:"Startup Cost"`
+	TotalCost    float64    `json:"Total Cost"`
+	PlanRows     float64    `json:"Plan Rows"`
+	PlanWidth    int        `json:"Plan Width"`
+	Filter       string     `json:"Filter,omitempty"`
+	IndexCond    string     `json:"Index Cond,omitempty"`
+	Plans        []PlanNode `json:"Plans,omitempty"`
+}
+
+// Explain returns the plan the server would use for sql with args,
+// without running it. Query options in args, as for Query, are dropped.
+func Explain(ctx context.Context, db DBTX, sql string, args ...any) (*ExplainPlan, error) {
+	_, args = splitQueryOptions(args)
+	var raw []byte
+	if err := db.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+sql, args...).Scan(&raw); err != nil {
+		return nil, fmt.Errorf("error explaining statement: %w", err)
+	}
+	var plans []ExplainPlan
+	if err := json.Unmarshal(raw, &plans); err != nil {
+		return nil, fmt.Errorf("error reading plan: %w", err)
+	}
+	if len(plans) == 0 {
+		return nil, errors.New("explain returned no plan")
+	}
+	plans[0].Raw = raw
+	return &plans[0], nil
+}
+
+// String renders the plan as an indented tree like EXPLAIN's text format
+func (p *ExplainPlan) String() string {
+	var b strings.Builder
+	p.Plan.write(&b, 0)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (n *PlanNode) write(b *strings.Builder, depth int) {
+	if depth > 0 {
+		b.WriteString(strings.Repeat("  ", depth) + "->  ")
+	}
+	// Outer and semi joins name their type, e.g. "Hash Left Join"
+	switch node := n.NodeType; {
+	case n.JoinType == "" || n.JoinType == "Inner":
+		b.WriteString(node)
+	case strings.HasSuffix(node, " Join"):
+		b.WriteString(strings.TrimSuffix(node, "Join") + n.JoinType + " Join")
+	default:
+		b.WriteString(node + " " + n.JoinType + " Join")
+	}
+	if n.IndexName != "" {
+		b.WriteString(" using " + n.IndexName)
+	}
+	if n.RelationName != "" {
+		b.WriteString(" on " + n.RelationName)
+		if n.Alias != "" && n.Alias != n.RelationName {
+			b.WriteString(" " + n.Alias)
+		}
+	}
+	fmt.Fprintf(b, "  (cost=%.2f..%.2f rows=%.0f width=%d)\n", n.StartupCost, n.TotalCost, n.PlanRows, n.PlanWidth)
+	for _, cond := range []struct{ label, text string }{{"Index Cond", n.IndexCond}, {"Filter", n.Filter}} {
+		if cond.text != "" {
+			fmt.Fprintf(b, "%s      %s: %s\n", strings.Repeat("  ", depth), cond.label, cond.text)
+		}
+	}
+	for i := range n.Plans {
+		n.Plans[i].write(b, depth+1)
+	}
+}
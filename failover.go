@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/pgerrors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FailoverRetry rides out the window in which the primary has been
+// demoted but the pool still holds connections to it. A write failing
+// with SQLSTATE 25006 (read_only_sql_transaction) resets the pool, so new
+// connections pick the writable host again through
+// PG_TARGET_SESSION_ATTRS=read-write or DNS, and is retried with backoff
+// for up to MaxWait before the error is returned. The rejected write never
+// ran, so retrying it is safe.
+type FailoverRetry struct {
+	DB      *pgxpool.Pool
+	MaxWait time.Duration // Total time spent retrying one write, default 30s
+	Backoff time.Duration // First delay between attempts, doubled up to 2s, default 250ms
+	Clock   Clock
+
+	redetections atomic.Int64
+
+	mu        sync.Mutex
+	lastReset time.Time
+}
+
+// NewFailoverRetry creates a retrier for writes on db
+func NewFailoverRetry(db *pgxpool.Pool) *FailoverRetry {
+	return &FailoverRetry{DB: db}
+}
+
+// Redetections returns how many times the pool was reset to find the new
+// primary
+func (f *FailoverRetry) Redetections() int64 {
+	return f.redetections.Load()
+}
+
+// redetect drops the pool's connections so the next ones are made to the
+// current primary. Concurrent failures within one backoff reset once.
+func (f *FailoverRetry) redetect(backoff time.Duration, err error) {
+	now := clockOr(f.Clock).Now()
+	f.mu.Lock()
+	if now.Sub(f.lastReset) < backoff {
+		f.mu.Unlock()
+		return
+	}
+	f.lastReset = now
+	f.mu.Unlock()
+
+	f.redetections.Add(1)
+	slog.Warn("Primary is read-only, reconnecting to find the new primary", slog.String("error", err.Error()))
+	f.DB.Reset()
+}
+
+// do runs fn until it succeeds, fails other than with 25006, or MaxWait
+// has passed
+func (f *FailoverRetry) do(ctx context.Context, fn func() error) error {
+	maxWait := f.MaxWait
+	if maxWait <= 0 {
+		maxWait = 30 * time.Second
+	}
+	backoff := f.Backoff
+	if backoff <= 0 {
+		backoff = 250 * time.Millisecond
+	}
+
+	clock := clockOr(f.Clock)
+	deadline := clock.Now().Add(maxWait)
+	delay := backoff
+	for {
+		err := fn()
+		if pgerrors.Code(err) != "25006" {
+			return err
+		}
+		f.redetect(backoff, err)
+		if clock.Now().Add(delay).After(deadline) {
+			return pgerrors.Classify(err)
+		}
+		if err := clock.Sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay = min(delay*2, 2*time.Second)
+	}
+}
+
+// Exec runs a statement, retrying it across a failover
+func (f *FailoverRetry) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := f.do(ctx, func() (err error) {
+		tag, err = f.DB.Exec(ctx, sql, args...)
+		return err
+	})
+	return tag, err
+}
+
+// QueryRow runs a single-row statement such as INSERT ... RETURNING. It is
+// run, and retried across a failover, when the row is scanned.
+func (f *FailoverRetry) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return failoverRow{f: f, ctx: ctx, sql: sql, args: args}
+}
+
+type failoverRow struct {
+	f    *FailoverRetry
+	ctx  context.Context
+	sql  string
+	args []any
+}
+
+func (r failoverRow) Scan(dest ...any) error {
+	return r.f.do(r.ctx, func() error {
+		return r.f.DB.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	})
+}
+
+// Tx runs fn in a transaction, running it again in a new transaction
+// across a failover. fn must not have effects outside the transaction.
+func (f *FailoverRetry) Tx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	return f.do(ctx, func() error {
+		return SafeTx(ctx, f.DB, fn)
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ForeignServer describes a postgres_fdw server, the user mapping used to
+// reach it and the remote tables to expose locally
+type ForeignServer struct {
+	Name    string
+	Host    string
+	Port    int
+	DBName  string
+	Options map[string]string // Extra server options, e.g. fetch_size or use_remote_estimate
+
+	LocalUser      string // Role the mapping is for, default CURRENT_USER
+	RemoteUser     string
+	RemotePassword string
+
+	Imports []ForeignImport
+}
+
+// ForeignImport exposes the tables of a remote schema as foreign tables in
+// a local schema
+type ForeignImport struct {
+	RemoteSchema string
+	LocalSchema  string
+	Tables       []string // Limit to these tables, default all
+}
+
+// SetupForeignServer creates or updates the server, its user mapping and
+// foreign tables in one transaction, so it can run at every startup.
+// Foreign tables are re-imported so remote column changes are picked up.
+func SetupForeignServer(ctx context.Context, db *pgxpool.Pool, srv ForeignServer) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS postgres_fdw"); err != nil {
+			return fmt.Errorf("error creating postgres_fdw extension: %w", err)
+		}
+
+		name := pgx.Identifier{srv.Name}.Sanitize()
+		var existing []string
+		err := tx.QueryRow(ctx, "SELECT COALESCE(srvoptions, '{}') FROM pg_foreign_server WHERE srvname = $1", srv.Name).Scan(&existing)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			_, err = tx.Exec(ctx, "CREATE SERVER "+name+" FOREIGN DATA WRAPPER postgres_fdw"+fdwOptions(srv.serverOptions(), nil))
+		case err == nil && len(srv.serverOptions()) > 0:
+			_, err = tx.Exec(ctx, "ALTER SERVER "+name+fdwOptions(srv.serverOptions(), existing))
+		}
+		if err != nil {
+			return fmt.Errorf("error configuring foreign server %s: %w", srv.Name, err)
+		}
+
+		// Recreating the mapping avoids reading its options, which only
+		// privileged roles can see
+		user := "CURRENT_USER"
+		if srv.LocalUser != "" {
+			user = pgx.Identifier{srv.LocalUser}.Sanitize()
+		}
+		mapping := make(map[string]string, 2)
+		if srv.RemoteUser != "" {
+			mapping["user"] = srv.RemoteUser
+		}
+		if srv.RemotePassword != "" {
+			mapping["password"] = srv.RemotePassword
+		}
+		if _, err := tx.Exec(ctx, "DROP USER MAPPING IF EXISTS FOR "+user+" SERVER "+name); err != nil {
+			return fmt.Errorf("error replacing user mapping for %s: %w", srv.Name, err)
+		}
+		if _, err := tx.Exec(ctx, "CREATE USER MAPPING FOR "+user+" SERVER "+name+fdwOptions(mapping, nil)); err != nil {
+			return fmt.Errorf("error creating user mapping for %s: %w", srv.Name, err)
+		}
+
+		for _, imp := range srv.Imports {
+			if err := importForeignSchema(ctx, tx, srv.Name, imp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (srv ForeignServer) serverOptions() map[string]string {
+	opts := make(map[string]string, len(srv.Options)+3)
+	for k, v := range srv.Options {
+		opts[k] = v
+	}
+	if srv.Host != "" {
+		opts["host"] = srv.Host
+	}
+	if srv.Port != 0 {
+		opts["port"] = strconv.Itoa(srv.Port)
+	}
+	if srv.DBName != "" {
+		opts["dbname"] = srv.DBName
+	}
+	return opts
+}
+
+// fdwOptions renders an OPTIONS clause in key order, or "" when opts is
+// empty. Keys already set in existing ("key=value" as in srvoptions) are
+// SET, others ADDed.
+func fdwOptions(opts map[string]string, existing []string) string {
+	if len(opts) == 0 {
+		return ""
+	}
+	set := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		k, _, _ := strings.Cut(e, "=")
+		set[k] = true
+	}
+
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		item := pgx.Identifier{k}.Sanitize() + " " + quoteLiteral(opts[k])
+		switch {
+		case existing == nil:
+			parts[i] = item
+		case set[k]:
+			parts[i] = "SET " + item
+		default:
+			parts[i] = "ADD " + item
+		}
+	}
+	return " OPTIONS (" + strings.Join(parts, ", ") + ")"
+}
+
+// importForeignSchema drops the server's foreign tables in the local schema
+// and imports them again
+func importForeignSchema(ctx context.Context, tx pgx.Tx, server string, imp ForeignImport) error {
+	local := pgx.Identifier{imp.LocalSchema}.Sanitize()
+	if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+local); err != nil {
+		return fmt.Errorf("error creating schema %s: %w", imp.LocalSchema, err)
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT c.relname FROM pg_foreign_table ft
+		JOIN pg_class c ON c.oid = ft.ftrelid
+		JOIN pg_foreign_server s ON s.oid = ft.ftserver
+		WHERE s.srvname = $1 AND c.relnamespace = $2::regnamespace`, server, local)
+	if err != nil {
+		return fmt.Errorf("error listing foreign tables in %s: %w", imp.LocalSchema, err)
+	}
+	existing, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("error listing foreign tables in %s: %w", imp.LocalSchema, err)
+	}
+	for _, t := range existing {
+		if _, err := tx.Exec(ctx, "DROP FOREIGN TABLE "+pgx.Identifier{imp.LocalSchema, t}.Sanitize()); err != nil {
+			return fmt.Errorf("error dropping foreign table %s.%s: %w", imp.LocalSchema, t, err)
+		}
+	}
+
+	stmt := "IMPORT FOREIGN SCHEMA " + pgx.Identifier{imp.RemoteSchema}.Sanitize()
+	if len(imp.Tables) > 0 {
+		quoted := make([]string, len(imp.Tables))
+		for i, t := range imp.Tables {
+			quoted[i] = pgx.Identifier{t}.Sanitize()
+		}
+		stmt += " LIMIT TO (" + strings.Join(quoted, ", ") + ")"
+	}
+	stmt += " FROM SERVER " + pgx.Identifier{server}.Sanitize() + " INTO " + local
+	if _, err := tx.Exec(ctx, stmt); err != nil {
+		return fmt.Errorf("error importing %s from %s: %w", imp.RemoteSchema, server, err)
+	}
+	return nil
+}
+
+// ForeignServerHealth is the result of probing a foreign server
+type ForeignServerHealth struct {
+	Server  string
+	Table   string // Foreign table the probe read
+	Latency time.Duration
+}
+
+// CheckForeignServer probes a foreign server by reading one row from one of
+// its foreign tables, which makes postgres_fdw connect if it has not yet
+func CheckForeignServer(ctx context.Context, db *pgxpool.Pool, server string) (ForeignServerHealth, error) {
+	h := ForeignServerHealth{Server: server}
+	err := db.QueryRow(ctx, `
+		SELECT ft.ftrelid::regclass::text FROM pg_foreign_table ft
+		JOIN pg_foreign_server s ON s.oid = ft.ftserver
+		WHERE s.srvname = $1 ORDER BY ft.ftrelid LIMIT 1`, server).Scan(&h.Table)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return h, fmt.Errorf("foreign server %s has no foreign tables to probe", server)
+	}
+	if err != nil {
+		return h, fmt.Errorf("error finding a foreign table of %s: %w", server, err)
+	}
+
+	start := time.Now()
+	rows, err := db.Query(ctx, "SELECT 1 FROM "+h.Table+" LIMIT 1")
+	if err == nil {
+		rows.Close()
+		err = rows.Err()
+	}
+	h.Latency = time.Since(start)
+	if err != nil {
+		return h, fmt.Errorf("error probing foreign server %s: %w", server, err)
+	}
+	return h, nil
+}
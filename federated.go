@@ -0,0 +1,195 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FederatedSource is one database taking part in a federated query
+type FederatedSource struct {
+	Name string
+	DB   *pgxpool.Pool
+	SQL  string // Overrides the query's SQL for this source, e.g. for a different schema
+}
+
+// MergeSpec says how rows from several sources are combined
+type MergeSpec struct {
+	Keys    []string // Rows with equal values in these columns are merged, the first source listed wins
+	OrderBy []string // Columns to sort by, each optionally followed by " DESC"; NULLs sort last
+	Limit   int      // Rows kept after sorting, 0 for all
+	Partial bool     // Return the rows of the sources that answered, along with the errors of the rest
+}
+
+// FederatedRow is a row of a federated query and the source it came from
+type FederatedRow struct {
+	Source string
+	Values map[string]any
+}
+
+// FederatedQuery runs a query on every source concurrently and merges the
+// results client-side, for simple reports across databases without a
+// foreign data wrapper. Each source should apply its own LIMIT where the
+// merge does, since all rows are read into memory.
+func FederatedQuery(ctx context.Context, sources []FederatedSource, spec MergeSpec, sql string, args ...any) ([]FederatedRow, error) {
+	results := make([][]FederatedRow, len(sources))
+	errs := make([]error, len(sources))
+
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := sql
+			if src.SQL != "" {
+				query = src.SQL
+			}
+			rows, err := src.DB.Query(ctx, query, args...)
+			if err == nil {
+				results[i], err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (FederatedRow, error) {
+					values, err := pgx.RowToMap(row)
+					return FederatedRow{Source: src.Name, Values: values}, err
+				})
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("error querying %s: %w", src.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := errors.Join(errs...)
+	if err != nil && !spec.Partial {
+		return nil, err
+	}
+
+	var merged []FederatedRow
+	seen := make(map[string]bool)
+	for _, rows := range results {
+		for _, row := range rows {
+			if len(spec.Keys) > 0 {
+				key := mergeKey(row, spec.Keys)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			merged = append(merged, row)
+		}
+	}
+
+	if len(spec.OrderBy) > 0 {
+		order := parseOrderBy(spec.OrderBy)
+		slices.SortStableFunc(merged, func(a, b FederatedRow) int {
+			for _, o := range order {
+				if c := compareValues(a.Values[o.column], b.Values[o.column]); c != 0 {
+					if o.desc && a.Values[o.column] != nil && b.Values[o.column] != nil {
+						return -c
+					}
+					return c
+				}
+			}
+			return 0
+		})
+	}
+	if spec.Limit > 0 && len(merged) > spec.Limit {
+		merged = merged[:spec.Limit]
+	}
+	return merged, err
+}
+
+type orderKey struct {
+	column string
+	desc   bool
+}
+
+func parseOrderBy(columns []string) []orderKey {
+	order := make([]orderKey, len(columns))
+	for i, c := range columns {
+		fields := strings.Fields(c)
+		if len(fields) == 0 {
+			continue
+		}
+		order[i] = orderKey{column: fields[0], desc: len(fields) > 1 && strings.EqualFold(fields[1], "desc")}
+	}
+	return order
+}
+
+func mergeKey(row FederatedRow, keys []string) string {
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%T:%v\x00", row.Values[k], row.Values[k])
+	}
+	return b.String()
+}
+
+// compareValues orders the values pgx decodes columns into. NULL sorts
+// after everything; values of other types compare by their text.
+func compareValues(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+
+	if af, ok := numericValue(a); ok {
+		if bf, ok := numericValue(b); ok {
+			return cmp.Compare(af, bf)
+		}
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv)
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			return av.Compare(bv)
+		}
+	case bool:
+		if bv, ok := b.(bool); ok && av != bv {
+			if av {
+				return 1
+			}
+			return -1
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func numericValue(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case pgtype.Numeric:
+		f, err := n.Float64Value()
+		return f.Float64, err == nil && f.Valid
+	}
+	return 0, false
+}
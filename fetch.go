@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/sync/errgroup"
+)
+
+// FetchOption customizes FetchByIDs
+type FetchOption func(*fetchSettings)
+
+type fetchSettings struct {
+	chunkSize   int
+	parallelism int
+}
+
+// WithFetchChunkSize sets how many IDs each query looks up, default 1000
+func WithFetchChunkSize(n int) FetchOption {
+	return func(s *fetchSettings) { s.chunkSize = n }
+}
+
+// WithFetchParallelism sets how many chunk queries run at once, default a
+// quarter of the pool's MaxConns, so enrichment does not starve other work
+func WithFetchParallelism(n int) FetchOption {
+	return func(s *fetchSettings) { s.parallelism = n }
+}
+
+// FetchByIDs loads the rows of table whose primary key is in ids, for
+// enriching a batch of records. Long lists are split into = ANY chunks
+// queried in parallel on separate connections. The rows come back in the
+// order of ids, once per distinct ID, and the IDs without a row are
+// returned as missing. T is mapped as by Repository and must tag a pk of
+// type K; an empty table uses T's table tag.
+//
+//	users, missing, err := FetchByIDs[User](ctx, app.DBClient, "", orderUserIDs)
+func FetchByIDs[T any, K comparable](ctx context.Context, db *pgxpool.Pool, table string, ids []K, opts ...FetchOption) (rows []T, missing []K, err error) {
+	t := reflect.TypeFor[T]()
+	e, err := parseEntity(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	if table != "" {
+		e.table = table
+	}
+	if e.table == "" {
+		return nil, nil, fmt.Errorf("entity %s has no table tag or name", t)
+	}
+	if e.pk < 0 {
+		return nil, nil, fmt.Errorf("entity %s has no pk field", t)
+	}
+	pk := e.columns[e.pk]
+	if pk.field.Type != reflect.TypeFor[K]() {
+		return nil, nil, fmt.Errorf("pk field %s.%s is %s, not %s", t, pk.field.Name, pk.field.Type, reflect.TypeFor[K]())
+	}
+
+	s := fetchSettings{chunkSize: 1000, parallelism: int(db.Config().MaxConns) / 4}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	s.chunkSize = max(s.chunkSize, 1)
+	s.parallelism = max(s.parallelism, 1)
+
+	// Distinct IDs in input order
+	seen := make(map[K]struct{}, len(ids))
+	unique := make([]K, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			unique = append(unique, id)
+		}
+	}
+
+	names := make([]string, len(e.columns))
+	for i, col := range e.columns {
+		names[i] = pgx.Identifier{col.name}.Sanitize()
+	}
+	prefix := fmt.Sprintf("SELECT %s FROM %s WHERE ", strings.Join(names, ", "), e.sanitizedTable())
+
+	chunks := make([][]T, (len(unique)+s.chunkSize-1)/s.chunkSize)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.parallelism)
+	for i := range chunks {
+		chunk := unique[i*s.chunkSize : min((i+1)*s.chunkSize, len(unique))]
+		g.Go(func() error {
+			cond, arg := AnyOf(pgx.Identifier{pk.name}.Sanitize(), 1, chunk)
+			found, err := db.Query(gctx, prefix+cond, arg)
+			if err != nil {
+				return err
+			}
+			chunks[i], err = pgx.CollectRows(found, pgx.RowToStructByName[T])
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, fmt.Errorf("error fetching %s by id: %w", e.table, err)
+	}
+
+	byID := make(map[K]T, len(unique))
+	for _, chunk := range chunks {
+		for _, row := range chunk {
+			byID[reflect.ValueOf(row).FieldByIndex(pk.field.Index).Interface().(K)] = row
+		}
+	}
+	rows = make([]T, 0, len(byID))
+	for _, id := range unique {
+		if row, ok := byID[id]; ok {
+			rows = append(rows, row)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return rows, missing, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// LivenessHandler reports that the process is up. It never touches the
+// database, so an outage does not get healthy pods restarted.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}` + "\n"))
+	})
+}
+
+// Readiness is the body of a readiness response
+type Readiness struct {
+	Ready     bool   `json:"ready"`
+	Error     string `json:"error,omitempty"`
+	Available int32  `json:"available_connections"`
+	Degraded  string `json:"degraded,omitempty"` // Why the app is running degraded, if it is
+}
+
+// ReadinessHandler reports whether the app can serve traffic: the database
+// answers a Ping within timeout and at least minAvailable connections are
+// idle or can still be opened. It answers 503 otherwise so traffic is
+// routed elsewhere until the database is back.
+func (app *App) ReadinessHandler(minAvailable int32, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		status := checkReadiness(ctx, app.primary(), minAvailable)
+		if app.SchemaErr != nil {
+			status.Degraded = app.SchemaErr.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
+
+func checkReadiness(ctx context.Context, db *pgxpool.Pool, minAvailable int32) Readiness {
+	stat := db.Stat()
+	status := Readiness{Available: stat.IdleConns() + stat.MaxConns() - stat.TotalConns()}
+
+	if err := db.Ping(ctx); err != nil {
+		status.Error = fmt.Sprintf("error pinging database: %v", err)
+		return status
+	}
+	if status.Available < minAvailable {
+		status.Error = fmt.Sprintf("%d connections available, need %d", status.Available, minAvailable)
+		return status
+	}
+	status.Ready = true
+	return status
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// HedgedReader cuts tail latency for idempotent reads: when the first
+// attempt has not answered within Delay, a second one is sent to Hedge and
+// whichever succeeds first wins; the other is cancelled. Hedges are capped
+// both in flight and as a share of reads so a slow database does not get
+// twice the load.
+type HedgedReader struct {
+	Primary *pgxpool.Pool
+	Hedge   *pgxpool.Pool // Pool for the second attempt, e.g. a replica; default Primary
+
+	Delay       time.Duration // Wait before hedging, default 100ms; around the p95 latency works well
+	MaxInFlight int64         // Hedges running at once, default 8
+	MaxRatio    float64       // Largest share of reads that may be hedged, default 0.05
+	Clock       Clock         // Default SystemClock
+
+	reads    atomic.Int64
+	hedged   atomic.Int64
+	wins     atomic.Int64
+	skipped  atomic.Int64
+	inflight atomic.Int64
+}
+
+// HedgeStats counts reads and hedges since the reader was created
+type HedgeStats struct {
+	Reads     int64
+	Hedged    int64 // Second attempts sent
+	HedgeWins int64 // Second attempts that answered first
+	Skipped   int64 // Hedges not sent because of the caps
+}
+
+// Stats returns the reader's counters
+func (r *HedgedReader) Stats() HedgeStats {
+	return HedgeStats{
+		Reads:     r.reads.Load(),
+		Hedged:    r.hedged.Load(),
+		HedgeWins: r.wins.Load(),
+		Skipped:   r.skipped.Load(),
+	}
+}
+
+// allowHedge checks the caps and reserves an in-flight slot
+func (r *HedgedReader) allowHedge() bool {
+	maxRatio := r.MaxRatio
+	if maxRatio <= 0 {
+		maxRatio = 0.05
+	}
+	limit := r.MaxInFlight
+	if limit <= 0 {
+		limit = 8
+	}
+
+	if float64(r.hedged.Load()+1) > maxRatio*float64(r.reads.Load()) {
+		r.skipped.Add(1)
+		return false
+	}
+	if r.inflight.Add(1) > limit {
+		r.inflight.Add(-1)
+		r.skipped.Add(1)
+		return false
+	}
+	r.hedged.Add(1)
+	return true
+}
+
+type hedgeResult[T any] struct {
+	rows  []T
+	err   error
+	hedge bool
+}
+
+// HedgedQuery runs an idempotent read, hedging it when it is slow. Only
+// use it for statements that are safe to run twice.
+func HedgedQuery[T any](ctx context.Context, r *HedgedReader, sql string, scan pgx.RowToFunc[T], args ...any) ([]T, error) {
+	r.reads.Add(1)
+	delay := r.Delay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	hedgeDB := r.Hedge
+	if hedgeDB == nil {
+		hedgeDB = r.Primary
+	}
+
+	// Returning cancels whichever attempt is still running
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult[T], 2)
+	run := func(db *pgxpool.Pool, hedge bool) {
+		rows, err := db.Query(ctx, sql, args...)
+		var out []T
+		if err == nil {
+			out, err = pgx.CollectRows(rows, scan)
+		}
+		results <- hedgeResult[T]{rows: out, err: err, hedge: hedge}
+	}
+	go run(r.Primary, false)
+
+	// Fires once after delay; the sleep ends early when the read returns
+	hedgeAt := make(chan struct{})
+	go func() {
+		if clockOr(r.Clock).Sleep(ctx, delay) == nil {
+			close(hedgeAt)
+		}
+	}()
+
+	pending := 1
+	var firstErr error
+	for {
+		select {
+		case <-hedgeAt:
+			hedgeAt = nil
+			if firstErr == nil && r.allowHedge() {
+				pending++
+				go func() {
+					defer r.inflight.Add(-1)
+					run(hedgeDB, true)
+				}()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.hedge {
+					r.wins.Add(1)
+				}
+				return res.rows, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Hints are pg_hint_plan hints for one query, built by chaining, e.g.
+//
+//	Hints{}.IndexScan("users", "users_email_idx").HashJoin("users", "orders")
+type Hints struct {
+	items []string
+}
+
+func (h Hints) add(method string, args ...string) Hints {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = hintIdent(a)
+	}
+	h.items = append(h.items[:len(h.items):len(h.items)], method+"("+strings.Join(quoted, " ")+")")
+	return h
+}
+
+// Scan methods
+func (h Hints) SeqScan(table string) Hints { return h.add("SeqScan", table) }
+func (h Hints) IndexScan(table string, indexes ...string) Hints {
+	return h.add("IndexScan", append([]string{table}, indexes...)...)
+}
+func (h Hints) IndexOnlyScan(table string, indexes ...string) Hints {
+	return h.add("IndexOnlyScan", append([]string{table}, indexes...)...)
+}
+func (h Hints) BitmapScan(table string, indexes ...string) Hints {
+	return h.add("BitmapScan", append([]string{table}, indexes...)...)
+}
+func (h Hints) NoSeqScan(table string) Hints   { return h.add("NoSeqScan", table) }
+func (h Hints) NoIndexScan(table string) Hints { return h.add("NoIndexScan", table) }
+
+// Join methods, naming every table taking part in the join
+func (h Hints) NestLoop(tables ...string) Hints    { return h.add("NestLoop", tables...) }
+func (h Hints) HashJoin(tables ...string) Hints    { return h.add("HashJoin", tables...) }
+func (h Hints) MergeJoin(tables ...string) Hints   { return h.add("MergeJoin", tables...) }
+func (h Hints) NoNestLoop(tables ...string) Hints  { return h.add("NoNestLoop", tables...) }
+func (h Hints) NoHashJoin(tables ...string) Hints  { return h.add("NoHashJoin", tables...) }
+func (h Hints) NoMergeJoin(tables ...string) Hints { return h.add("NoMergeJoin", tables...) }
+
+// Leading fixes the join order
+func (h Hints) Leading(tables ...string) Hints {
+	quoted := make([]string, len(tables))
+	for i, t := range tables {
+		quoted[i] = hintIdent(t)
+	}
+	h.items = append(h.items[:len(h.items):len(h.items)], "Leading(("+strings.Join(quoted, " ")+"))")
+	return h
+}
+
+// Rows corrects the planner's row estimate for a join, e.g. "*10" or "#1000"
+func (h Hints) Rows(correction string, tables ...string) Hints {
+	return h.add("Rows", append(tables[:len(tables):len(tables)], correction)...)
+}
+
+// Set changes a planner setting for this query only
+func (h Hints) Set(name, value string) Hints {
+	return h.add("Set", name, value)
+}
+
+// String renders the hint comment, or "" when there are no hints
+func (h Hints) String() string {
+	if len(h.items) == 0 {
+		return ""
+	}
+	return "/*+ " + strings.Join(h.items, " ") + " */"
+}
+
+// Apply prefixes sql with the hint comment. pg_hint_plan only reads the
+// first comment of a query.
+func (h Hints) Apply(sql string) string {
+	if len(h.items) == 0 {
+		return sql
+	}
+	return h.String() + " " + sql
+}
+
+var plainHintIdent = regexp.MustCompile(`^[A-Za-z_0-9$.*#+-]+$`)
+
+// hintIdent double-quotes names that pg_hint_plan would otherwise split or
+// fold, and drops anything that could close the comment early
+func hintIdent(name string) string {
+	name = strings.ReplaceAll(name, "*/", "")
+	if plainHintIdent.MatchString(name) {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Hinter runs queries with hints when pg_hint_plan is loaded and without
+// them otherwise, so the same code works against servers without the
+// extension
+type Hinter struct {
+	DB      *pgxpool.Pool
+	Enabled bool
+}
+
+// NewHinter checks once whether pg_hint_plan is available. It is usually
+// loaded through shared_preload_libraries rather than CREATE EXTENSION, so
+// its enable_hint setting is checked too.
+func NewHinter(ctx context.Context, db *pgxpool.Pool) (*Hinter, error) {
+	var enabled bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_hint_plan')
+		    OR COALESCE(current_setting('pg_hint_plan.enable_hint', true), 'off') = 'on'`).Scan(&enabled)
+	if err != nil {
+		return nil, fmt.Errorf("error checking for pg_hint_plan: %w", err)
+	}
+	return &Hinter{DB: db, Enabled: enabled}, nil
+}
+
+func (h *Hinter) sql(hints Hints, sql string) string {
+	if !h.Enabled {
+		return sql
+	}
+	return hints.Apply(sql)
+}
+
+// Query runs a hinted query
+func (h *Hinter) Query(ctx context.Context, hints Hints, sql string, args ...any) (pgx.Rows, error) {
+	return h.DB.Query(ctx, h.sql(hints, sql), args...)
+}
+
+// QueryRow runs a hinted single-row query
+func (h *Hinter) QueryRow(ctx context.Context, hints Hints, sql string, args ...any) pgx.Row {
+	return h.DB.QueryRow(ctx, h.sql(hints, sql), args...)
+}
+
+// Exec runs a hinted statement
+func (h *Hinter) Exec(ctx context.Context, hints Hints, sql string, args ...any) (pgconn.CommandTag, error) {
+	return h.DB.Exec(ctx, h.sql(hints, sql), args...)
+}
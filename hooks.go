@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AcquireValidator reports whether a pooled connection may be handed out
+type AcquireValidator func(ctx context.Context, conn *pgx.Conn) bool
+
+// WithBeforeAcquire runs validate before a connection is handed out.
+// Rejected connections are destroyed and the pool acquires another one.
+// Multiple validators run in the order they were given.
+func WithBeforeAcquire(validate AcquireValidator) PoolOption {
+	return func(s *poolSettings) {
+		prev := s.config.BeforeAcquire
+		s.config.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+			if prev != nil && !prev(ctx, conn) {
+				return false
+			}
+
+			s.metrics.addAcquireChecked()
+			if !validate(ctx, conn) {
+				s.metrics.addAcquireRejected()
+				slog.Warn("Rejected connection before acquire", slog.Uint64("pid", uint64(conn.PgConn().PID())))
+				return false
+			}
+			return true
+		}
+	}
+}
+
+// PingWithin validates a connection with a server round trip that must
+// complete within budget
+func PingWithin(budget time.Duration) AcquireValidator {
+	return func(ctx context.Context, conn *pgx.Conn) bool {
+		ctx, cancel := context.WithTimeout(ctx, budget)
+		defer cancel()
+
+		return conn.Ping(ctx) == nil
+	}
+}
+
+// RequireSetting validates that a session setting (e.g. "role" or
+// "search_path") still has the expected value
+func RequireSetting(name, want string) AcquireValidator {
+	return func(ctx context.Context, conn *pgx.Conn) bool {
+		var got string
+		if err := conn.QueryRow(ctx, "SELECT current_setting($1)", name).Scan(&got); err != nil {
+			return false
+		}
+		return got == want
+	}
+}
+
+// SessionResetPolicy selects what is cleaned up when a connection returns to
+// the pool. Prepared statements are left alone so pgx's statement cache
+// stays valid.
+type SessionResetPolicy struct {
+	ResetSettings        bool          // RESET ALL, undoes SET ROLE, search_path and other GUCs
+	ClosePortals         bool          // CLOSE ALL, closes cursors left open
+	DiscardTemp          bool          // DISCARD TEMP, drops temporary tables
+	Unlisten             bool          // UNLISTEN *
+	ReleaseAdvisoryLocks bool          // pg_advisory_unlock_all()
+	Timeout              time.Duration // Budget for the reset round trip, default 1 second
+}
+
+// DefaultSessionReset resets settings, portals and temp state
+func DefaultSessionReset() SessionResetPolicy {
+	return SessionResetPolicy{
+		ResetSettings: true,
+		ClosePortals:  true,
+		DiscardTemp:   true,
+		Timeout:       time.Second,
+	}
+}
+
+// statements returns the reset as a single multi-statement string so it
+// costs one simple-protocol round trip
+func (p SessionResetPolicy) statements() string {
+	var stmts []string
+	if p.ClosePortals {
+		stmts = append(stmts, "CLOSE ALL")
+	}
+	if p.ResetSettings {
+		stmts = append(stmts, "RESET ALL")
+	}
+	if p.DiscardTemp {
+		stmts = append(stmts, "DISCARD TEMP")
+	}
+	if p.Unlisten {
+		stmts = append(stmts, "UNLISTEN *")
+	}
+	if p.ReleaseAdvisoryLocks {
+		stmts = append(stmts, "SELECT pg_advisory_unlock_all()")
+	}
+	return strings.Join(stmts, "; ")
+}
+
+// WithSessionReset installs an AfterRelease hook that cleans session state
+// before a connection is reused. Connections that fail the reset are
+// destroyed rather than returned to the pool. It does nothing in PgBouncer
+// mode, where PgBouncer's server_reset_query does the job.
+func WithSessionReset(policy SessionResetPolicy) PoolOption {
+	sql := policy.statements()
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	return func(s *poolSettings) {
+		if sql == "" {
+			return
+		}
+
+		prev := s.config.AfterRelease
+		s.config.AfterRelease = func(conn *pgx.Conn) bool {
+			if prev != nil && !prev(conn) {
+				return false
+			}
+			// Read here, not when the option is applied, so WithPgBouncerMode
+			// may come later
+			if s.pgbouncer {
+				return true
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			if _, err := conn.Exec(ctx, sql); err != nil {
+				s.metrics.addResetFailed()
+				slog.Warn("Session reset failed, destroying connection",
+					slog.Uint64("pid", uint64(conn.PgConn().PID())),
+					slog.String("error", err.Error()))
+				return false
+			}
+			s.metrics.addReset()
+			return true
+		}
+	}
+}
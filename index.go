@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/pgerrors"
+)
+
+// IndexProgress is a snapshot of pg_stat_progress_create_index for a build
+type IndexProgress struct {
+	Index        string
+	Phase        string
+	LockersTotal int64
+	LockersDone  int64
+	BlocksTotal  int64
+	BlocksDone   int64
+	TuplesTotal  int64
+	TuplesDone   int64
+}
+
+// Percent returns block progress of the current phase, or -1 when unknown
+func (p IndexProgress) Percent() float64 {
+	if p.BlocksTotal > 0 {
+		return float64(p.BlocksDone) / float64(p.BlocksTotal) * 100
+	}
+	if p.TuplesTotal > 0 {
+		return float64(p.TuplesDone) / float64(p.TuplesTotal) * 100
+	}
+	return -1
+}
+
+// IndexOption customizes CreateIndexConcurrently
+type IndexOption func(*indexBuild)
+
+type indexBuild struct {
+	retries      int
+	retryDelay   time.Duration
+	pollInterval time.Duration
+	progress     func(IndexProgress)
+	clock        Clock
+}
+
+// WithIndexRetries retries a build that failed on a lock timeout or deadlock
+// up to n more times, waiting delay between attempts. Other errors, such as
+// a unique violation, fail straight away.
+func WithIndexRetries(n int, delay time.Duration) IndexOption {
+	return func(b *indexBuild) {
+		b.retries = n
+		b.retryDelay = delay
+	}
+}
+
+// WithIndexProgress reports build progress every interval, default 5s,
+// instead of logging it
+func WithIndexProgress(interval time.Duration, fn func(IndexProgress)) IndexOption {
+	return func(b *indexBuild) {
+		b.pollInterval = interval
+		b.progress = fn
+	}
+}
+
+// WithIndexClock times retries and progress polls with c instead of the
+// system clock
+func WithIndexClock(c Clock) IndexOption {
+	return func(b *indexBuild) { b.clock = c }
+}
+
+var (
+	identPattern = `(?:"(?:[^"]|"")+"|[\w$]+)`
+	createIdxRe  = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:UNIQUE\s+)?INDEX\s+(CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?(` + identPattern + `)\s+ON\s+(?:ONLY\s+)?(` + identPattern + `(?:\.` + identPattern + `)?)`)
+	schemaPartRe = regexp.MustCompile(`^(` + identPattern + `)\.` + identPattern + `$`)
+	indexWordRe  = regexp.MustCompile(`(?i)\bINDEX\s+`)
+)
+
+// ErrInvalidIndex is returned when a build keeps leaving an INVALID index behind
+var ErrInvalidIndex = errors.New("index build left an invalid index")
+
+// CreateIndexConcurrently runs a CREATE INDEX statement with CONCURRENTLY,
+// outside any transaction, while reporting progress. The statement must name
+// the index. An INVALID index left by an earlier or failed attempt is dropped
+// before (re)trying, since IF NOT EXISTS would otherwise silently keep it.
+func (app *App) CreateIndexConcurrently(ctx context.Context, ddl string, opts ...IndexOption) error {
+	m := createIdxRe.FindStringSubmatchIndex(ddl)
+	if m == nil {
+		return fmt.Errorf("not a named CREATE INDEX statement: %q", ddl)
+	}
+	// Add CONCURRENTLY if the caller left it out
+	if m[2] < 0 {
+		loc := indexWordRe.FindStringIndex(ddl)
+		ddl = ddl[:loc[1]] + "CONCURRENTLY " + ddl[loc[1]:]
+		m = createIdxRe.FindStringSubmatchIndex(ddl)
+	}
+	index := ddl[m[4]:m[5]]
+	table := ddl[m[6]:m[7]]
+	// Indexes always live in their table's schema
+	if sm := schemaPartRe.FindStringSubmatch(table); sm != nil {
+		index = sm[1] + "." + index
+	}
+
+	build := &indexBuild{pollInterval: 5 * time.Second, retryDelay: 5 * time.Second}
+	for _, opt := range opts {
+		opt(build)
+	}
+	build.clock = clockOr(build.clock)
+	if build.pollInterval <= 0 {
+		build.pollInterval = 5 * time.Second
+	}
+	if build.progress == nil {
+		build.progress = func(p IndexProgress) {
+			slog.Info("Index build progress",
+				slog.String("index", p.Index),
+				slog.String("phase", p.Phase),
+				slog.Float64("percent", p.Percent()))
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt <= build.retries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("Retrying index build", slog.String("index", index), slog.Int("attempt", attempt+1))
+			if err := build.clock.Sleep(ctx, build.retryDelay); err != nil {
+				return err
+			}
+		}
+
+		if err = app.dropInvalidIndex(ctx, index); err != nil {
+			return err
+		}
+
+		err = app.buildIndex(ctx, ddl, index, build)
+		if err == nil {
+			valid, found, verr := app.indexValid(ctx, index)
+			if verr != nil {
+				return verr
+			}
+			if found && valid {
+				slog.Info("Index build complete", slog.String("index", index))
+				return nil
+			}
+			err = ErrInvalidIndex
+		}
+		if ctx.Err() != nil {
+			return errors.Join(err, app.dropInvalidIndex(context.WithoutCancel(ctx), index))
+		}
+		// Only lock contention can go differently next time
+		if code := pgerrors.Code(err); code != "55P03" && code != "40P01" {
+			break
+		}
+	}
+
+	// Do not leave an invalid index behind for writes to keep maintaining
+	dropErr := app.dropInvalidIndex(ctx, index)
+	return errors.Join(fmt.Errorf("error creating index %s: %w", index, err), dropErr)
+}
+
+// buildIndex runs the DDL on a pinned connection so its backend can be
+// watched from another connection
+func (app *App) buildIndex(ctx context.Context, ddl, index string, build *indexBuild) error {
+	conn, err := app.primary().Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring connection: %w", err)
+	}
+	defer conn.Release()
+	pid := conn.Conn().PgConn().PID()
+
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for build.clock.Sleep(pollCtx, build.pollInterval) == nil {
+			p := IndexProgress{Index: index}
+			err := app.primary().QueryRow(pollCtx, `
+				SELECT phase, lockers_total, lockers_done, blocks_total, blocks_done, tuples_total, tuples_done
+				FROM pg_stat_progress_create_index WHERE pid = $1`, pid).
+				Scan(&p.Phase, &p.LockersTotal, &p.LockersDone, &p.BlocksTotal, &p.BlocksDone, &p.TuplesTotal, &p.TuplesDone)
+			if err == nil {
+				build.progress(p)
+			}
+		}
+	}()
+	// No progress is reported once the build has returned
+	defer func() {
+		stopPolling()
+		<-polled
+	}()
+
+	_, err = conn.Exec(ctx, ddl)
+	return err
+}
+
+// indexValid reports whether the index exists and is valid
+func (app *App) indexValid(ctx context.Context, index string) (valid, found bool, err error) {
+	var v *bool
+	err = app.primary().QueryRow(ctx,
+		"SELECT (SELECT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1))", index).Scan(&v)
+	if err != nil {
+		return false, false, fmt.Errorf("error checking index %s: %w", index, err)
+	}
+	if v == nil {
+		return false, false, nil
+	}
+	return *v, true, nil
+}
+
+func (app *App) dropInvalidIndex(ctx context.Context, index string) error {
+	valid, found, err := app.indexValid(ctx, index)
+	if err != nil || !found || valid {
+		return err
+	}
+
+	slog.Warn("Dropping invalid index", slog.String("index", index))
+	if _, err := app.primary().Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+index); err != nil {
+		return fmt.Errorf("error dropping invalid index %s: %w", index, err)
+	}
+	return nil
+}
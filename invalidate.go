@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TableCache is a cache whose results can be evicted by the table they
+// read. An empty table evicts everything; an empty key evicts every
+// result reading the table.
+type TableCache interface {
+	InvalidateTable(ctx context.Context, table, key string) error
+}
+
+// Invalidation is the payload of a cache invalidation notification, sent
+// as JSON such as {"table":"users","key":"42"} or as a bare table name
+type Invalidation struct {
+	Table string `json:"table"`
+	Key   string `json:"key,omitempty"`
+}
+
+func parseInvalidation(payload string) (Invalidation, error) {
+	var inv Invalidation
+	if !strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		inv.Table = strings.TrimSpace(payload)
+	} else if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+		return inv, err
+	}
+	if inv.Table == "" {
+		return inv, errors.New("invalidation names no table")
+	}
+	return inv, nil
+}
+
+// NotifyInvalidation tells every CacheInvalidator listening on channel to
+// evict results of table for key, or all of them when key is empty. Sent
+// in a transaction it is delivered when the transaction commits.
+func NotifyInvalidation(ctx context.Context, db DBTX, channel, table, key string) error {
+	payload, err := json.Marshal(Invalidation{Table: table, Key: key})
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, "SELECT pg_notify($1, $2)", channel, string(payload)); err != nil {
+		return fmt.Errorf("error notifying %s: %w", channel, err)
+	}
+	return nil
+}
+
+// InvalidationTrigger returns DDL for a trigger notifying channel of every
+// row written to table, keyed by keyColumn, so writes from any client
+// invalidate caches without calling NotifyInvalidation. Updates are keyed
+// by the new row.
+func InvalidationTrigger(table, channel, keyColumn string) string {
+	name := strings.ReplaceAll(table, ".", "_") + "_notify_invalidation"
+	col := pgx.Identifier{keyColumn}.Sanitize()
+	return fmt.Sprintf(`CREATE OR REPLACE FUNCTION %[1]s() RETURNS trigger LANGUAGE plpgsql AS $fn$
+BEGIN
+	PERFORM pg_notify(%[2]s, json_build_object('table', TG_TABLE_NAME,
+		'key', CASE WHEN TG_OP = 'DELETE' THEN OLD.%[3]s ELSE NEW.%[3]s END::text)::text);
+	RETURN NULL;
+END
+$fn$;
+DROP TRIGGER IF EXISTS %[1]s ON %[4]s;
+CREATE TRIGGER %[1]s AFTER INSERT OR UPDATE OR DELETE ON %[4]s FOR EACH ROW EXECUTE FUNCTION %[1]s();`,
+		pgx.Identifier{name}.Sanitize(), quoteLiteral(channel), col, pgx.Identifier(strings.Split(table, ".")).Sanitize())
+}
+
+// sameTable compares table names case-insensitively, letting an
+// unqualified name match the same table in any schema
+func sameTable(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return true
+	}
+	if !strings.Contains(a, ".") || !strings.Contains(b, ".") {
+		return a[strings.LastIndex(a, ".")+1:] == b[strings.LastIndex(b, ".")+1:]
+	}
+	return false
+}
+
+// CacheInvalidator keeps caches consistent across instances: it listens
+// for Invalidation notifications and evicts matching results from every
+// cache added with Add. Because notifications sent while its connection
+// was down are lost, it clears every cache when it reconnects.
+type CacheInvalidator struct {
+	Listener *Listener
+
+	mu     sync.Mutex
+	caches []TableCache
+}
+
+// NewCacheInvalidator creates an invalidator listening on channel
+func NewCacheInvalidator(db *pgxpool.Pool, channel string) *CacheInvalidator {
+	c := &CacheInvalidator{}
+	c.Listener = NewListener(db, c.handle, channel)
+	c.Listener.OnReconnect = func(ctx context.Context) {
+		slog.Info("Clearing caches after reconnecting invalidation listener")
+		c.Invalidate(ctx, Invalidation{})
+	}
+	return c
+}
+
+// Add registers caches to evict from
+func (c *CacheInvalidator) Add(caches ...TableCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caches = append(c.caches, caches...)
+}
+
+// Run listens until ctx is cancelled
+func (c *CacheInvalidator) Run(ctx context.Context) error {
+	return c.Listener.Run(ctx)
+}
+
+// Invalidate evicts inv from every cache in this instance
+func (c *CacheInvalidator) Invalidate(ctx context.Context, inv Invalidation) {
+	c.mu.Lock()
+	caches := c.caches
+	c.mu.Unlock()
+	for _, cache := range caches {
+		if err := cache.InvalidateTable(ctx, inv.Table, inv.Key); err != nil {
+			slog.Warn("Error invalidating cache", slog.String("table", inv.Table), slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (c *CacheInvalidator) handle(ctx context.Context, n *pgconn.Notification) {
+	inv, err := parseInvalidation(n.Payload)
+	if err != nil {
+		slog.Warn("Ignoring invalid cache invalidation", slog.String("payload", n.Payload), slog.String("error", err.Error()))
+		return
+	}
+	c.Invalidate(ctx, inv)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ScanJSON is a pgx.RowToFunc decoding a row's single json or jsonb column
+// into T. A NULL column gives the zero T.
+//
+//	docs, err := pgx.CollectRows(rows, ScanJSON[Document])
+func ScanJSON[T any](row pgx.CollectableRow) (T, error) {
+	var v T
+	var raw []byte
+	if err := row.Scan(&raw); err != nil {
+		return v, err
+	}
+	if raw == nil {
+		return v, nil
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return v, fmt.Errorf("error decoding json column: %w", err)
+	}
+	return v, nil
+}
+
+// jsonArg is a parameter sent as JSON text
+type jsonArg struct {
+	v any
+}
+
+func (a jsonArg) Value() (driver.Value, error) {
+	b, err := json.Marshal(a.v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding json parameter: %w", err)
+	}
+	if bytes.Equal(b, []byte("null")) {
+		return nil, nil
+	}
+	return string(b), nil
+}
+
+// ArgJSON wraps v so it is always marshalled to JSON, whether the parameter
+// is json, jsonb or untyped text as under the simple protocol. Without it
+// pgx sends strings and byte slices to a jsonb parameter as they are, and
+// cannot encode structs for an untyped one. Nil values are sent as NULL.
+func ArgJSON(v any) driver.Valuer {
+	return jsonArg{v: v}
+}
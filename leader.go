@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// LeaderElector elects one instance among those running with the same key
+// to do single-writer background work. The leader holds a session-level
+// advisory lock on a dedicated connection taken out of the pool; the
+// others retry every Interval. The connection is checked every Interval
+// too, and on losing it the leader steps down and reconnects.
+//
+// Leadership is only as fresh as the last check: after the leader's
+// connection drops, another instance may take over up to Interval before
+// it notices, so work should not rely on strict exclusion. It needs a
+// direct connection rather than PgBouncer transaction pooling.
+type LeaderElector struct {
+	DB       *pgxpool.Pool
+	Key      int64
+	Interval time.Duration // Between lock attempts and connection checks, default 5s
+	Clock    Clock
+
+	leader atomic.Bool
+
+	mu   sync.Mutex
+	subs []chan bool
+}
+
+// NewLeaderElector creates an elector for the role named name
+func NewLeaderElector(db *pgxpool.Pool, name string) *LeaderElector {
+	return &LeaderElector{DB: db, Key: AdvisoryKey("leader:" + name), Interval: 5 * time.Second}
+}
+
+// IsLeader reports whether this instance currently leads
+func (e *LeaderElector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Changes returns a channel receiving true when this instance becomes
+// leader and false when it steps down. A slow reader only misses
+// intermediate states: the latest one is always delivered.
+func (e *LeaderElector) Changes() <-chan bool {
+	ch := make(chan bool, 1)
+	e.mu.Lock()
+	e.subs = append(e.subs, ch)
+	e.mu.Unlock()
+	return ch
+}
+
+func (e *LeaderElector) set(leader bool) {
+	if e.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		slog.Info("Became leader", slog.Int64("key", e.Key))
+	} else {
+		slog.Warn("Stepped down as leader", slog.Int64("key", e.Key))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ch := range e.subs {
+		select {
+		case <-ch: // Replace an unread state
+		default:
+		}
+		ch <- leader
+	}
+}
+
+// Run campaigns for leadership until ctx is cancelled, then releases the
+// lock if it holds it
+func (e *LeaderElector) Run(ctx context.Context) error {
+	interval := e.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	clock := clockOr(e.Clock)
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			closeCtx := context.WithoutCancel(ctx)
+			if e.IsLeader() {
+				_, _ = conn.Exec(closeCtx, "SELECT pg_advisory_unlock($1)", e.Key)
+			}
+			_ = conn.Close(closeCtx)
+		}
+		e.set(false)
+	}()
+
+	for {
+		if conn == nil {
+			pooled, err := e.DB.Acquire(ctx)
+			if err == nil {
+				conn = pooled.Hijack()
+			} else if ctx.Err() == nil {
+				slog.Warn("Error connecting for leader election", slog.String("error", err.Error()))
+			}
+		}
+
+		if conn != nil {
+			if err := e.campaign(ctx, conn); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				slog.Warn("Lost leader election connection", slog.String("error", err.Error()))
+				_ = conn.Close(context.WithoutCancel(ctx))
+				conn = nil
+				e.set(false)
+			}
+		}
+
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// campaign takes the lock if this instance does not hold it, or checks the
+// connection that holds it
+func (e *LeaderElector) campaign(ctx context.Context, conn *pgx.Conn) error {
+	if e.IsLeader() {
+		_, err := conn.Exec(ctx, "SELECT 1")
+		return err
+	}
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", e.Key).Scan(&locked); err != nil {
+		return err
+	}
+	if locked {
+		e.set(true)
+	}
+	return nil
+}
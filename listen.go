@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Listener receives NOTIFY messages on Channels and passes each to Handle.
+// It listens on a dedicated connection taken out of the pool and
+// reconnects after RetryInterval when the connection is lost.
+// Notifications sent while it was disconnected are lost, so OnReconnect
+// runs once it listens again, for consumers that must resynchronize.
+//
+// LISTEN needs a session, so it does not work through PgBouncer in
+// transaction pooling mode.
+type Listener struct {
+	DB            *pgxpool.Pool
+	Active        *ActivePool // Optional, reconnects go to its pool instead of DB
+	Channels      []string
+	Handle        func(ctx context.Context, n *pgconn.Notification)
+	OnReconnect   func(ctx context.Context)
+	RetryInterval time.Duration // Wait before reconnecting, default 5s
+	Clock         Clock
+}
+
+// NewListener creates a listener passing notifications on channels to
+// handle
+func NewListener(db *pgxpool.Pool, handle func(ctx context.Context, n *pgconn.Notification), channels ...string) *Listener {
+	return &Listener{DB: db, Channels: channels, Handle: handle, RetryInterval: 5 * time.Second}
+}
+
+// Run listens until ctx is cancelled
+func (l *Listener) Run(ctx context.Context) error {
+	interval := l.RetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	clock := clockOr(l.Clock)
+	listened := false
+	for {
+		ok, err := l.listen(ctx, listened)
+		listened = listened || ok
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Warn("Lost notification listener connection", slog.Any("channels", l.Channels), slog.String("error", err.Error()))
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// listen connects, listens and handles notifications until the connection
+// fails, reporting whether it got as far as listening
+func (l *Listener) listen(ctx context.Context, reconnect bool) (bool, error) {
+	pooled, err := l.Active.Or(l.DB).Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	conn := pooled.Hijack()
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	for _, ch := range l.Channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{ch}.Sanitize()); err != nil {
+			return false, err
+		}
+	}
+	if reconnect && l.OnReconnect != nil {
+		l.OnReconnect(ctx)
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		func() {
+			var err error
+			defer recoverTo(&err, nil)
+			l.Handle(ctx, n)
+		}()
+	}
+}
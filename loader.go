@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// ConfigSource identifies the layer an effective config value came from
+type ConfigSource string
+
+const (
+	SourceDefault ConfigSource = "default"
+	SourceFile    ConfigSource = "file"
+	SourceEnv     ConfigSource = "env"
+	SourceFlag    ConfigSource = "flag"
+	SourceURL     ConfigSource = "url"
+)
+
+// ConfigSources maps config keys such as PG_HOST to the layer that set them
+type ConfigSources map[string]ConfigSource
+
+// ConfigLoader merges configuration layers with increasing precedence:
+// built-in defaults, an optional YAML/JSON/TOML/.env file, environment
+// variables, then command-line flags. A connection URL (PG_URL or
+// DATABASE_URL) only fills values that would otherwise come from defaults.
+type ConfigLoader struct {
+	File     string    // Optional config file, skipped when missing; overridden by --config
+	Args     []string  // Command-line arguments, e.g. os.Args[1:]
+	Defaults *DBConfig // Built-in defaults, DefaultDBConfig() when nil
+
+	// Flags are extra flags, e.g. a subcommand's, parsed together with the
+	// config flags. Positional arguments are available from Flags.Args().
+	Flags *pflag.FlagSet
+}
+
+// DefaultDBConfig returns the built-in configuration defaults
+func DefaultDBConfig() *DBConfig {
+	return &DBConfig{
+		Host:              "localhost",
+		Port:              5432,
+		MaxConns:          10,
+		MinConns:          2,                // Minimum connections in the pool, pgxpool default is 0
+		MaxConnLifeTime:   30 * time.Minute, // Maximum connection lifetime, pgxpool default is one hour
+		MaxConnIdleTime:   10 * time.Minute, // Maximum idle time, pgxpool default is 30 minutes
+		HealthCheckPeriod: 2 * time.Minute,  // Health check frequency, pgxpool default is 60 seconds
+		CredentialsTTL:    5 * time.Minute,
+		MigrationsDir:     "migrations",
+	}
+}
+
+// configField is a DBConfig field addressable by config key
+type configField struct {
+	key   string // e.g. PG_MAX_CONNS
+	flag  string // e.g. max-conns
+	index []int
+}
+
+// configFields lists the DBConfig fields that carry a config key
+func configFields() []configField {
+	var fields []configField
+	t := reflect.TypeOf(DBConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" || key == "-" {
+			continue
+		}
+		fields = append(fields, configField{
+			key:   key,
+			flag:  strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(key, "PG_")), "_", "-"),
+			index: t.Field(i).Index,
+		})
+	}
+	return fields
+}
+
+// Load returns the effective configuration and the source of each value
+func (l *ConfigLoader) Load() (*DBConfig, ConfigSources, error) {
+	defaults := l.Defaults
+	if defaults == nil {
+		defaults = DefaultDBConfig()
+	}
+	fields := configFields()
+
+	v := viper.New()
+	dv := reflect.ValueOf(defaults).Elem()
+	for _, f := range fields {
+		v.SetDefault(f.key, dv.FieldByIndex(f.index).Interface())
+	}
+
+	// Flags are parsed as strings and decoded alongside the other layers
+	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	configFile := fs.String("config", l.File, "configuration file (.yaml, .json, .toml or .env)")
+	for _, f := range fields {
+		fs.String(f.flag, "", "overrides "+f.key)
+		if err := v.BindPFlag(f.key, fs.Lookup(f.flag)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if l.Flags != nil {
+		fs.AddFlagSet(l.Flags)
+	}
+	if err := fs.Parse(l.Args); err != nil {
+		return nil, nil, fmt.Errorf("error parsing flags: %w", err)
+	}
+	if l.Flags != nil {
+		// AddFlagSet shares the flags but not the positional arguments
+		if err := l.Flags.Parse(fs.Args()); err != nil {
+			return nil, nil, fmt.Errorf("error parsing flags: %w", err)
+		}
+	}
+
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+		// A missing default file is fine, the environment may carry
+		// everything; a missing --config file is not
+		var notFound viper.ConfigFileNotFoundError
+		err := v.ReadInConfig()
+		if missing := errors.Is(err, os.ErrNotExist) || errors.As(err, &notFound); missing && !fs.Changed("config") {
+			err = nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+	v.AutomaticEnv() // Read environment variables
+
+	var cfg DBConfig
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, nil, err
+	}
+
+	sources := make(ConfigSources, len(fields))
+	for _, f := range fields {
+		switch {
+		case fs.Changed(f.flag):
+			sources[f.key] = SourceFlag
+		case os.Getenv(f.key) != "":
+			sources[f.key] = SourceEnv
+		case v.InConfig(f.key):
+			sources[f.key] = SourceFile
+		default:
+			sources[f.key] = SourceDefault
+		}
+	}
+
+	if err := mergeURL(&cfg, fields, sources); err != nil {
+		return nil, nil, err
+	}
+	return &cfg, sources, nil
+}
+
+// ConfigFromURL returns the built-in defaults overlaid with a connection
+// URL, for a second database given on the command line
+func ConfigFromURL(raw string) (*DBConfig, error) {
+	cfg := DefaultDBConfig()
+	cfg.URL = raw
+
+	fields := configFields()
+	sources := make(ConfigSources, len(fields))
+	for _, f := range fields {
+		sources[f.key] = SourceDefault
+	}
+	if err := mergeURL(cfg, fields, sources); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// mergeURL applies the connection URL to every field still at its default
+func mergeURL(cfg *DBConfig, fields []configField, sources ConfigSources) error {
+	if cfg.URL == "" {
+		if env := os.Getenv("DATABASE_URL"); env != "" {
+			cfg.URL = env
+			sources["PG_URL"] = SourceEnv
+		}
+	}
+	if cfg.URL == "" {
+		return nil
+	}
+
+	u, err := ParseDatabaseURL(cfg.URL)
+	if err != nil {
+		return err
+	}
+
+	cv := reflect.ValueOf(cfg).Elem()
+	uv := reflect.ValueOf(u).Elem()
+	for _, f := range fields {
+		if sources[f.key] != SourceDefault {
+			continue
+		}
+		if val := uv.FieldByIndex(f.index); !val.IsZero() {
+			cv.FieldByIndex(f.index).Set(val)
+			sources[f.key] = SourceURL
+		}
+	}
+
+	for k, val := range u.Params {
+		if _, ok := cfg.Params[k]; ok {
+			continue
+		}
+		if cfg.Params == nil {
+			cfg.Params = make(map[string]string)
+		}
+		cfg.Params[k] = val
+	}
+	return nil
+}
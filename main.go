@@ -2,66 +2,409 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log/slog"
-	"strings"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/adityapatel-00/go-pgxpool/pgerrors"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/spf13/viper"
 )
 
 // DBConfig holds all database configuration parameters
 type DBConfig struct {
-	Host              string `mapstructure:"PG_HOST"`
-	Port              int    `mapstructure:"PG_PORT"`
-	UserName          string `mapstructure:"PG_USERNAME"`
-	Password          string `mapstructure:"PG_PASSWORD"`
-	DBName            string `mapstructure:"PG_DBNAME"`
-	MaxConns          int32
-	MinConns          int32
-	MaxConnLifeTime   time.Duration
-	MaxConnIdleTime   time.Duration
-	HealthCheckPeriod time.Duration
+	Host              string            `mapstructure:"PG_HOST"` // One host, or several comma-separated as host[:port] tried in order
+	Port              int               `mapstructure:"PG_PORT"`
+	UserName          string            `mapstructure:"PG_USERNAME"`
+	Password          string            `mapstructure:"PG_PASSWORD"`
+	DBName            string            `mapstructure:"PG_DBNAME"`
+	URL               string            `mapstructure:"PG_URL"` // Full connection URL, merged under the fields above
+	Params            map[string]string // Extra connection parameters such as sslmode
+	RuntimeParams     map[string]string // Session settings sent at connect, e.g. timezone or statement_timeout
+	ApplicationName   string            `mapstructure:"PG_APPLICATION_NAME"` // Shown in pg_stat_activity
+	SearchPath        string            `mapstructure:"PG_SEARCH_PATH"`      // Schemas for unqualified names, e.g. "app, public"
+	MaxConns          int32             `mapstructure:"PG_MAX_CONNS"`
+	MinConns          int32             `mapstructure:"PG_MIN_CONNS"`
+	MaxConnLifeTime   time.Duration     `mapstructure:"PG_MAX_CONN_LIFETIME"`
+	MaxConnIdleTime   time.Duration     `mapstructure:"PG_MAX_CONN_IDLE_TIME"`
+	HealthCheckPeriod time.Duration     `mapstructure:"PG_HEALTH_CHECK_PERIOD"`
+	AcquirePing       time.Duration     `mapstructure:"PG_ACQUIRE_PING"` // Ping each connection within this before handing it out, at a round trip per acquire; zero skips it
+
+	// Credentials from a secret store instead of PG_PASSWORD
+	CredentialsProvider string             `mapstructure:"PG_CREDENTIALS_PROVIDER"` // vault, aws-secretsmanager or gcp-secretmanager
+	CredentialsSecret   string             `mapstructure:"PG_CREDENTIALS_SECRET"`   // Secret path, ID or resource name
+	CredentialsTTL      time.Duration      `mapstructure:"PG_CREDENTIALS_TTL"`      // How long fetched credentials are reused
+	Credentials         CredentialProvider `mapstructure:"-"`                       // Custom provider, overrides the fields above
+
+	Clock Clock `mapstructure:"-"` // Time source of WaitForDB's backoff, default SystemClock
+
+	PgBouncerMode bool `mapstructure:"PG_PGBOUNCER_MODE"` // Connecting through PgBouncer in transaction pooling mode
+
+	LazyConnect bool `mapstructure:"PG_LAZY_CONNECT"` // Start without reaching the database; connections are made on first use
+
+	SuperviseInterval time.Duration `mapstructure:"PG_SUPERVISE_INTERVAL"` // Ping the primary this often and rebuild its pool after repeated failures, zero leaves it unsupervised
+
+	TargetSessionAttrs string `mapstructure:"PG_TARGET_SESSION_ATTRS"` // any, read-write, read-only, primary, standby or prefer-standby
+
+	ReplicaURL string `mapstructure:"PG_REPLICA_URL"` // Standby for App.Replica; connections to a writable node are refused
+
+	AnalyticsURL              string        `mapstructure:"PG_ANALYTICS_URL"`               // Server for App.Analytics, defaults to the primary
+	AnalyticsMaxConns         int32         `mapstructure:"PG_ANALYTICS_MAX_CONNS"`         // Connections of the analytics pool, zero shares the main pool
+	AnalyticsMaxConnLifeTime  time.Duration `mapstructure:"PG_ANALYTICS_MAX_CONN_LIFETIME"` // Default 4 hours
+	AnalyticsStatementTimeout time.Duration `mapstructure:"PG_ANALYTICS_STATEMENT_TIMEOUT"` // statement_timeout of reporting queries, zero keeps the server default
+	AnalyticsCostThreshold    float64       `mapstructure:"PG_ANALYTICS_COST_THRESHOLD"`    // Planner cost above which App.Workload sends a read to the analytics pool, zero disables
+
+	SlowQueryThreshold time.Duration `mapstructure:"PG_SLOW_QUERY_THRESHOLD"` // Statements slower than this are logged at Warn, zero disables
+	SlowQueryExplain   bool          `mapstructure:"PG_SLOW_QUERY_EXPLAIN"`   // Attach the EXPLAIN plan of slow statements to their log entries
+
+	TableConcurrency string `mapstructure:"PG_TABLE_CONCURRENCY"` // Concurrent statements allowed per hot table, e.g. "counters=2,public.jobs=4"
+
+	TTLTables string `mapstructure:"PG_TTL_TABLES"` // Tables whose expired rows App.TTL deletes, e.g. "sessions,cache.entries=valid_until"; the column defaults to expires_at
+
+	AuthMode  string `mapstructure:"PG_AUTH_MODE"`  // password (default) or rds-iam
+	AWSRegion string `mapstructure:"PG_AWS_REGION"` // Region for rds-iam tokens, defaults to the AWS config
+
+	MigrationsDir    string `mapstructure:"PG_MIGRATIONS_DIR"`    // Migration files for the migrate command
+	MigrationSchemas string `mapstructure:"PG_MIGRATION_SCHEMAS"` // Comma-separated schemas migrated as separate targets
+
+	AdminAddr  string `mapstructure:"PG_ADMIN_ADDR"`  // Serve health, metrics and pool stats here, e.g. ":9090" for 127.0.0.1 or "0.0.0.0:9090"; the app then runs until signalled
+	AdminToken string `mapstructure:"PG_ADMIN_TOKEN"` // Bearer token for admin endpoints that change data, which are refused without one
+
+	PreparedTxPrefix string `mapstructure:"PG_PREPARED_TX_PREFIX"` // GID prefix of this application's prepared transactions, enables the janitor
+	PreparedTxPolicy string `mapstructure:"PG_PREPARED_TX_POLICY"` // alert (default), rollback or commit
+
+	CrashDumpPath string `mapstructure:"PG_CRASH_DUMP"` // Where the diagnostic bundle goes when the app panics or fails, stderr when empty
+
+	CacheRedisURL string        `mapstructure:"PG_CACHE_REDIS_URL"` // Redis for App.Cache, e.g. "redis://localhost:6379/0"; unset disables it
+	CacheTTL      time.Duration `mapstructure:"PG_CACHE_TTL"`       // TTL of cached queries, default 5 minutes
+	CacheTTLs     string        `mapstructure:"PG_CACHE_TTLS"`      // Per-query TTLs, e.g. "user_count=30s,plans=1h"
+
+	CacheInvalidationChannel string `mapstructure:"PG_CACHE_INVALIDATION_CHANNEL"` // NOTIFY channel App.Invalidations listens on; unset disables it
+
+	JobsTable string `mapstructure:"PG_JOBS_TABLE"` // Table of App.Jobs, also managed on the admin endpoints; unset disables it
+
+	RateLimit     float64 `mapstructure:"PG_RATE_LIMIT"`      // Statements per second through App.RateLimit, zero disables it
+	RateBurst     int     `mapstructure:"PG_RATE_BURST"`      // Statements allowed at once above the rate, default 1
+	RateLimitMode string  `mapstructure:"PG_RATE_LIMIT_MODE"` // wait (default) queues over-rate statements, reject fails them
+
+	QueryBudgetQueries int           `mapstructure:"PG_QUERY_BUDGET_QUERIES"` // Queries one request may run through App.Budget.Middleware, zero is unlimited
+	QueryBudgetTime    time.Duration `mapstructure:"PG_QUERY_BUDGET_TIME"`    // Cumulative query time one request may spend, zero is unlimited
+	QueryBudgetMode    string        `mapstructure:"PG_QUERY_BUDGET_MODE"`    // enforce (default) fails requests over budget, log only logs them
 }
 
 type App struct {
-	DBClient *pgxpool.Pool
+	DBClient *pgxpool.Pool // Primary built at startup; under Supervisor, App methods and the components Run builds follow its rebuilds
+	Replica  *pgxpool.Pool // Read-only pool on a standby, nil unless PG_REPLICA_URL is set
+	Metrics  *PoolMetrics
+	Rotator  *CredentialRotator
+
+	Statements *StatementMetrics // Per-statement latency, also an http.Handler for Prometheus
+	Spills     *SpillMonitor     // Per-statement temp file usage, also an http.Handler
+	Callers    *CallerMetrics    // Load per App.Named caller, also an http.Handler
+	Tables     *TableLimiter     // Per-table concurrency caps, nil when none are configured
+	Cache      *RedisCache       // Read-through cache for NewRedisQuery, nil unless PG_CACHE_REDIS_URL is set
+	RateLimit  *RateLimiter      // Token bucket in front of Query and Exec, nil unless PG_RATE_LIMIT is set
+	Budget     *QueryBudget      // Per-request query limits for HTTP handlers, inert unless PG_QUERY_BUDGET_* is set
+	Workload   *WorkloadRouter   // Sends analytical reads to the analytics pool, everything to DBClient without one
+	Scheduler  *Scheduler        // Cron jobs added with App.Schedule, each run on one instance at a time
+	Jobs       *Queue            // Job queue, nil unless PG_JOBS_TABLE is set
+	TTL        TTLTables         // Expired row sweepers, also an http.Handler; nil unless PG_TTL_TABLES is set
+	Supervisor *PoolSupervisor   // Rebuilds the primary pool while the database stays unreachable, nil unless PG_SUPERVISE_INTERVAL is set
+
+	Invalidations *CacheInvalidator // Evicts caches added to it on NOTIFY, nil unless PG_CACHE_INVALIDATION_CHANNEL is set
+
+	Diagnostics *Diagnostics // Pool history for crash dumps, also published as the "pgxpool" expvar
+
+	AdminToken string // Bearer token AdminHandler requires on requests that change data
+	Clock      Clock  // Timestamps PoolStats, default SystemClock
+
+	SchemaErr error // Set when started degraded against an unsupported schema or unreachable database
+
+	analytics *pgxpool.Pool // Returned by Analytics, nil unless PG_ANALYTICS_MAX_CONNS is set
+
+	sqlDBOnce sync.Once
+	sqlDB     *sql.DB // Built by SQLDB
 }
 
+// supportedSchema is the migration range this build works with. Raise
+// MinVersion when code starts depending on a new migration.
+var supportedSchema = SchemaGate{MinVersion: 0}
+
 func main() {
-	// Create a root context with cancellation
-	rootCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	os.Exit(Run(context.Background(), os.Args[1:]))
+}
 
-	// Initialize database configuration from environment variables
-	dbConfig, err := LoadConfig(".env") // Change for yaml or json. ex: config.yaml
+// Run runs the application, or the subcommand named by args[0], and returns
+// the process exit code. SIGINT and SIGTERM cancel the root context; the
+// pool is closed, waiting for acquired connections, before Run returns.
+func Run(ctx context.Context, args []string) (code int) {
+	// Create a root context cancelled on shutdown signals
+	rootCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var diag *Diagnostics
+	defer func() {
+		// Setup helpers panic on bad config; report them as a failed exit
+		reason := fmt.Sprintf("exit code %d", code)
+		if r := recover(); r != nil {
+			slog.Error("Application panicked", slog.Any("panic", r))
+			code = 1
+			reason = fmt.Sprintf("panic: %v", r)
+		}
+		if code != 0 && diag != nil {
+			diag.Dump(reason)
+		}
+		if rootCtx.Err() != nil && ctx.Err() == nil {
+			slog.Info("Shut down on signal")
+		}
+		_ = os.Stderr.Sync()
+	}()
+
+	// Subcommands
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			if err := cmd(rootCtx, args[1:]); err != nil {
+				slog.Error("Command failed", slog.String("command", args[0]), slog.String("error", err.Error()))
+				return 1
+			}
+			return 0
+		}
+	}
+
+	// Initialize database configuration from defaults, file, environment and flags
+	loader := &ConfigLoader{File: ".env", Args: args} // Change for yaml, json or toml. ex: config.yaml
+	dbConfig, sources, err := loader.Load()
 	if err != nil {
-		slog.Info("Error loading config", slog.String("error=", err.Error()))
+		slog.Error("Error loading config", slog.String("error", err.Error()))
+		return 1
 	}
-	dbConfig.MaxConns = 10
-	dbConfig.MinConns = 2                        // Minimum connections in the pool, default is 0
-	dbConfig.MaxConnLifeTime = 30 * time.Minute  // Maximum connection lifetime, default is one hour
-	dbConfig.MaxConnIdleTime = 10 * time.Minute  // Maximum idle time, default is 30 minutes
-	dbConfig.HealthCheckPeriod = 2 * time.Minute // Health check frequency, default is 60 seconds
 
-	slog.Info("config", slog.Any("c=", dbConfig))
+	slog.Info("Loaded config", slog.Any("config", redactConfig(dbConfig)), slog.Any("sources", sources))
 
 	// Create the connection pool
-	db, err := NewPg(rootCtx, dbConfig, WithPgxConfig(dbConfig))
+	metrics := &PoolMetrics{}
+	rotator := NewCredentialRotator()
+	statements := NewStatementMetrics()
+	spills := NewSpillMonitor()
+	callers := NewCallerMetrics()
+	budget, err := dbConfig.queryBudget()
+	if err != nil {
+		slog.Error("Error configuring query budget", slog.String("error", err.Error()))
+		return 1
+	}
+	diag = NewDiagnostics(dbConfig)
+	diag.Path = dbConfig.CrashDumpPath
+	if dbConfig.SlowQueryThreshold > 0 {
+		spills.Threshold = dbConfig.SlowQueryThreshold
+	}
+	poolOpts := []PoolOption{
+		WithMetrics(metrics),
+		WithTracer(statements),                  // Latency histograms per normalized statement
+		WithTracer(spills),                      // Temp file spills of slow statements
+		WithTracer(callers),                     // Queries and acquire waits per App.Named caller
+		WithTracer(diag),                        // Recent errors and held connections for crash dumps
+		WithTracer(budget),                      // Queries and query time per request under App.Budget.Middleware
+		WithCredentialRotation(rotator),         // Allow app.RotateCredentials without a restart
+		WithSessionReset(DefaultSessionReset()), // Clear SET ROLE / search_path before reuse
+	}
+	db, err := newPool(rootCtx, dbConfig, poolOpts...)
 	if err != nil {
 		slog.Error("Error connecting to database", slog.String("error", err.Error()))
-		panic(err)
+		return 1
 	}
 	defer db.Close()
 
+	// The primary as app.Supervisor rebuilds it. Components built on db
+	// below also get active and resolve the pool on each use; nil keeps
+	// them on db.
+	var active *ActivePool
+	if dbConfig.SuperviseInterval > 0 {
+		active = NewActivePool(db)
+		defer func() { active.Pool().Close() }()
+	}
+
+	tables, err := dbConfig.tableLimiter(db)
+	if err != nil {
+		slog.Error("Error configuring table concurrency", slog.String("error", err.Error()))
+		return 1
+	}
+	if tables != nil {
+		tables.Active = active
+	}
+
+	rateLimit, err := dbConfig.rateLimiter(db, metrics)
+	if err != nil {
+		slog.Error("Error configuring rate limit", slog.String("error", err.Error()))
+		return 1
+	}
+	if rateLimit != nil {
+		rateLimit.Active = active
+	}
+	spills.Active = active
+
+	cache, redisClient, err := dbConfig.redisCache()
+	if err != nil {
+		slog.Error("Error configuring cache", slog.String("error", err.Error()))
+		return 1
+	}
+	if redisClient != nil {
+		defer redisClient.Close()
+	}
+
 	app := &App{
 		DBClient: db,
+		Metrics:  metrics,
+		Rotator:  rotator,
+
+		Statements: statements,
+		Spills:     spills,
+		Callers:    callers,
+		Tables:     tables,
+		Cache:      cache,
+		RateLimit:  rateLimit,
+		Budget:     budget,
+		Scheduler:  NewScheduler(db, "scheduled_jobs"),
+
+		Diagnostics: diag,
+		AdminToken:  dbConfig.AdminToken,
+	}
+	app.Scheduler.Active = active
+	diag.Stats = app.PoolStats
+	diag.Publish("pgxpool")
+	go diag.Run(rootCtx)
+
+	// Replace the primary pool when the database stays unreachable
+	if active != nil {
+		app.Supervisor = &PoolSupervisor{
+			Active: active,
+			Connect: func(ctx context.Context) (*pgxpool.Pool, error) {
+				return newPool(ctx, dbConfig, poolOpts...)
+			},
+			CheckInterval: dbConfig.SuperviseInterval,
+		}
+		go func() {
+			if err := app.Supervisor.Run(rootCtx); err != nil && rootCtx.Err() == nil {
+				slog.Error("Pool supervisor stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	if dbConfig.ReplicaURL != "" {
+		replicaConfig, err := ConfigFromURL(dbConfig.ReplicaURL)
+		if err != nil {
+			slog.Error("Error parsing replica url", slog.String("error", err.Error()))
+			return 1
+		}
+		replicaConfig.LazyConnect = dbConfig.LazyConnect
+		replica, err := newPool(rootCtx, replicaConfig, WithReplica())
+		if err != nil {
+			slog.Error("Error connecting to replica", slog.String("error", err.Error()))
+			return 1
+		}
+		defer replica.Close()
+		app.Replica = replica
+	}
+
+	// Reporting queries get their own small pool when configured
+	analyticsConfig, err := dbConfig.analyticsConfig()
+	if err != nil {
+		slog.Error("Error configuring analytics pool", slog.String("error", err.Error()))
+		return 1
+	}
+	if analyticsConfig != nil {
+		analytics, err := newPool(rootCtx, analyticsConfig,
+			WithAnalytics(dbConfig.AnalyticsStatementTimeout),
+			WithTracer(statements),
+		)
+		if err != nil {
+			slog.Error("Error connecting analytics pool", slog.String("error", err.Error()))
+			return 1
+		}
+		defer analytics.Close()
+		app.analytics = analytics
+	}
+	app.Workload = NewWorkloadRouter(db, app.Analytics())
+	app.Workload.CostThreshold = dbConfig.AnalyticsCostThreshold
+	app.Workload.Active = active
+
+	// Refuse to run against a schema this build does not understand
+	if err = app.CheckSchema(rootCtx, supportedSchema); err != nil {
+		if !dbConfig.LazyConnect {
+			slog.Error("Error checking schema version", slog.String("error", err.Error()))
+			return 1
+		}
+		// The database is optional for lazily connected services
+		slog.Warn("Starting degraded, database unavailable", slog.String("error", err.Error()))
+		app.SchemaErr = err
 	}
 	slog.Info("Application started successfully!")
 
+	go func() {
+		if err := spills.Run(rootCtx, db); err != nil && rootCtx.Err() == nil {
+			slog.Error("Spill monitor stopped", slog.String("error", err.Error()))
+		}
+	}()
+
+	go func() {
+		if err := app.Scheduler.Run(rootCtx); err != nil && rootCtx.Err() == nil {
+			slog.Error("Scheduler stopped", slog.String("error", err.Error()))
+		}
+	}()
+
+	if dbConfig.JobsTable != "" {
+		jobs, err := NewQueue(rootCtx, db, dbConfig.JobsTable)
+		if err != nil {
+			if !dbConfig.LazyConnect {
+				slog.Error("Error creating job queue", slog.String("error", err.Error()))
+				return 1
+			}
+			slog.Warn("Starting without the job queue", slog.String("error", err.Error()))
+		} else {
+			jobs.Active = active
+		}
+		app.Jobs = jobs
+	}
+
+	// Delete expired rows of session- and cache-like tables
+	if app.TTL, err = dbConfig.ttlTables(db, app.Replica, active, metrics); err != nil {
+		slog.Error("Error configuring TTL tables", slog.String("error", err.Error()))
+		return 1
+	}
+	for _, t := range app.TTL {
+		go func() {
+			if err := t.Run(rootCtx); err != nil && rootCtx.Err() == nil {
+				slog.Error("TTL sweeper stopped", slog.String("table", t.Table), slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	// Keep caches in step with writes made by other instances
+	if dbConfig.CacheInvalidationChannel != "" {
+		app.Invalidations = NewCacheInvalidator(db, dbConfig.CacheInvalidationChannel)
+		app.Invalidations.Listener.Active = active
+		go func() {
+			if err := app.Invalidations.Run(rootCtx); err != nil && rootCtx.Err() == nil {
+				slog.Error("Cache invalidation listener stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	// Resolve prepared transactions orphaned by earlier runs
+	if dbConfig.PreparedTxPrefix != "" {
+		janitor, err := dbConfig.preparedTxJanitor(db)
+		if err != nil {
+			slog.Error("Error configuring prepared transaction janitor", slog.String("error", err.Error()))
+			return 1
+		}
+		janitor.Active = active
+		go janitor.Run(rootCtx)
+	}
+
 	// Do some operations
 	// V1: Acquiring explicit connection
 	err = app.DoExplicitConnectionOperations(rootCtx)
@@ -77,56 +420,69 @@ func main() {
 
 	// Monitor pool stats
 	app.monitorPoolStats()
+
+	// Keep serving the admin endpoints until shutdown
+	if dbConfig.AdminAddr != "" {
+		if err := app.serveAdmin(rootCtx, dbConfig.AdminAddr); err != nil {
+			slog.Error("Error serving admin endpoints", slog.String("error", err.Error()))
+			return 1
+		}
+	}
+	return 0
 }
 
+// LoadConfig loads configuration from defaults, the given file and the
+// environment. Use ConfigLoader to also apply command-line flags or to see
+// where each value came from.
 func LoadConfig(configFile string) (*DBConfig, error) {
-	var cfg DBConfig
-
-	// Set file name for environment configuration
-	viper.SetConfigFile(configFile)
-	viper.AutomaticEnv() // Read environment variables
+	cfg, _, err := (&ConfigLoader{File: configFile}).Load()
+	return cfg, err
+}
 
-	// Read the configuration file
-	if err := viper.ReadInConfig(); err != nil {
-		return nil, err
+// Create a pgx connection config from DBConfig. Credentials from a secret
+// store are not fetched here; NewPg's BeforeConnect hook fetches them for
+// each new connection.
+func WithPgxConfig(dbConfig *DBConfig) (*pgx.ConnConfig, error) {
+	// Create the dsn string
+	config, err := pgx.ParseConfig(dbConfig.connString())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing connection config: %w", err)
 	}
 
-	// Unmarshal into DBConfig
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return nil, err
+	// Session defaults sent in the startup packet
+	for k, v := range dbConfig.RuntimeParams {
+		config.RuntimeParams[k] = v
+	}
+	if dbConfig.ApplicationName != "" {
+		config.RuntimeParams["application_name"] = dbConfig.ApplicationName
+	}
+	// As a startup parameter it is also what RESET ALL returns to
+	if dbConfig.SearchPath != "" {
+		config.RuntimeParams["search_path"] = dbConfig.SearchPath
 	}
 
-	return &cfg, nil
+	return config, nil
 }
 
-// Ensure singleton pattern for connection configuration
-var pgOnce sync.Once
-
-// Create a pgx connection config from DBConfig
-func WithPgxConfig(dbConfig *DBConfig) *pgx.ConnConfig {
-	// Create the dsn string
-	connString := strings.TrimSpace(fmt.Sprintf(
-		"user=%s password=%s dbname=%s host=%s port=%d",
-		dbConfig.UserName, dbConfig.Password, dbConfig.DBName,
-		dbConfig.Host, dbConfig.Port))
-
-	config, err := pgx.ParseConfig(connString)
+// newPool is NewPg with the connection config built by WithPgxConfig
+func newPool(ctx context.Context, dbConfig *DBConfig, opts ...PoolOption) (*pgxpool.Pool, error) {
+	pgxConfig, err := WithPgxConfig(dbConfig)
 	if err != nil {
-		slog.Error("Error parsing connection config", slog.String("error", err.Error()))
-		panic(err)
+		return nil, err
 	}
-
-	return config
+	return NewPg(ctx, dbConfig, pgxConfig, opts...)
 }
 
 // Create a new connection pool with the provided configuration
-func NewPg(ctx context.Context, dbConfig *DBConfig, pgxConfig *pgx.ConnConfig) (*pgxpool.Pool, error) {
+func NewPg(ctx context.Context, dbConfig *DBConfig, pgxConfig *pgx.ConnConfig, opts ...PoolOption) (*pgxpool.Pool, error) {
 	// Parse the pool configuration from connection string
 	config, err := pgxpool.ParseConfig(pgxConfig.ConnString())
 	if err != nil {
 		slog.Error("Error parsing pool config", slog.String("error", err.Error()))
 		return nil, err
 	}
+	// Keep what WithPgxConfig set beyond the connection string
+	config.ConnConfig = pgxConfig.Copy()
 
 	// Apply pool-specific configurations
 	config.MaxConns = dbConfig.MaxConns
@@ -135,11 +491,33 @@ func NewPg(ctx context.Context, dbConfig *DBConfig, pgxConfig *pgx.ConnConfig) (
 	config.MaxConnIdleTime = dbConfig.MaxConnIdleTime
 	config.HealthCheckPeriod = dbConfig.HealthCheckPeriod
 
-	// Initialize the pool with singleton pattern
-	var db *pgxpool.Pool
-	pgOnce.Do(func() {
-		db, err = pgxpool.NewWithConfig(ctx, config)
-	})
+	// Options implied by the config run before the caller's
+	builtin, err := dbConfig.poolOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(builtin, opts...)
+
+	// Apply optional hooks
+	settings := &poolSettings{config: config}
+	for _, opt := range opts {
+		opt(settings)
+	}
+
+	// Initialize the pool; each call creates its own, e.g. for a second database
+	db, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		slog.Error("Unable to create connection pool", slog.String("error", err.Error()))
+		return nil, err
+	}
+	for _, fn := range settings.created {
+		fn(db)
+	}
+
+	if dbConfig.LazyConnect {
+		slog.Info("Created connection pool without connecting")
+		return db, nil
+	}
 
 	// Verify the connection
 	if err = db.Ping(ctx); err != nil {
@@ -172,11 +550,17 @@ func NewBasicPg(ctx context.Context, dbConfig *DBConfig) (*pgxpool.Pool, error)
 	return pool, nil
 }
 
+// User is a row of the example users table
+type User struct {
+	ID   int    `db:"id,pk" table:"users"`
+	Name string `db:"name"`
+}
+
 func (app *App) DoExplicitConnectionOperations(ctx context.Context) error {
 	// Acquire connection explicitly
-	conn, err := app.DBClient.Acquire(ctx)
+	conn, err := app.primary().Acquire(ctx)
 	if err != nil {
-		return fmt.Errorf("error acquiring connection: %v", err)
+		return fmt.Errorf("error acquiring connection: %w", pgerrors.Classify(err))
 	}
 	defer conn.Release()
 
@@ -185,34 +569,24 @@ func (app *App) DoExplicitConnectionOperations(ctx context.Context) error {
 	err = conn.QueryRow(ctx,
 		"SELECT COUNT(*) FROM users").Scan(&userCount)
 	if err != nil {
-		return fmt.Errorf("error counting users: %v", err)
+		return fmt.Errorf("error counting users: %w", pgerrors.Classify(err))
 	}
 	slog.Info("User count", slog.Int("count", userCount))
 
-	type User struct {
-		Id   int
-		Name string
-	}
-	// Multiple rows query
-	rows, err := conn.Query(ctx,
-		"SELECT id, name FROM users")
-	if err != nil {
-		return fmt.Errorf("error querying users: %v", err)
-	}
-	users, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByNameLax[User])
+	// Multiple rows through a repository
+	users, err := NewRepository[User](conn).List(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading rows: %v", err)
+		return fmt.Errorf("error querying users: %w", pgerrors.Classify(err))
 	}
 	for _, user := range users {
-		slog.Info("User retrieved", slog.Int("id", user.Id), slog.String("name", user.Name))
+		slog.Info("User retrieved", slog.Int("id", user.ID), slog.String("name", user.Name))
 	}
-	defer rows.Close()
 
 	// Exec for insert/update/delete
 	result, err := conn.Exec(ctx,
 		"UPDATE users SET last_login = NOW() WHERE id = @id", pgx.NamedArgs{"id": 1})
 	if err != nil {
-		return fmt.Errorf("error updating user: %v", err)
+		return fmt.Errorf("error updating user: %w", pgerrors.Classify(err))
 	}
 	slog.Info("Rows affected", slog.Int64("rows_affected", result.RowsAffected()))
 
@@ -222,18 +596,18 @@ func (app *App) DoExplicitConnectionOperations(ctx context.Context) error {
 func (app *App) DoDirectPoolOperations(ctx context.Context) error {
 	// Simple query directly using pool
 	var userCount int
-	err := app.DBClient.QueryRow(ctx,
+	err := app.primary().QueryRow(ctx,
 		"SELECT COUNT(*) FROM users").Scan(&userCount)
 	if err != nil {
-		return fmt.Errorf("error executing query: %v", err)
+		return fmt.Errorf("error executing query: %w", pgerrors.Classify(err))
 	}
 	slog.Info("User count", slog.Int("count", userCount))
 
 	// Multiple rows query
-	rows, err := app.DBClient.Query(ctx,
+	rows, err := app.primary().Query(ctx,
 		"SELECT id, name FROM users")
 	if err != nil {
-		return fmt.Errorf("error querying users: %v", err)
+		return fmt.Errorf("error querying users: %w", pgerrors.Classify(err))
 	}
 	for rows.Next() {
 		var (
@@ -242,17 +616,17 @@ func (app *App) DoDirectPoolOperations(ctx context.Context) error {
 		)
 		err = rows.Scan(&id, &name)
 		if err != nil {
-			return fmt.Errorf("error reading user: %v", err)
+			return fmt.Errorf("error reading user: %w", pgerrors.Classify(err))
 		}
 		slog.Info("User retrieved", slog.Int("id", id), slog.String("name", name))
 	}
 	defer rows.Close()
 
 	// Exec for insert/update/delete
-	result, err := app.DBClient.Exec(ctx,
+	result, err := app.primary().Exec(ctx,
 		"UPDATE users SET last_login = NOW() WHERE id = @id", pgx.NamedArgs{"id": 1})
 	if err != nil {
-		return fmt.Errorf("error updating user: %v", err)
+		return fmt.Errorf("error updating user: %w", pgerrors.Classify(err))
 	}
 	slog.Info("Rows affected", slog.Int64("rows_affected", result.RowsAffected()))
 
@@ -260,12 +634,33 @@ func (app *App) DoDirectPoolOperations(ctx context.Context) error {
 }
 
 func (app *App) monitorPoolStats() {
-	stats := app.DBClient.Stat()
+	stats := app.PoolStats()
 
 	slog.Info("Pool stats",
-		slog.Int("total_connections", int(stats.TotalConns())),
-		slog.Int("acquired_connections", int(stats.AcquiredConns())),
-		slog.Int("idle_connections", int(stats.IdleConns())),
-		slog.Int("max_connections", int(stats.MaxConns())),
+		slog.Int("total_connections", int(stats.TotalConns)),
+		slog.Int("acquired_connections", int(stats.AcquiredConns)),
+		slog.Int("idle_connections", int(stats.IdleConns)),
+		slog.Int("max_connections", int(stats.MaxConns)),
+		slog.Int64("acquire_rejected", stats.AcquireRejected),
+		slog.Int64("reset_failed", stats.ResetFailed),
+		slog.Int64("rotation_recycled", stats.RotationRecycled),
+		slog.Int64("throttled", stats.Throttled),
+		slog.Int64("ttl_expired", stats.Expired),
 	)
+
+	if app.Statements == nil {
+		return
+	}
+	// Statements taking the most total time
+	top := app.Statements.Snapshot()
+	for _, st := range top[:min(3, len(top))] {
+		slog.Info("Statement stats",
+			slog.String("sql", summarizeSQL(st.SQL, 80)),
+			slog.Int64("count", st.Count),
+			slog.Int64("errors", st.Errors),
+			slog.Duration("p50", st.P50),
+			slog.Duration("p95", st.P95),
+			slog.Duration("p99", st.P99),
+		)
+	}
 }
@@ -0,0 +1,116 @@
+package main
+
+import "sync/atomic"
+
+// PoolMetrics counts connection lifecycle events that pgxpool.Stat does not
+// track. A nil *PoolMetrics is valid and records nothing.
+type PoolMetrics struct {
+	acquireChecked  atomic.Int64
+	acquireRejected atomic.Int64
+	resets          atomic.Int64
+	resetFailed     atomic.Int64
+
+	rotationRecycled atomic.Int64
+
+	throttled atomic.Int64
+
+	expired atomic.Int64
+}
+
+// AcquireChecked returns how many connections were run through BeforeAcquire validation
+func (m *PoolMetrics) AcquireChecked() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.acquireChecked.Load()
+}
+
+// AcquireRejected returns how many connections failed BeforeAcquire validation and were destroyed
+func (m *PoolMetrics) AcquireRejected() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.acquireRejected.Load()
+}
+
+// Resets returns how many released connections had their session state reset
+func (m *PoolMetrics) Resets() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.resets.Load()
+}
+
+// ResetFailed returns how many released connections were destroyed because the session reset failed
+func (m *PoolMetrics) ResetFailed() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.resetFailed.Load()
+}
+
+// RotationRecycled returns how many connections were replaced after a credential rotation
+func (m *PoolMetrics) RotationRecycled() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.rotationRecycled.Load()
+}
+
+// Throttled returns how many statements the RateLimiter delayed or rejected
+func (m *PoolMetrics) Throttled() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.throttled.Load()
+}
+
+// Expired returns how many expired rows TTLTable sweeps deleted
+func (m *PoolMetrics) Expired() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.expired.Load()
+}
+
+func (m *PoolMetrics) addAcquireChecked() {
+	if m != nil {
+		m.acquireChecked.Add(1)
+	}
+}
+
+func (m *PoolMetrics) addAcquireRejected() {
+	if m != nil {
+		m.acquireRejected.Add(1)
+	}
+}
+
+func (m *PoolMetrics) addReset() {
+	if m != nil {
+		m.resets.Add(1)
+	}
+}
+
+func (m *PoolMetrics) addResetFailed() {
+	if m != nil {
+		m.resetFailed.Add(1)
+	}
+}
+
+func (m *PoolMetrics) addRotationRecycled() {
+	if m != nil {
+		m.rotationRecycled.Add(1)
+	}
+}
+
+func (m *PoolMetrics) addThrottled() {
+	if m != nil {
+		m.throttled.Add(1)
+	}
+}
+
+func (m *PoolMetrics) addExpired(n int64) {
+	if m != nil {
+		m.expired.Add(n)
+	}
+}
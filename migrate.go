@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultMigrationLockKey is the advisory lock every instance takes before
+// migrating, so concurrent deploys apply migrations one at a time
+const DefaultMigrationLockKey int64 = 0x70677870_6d696772 // "pgxpmigr"
+
+// ErrMigrationLockTimeout is returned when another instance holds the
+// migration lock for longer than the configured wait
+var ErrMigrationLockTimeout = errors.New("timed out waiting for migration lock")
+
+// MigrationFunc is a migration written in Go, for changes that need
+// application logic. It runs inside the migration transaction.
+type MigrationFunc func(ctx context.Context, tx pgx.Tx) error
+
+// Migration is one versioned schema change, either SQL files or Go functions
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+
+	UpFunc   MigrationFunc
+	DownFunc MigrationFunc
+
+	// Irreversible is set by a "-- migrate:irreversible" line in the up
+	// file, or by registering a Go migration without a down function,
+	// declaring that the migration intentionally has no down
+	Irreversible bool
+}
+
+// Migrator applies versioned SQL migrations named like
+// 0001_create_users.up.sql (with an optional matching .down.sql)
+type Migrator struct {
+	DB          *pgxpool.Pool
+	FS          fs.FS
+	Dir         string        // Directory within FS, default "."
+	Table       string        // Version table, default schema_migrations
+	Schema      string        // Schema the migrations run in and the version table lives in; empty uses search_path
+	LockKey     int64         // Advisory lock key, default DefaultMigrationLockKey
+	LockTimeout time.Duration // How long to wait for another instance, default 5 minutes
+	Clock       Clock         // Default SystemClock
+
+	DDLLockTimeout time.Duration // lock_timeout set inside each migration transaction, default 10s; zero leaves it unset
+	DryRun         bool          // Print the plan to Output instead of applying it
+	Output         io.Writer     // Destination for dry-run output, default os.Stdout
+
+	VerifyReversible bool           // Refuse to run Up unless Verify passes
+	ChecksumPolicy   ChecksumPolicy // What Up does when an applied migration's file changed, default ChecksumFail
+
+	registered []Migration
+}
+
+// NewMigrator creates a Migrator reading migrations from the root of fsys
+func NewMigrator(db *pgxpool.Pool, fsys fs.FS) *Migrator {
+	return &Migrator{
+		DB:          db,
+		FS:          fsys,
+		Dir:         ".",
+		Table:       "schema_migrations",
+		LockKey:     DefaultMigrationLockKey,
+		LockTimeout: 5 * time.Minute,
+
+		DDLLockTimeout: 10 * time.Second,
+	}
+}
+
+var (
+	migrationFileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+	irreversibleRe  = regexp.MustCompile(`(?im)^\s*--\s*migrate:irreversible\s*$`)
+)
+
+// Register adds a Go migration to the version sequence alongside the SQL
+// files. A nil down marks the migration irreversible.
+func (m *Migrator) Register(version int64, name string, up, down MigrationFunc) {
+	m.registered = append(m.registered, Migration{
+		Version:      version,
+		Name:         name,
+		UpFunc:       up,
+		DownFunc:     down,
+		Irreversible: down == nil,
+	})
+}
+
+// Migrations returns the migrations found in the directory together with
+// the registered Go migrations, ordered by version
+func (m *Migrator) Migrations() ([]Migration, error) {
+	var entries []fs.DirEntry
+	if m.FS != nil {
+		var err error
+		if entries, err = fs.ReadDir(m.FS, m.Dir); err != nil {
+			return nil, fmt.Errorf("error reading migrations: %w", err)
+		}
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		match := migrationFileRe.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", e.Name(), err)
+		}
+		body, err := fs.ReadFile(m.FS, path.Join(m.Dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", e.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		} else if mig.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d used by both %q and %q", version, mig.Name, match[2])
+		}
+		if match[3] == "up" {
+			mig.UpSQL = string(body)
+			mig.Irreversible = irreversibleRe.Match(body)
+		} else {
+			mig.DownSQL = string(body)
+		}
+	}
+
+	for _, reg := range m.registered {
+		if mig, ok := byVersion[reg.Version]; ok {
+			return nil, fmt.Errorf("migration version %d used by both %q and Go migration %q", reg.Version, mig.Name, reg.Name)
+		}
+		if reg.UpFunc == nil {
+			return nil, fmt.Errorf("go migration %d_%s has no up function", reg.Version, reg.Name)
+		}
+		byVersion[reg.Version] = &reg
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.UpSQL == "" && mig.UpFunc == nil {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies all pending migrations, each in its own transaction, while
+// holding the migration advisory lock. Applied migrations are first checked
+// against their recorded checksums. In DryRun mode it prints the plan
+// instead.
+func (m *Migrator) Up(ctx context.Context) error {
+	if m.VerifyReversible {
+		if err := m.Verify(); err != nil {
+			return err
+		}
+	}
+
+	if m.DryRun {
+		plan, err := m.Plan(ctx)
+		if err != nil {
+			return err
+		}
+		return m.printPlan(plan)
+	}
+
+	migrations, err := m.Migrations()
+	if err != nil {
+		return err
+	}
+
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		if err := m.verifyChecksums(ctx, conn, migrations, true); err != nil {
+			return err
+		}
+		applied, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			if applied[mig.Version] {
+				continue
+			}
+			if err := m.apply(ctx, conn, m.step(mig), "Applied migration"); err != nil {
+				return fmt.Errorf("error applying migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// withLock runs fn on a pinned connection holding the migration lock, with
+// the version table in place
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.DB.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring connection: %w", err)
+	}
+	defer conn.Release()
+
+	unlock, err := m.lock(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := m.ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// apply runs one step's statements in a single transaction
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, step MigrationStep, msg string) error {
+	clock := clockOr(m.Clock)
+	start := clock.Now()
+	for _, w := range step.Warnings {
+		slog.Warn("Migration takes heavy locks", slog.Int64("version", step.Version), slog.String("warning", w))
+	}
+
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for _, stmt := range step.Statements {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		if step.Func != nil {
+			if err := step.Func(ctx, tx); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, step.Record)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info(msg,
+		slog.Int64("version", step.Version),
+		slog.String("name", step.Name),
+		slog.Duration("duration", clock.Now().Sub(start)))
+	return nil
+}
+
+func (m *Migrator) printPlan(plan *MigrationPlan) error {
+	out := m.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	_, err := plan.WriteTo(out)
+	return err
+}
+
+// lock takes the session-level migration lock on conn, waiting up to
+// LockTimeout while another instance holds it
+func (m *Migrator) lock(ctx context.Context, conn *pgxpool.Conn) (func(), error) {
+	clock := clockOr(m.Clock)
+	deadline := clock.Now().Add(m.LockTimeout)
+	lastLog := time.Time{}
+
+	for {
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", m.LockKey).Scan(&locked); err != nil {
+			return nil, fmt.Errorf("error taking migration lock: %w", err)
+		}
+		if locked {
+			if !lastLog.IsZero() {
+				slog.Info("Acquired migration lock")
+			}
+			return func() {
+				_, err := conn.Exec(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", m.LockKey)
+				if err != nil {
+					slog.Error("Error releasing migration lock", slog.String("error", err.Error()))
+				}
+			}, nil
+		}
+
+		now := clock.Now()
+		if now.After(deadline) {
+			return nil, fmt.Errorf("%w after %s", ErrMigrationLockTimeout, m.LockTimeout)
+		}
+		if now.Sub(lastLog) >= 10*time.Second {
+			lastLog = now
+			attrs := []any{slog.Duration("timeout", m.LockTimeout)}
+			if pid, app, err := m.lockHolder(ctx, conn); err == nil {
+				attrs = append(attrs, slog.Int("holder_pid", pid), slog.String("holder_application", app))
+			}
+			slog.Warn("Another instance is migrating, waiting for migration lock", attrs...)
+		}
+		if err := clock.Sleep(ctx, 500*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lockHolder looks up the backend holding the migration lock. Bigint
+// advisory keys are stored as classid (high half) and objid (low half).
+func (m *Migrator) lockHolder(ctx context.Context, conn *pgxpool.Conn) (int, string, error) {
+	var (
+		pid int
+		app string
+	)
+	err := conn.QueryRow(ctx, `
+		SELECT l.pid, COALESCE(a.application_name, '')
+		FROM pg_locks l LEFT JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+		  AND l.classid = ($1::bigint >> 32)::oid AND l.objid = ($1::bigint & 4294967295)::oid
+		LIMIT 1`, m.LockKey).Scan(&pid, &app)
+	return pid, app, err
+}
+
+// table returns the version table, qualified with Schema when one is set
+func (m *Migrator) table() string {
+	if m.Schema == "" || strings.Contains(m.Table, ".") {
+		return m.Table
+	}
+	return pgx.Identifier{m.Schema}.Sanitize() + "." + m.Table
+}
+
+// searchPath returns the statement scoping a migration transaction to
+// Schema, or "" when no schema is set
+func (m *Migrator) searchPath() string {
+	if m.Schema == "" {
+		return ""
+	}
+	return "SET LOCAL search_path TO " + pgx.Identifier{m.Schema}.Sanitize()
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *pgxpool.Conn) error {
+	if m.Schema != "" {
+		if _, err := conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{m.Schema}.Sanitize()); err != nil {
+			return fmt.Errorf("error creating schema %s: %w", m.Schema, err)
+		}
+	}
+	_, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+m.table()+` (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now(),
+		checksum text
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", m.table(), err)
+	}
+	// Tables created before checksums were recorded
+	_, err = conn.Exec(ctx, "ALTER TABLE "+m.table()+" ADD COLUMN IF NOT EXISTS checksum text")
+	if err != nil {
+		return fmt.Errorf("error upgrading %s: %w", m.table(), err)
+	}
+	return nil
+}
+
+func (m *Migrator) appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int64]bool, error) {
+	rows, err := conn.Query(ctx, "SELECT version FROM "+m.table())
+	if err != nil {
+		return nil, fmt.Errorf("error reading applied migrations: %w", err)
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("error reading applied migrations: %w", err)
+	}
+
+	applied := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrChecksumMismatch is returned when an applied migration's file no longer
+// matches the checksum recorded when it ran
+var ErrChecksumMismatch = errors.New("applied migration has been modified")
+
+// ChecksumPolicy decides what happens when an applied migration changed
+type ChecksumPolicy int
+
+const (
+	ChecksumFail ChecksumPolicy = iota // Refuse to migrate (default)
+	ChecksumWarn                       // Log a warning and continue
+)
+
+// Checksum returns the sha256 of the up file. Line endings are normalized so
+// a checkout with CRLF endings matches one with LF. Go migrations have no
+// file, so only their name is covered.
+func (mig Migration) Checksum() string {
+	body := mig.UpSQL
+	if mig.UpFunc != nil {
+		body = "go:" + mig.Name
+	}
+	sum := sha256.Sum256([]byte(strings.ReplaceAll(body, "\r\n", "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// appliedMigration is a row of the version table
+type appliedMigration struct {
+	Name      string
+	Checksum  string // Empty for rows recorded before checksums existed
+	AppliedAt time.Time
+}
+
+// appliedMigrations reads the version table. The checksum is read through
+// to_jsonb so tables that have not been upgraded yet can still be read.
+func (m *Migrator) appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int64]appliedMigration, error) {
+	rows, err := conn.Query(ctx, "SELECT version, name, COALESCE(to_jsonb(t)->>'checksum', ''), applied_at FROM "+m.table()+" t")
+	if err != nil {
+		return nil, fmt.Errorf("error reading migration checksums: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]appliedMigration)
+	for rows.Next() {
+		var (
+			version int64
+			row     appliedMigration
+		)
+		if err := rows.Scan(&version, &row.Name, &row.Checksum, &row.AppliedAt); err != nil {
+			return nil, fmt.Errorf("error reading migration checksums: %w", err)
+		}
+		applied[version] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading migration checksums: %w", err)
+	}
+	return applied, nil
+}
+
+// modified reports whether mig no longer matches the checksum recorded when
+// it was applied. A baseline written by Squash replaces the migration it was
+// numbered after, so it is not compared against that migration's checksum.
+func (row appliedMigration) modified(mig Migration) bool {
+	if row.Checksum == "" || (mig.Name == "baseline" && row.Name != "baseline") {
+		return false
+	}
+	return row.Checksum != mig.Checksum()
+}
+
+// verifyChecksums compares applied migrations against their files. Rows
+// recorded before checksums existed adopt the current file's checksum when
+// record is set.
+func (m *Migrator) verifyChecksums(ctx context.Context, conn *pgxpool.Conn, migrations []Migration, record bool) error {
+	applied, err := m.appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, mig := range migrations {
+		row, ok := applied[mig.Version]
+		switch {
+		case !ok:
+			continue
+		case row.Checksum == "":
+			if !record {
+				continue
+			}
+			_, err := conn.Exec(ctx, "UPDATE "+m.table()+" SET checksum = $1 WHERE version = $2", mig.Checksum(), mig.Version)
+			if err != nil {
+				return fmt.Errorf("error recording checksum for migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			slog.Info("Recorded checksum for previously applied migration", slog.Int64("version", mig.Version), slog.String("name", mig.Name))
+		case row.modified(mig):
+			if m.ChecksumPolicy == ChecksumWarn {
+				slog.Warn("Applied migration has been modified",
+					slog.Int64("version", mig.Version),
+					slog.String("name", mig.Name),
+					slog.String("recorded", row.Checksum),
+					slog.String("current", mig.Checksum()))
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, mig.Version, mig.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrIrreversibleMigration is returned when Down reaches a migration marked
+// -- migrate:irreversible
+var ErrIrreversibleMigration = errors.New("migration is irreversible")
+
+// Verify checks that every migration can be rolled back: it must have a
+// down file or be explicitly marked irreversible, but not both
+func (m *Migrator) Verify() error {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, mig := range migrations {
+		switch {
+		case mig.UpFunc != nil:
+			// Go migrations are irreversible exactly when registered without a down
+		case mig.DownSQL == "" && !mig.Irreversible:
+			errs = append(errs, fmt.Errorf("migration %d_%s has no down file; add one or mark it -- migrate:irreversible", mig.Version, mig.Name))
+		case mig.DownSQL != "" && mig.Irreversible:
+			errs = append(errs, fmt.Errorf("migration %d_%s is marked irreversible but has a down file", mig.Version, mig.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// downStep builds the statements that roll back one migration
+func (m *Migrator) downStep(mig Migration) MigrationStep {
+	stmts := m.setupStatements()
+	if mig.DownFunc == nil {
+		stmts = append(stmts, strings.TrimSpace(mig.DownSQL))
+	}
+
+	return MigrationStep{
+		Migration:  mig,
+		Statements: stmts,
+		Func:       mig.DownFunc,
+		Record:     fmt.Sprintf("DELETE FROM %s WHERE version = %d", m.table(), mig.Version),
+		Warnings:   lockWarnings(mig.DownSQL),
+	}
+}
+
+// downSteps returns the rollback steps for the latest n applied migrations,
+// refusing irreversible ones or ones without a down file
+func (m *Migrator) downSteps(applied map[int64]bool, n int) ([]MigrationStep, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]Migration, len(migrations))
+	for _, mig := range migrations {
+		byVersion[mig.Version] = mig
+	}
+
+	versions := make([]int64, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+	var steps []MigrationStep
+	for _, v := range versions[:min(n, len(versions))] {
+		mig, ok := byVersion[v]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("applied migration %d has no file", v)
+		case mig.Irreversible:
+			return nil, fmt.Errorf("cannot roll back %d_%s: %w", mig.Version, mig.Name, ErrIrreversibleMigration)
+		case mig.DownSQL == "" && mig.DownFunc == nil:
+			return nil, fmt.Errorf("cannot roll back %d_%s: no down file", mig.Version, mig.Name)
+		}
+		steps = append(steps, m.downStep(mig))
+	}
+	return steps, nil
+}
+
+// Down rolls back the latest n applied migrations, newest first. Every step
+// is checked before anything runs, so an irreversible migration stops the
+// rollback up front. In DryRun mode the plan is printed instead.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	if m.DryRun {
+		applied, err := m.readApplied(ctx, nil)
+		if err != nil {
+			return err
+		}
+		steps, err := m.downSteps(applied, n)
+		if err != nil {
+			return err
+		}
+		return m.printPlan(&MigrationPlan{Table: m.table(), Steps: steps})
+	}
+
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		steps, err := m.downSteps(applied, n)
+		if err != nil {
+			return err
+		}
+
+		for _, step := range steps {
+			if err := m.apply(ctx, conn, step, "Rolled back migration"); err != nil {
+				return fmt.Errorf("error rolling back migration %d_%s: %w", step.Version, step.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+var (
+	dumpSessionSetRe = regexp.MustCompile(`(?m)^SET (\w+) = `)
+	dumpSearchPathRe = regexp.MustCompile(`set_config\('search_path', '', false\)`)
+	dumpMetaLineRe   = regexp.MustCompile(`(?m)^\\.*$`)
+	// seedTableRe finds the tables a SQL migration writes rows into
+	seedTableRe = regexp.MustCompile(`(?i)\b(?:INSERT\s+INTO|COPY)\s+(` + identPattern + `(?:\.` + identPattern + `)?)`)
+)
+
+// Squash writes a baseline migration into dir containing the current schema
+// (via pg_dump --schema-only) at the latest applied version. Fresh installs
+// then apply the baseline instead of replaying history; databases that
+// already recorded that version skip it. It returns the baseline path and
+// the squashed migration versions, whose files should be removed.
+//
+// Rows the squashed migrations seeded are kept: the current contents of
+// every table their SQL inserts or copies into are dumped into the
+// baseline too. Squash refuses when a Go migration was applied, since what
+// data it wrote cannot be told from outside.
+func (m *Migrator) Squash(ctx context.Context, dir string) (string, []int64, error) {
+	var (
+		baseline string
+		squashed []int64
+	)
+
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return errors.New("no applied migrations to squash")
+		}
+		for v := range applied {
+			squashed = append(squashed, v)
+		}
+		sort.Slice(squashed, func(i, j int) bool { return squashed[i] < squashed[j] })
+		latest := squashed[len(squashed)-1]
+
+		seeded, err := m.seedTables(ctx, conn, applied)
+		if err != nil {
+			return err
+		}
+		schema, err := m.dump(ctx, "--schema-only")
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if len(seeded) > 0 {
+			args := []string{"--data-only", "--column-inserts"}
+			for _, t := range seeded {
+				args = append(args, "--table="+t)
+			}
+			if data, err = m.dump(ctx, args...); err != nil {
+				return err
+			}
+		}
+
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "-- Baseline of migrations %d..%d squashed on %s\n", squashed[0], latest, clockOr(m.Clock).Now().UTC().Format(time.RFC3339))
+		b.WriteString("-- migrate:irreversible\n\n")
+		b.Write(schema)
+		if len(seeded) > 0 {
+			fmt.Fprintf(&b, "\n-- Rows seeded by the squashed migrations: %s\n", strings.Join(seeded, ", "))
+			b.Write(data)
+		}
+		// pg_dump empties search_path; restore it for the version insert
+		b.WriteString("\nSET LOCAL search_path TO DEFAULT;\n")
+
+		baseline = filepath.Join(dir, fmt.Sprintf("%04d_baseline.up.sql", latest))
+		return os.WriteFile(baseline, b.Bytes(), 0o644)
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("error squashing migrations: %w", err)
+	}
+
+	slog.Info("Squashed migrations into baseline",
+		slog.String("file", baseline),
+		slog.Int("migrations", len(squashed)))
+	return baseline, squashed, nil
+}
+
+// seedTables returns the existing tables the applied SQL migrations write
+// rows into, qualified with Schema when they are not already
+func (m *Migrator) seedTables(ctx context.Context, conn *pgxpool.Conn, applied map[int64]bool) ([]string, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, mig := range migrations {
+		if !applied[mig.Version] {
+			continue
+		}
+		if mig.UpFunc != nil {
+			return nil, fmt.Errorf("cannot squash Go migration %d_%s: the data it wrote would be lost", mig.Version, mig.Name)
+		}
+		for _, match := range seedTableRe.FindAllStringSubmatch(mig.UpSQL, -1) {
+			table := match[1]
+			if m.Schema != "" && !strings.Contains(table, ".") {
+				table = pgx.Identifier{m.Schema}.Sanitize() + "." + table
+			}
+			if !slices.Contains(tables, table) {
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	// Skip tables a later migration dropped, which pg_dump would reject
+	var existing []string
+	for _, table := range tables {
+		var found bool
+		if err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&found); err != nil {
+			return nil, fmt.Errorf("error looking up %s: %w", table, err)
+		}
+		if found {
+			existing = append(existing, table)
+		}
+	}
+	return existing, nil
+}
+
+// dump runs pg_dump with args against the pool's database and rewrites the
+// output so it can run inside a migration transaction without leaking
+// session settings
+func (m *Migrator) dump(ctx context.Context, args ...string) ([]byte, error) {
+	env, err := m.dumpEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "--no-owner", "--no-privileges", "--exclude-table="+m.table())
+	if m.Schema != "" {
+		args = append(args, "--schema="+pgx.Identifier{m.Schema}.Sanitize())
+	}
+	cmd := exec.CommandContext(ctx, "pg_dump", args...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pg_dump failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	out = dumpMetaLineRe.ReplaceAll(out, nil)
+	out = dumpSessionSetRe.ReplaceAll(out, []byte("SET LOCAL $1 = "))
+	out = dumpSearchPathRe.ReplaceAll(out, []byte("set_config('search_path', '', true)"))
+	return out, nil
+}
+
+// dumpEnvVars maps the libpq settings pg_dump needs to reach the database
+// like the pool does onto their environment variables. pgx-only settings
+// are left out, since libpq rejects them.
+var dumpEnvVars = map[string]string{
+	"sslmode":              "PGSSLMODE",
+	"sslrootcert":          "PGSSLROOTCERT",
+	"sslcert":              "PGSSLCERT",
+	"sslkey":               "PGSSLKEY",
+	"sslsni":               "PGSSLSNI",
+	"sslcrl":               "PGSSLCRL",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"options":              "PGOPTIONS",
+	"application_name":     "PGAPPNAME",
+}
+
+// dumpEnv returns the libpq environment for pg_dump: the hosts, user and
+// password the pool's BeforeConnect hook resolves, so rotated secrets and
+// IAM tokens are used, plus the TLS and session settings of its
+// connection string
+func (m *Migrator) dumpEnv(ctx context.Context) ([]string, error) {
+	pc := m.DB.Config()
+	cc := pc.ConnConfig.Copy()
+	if pc.BeforeConnect != nil {
+		if err := pc.BeforeConnect(ctx, cc); err != nil {
+			return nil, fmt.Errorf("error resolving credentials for pg_dump: %w", err)
+		}
+	}
+	params, err := dsnParams(cc.ConnString())
+	if err != nil {
+		return nil, err
+	}
+
+	// Fallbacks repeat a host for each TLS mode tried, so list each once
+	var hosts, ports []string
+	seen := make(map[string]bool)
+	for _, fb := range append([]*pgconn.FallbackConfig{{Host: cc.Host, Port: cc.Port}}, cc.Fallbacks...) {
+		port := strconv.Itoa(int(fb.Port))
+		if addr := net.JoinHostPort(fb.Host, port); !seen[addr] {
+			seen[addr] = true
+			hosts, ports = append(hosts, fb.Host), append(ports, port)
+		}
+	}
+	env := []string{
+		"PGHOST=" + strings.Join(hosts, ","),
+		"PGPORT=" + strings.Join(ports, ","),
+		"PGUSER=" + cc.User,
+		"PGPASSWORD=" + cc.Password,
+		"PGDATABASE=" + cc.Database,
+	}
+	for key, name := range dumpEnvVars {
+		if v, ok := params[key]; ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env, nil
+}
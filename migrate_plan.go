@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MigrationStep is a pending migration with the exact statements Up runs
+// inside its transaction: Statements, then Func for Go migrations, then
+// Record to update the version table
+type MigrationStep struct {
+	Migration
+	Statements []string
+	Func       MigrationFunc
+	Record     string
+	Warnings   []string
+}
+
+// MigrationPlan lists the steps Up would take
+type MigrationPlan struct {
+	Table string
+	Steps []MigrationStep
+}
+
+// step builds the statements for one migration. Up executes exactly these
+// statements, so the dry-run output matches what is applied.
+func (m *Migrator) step(mig Migration) MigrationStep {
+	stmts := m.setupStatements()
+	if mig.UpFunc == nil {
+		stmts = append(stmts, strings.TrimSpace(mig.UpSQL))
+	}
+
+	return MigrationStep{
+		Migration:  mig,
+		Statements: stmts,
+		Func:       mig.UpFunc,
+		Record:     fmt.Sprintf("INSERT INTO %s (version, name, checksum) VALUES (%d, %s, %s)", m.table(), mig.Version, quoteLiteral(mig.Name), quoteLiteral(mig.Checksum())),
+		Warnings:   lockWarnings(mig.UpSQL),
+	}
+}
+
+// setupStatements scope each migration transaction's search path and lock
+// timeout
+func (m *Migrator) setupStatements() []string {
+	var stmts []string
+	if sp := m.searchPath(); sp != "" {
+		stmts = append(stmts, sp)
+	}
+	if m.DDLLockTimeout > 0 {
+		stmts = append(stmts, fmt.Sprintf("SET LOCAL lock_timeout = '%dms'", m.DDLLockTimeout.Milliseconds()))
+	}
+	return stmts
+}
+
+// Plan returns the pending migrations without applying anything or taking
+// the migration lock. Applied migrations whose files changed are reported
+// according to ChecksumPolicy.
+func (m *Migrator) Plan(ctx context.Context) (*MigrationPlan, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.readApplied(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &MigrationPlan{Table: m.table()}
+	for _, mig := range migrations {
+		if !applied[mig.Version] {
+			plan.Steps = append(plan.Steps, m.step(mig))
+		}
+	}
+	return plan, nil
+}
+
+// readApplied returns the applied versions without taking the migration
+// lock or creating the version table. Checksums of the given migrations are
+// verified against what the table records.
+func (m *Migrator) readApplied(ctx context.Context, verify []Migration) (map[int64]bool, error) {
+	conn, ok, err := m.readConn(ctx)
+	if err != nil || !ok {
+		return map[int64]bool{}, err
+	}
+	defer conn.Release()
+
+	if len(verify) > 0 {
+		if err := m.verifyChecksums(ctx, conn, verify, false); err != nil {
+			return nil, err
+		}
+	}
+	return m.appliedVersions(ctx, conn)
+}
+
+// readConn acquires a connection for reading the version table, reporting
+// false when the table does not exist yet
+func (m *Migrator) readConn(ctx context.Context) (*pgxpool.Conn, bool, error) {
+	var exists bool
+	if err := m.DB.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", m.table()).Scan(&exists); err != nil {
+		return nil, false, fmt.Errorf("error checking %s: %w", m.table(), err)
+	}
+	if !exists {
+		return nil, false, nil
+	}
+
+	conn, err := m.DB.Acquire(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("error acquiring connection: %w", err)
+	}
+	return conn, true, nil
+}
+
+// WriteTo renders the plan as a runnable SQL script with warnings as comments
+func (p *MigrationPlan) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	if len(p.Steps) == 0 {
+		b.WriteString("-- No pending migrations\n")
+	}
+	for _, step := range p.Steps {
+		fmt.Fprintf(&b, "-- Migration %d_%s\n", step.Version, step.Name)
+		for _, warning := range step.Warnings {
+			fmt.Fprintf(&b, "-- WARNING: %s\n", warning)
+		}
+		b.WriteString("BEGIN;\n")
+		for _, stmt := range step.Statements {
+			b.WriteString(strings.TrimRight(stmt, "; \n"))
+			b.WriteString(";\n")
+		}
+		if step.Func != nil {
+			b.WriteString("-- Go migration function runs here\n")
+		}
+		b.WriteString(step.Record)
+		b.WriteString(";\nCOMMIT;\n\n")
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// lockRule flags a statement pattern known to hold heavy locks for a long time
+type lockRule struct {
+	match  *regexp.Regexp
+	unless *regexp.Regexp
+	reason string
+}
+
+var lockRules = []lockRule{
+	{
+		match:  regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bALTER\s+(COLUMN\s+)?\S+\s+SET\s+NOT\s+NULL`),
+		reason: "SET NOT NULL scans the whole table under an ACCESS EXCLUSIVE lock; add a NOT VALID CHECK (col IS NOT NULL) constraint and VALIDATE it first",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bALTER\s+(COLUMN\s+)?\S+\s+(SET\s+DATA\s+)?TYPE\b`),
+		reason: "changing a column type can rewrite the table under an ACCESS EXCLUSIVE lock",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bADD\s+(CONSTRAINT\s+\S+\s+)?(FOREIGN\s+KEY|CHECK)\b`),
+		unless: regexp.MustCompile(`(?i)\bNOT\s+VALID\b`),
+		reason: "adding a constraint validates every row while holding the lock; add it NOT VALID and run VALIDATE CONSTRAINT separately",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bADD\s+(CONSTRAINT\s+\S+\s+)?(PRIMARY\s+KEY|UNIQUE)\b`),
+		unless: regexp.MustCompile(`(?i)\bUSING\s+INDEX\b`),
+		reason: "adding a primary key or unique constraint builds its index under an ACCESS EXCLUSIVE lock; build the index CONCURRENTLY and attach it USING INDEX",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bADD\s+(COLUMN\s+)?\S+\s+[^,]*\b(BIGSERIAL|SERIAL|SMALLSERIAL|DEFAULT\s+(random|clock_timestamp|gen_random_uuid|nextval)\s*\()`),
+		reason: "adding a column with a volatile default rewrites the table under an ACCESS EXCLUSIVE lock",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^CREATE\s+(UNIQUE\s+)?INDEX\b`),
+		unless: regexp.MustCompile(`(?i)\bCONCURRENTLY\b`),
+		reason: "CREATE INDEX blocks writes for the whole build; use CreateIndexConcurrently outside the migration",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^(VACUUM\s+(\(.*\bFULL\b.*\)|FULL)|CLUSTER)\b`),
+		reason: "VACUUM FULL and CLUSTER rewrite the table under an ACCESS EXCLUSIVE lock",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^REINDEX\b`),
+		unless: regexp.MustCompile(`(?i)\bCONCURRENTLY\b`),
+		reason: "REINDEX without CONCURRENTLY blocks writes to the table",
+	},
+	{
+		match:  regexp.MustCompile(`(?is)^LOCK\s+(TABLE\s+)?\S+`),
+		reason: "explicit LOCK TABLE holds the lock until the migration commits",
+	},
+}
+
+var (
+	lineCommentRe  = regexp.MustCompile(`--[^\n]*`)
+	blockCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+)
+
+// lockWarnings checks each statement of a migration against lockRules.
+// Statements are split on semicolons, which is good enough for linting
+// even though it does not understand dollar-quoted bodies.
+func lockWarnings(sql string) []string {
+	sql = blockCommentRe.ReplaceAllString(lineCommentRe.ReplaceAllString(sql, ""), "")
+
+	var warnings []string
+	for _, stmt := range strings.Split(sql, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		for _, rule := range lockRules {
+			if rule.match.MatchString(stmt) && (rule.unless == nil || !rule.unless.MatchString(stmt)) {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", summarizeSQL(stmt, 80), rule.reason))
+			}
+		}
+	}
+	return warnings
+}
+
+// summarizeSQL collapses whitespace and truncates a statement for messages
+func summarizeSQL(sql string, max int) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	if len(sql) > max {
+		return sql[:max-3] + "..."
+	}
+	return sql
+}
+
+// quoteLiteral renders s as a SQL string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
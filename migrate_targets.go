@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// MigrationStatus describes one migration of a target
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool // Applied, but the file no longer matches the recorded checksum
+	Missing   bool // Applied, but there is no file for it any more
+}
+
+// Status lists every migration known from the files or the version table,
+// ordered by version
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int64]appliedMigration{}
+	conn, ok, err := m.readConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		defer conn.Release()
+		if applied, err = m.appliedMigrations(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, mig := range migrations {
+		st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if row, ok := applied[mig.Version]; ok {
+			st.Applied = true
+			st.AppliedAt = row.AppliedAt
+			st.Modified = row.modified(mig)
+			delete(applied, mig.Version)
+		}
+		statuses = append(statuses, st)
+	}
+	for version, row := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Version:   version,
+			Name:      row.Name,
+			Applied:   true,
+			AppliedAt: row.AppliedAt,
+			Missing:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// MigrationTarget is a named schema or database with its own migrations and
+// version table
+type MigrationTarget struct {
+	Name     string
+	Migrator *Migrator
+}
+
+// MigrationTargets migrates several targets independently, in order
+type MigrationTargets []MigrationTarget
+
+// TargetStatus is the migration status of one target. Err is set when the
+// target could not be read; other targets are still reported.
+type TargetStatus struct {
+	Target     string
+	Migrations []MigrationStatus
+	Err        error
+}
+
+// Lookup returns the target with the given name
+func (t MigrationTargets) Lookup(name string) (MigrationTarget, bool) {
+	for _, target := range t {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return MigrationTarget{}, false
+}
+
+// Up applies pending migrations to every target, stopping at the first
+// target that fails
+func (t MigrationTargets) Up(ctx context.Context) error {
+	for _, target := range t {
+		if err := target.Migrator.Up(ctx); err != nil {
+			return fmt.Errorf("error migrating %s: %w", target.Name, err)
+		}
+	}
+	return nil
+}
+
+// Status reads the status of every target
+func (t MigrationTargets) Status(ctx context.Context) []TargetStatus {
+	statuses := make([]TargetStatus, 0, len(t))
+	for _, target := range t {
+		migrations, err := target.Migrator.Status(ctx)
+		statuses = append(statuses, TargetStatus{Target: target.Name, Migrations: migrations, Err: err})
+	}
+	return statuses
+}
+
+// WriteMigrationStatus renders statuses as a table, one row per migration
+func WriteMigrationStatus(w io.Writer, statuses []TargetStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tVERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, ts := range statuses {
+		if ts.Err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\terror: %v\t-\n", ts.Target, ts.Err)
+			continue
+		}
+		if len(ts.Migrations) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\tno migrations\t-\n", ts.Target)
+		}
+		for _, st := range ts.Migrations {
+			state, appliedAt := "pending", "-"
+			if st.Applied {
+				state, appliedAt = "applied", st.AppliedAt.Format(time.RFC3339)
+			}
+			switch {
+			case st.Modified:
+				state += " (modified)"
+			case st.Missing:
+				state += " (no file)"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", ts.Target, st.Version, st.Name, state, appliedAt)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS users (
+    id         bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name       text NOT NULL,
+    last_login timestamptz
+);
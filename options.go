@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolOption customizes the pool built by NewPg
+type PoolOption func(*poolSettings)
+
+// poolSettings carries the pool config being built along with state shared
+// between options. Hooks read it when they run, so option order does not
+// matter.
+type poolSettings struct {
+	config    *pgxpool.Config
+	metrics   *PoolMetrics
+	pgbouncer bool                  // Set by WithPgBouncerMode; session-level features are skipped
+	created   []func(*pgxpool.Pool) // Run by NewPg with the new pool, for options that query it
+}
+
+// WithMetrics records connection hook outcomes for the pool into m
+func WithMetrics(m *PoolMetrics) PoolOption {
+	return func(s *poolSettings) {
+		s.metrics = m
+	}
+}
+
+// poolOptions returns the options implied by the config. Hooks installed
+// later run after earlier ones, so the IAM token overrides any password.
+func (c *DBConfig) poolOptions() ([]PoolOption, error) {
+	var opts []PoolOption
+
+	if c.PgBouncerMode {
+		opts = append(opts, WithPgBouncerMode())
+	}
+	if c.AcquirePing > 0 {
+		opts = append(opts, WithBeforeAcquire(PingWithin(c.AcquirePing)))
+	}
+	switch {
+	case c.SlowQueryThreshold > 0 && c.SlowQueryExplain:
+		opts = append(opts, WithSlowQueryPlans(c.SlowQueryThreshold))
+	case c.SlowQueryThreshold > 0:
+		opts = append(opts, WithTracer(&SlowQueryTracer{Threshold: c.SlowQueryThreshold}))
+	}
+
+	// Refresh credentials from the secret store for every new connection
+	provider, err := c.credentialProvider()
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		opts = append(opts, WithCredentialRefresh(provider, c.CredentialsTTL))
+	}
+
+	// Generate an IAM auth token per connection
+	switch c.AuthMode {
+	case "", AuthModePassword:
+	case AuthModeRDSIAM:
+		opts = append(opts, WithRDSIAMAuth(c.AWSRegion))
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", c.AuthMode)
+	}
+
+	return opts, nil
+}
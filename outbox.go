@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// OutboxEvent is a message waiting in the outbox
+type OutboxEvent struct {
+	ID        int64
+	Topic     string
+	Key       string // Partition or ordering key for the broker, may be empty
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	Attempts  int // Failed publishes so far
+}
+
+// Outbox implements the transactional outbox pattern: Enqueue writes an
+// event in the same transaction as the change it describes, so the two
+// commit or roll back together, and Run relays committed events to a
+// broker through Publish. Delivery is at least once: an event is deleted
+// only after Publish returns nil, and a crash in between publishes it
+// again, so consumers must tolerate duplicates.
+//
+// Relays claim batches with FOR UPDATE SKIP LOCKED, so several instances
+// can run Run without publishing the same event twice at once. Within an
+// instance events are published in the order they were enqueued, and a
+// failed publish stops the batch so later events do not overtake it. An
+// event that fails MaxAttempts times is moved to <Table>_dead instead, so
+// one event the broker keeps rejecting does not hold up the rest.
+type Outbox struct {
+	DB           *pgxpool.Pool
+	Table        string
+	Publish      func(ctx context.Context, ev OutboxEvent) error
+	BatchSize    int           // Events claimed per transaction, default 100
+	PollInterval time.Duration // Wait when the outbox is empty or publishing fails, default 1s
+	MaxAttempts  int           // Failed publishes before dead-lettering, default 5
+	Clock        Clock
+}
+
+// NewOutbox creates an outbox relaying to publish, creating its table and
+// its dead-letter table if needed
+func NewOutbox(ctx context.Context, db *pgxpool.Pool, table string, publish func(ctx context.Context, ev OutboxEvent) error) (*Outbox, error) {
+	o := &Outbox{DB: db, Table: table, Publish: publish, BatchSize: 100, PollInterval: time.Second, MaxAttempts: 5}
+	_, err := db.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(table)+` (
+		id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		topic text NOT NULL,
+		key text NOT NULL DEFAULT '',
+		payload jsonb NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		attempts int NOT NULL DEFAULT 0,
+		last_error text
+	);
+	CREATE TABLE IF NOT EXISTS `+sanitizeTable(table+"_dead")+` (
+		id bigint PRIMARY KEY,
+		topic text NOT NULL,
+		key text NOT NULL,
+		payload jsonb NOT NULL,
+		created_at timestamptz NOT NULL,
+		attempts int NOT NULL,
+		failed_at timestamptz NOT NULL DEFAULT now(),
+		last_error text
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", table, err)
+	}
+	return o, nil
+}
+
+// Enqueue adds an event in tx, the caller's transaction. payload is
+// marshalled to JSON unless it already is []byte or json.RawMessage.
+func (o *Outbox) Enqueue(ctx context.Context, tx DBTX, topic, key string, payload any) error {
+	data, err := jsonPayload(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding %s event: %w", topic, err)
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO `+sanitizeTable(o.Table)+` (topic, key, payload) VALUES ($1, $2, $3)`, topic, key, string(data))
+	if err != nil {
+		return fmt.Errorf("error enqueueing %s event: %w", topic, err)
+	}
+	return nil
+}
+
+// RelayOnce claims one batch, publishes it and deletes what was published,
+// returning how many events were published
+func (o *Outbox) RelayOnce(ctx context.Context) (int, error) {
+	batch := o.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	maxAttempts := o.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	published := 0
+	err := pgx.BeginFunc(ctx, o.DB, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT id, topic, key, payload, created_at, attempts FROM `+sanitizeTable(o.Table)+`
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, batch)
+		if err != nil {
+			return err
+		}
+		events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OutboxEvent, error) {
+			var ev OutboxEvent
+			err := row.Scan(&ev.ID, &ev.Topic, &ev.Key, &ev.Payload, &ev.CreatedAt, &ev.Attempts)
+			return ev, err
+		})
+		if err != nil {
+			return err
+		}
+
+		var done []int64
+		var pubErr error
+		for _, ev := range events {
+			if pubErr = o.Publish(ctx, ev); pubErr != nil {
+				if ev.Attempts+1 >= maxAttempts {
+					slog.Error("Moving outbox event to dead-letter table", slog.String("topic", ev.Topic), slog.Int64("id", ev.ID),
+						slog.Int("attempts", ev.Attempts+1), slog.String("error", pubErr.Error()))
+					if _, err := tx.Exec(ctx, `WITH dead AS (
+						DELETE FROM `+sanitizeTable(o.Table)+` WHERE id = $1 RETURNING id, topic, key, payload, created_at, attempts
+					)
+					INSERT INTO `+sanitizeTable(o.Table+"_dead")+` (id, topic, key, payload, created_at, attempts, last_error)
+					SELECT id, topic, key, payload, created_at, attempts + 1, $2 FROM dead`, ev.ID, pubErr.Error()); err != nil {
+						return err
+					}
+					pubErr = nil
+					continue
+				}
+				if _, err := tx.Exec(ctx, `UPDATE `+sanitizeTable(o.Table)+` SET attempts = attempts + 1, last_error = $2 WHERE id = $1`,
+					ev.ID, pubErr.Error()); err != nil {
+					return err
+				}
+				pubErr = fmt.Errorf("error publishing outbox event %d: %w", ev.ID, pubErr)
+				break
+			}
+			done = append(done, ev.ID)
+		}
+		if len(done) > 0 {
+			if _, err := tx.Exec(ctx, `DELETE FROM `+sanitizeTable(o.Table)+` WHERE id = ANY($1)`, done); err != nil {
+				return err
+			}
+		}
+		published = len(done)
+		if pubErr != nil {
+			// Commit the deletes and attempt count; the error is returned below
+			if err := tx.Commit(ctx); err != nil {
+				return err
+			}
+			return pubErr
+		}
+		return nil
+	})
+	if err != nil {
+		return published, err
+	}
+	return published, nil
+}
+
+// Run relays events until ctx is cancelled. Full batches are followed
+// straight away by the next; otherwise it waits PollInterval.
+func (o *Outbox) Run(ctx context.Context) error {
+	interval := o.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	batch := o.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+
+	clock := clockOr(o.Clock)
+	for {
+		n, err := o.RelayOnce(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("Error relaying outbox events", slog.String("table", o.Table), slog.String("error", err.Error()))
+		}
+		if err == nil && n == batch {
+			continue
+		}
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
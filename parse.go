@@ -0,0 +1,393 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Statement is what ParseStatement learns about one SQL statement
+type Statement struct {
+	Verb         string   // First keyword of the top-level statement, upper-cased: SELECT, INSERT, UPDATE, DELETE, ...
+	Tables       []string // Tables read or written, as StatementTables names them; CTE names are left out
+	Placeholders int      // Highest $n placeholder, the number of arguments the statement takes
+	ReadOnly     bool     // Safe on a standby: a query that neither writes nor takes row locks
+}
+
+// ParseStatement classifies sql by tokenizing it, so keywords and names
+// inside string literals, dollar quotes, quoted identifiers and comments
+// are never mistaken for structure. It does not validate the SQL: unknown
+// syntax yields what could be recognized.
+//
+// WITH queries take the verb of their main statement and are read-only
+// only when every CTE is a query too. Tables are found after FROM, JOIN,
+// UPDATE, INTO, USING, TABLE and TRUNCATE, following comma-separated FROM
+// lists and subqueries; FROM inside a function call, as in EXTRACT, is
+// ignored.
+func ParseStatement(sql string) Statement {
+	tokens := tokenizeSQL(sql)
+	var st Statement
+	for _, t := range tokens {
+		if t.kind == tokParam {
+			if n, err := strconv.Atoi(t.text[1:]); err == nil {
+				st.Placeholders = max(st.Placeholders, n)
+			}
+		}
+	}
+
+	p := &stmtParser{tokens: tokens, ctes: make(map[string]bool), seen: make(map[string]bool)}
+	st.Verb, st.ReadOnly = p.verb()
+	p.pos = 0
+	st.Tables = p.tables()
+	return st
+}
+
+type tokKind int
+
+const (
+	tokWord   tokKind = iota // Keyword or unquoted identifier, lower-cased
+	tokIdent                 // Quoted identifier, unquoted
+	tokString                // String or dollar-quoted literal
+	tokParam                 // $n
+	tokOther                 // Number, operator or punctuation
+)
+
+type sqlToken struct {
+	kind tokKind
+	text string
+}
+
+func (t sqlToken) is(word string) bool { return t.kind == tokWord && t.text == word }
+
+// tokenizeSQL splits sql into tokens, dropping whitespace and comments
+func tokenizeSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			// Block comments nest in Postgres
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		case c == '\'' || (c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\'':
+			escapes := c != '\''
+			if escapes {
+				i++
+			}
+			start := i
+			for i++; i < len(sql); i++ {
+				if escapes && sql[i] == '\\' {
+					i++
+				} else if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+			i = min(i+1, len(sql))
+			tokens = append(tokens, sqlToken{tokString, sql[start:i]})
+		case c == '"':
+			var b strings.Builder
+			for i++; i < len(sql); i++ {
+				if sql[i] == '"' {
+					if i+1 < len(sql) && sql[i+1] == '"' {
+						i++
+					} else {
+						break
+					}
+				}
+				b.WriteByte(sql[i])
+			}
+			i = min(i+1, len(sql))
+			tokens = append(tokens, sqlToken{tokIdent, b.String()})
+		case c == '$':
+			if m := dollarQuoteRe.FindStringIndex(sql[i:]); m != nil && m[0] == 0 {
+				tag := sql[i : i+m[1]]
+				end := strings.Index(sql[i+len(tag):], tag)
+				if end < 0 {
+					end = len(sql) - i - len(tag)
+				} else {
+					end += len(tag)
+				}
+				tokens = append(tokens, sqlToken{tokString, sql[i : i+len(tag)+end]})
+				i += len(tag) + end
+				continue
+			}
+			j := i + 1
+			for j < len(sql) && sql[j] >= '0' && sql[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				tokens = append(tokens, sqlToken{tokParam, sql[i:j]})
+			} else {
+				tokens = append(tokens, sqlToken{tokOther, "$"})
+			}
+			i = j
+		case isIdentStart(sql[i:]):
+			j := i
+			for j < len(sql) {
+				r, size := utf8.DecodeRuneInString(sql[j:])
+				if !(r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, sqlToken{tokWord, strings.ToLower(sql[i:j])})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(sql) && (sql[j] >= '0' && sql[j] <= '9' || sql[j] == '.' || sql[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, sqlToken{tokOther, sql[i:j]})
+			i = j
+		default:
+			tokens = append(tokens, sqlToken{tokOther, sql[i : i+1]})
+			i++
+		}
+	}
+	return tokens
+}
+
+func isIdentStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+type stmtParser struct {
+	tokens []sqlToken
+	pos    int
+	ctes   map[string]bool // Names defined by WITH, which are not tables
+	seen   map[string]bool
+}
+
+func (p *stmtParser) peek(offset int) sqlToken {
+	if i := p.pos + offset; i >= 0 && i < len(p.tokens) {
+		return p.tokens[i]
+	}
+	return sqlToken{kind: tokOther}
+}
+
+// skipParens moves past the parenthesized group starting at pos
+func (p *stmtParser) skipParens() {
+	depth := 0
+	for ; p.pos < len(p.tokens); p.pos++ {
+		switch t := p.tokens[p.pos]; {
+		case t.kind == tokOther && t.text == "(":
+			depth++
+		case t.kind == tokOther && t.text == ")":
+			depth--
+			if depth == 0 {
+				p.pos++
+				return
+			}
+		}
+	}
+}
+
+// readOnlyVerbs are statements that never write
+var readOnlyVerbs = map[string]bool{"SELECT": true, "VALUES": true, "TABLE": true, "SHOW": true, "EXPLAIN": true}
+
+// writeVerbs are the data-modifying statements a CTE may hold
+var writeVerbs = map[string]bool{"insert": true, "update": true, "delete": true, "merge": true}
+
+// verb returns the main statement's verb, skipping CTEs and recording
+// their names, and whether the statement is read-only
+func (p *stmtParser) verb() (string, bool) {
+	for p.peek(0).kind == tokOther && p.peek(0).text == "(" {
+		p.pos++ // (SELECT ...) UNION ...
+	}
+	readOnly := true
+	if p.peek(0).is("with") {
+		p.pos++
+		if p.peek(0).is("recursive") {
+			p.pos++
+		}
+		for p.pos < len(p.tokens) {
+			if name := p.peek(0); name.kind == tokWord || name.kind == tokIdent {
+				p.ctes[name.text] = true
+			}
+			// Move to the CTE body: name [(columns)] AS [NOT] [MATERIALIZED] (
+			for p.pos < len(p.tokens) && !p.peek(0).is("as") {
+				p.pos++
+			}
+			for p.pos < len(p.tokens) && !(p.peek(0).kind == tokOther && p.peek(0).text == "(") {
+				p.pos++
+			}
+			if writeVerbs[p.peek(1).text] && p.peek(1).kind == tokWord {
+				readOnly = false
+			}
+			p.skipParens()
+			if !(p.peek(0).kind == tokOther && p.peek(0).text == ",") {
+				break
+			}
+			p.pos++
+		}
+	}
+
+	t := p.peek(0)
+	if t.kind != tokWord {
+		return "", false
+	}
+	verb := strings.ToUpper(t.text)
+	if !readOnlyVerbs[verb] {
+		return verb, false
+	}
+	if verb == "EXPLAIN" {
+		// EXPLAIN ANALYZE runs the statement
+		for i := p.pos; i < len(p.tokens); i++ {
+			if p.tokens[i].is("analyze") {
+				return verb, false
+			}
+			if p.tokens[i].kind == tokWord && (p.tokens[i].text == "select" || writeVerbs[p.tokens[i].text]) {
+				return verb, readOnly && !writeVerbs[p.tokens[i].text]
+			}
+		}
+	}
+	if verb == "SELECT" {
+		// SELECT ... INTO creates a table; FOR UPDATE/SHARE takes row locks
+		depth := 0
+		for i := p.pos; i < len(p.tokens); i++ {
+			switch t := p.tokens[i]; {
+			case t.kind == tokOther && t.text == "(":
+				depth++
+			case t.kind == tokOther && t.text == ")":
+				depth--
+			case depth == 0 && t.is("into"):
+				return verb, false
+			case t.is("for") && i+1 < len(p.tokens) && (p.tokens[i+1].is("update") || p.tokens[i+1].is("share") || p.tokens[i+1].is("no") || p.tokens[i+1].is("key")):
+				return verb, false
+			}
+		}
+	}
+	return verb, readOnly
+}
+
+// tableKeywords are followed by a table name
+var tableKeywords = map[string]bool{"from": true, "join": true, "update": true, "into": true, "table": true, "truncate": true, "using": true}
+
+// tables returns the tables referenced anywhere in the statement
+func (p *stmtParser) tables() []string {
+	var tables []string
+	// subquery[d] is whether the parenthesis at depth d holds a query
+	// rather than function arguments or a column list
+	subquery := []bool{true}
+	for ; p.pos < len(p.tokens); p.pos++ {
+		t := p.tokens[p.pos]
+		switch {
+		case t.kind == tokOther && t.text == "(":
+			next := p.peek(1)
+			subquery = append(subquery, next.is("select") || next.is("with") || next.is("values") || next.is("table") || writeVerbs[next.text] && next.kind == tokWord)
+		case t.kind == tokOther && t.text == ")":
+			if len(subquery) > 1 {
+				subquery = subquery[:len(subquery)-1]
+			}
+		case t.kind == tokWord && tableKeywords[t.text] && subquery[len(subquery)-1]:
+			if prev := p.peek(-1); p.pos > 0 && (t.is("table") && (prev.is("create") || prev.is("returns")) || t.is("from") && prev.is("distinct")) {
+				continue // A table being defined, RETURNS TABLE, or IS DISTINCT FROM
+			}
+			p.pos++
+			for {
+				for p.peek(0).is("only") || p.peek(0).is("lateral") || p.peek(0).is("table") {
+					p.pos++
+				}
+				name, ok := p.tableName(t.is("into"))
+				if !ok {
+					p.pos--
+					break
+				}
+				if !p.ctes[name] && !p.seen[name] {
+					p.seen[name] = true
+					tables = append(tables, name)
+				}
+				if !t.is("from") && !t.is("truncate") {
+					p.pos--
+					break
+				}
+				// Skip the alias to find a comma-separated next table
+				for p.peek(0).kind == tokOther && p.peek(0).text == "*" {
+					p.pos++ // ONLY t *
+				}
+				if p.peek(0).is("as") {
+					p.pos++
+				}
+				if a := p.peek(0); a.kind == tokIdent || a.kind == tokWord && !isClauseKeyword(a.text) {
+					p.pos++
+					if p.peek(0).kind == tokOther && p.peek(0).text == "(" {
+						p.skipParens() // Column aliases
+					}
+				}
+				if !(p.peek(0).kind == tokOther && p.peek(0).text == ",") {
+					p.pos--
+					break
+				}
+				p.pos++
+			}
+		}
+	}
+	return tables
+}
+
+// tableName reads a possibly schema-qualified name at pos, moving past it.
+// A name followed by ( is a function call, not a table, unless columns
+// says it is an INSERT target with its column list.
+func (p *stmtParser) tableName(columns bool) (string, bool) {
+	var parts []string
+	start := p.pos
+	for {
+		t := p.peek(0)
+		if t.kind != tokIdent && (t.kind != tokWord || isClauseKeyword(t.text)) {
+			break
+		}
+		parts = append(parts, t.text)
+		p.pos++
+		if !(p.peek(0).kind == tokOther && p.peek(0).text == ".") {
+			break
+		}
+		p.pos++
+	}
+	if len(parts) == 0 || !columns && p.peek(0).kind == tokOther && p.peek(0).text == "(" {
+		p.pos = start
+		return "", false
+	}
+	return strings.Join(parts, "."), true
+}
+
+// isClauseKeyword reports whether word starts a clause or join, so it
+// cannot be a table name or alias
+func isClauseKeyword(word string) bool {
+	switch word {
+	case "select", "where", "group", "order", "having", "limit", "offset", "fetch", "for", "window",
+		"union", "intersect", "except", "join", "inner", "left", "right", "full", "cross", "natural",
+		"on", "using", "set", "values", "returning", "default", "lateral", "only", "as", "with",
+		"from", "into", "do", "when", "then", "and", "or", "not", "overriding", "conflict", "cascade", "restrict", "restart", "continue",
+		"of", "nowait", "skip", "tablesample":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5"
+)
+
+// WithPgBouncerMode makes the pool work behind PgBouncer in transaction
+// pooling mode, where consecutive statements may run on different server
+// connections. Queries use the simple protocol so no prepared statements
+// outlive a transaction, statement and description caching is disabled, and
+// session-level hooks such as WithSessionReset are skipped.
+//
+// Session state does not survive between transactions either: advisory
+// locks, LISTEN, SET without LOCAL and temporary tables must not be relied
+// on. Run migrations and CreateIndexConcurrently over a direct connection.
+func WithPgBouncerMode() PoolOption {
+	return func(s *poolSettings) {
+		s.pgbouncer = true
+
+		cc := s.config.ConnConfig
+		cc.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+		cc.StatementCacheCapacity = 0
+		cc.DescriptionCacheCapacity = 0
+	}
+}
@@ -0,0 +1,114 @@
+// Package pgerrors classifies Postgres errors by SQLSTATE so callers can
+// match on sentinel errors instead of error codes or message text
+package pgerrors
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Sentinel errors matched with errors.Is after Classify
+var (
+	ErrNotFound             = errors.New("not found")
+	ErrUniqueViolation      = errors.New("unique violation")
+	ErrForeignKeyViolation  = errors.New("foreign key violation")
+	ErrNotNullViolation     = errors.New("not null violation")
+	ErrCheckViolation       = errors.New("check violation")
+	ErrSerializationFailure = errors.New("serialization failure")
+	ErrDeadlockDetected     = errors.New("deadlock detected")
+	ErrLockNotAvailable     = errors.New("lock not available")
+	ErrQueryCanceled        = errors.New("query canceled")
+	ErrReadOnlyTransaction  = errors.New("read-only transaction")
+)
+
+// sentinels maps SQLSTATE codes to their sentinel error
+var sentinels = map[string]error{
+	"23505": ErrUniqueViolation,
+	"23503": ErrForeignKeyViolation,
+	"23502": ErrNotNullViolation,
+	"23514": ErrCheckViolation,
+	"40001": ErrSerializationFailure,
+	"40P01": ErrDeadlockDetected,
+	"55P03": ErrLockNotAvailable,
+	"57014": ErrQueryCanceled,
+	"25006": ErrReadOnlyTransaction,
+}
+
+// Error is a classified error. errors.Is matches both its sentinel and
+// anything in the original chain, and errors.As still finds the
+// *pgconn.PgError.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() []error { return []error{e.Kind, e.Err} }
+
+// Classify wraps err with the sentinel for its SQLSTATE, or for
+// pgx.ErrNoRows. Other errors, and nil, are returned unchanged.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Error{Kind: ErrNotFound, Err: err}
+	}
+	if kind, ok := sentinels[Code(err)]; ok {
+		return &Error{Kind: kind, Err: err}
+	}
+	return err
+}
+
+// Code returns the SQLSTATE of the Postgres error in err's chain, or ""
+func Code(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// Constraint returns the constraint a Postgres error in err's chain
+// violated, or ""
+func Constraint(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.ConstraintName
+	}
+	return ""
+}
+
+// IsRetryable reports whether running the same statement or transaction
+// again may succeed: serialization failures, deadlocks, lock timeouts, lost or
+// refused connections, and server shutdowns
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	code := Code(err)
+	switch {
+	case code == "":
+		return false
+	case code == "40001", code == "40P01", code == "55P03":
+		return true
+	case code == "53300": // too_many_connections
+		return true
+	case strings.HasPrefix(code, "08"): // connection_exception
+		return true
+	case code == "57P01", code == "57P02", code == "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+		return true
+	}
+	return false
+}
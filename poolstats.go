@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PoolStatsSnapshot is the pool's Stat() counters and the app's hook
+// metrics at one moment
+type PoolStatsSnapshot struct {
+	At                   time.Time     `json:"at"`
+	TotalConns           int32         `json:"total_conns"`
+	AcquiredConns        int32         `json:"acquired_conns"`
+	IdleConns            int32         `json:"idle_conns"`
+	ConstructingConns    int32         `json:"constructing_conns"`
+	MaxConns             int32         `json:"max_conns"`
+	AcquireCount         int64         `json:"acquire_count"`
+	EmptyAcquireCount    int64         `json:"empty_acquire_count"` // Acquires that had to wait for a connection
+	CanceledAcquireCount int64         `json:"canceled_acquire_count"`
+	AcquireDuration      time.Duration `json:"acquire_duration_ns"`
+	NewConnsCount        int64         `json:"new_conns_count"`
+	LifetimeDestroyed    int64         `json:"max_lifetime_destroy_count"`
+	IdleDestroyed        int64         `json:"max_idle_destroy_count"`
+	AcquireRejected      int64         `json:"acquire_rejected"`
+	ResetFailed          int64         `json:"reset_failed"`
+	RotationRecycled     int64         `json:"rotation_recycled"`
+	Throttled            int64         `json:"throttled"`   // Statements delayed or rejected by the rate limiter
+	Expired              int64         `json:"ttl_expired"` // Rows deleted by TTLTable sweeps
+}
+
+// PoolStats snapshots the pool's counters
+func (app *App) PoolStats() PoolStatsSnapshot {
+	stats := app.primary().Stat()
+	return PoolStatsSnapshot{
+		At:                   clockOr(app.Clock).Now(),
+		TotalConns:           stats.TotalConns(),
+		AcquiredConns:        stats.AcquiredConns(),
+		IdleConns:            stats.IdleConns(),
+		ConstructingConns:    stats.ConstructingConns(),
+		MaxConns:             stats.MaxConns(),
+		AcquireCount:         stats.AcquireCount(),
+		EmptyAcquireCount:    stats.EmptyAcquireCount(),
+		CanceledAcquireCount: stats.CanceledAcquireCount(),
+		AcquireDuration:      stats.AcquireDuration(),
+		NewConnsCount:        stats.NewConnsCount(),
+		LifetimeDestroyed:    stats.MaxLifetimeDestroyCount(),
+		IdleDestroyed:        stats.MaxIdleDestroyCount(),
+		AcquireRejected:      app.Metrics.AcquireRejected(),
+		ResetFailed:          app.Metrics.ResetFailed(),
+		RotationRecycled:     app.Metrics.RotationRecycled(),
+		Throttled:            app.Metrics.Throttled(),
+		Expired:              app.Metrics.Expired(),
+	}
+}
+
+// PoolStatsHandler serves a snapshot as JSON, or with ?interval=1s a
+// stream of newline-delimited snapshots until the client disconnects
+func (app *App) PoolStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+
+		raw := r.URL.Query().Get("interval")
+		if raw == "" {
+			_ = enc.Encode(app.PoolStats())
+			return
+		}
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval < 100*time.Millisecond {
+			http.Error(w, "interval must be a duration of at least 100ms", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		for {
+			if err := enc.Encode(app.PoolStats()); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if sleepCtx(r.Context(), interval) != nil {
+				return
+			}
+		}
+	})
+}
+
+// poolStatsTable prints snapshots as aligned rows with per-second rates,
+// repeating the header every 20 rows
+type poolStatsTable struct {
+	w    io.Writer
+	rows int
+	prev *PoolStatsSnapshot
+}
+
+const poolStatsRow = "%-8s %6v %8v %6v %6v %10v %9v %10v %9v %8v\n"
+
+func (t *poolStatsTable) write(s PoolStatsSnapshot) error {
+	if t.rows%20 == 0 {
+		if _, err := fmt.Fprintf(t.w, poolStatsRow, "TIME", "TOTAL", "ACQUIRED", "IDLE", "MAX",
+			"ACQUIRE/S", "WAITED/S", "AVG WAIT", "NEW CONNS", "REJECTED"); err != nil {
+			return err
+		}
+	}
+	t.rows++
+
+	var acquires, waited float64
+	avgWait := time.Duration(0)
+	if p := t.prev; p != nil {
+		if secs := s.At.Sub(p.At).Seconds(); secs > 0 {
+			acquires = float64(s.AcquireCount-p.AcquireCount) / secs
+			waited = float64(s.EmptyAcquireCount-p.EmptyAcquireCount) / secs
+		}
+		if n := s.AcquireCount - p.AcquireCount; n > 0 {
+			avgWait = (s.AcquireDuration - p.AcquireDuration) / time.Duration(n)
+		}
+	}
+	t.prev = &s
+
+	_, err := fmt.Fprintf(t.w, poolStatsRow, s.At.Format("15:04:05"), s.TotalConns, s.AcquiredConns, s.IdleConns, s.MaxConns,
+		fmt.Sprintf("%.1f", acquires), fmt.Sprintf("%.1f", waited), avgWait.Round(time.Microsecond), s.NewConnsCount, s.AcquireRejected)
+	return err
+}
+
+// StreamPoolStats reads the stream served by PoolStatsHandler at rawURL and
+// prints it to w as a table, or passes the JSON through, until ctx is done
+func StreamPoolStats(ctx context.Context, rawURL string, interval time.Duration, w io.Writer, asJSON bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid stats url: %w", err)
+	}
+	q := u.Query()
+	q.Set("interval", interval.String())
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching pool stats: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("error fetching pool stats: %s: %s", resp.Status, body)
+	}
+
+	table := &poolStatsTable{w: w}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if asJSON {
+			if _, err := fmt.Fprintln(w, scanner.Text()); err != nil {
+				return err
+			}
+			continue
+		}
+		var s PoolStatsSnapshot
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return fmt.Errorf("error decoding pool stats: %w", err)
+		}
+		if err := table.write(s); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PreparedTxPolicy decides what the janitor does with an orphaned prepared
+// transaction
+type PreparedTxPolicy int
+
+const (
+	PreparedTxAlert    PreparedTxPolicy = iota // Log and report only (default)
+	PreparedTxRollback                         // ROLLBACK PREPARED
+	PreparedTxCommit                           // COMMIT PREPARED
+)
+
+// PreparedTx is a row of pg_prepared_xacts
+type PreparedTx struct {
+	GID      string
+	Prepared time.Time
+	Owner    string
+	Database string
+}
+
+// PreparedTxJanitor finds prepared transactions (two-phase commit) left
+// behind by this application and resolves them. Orphaned prepared
+// transactions hold locks and block vacuum until someone ends them.
+type PreparedTxJanitor struct {
+	DB     *pgxpool.Pool
+	Active *ActivePool // Optional, used instead of DB once set
+
+	// GIDPrefix limits the janitor to transactions this application
+	// prepared. Only transactions owned by the current user in the current
+	// database are considered either way.
+	GIDPrefix string
+	MinAge    time.Duration // Younger transactions may still be committing, default 10 minutes
+	Interval  time.Duration // How often Run sweeps, default 5 minutes
+	Policy    PreparedTxPolicy
+
+	OnFound func(PreparedTx) // Called for every orphan found, before the policy is applied
+	Clock   Clock            // Default SystemClock
+}
+
+// Sweep resolves the orphaned prepared transactions found now and returns
+// them
+func (j *PreparedTxJanitor) Sweep(ctx context.Context) ([]PreparedTx, error) {
+	minAge := j.MinAge
+	if minAge <= 0 {
+		minAge = 10 * time.Minute
+	}
+
+	rows, err := j.Active.Or(j.DB).Query(ctx, `
+		SELECT gid, prepared, owner, database FROM pg_prepared_xacts
+		WHERE database = current_database() AND owner = current_user
+		  AND starts_with(gid, $1) AND prepared < now() - make_interval(secs => $2)
+		ORDER BY prepared`, j.GIDPrefix, minAge.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error listing prepared transactions: %w", err)
+	}
+	orphans, err := pgx.CollectRows(rows, pgx.RowToStructByPos[PreparedTx])
+	if err != nil {
+		return nil, fmt.Errorf("error listing prepared transactions: %w", err)
+	}
+
+	var errs []error
+	for _, tx := range orphans {
+		attrs := []any{
+			slog.String("gid", tx.GID),
+			slog.Duration("age", clockOr(j.Clock).Now().Sub(tx.Prepared)),
+			slog.String("owner", tx.Owner),
+		}
+		if j.OnFound != nil {
+			j.OnFound(tx)
+		}
+
+		var action string
+		switch j.Policy {
+		case PreparedTxRollback:
+			action = "ROLLBACK"
+		case PreparedTxCommit:
+			action = "COMMIT"
+		default:
+			slog.Warn("Found orphaned prepared transaction", attrs...)
+			continue
+		}
+
+		// COMMIT/ROLLBACK PREPARED take no parameters
+		if _, err := j.Active.Or(j.DB).Exec(ctx, action+" PREPARED "+quoteLiteral(tx.GID)); err != nil {
+			errs = append(errs, fmt.Errorf("error resolving prepared transaction %s: %w", tx.GID, err))
+			continue
+		}
+		slog.Warn("Resolved orphaned prepared transaction", append(attrs, slog.String("action", action))...)
+	}
+	return orphans, errors.Join(errs...)
+}
+
+// Run sweeps at startup and then every Interval until ctx is cancelled
+func (j *PreparedTxJanitor) Run(ctx context.Context) error {
+	interval := j.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	for {
+		if _, err := j.Sweep(ctx); err != nil {
+			slog.Error("Prepared transaction sweep failed", slog.String("error", err.Error()))
+		}
+		if err := clockOr(j.Clock).Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// preparedTxJanitor builds the janitor from PG_PREPARED_TX_PREFIX and
+// PG_PREPARED_TX_POLICY
+func (c *DBConfig) preparedTxJanitor(db *pgxpool.Pool) (*PreparedTxJanitor, error) {
+	j := &PreparedTxJanitor{DB: db, GIDPrefix: c.PreparedTxPrefix}
+	switch c.PreparedTxPolicy {
+	case "", "alert":
+		j.Policy = PreparedTxAlert
+	case "rollback":
+		j.Policy = PreparedTxRollback
+	case "commit":
+		j.Policy = PreparedTxCommit
+	default:
+		return nil, fmt.Errorf("unknown prepared transaction policy %q", c.PreparedTxPolicy)
+	}
+	return j, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PriorityPools splits MaxConns between two pools so background scans
+// cannot starve the API path: Reserved serves queries at normal or
+// critical priority, such as health checks and interactive requests, and
+// Batch serves PriorityLow work. Each side can only exhaust its own
+// connections; a busy Batch pool never delays a reserved query.
+//
+//	pools, err := NewPriorityPools(ctx, cfg, 0.25, WithMetrics(metrics))
+//	rows, err := pools.Query(dbctx.WithPriority(ctx, dbctx.PriorityLow), "SELECT ...")
+type PriorityPools struct {
+	Reserved *pgxpool.Pool
+	Batch    *pgxpool.Pool
+}
+
+// NewPriorityPools creates the two pools from cfg, reserving the given
+// fraction of MaxConns and MinConns, rounded up, for priority work. Both
+// pools get at least one connection and the same options.
+func NewPriorityPools(ctx context.Context, cfg *DBConfig, reserve float64, opts ...PoolOption) (*PriorityPools, error) {
+	if reserve <= 0 || reserve >= 1 {
+		return nil, fmt.Errorf("invalid priority reserve %g: expected a fraction between 0 and 1", reserve)
+	}
+	if cfg.MaxConns < 2 {
+		return nil, fmt.Errorf("cannot split %d max connections into priority pools", cfg.MaxConns)
+	}
+	reservedCfg, batchCfg := *cfg, *cfg
+	reservedCfg.MaxConns = min(int32(math.Ceil(float64(cfg.MaxConns)*reserve)), cfg.MaxConns-1)
+	batchCfg.MaxConns = cfg.MaxConns - reservedCfg.MaxConns
+	reservedCfg.MinConns = min(int32(math.Ceil(float64(cfg.MinConns)*reserve)), reservedCfg.MaxConns)
+	batchCfg.MinConns = min(cfg.MinConns-reservedCfg.MinConns, batchCfg.MaxConns)
+
+	reserved, err := newPool(ctx, &reservedCfg, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reserved pool: %w", err)
+	}
+	batch, err := newPool(ctx, &batchCfg, opts...)
+	if err != nil {
+		reserved.Close()
+		return nil, fmt.Errorf("error creating batch pool: %w", err)
+	}
+	return &PriorityPools{Reserved: reserved, Batch: batch}, nil
+}
+
+// Pool returns the pool for the priority of ctx
+func (p *PriorityPools) Pool(ctx context.Context) *pgxpool.Pool {
+	if dbctx.QueryPriority(ctx) < dbctx.PriorityNormal {
+		return p.Batch
+	}
+	return p.Reserved
+}
+
+// Acquire gets a connection from the pool for the priority of ctx
+func (p *PriorityPools) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	return p.Pool(ctx).Acquire(ctx)
+}
+
+// Begin starts a transaction on the pool for the priority of ctx
+func (p *PriorityPools) Begin(ctx context.Context) (pgx.Tx, error) {
+	return p.Pool(ctx).Begin(ctx)
+}
+
+// Exec runs a statement on the pool for the priority of ctx
+func (p *PriorityPools) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return p.Pool(ctx).Exec(ctx, sql, args...)
+}
+
+// Query runs a query on the pool for the priority of ctx
+func (p *PriorityPools) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return p.Pool(ctx).Query(ctx, sql, args...)
+}
+
+// QueryRow runs a single-row query on the pool for the priority of ctx
+func (p *PriorityPools) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return p.Pool(ctx).QueryRow(ctx, sql, args...)
+}
+
+// Close closes both pools, waiting for their connections to be released
+func (p *PriorityPools) Close() {
+	p.Reserved.Close()
+	p.Batch.Close()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5"
+)
+
+// SimpleProtocol switches one call to the simple protocol when passed as
+// its first argument, for statements the extended protocol rejects, such
+// as several statements in one string or SET with a parameter:
+//
+//	_, err := db.Exec(ctx, "SET LOCAL lock_timeout = $1; UPDATE jobs SET ...", SimpleProtocol(), "2s")
+//
+// Arguments are interpolated client-side, so the rest of the pool keeps
+// its exec mode and statement cache. The query helpers in this package
+// pass it through like any other argument.
+func SimpleProtocol() pgx.QueryExecMode {
+	return pgx.QueryExecModeSimpleProtocol
+}
+
+// splitQueryOptions separates the leading pgx query options, exec modes
+// and result formats, from the statement's arguments
+func splitQueryOptions(args []any) (opts, rest []any) {
+	i := 0
+	for ; i < len(args); i++ {
+		switch args[i].(type) {
+		case pgx.QueryExecMode, pgx.QueryResultFormats, pgx.QueryResultFormatsByOID:
+			continue
+		}
+		break
+	}
+	return args[:i], args[i:]
+}
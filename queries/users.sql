@@ -0,0 +1,8 @@
+-- name: GetUser :one
+SELECT id, name, last_login FROM users WHERE id = $1;
+
+-- name: ListUsers :many
+SELECT id, name, last_login FROM users ORDER BY id;
+
+-- name: TouchUserLogin :execrows
+UPDATE users SET last_login = now() WHERE id = $1;
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrLeaseExpired is returned when a job is completed or failed after its
+// visibility timeout ran out, when it may already be redelivered
+var ErrLeaseExpired = errors.New("job lease expired")
+
+// Job is a job delivered to a worker
+type Job struct {
+	ID         int64
+	Queue      string
+	Payload    json.RawMessage
+	Attempts   int // Deliveries so far, this one included
+	EnqueuedAt time.Time
+}
+
+// Queue is a job queue in a Postgres table. Jobs are enqueued in the
+// caller's transaction, so they exist only if it commits, and dequeued
+// with FOR UPDATE SKIP LOCKED, so workers on any number of instances never
+// wait on each other or take the same job.
+//
+// A dequeued job stays invisible for VisibilityTimeout. Completing it
+// deletes it; failing it schedules a retry after an exponential backoff,
+// and after MaxAttempts deliveries moves it to <Table>_dead. A worker that
+// dies or stalls past the timeout loses the job to the next Dequeue, so
+// delivery is at least once and handlers must be idempotent; long handlers
+// can call Extend.
+type Queue struct {
+	DB                *pgxpool.Pool
+	Active            *ActivePool // Optional, used instead of DB once set
+	Table             string
+	VisibilityTimeout time.Duration // How long a dequeued job is hidden, default 30s
+	MaxAttempts       int           // Deliveries before dead-lettering, default 5
+	MinBackoff        time.Duration // Delay before the first retry, doubled per attempt, default 1s
+	MaxBackoff        time.Duration // Default 1h
+	PollInterval      time.Duration // Wait when the queue is empty, default 1s
+	Clock             Clock
+}
+
+// NewQueue creates a queue stored in table, creating it and its dead-letter
+// table if needed
+func NewQueue(ctx context.Context, db *pgxpool.Pool, table string) (*Queue, error) {
+	q := &Queue{DB: db, Table: table, VisibilityTimeout: 30 * time.Second, MaxAttempts: 5,
+		MinBackoff: time.Second, MaxBackoff: time.Hour, PollInterval: time.Second}
+	// Index names take the table's schema, so only its last part goes in
+	index := pgx.Identifier{table[strings.LastIndexByte(table, '.')+1:] + "_queue_run_at_idx"}.Sanitize()
+	_, err := db.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(table)+` (
+		id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		queue text NOT NULL,
+		payload jsonb NOT NULL,
+		attempts int NOT NULL DEFAULT 0,
+		run_at timestamptz NOT NULL DEFAULT now(),
+		created_at timestamptz NOT NULL DEFAULT now(),
+		last_error text
+	);
+	CREATE INDEX IF NOT EXISTS `+index+` ON `+sanitizeTable(table)+` (queue, run_at);
+	CREATE TABLE IF NOT EXISTS `+sanitizeTable(table+"_dead")+` (
+		id bigint PRIMARY KEY,
+		queue text NOT NULL,
+		payload jsonb NOT NULL,
+		attempts int NOT NULL,
+		created_at timestamptz NOT NULL,
+		failed_at timestamptz NOT NULL DEFAULT now(),
+		last_error text
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", table, err)
+	}
+	return q, nil
+}
+
+// jsonPayload marshals payload to JSON unless it already is []byte or
+// json.RawMessage
+func jsonPayload(payload any) ([]byte, error) {
+	switch p := payload.(type) {
+	case json.RawMessage:
+		return p, nil
+	case []byte:
+		return p, nil
+	}
+	return json.Marshal(payload)
+}
+
+// Enqueue adds a job to queue in tx, the caller's transaction, returning
+// its ID
+func (q *Queue) Enqueue(ctx context.Context, tx DBTX, queue string, payload any) (int64, error) {
+	return q.EnqueueAt(ctx, tx, queue, payload, time.Time{})
+}
+
+// EnqueueAt adds a job that is not delivered before runAt; a zero runAt
+// means now
+func (q *Queue) EnqueueAt(ctx context.Context, tx DBTX, queue string, payload any, runAt time.Time) (int64, error) {
+	data, err := jsonPayload(payload)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding %s job: %w", queue, err)
+	}
+	var at any
+	if !runAt.IsZero() {
+		at = runAt
+	}
+	var id int64
+	err = tx.QueryRow(ctx, `INSERT INTO `+sanitizeTable(q.Table)+` (queue, payload, run_at) VALUES ($1, $2, COALESCE($3::timestamptz, now())) RETURNING id`,
+		queue, string(data), at).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error enqueueing %s job: %w", queue, err)
+	}
+	return id, nil
+}
+
+// Dequeue claims up to n due jobs from queue, hiding them for
+// VisibilityTimeout
+func (q *Queue) Dequeue(ctx context.Context, queue string, n int) ([]Job, error) {
+	visibility := q.VisibilityTimeout
+	if visibility <= 0 {
+		visibility = 30 * time.Second
+	}
+	rows, err := q.Active.Or(q.DB).Query(ctx, `UPDATE `+sanitizeTable(q.Table)+` SET attempts = attempts + 1, run_at = now() + make_interval(secs => $3)
+		WHERE id IN (
+			SELECT id FROM `+sanitizeTable(q.Table)+` WHERE queue = $1 AND run_at <= now()
+			ORDER BY run_at, id LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, queue, payload, attempts, created_at`, queue, n, visibility.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error dequeueing %s jobs: %w", queue, err)
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Job, error) {
+		var job Job
+		err := row.Scan(&job.ID, &job.Queue, &job.Payload, &job.Attempts, &job.EnqueuedAt)
+		return job, err
+	})
+}
+
+// leased runs a statement on job that only applies while this delivery
+// still holds it, returning ErrLeaseExpired otherwise
+func (q *Queue) leased(ctx context.Context, job Job, sql string, args ...any) error {
+	tag, err := q.Active.Or(q.DB).Exec(ctx, sql, append([]any{job.ID, job.Attempts}, args...)...)
+	if err != nil {
+		return fmt.Errorf("error updating job %d: %w", job.ID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("job %d: %w", job.ID, ErrLeaseExpired)
+	}
+	return nil
+}
+
+// Complete deletes a job that was handled
+func (q *Queue) Complete(ctx context.Context, job Job) error {
+	return q.leased(ctx, job, `DELETE FROM `+sanitizeTable(q.Table)+` WHERE id = $1 AND attempts = $2`)
+}
+
+// Extend hides a job for another d from now, for handlers that outlast
+// VisibilityTimeout
+func (q *Queue) Extend(ctx context.Context, job Job, d time.Duration) error {
+	return q.leased(ctx, job, `UPDATE `+sanitizeTable(q.Table)+` SET run_at = now() + make_interval(secs => $3)
+		WHERE id = $1 AND attempts = $2`, d.Seconds())
+}
+
+// Fail records cause against a job and schedules its retry, or moves it to
+// the dead-letter table once it has had MaxAttempts deliveries
+func (q *Queue) Fail(ctx context.Context, job Job, cause error) error {
+	maxAttempts := q.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	if job.Attempts >= maxAttempts {
+		slog.Error("Moving job to dead-letter table", slog.String("queue", job.Queue), slog.Int64("id", job.ID),
+			slog.Int("attempts", job.Attempts), slog.String("error", cause.Error()))
+		return q.leased(ctx, job, `WITH dead AS (
+			DELETE FROM `+sanitizeTable(q.Table)+` WHERE id = $1 AND attempts = $2 RETURNING id, queue, payload, attempts, created_at
+		)
+		INSERT INTO `+sanitizeTable(q.Table+"_dead")+` (id, queue, payload, attempts, created_at, last_error)
+		SELECT id, queue, payload, attempts, created_at, $3 FROM dead`, cause.Error())
+	}
+	return q.leased(ctx, job, `UPDATE `+sanitizeTable(q.Table)+` SET run_at = now() + make_interval(secs => $3), last_error = $4
+		WHERE id = $1 AND attempts = $2`, q.backoff(job.Attempts).Seconds(), cause.Error())
+}
+
+// release makes a job due again without counting the delivery, for jobs
+// interrupted by shutdown
+func (q *Queue) release(ctx context.Context, job Job) error {
+	return q.leased(ctx, job, `UPDATE `+sanitizeTable(q.Table)+` SET run_at = now(), attempts = attempts - 1
+		WHERE id = $1 AND attempts = $2`)
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := q.MinBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := q.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Hour
+	}
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// Requeue moves a dead-lettered job back onto its queue with its attempts
+// reset
+func (q *Queue) Requeue(ctx context.Context, id int64) error {
+	tag, err := q.Active.Or(q.DB).Exec(ctx, `WITH dead AS (
+		DELETE FROM `+sanitizeTable(q.Table+"_dead")+` WHERE id = $1 RETURNING queue, payload, created_at
+	)
+	INSERT INTO `+sanitizeTable(q.Table)+` (queue, payload, created_at) SELECT queue, payload, created_at FROM dead`, id)
+	if err != nil {
+		return fmt.Errorf("error requeueing job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("job %d is not dead-lettered", id)
+	}
+	return nil
+}
+
+// Work runs handle on jobs from queue, up to concurrency at a time, until
+// ctx is cancelled, then waits for running handlers. A job is completed
+// when handle returns nil and failed otherwise; a panic counts as a
+// failure. Jobs whose handler fails because of shutdown are released for
+// another worker without counting the attempt.
+func (q *Queue) Work(ctx context.Context, queue string, concurrency int, handle func(ctx context.Context, job Job) error) error {
+	concurrency = max(concurrency, 1)
+	interval := q.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	clock := clockOr(q.Clock)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		// Wait for a free slot, then claim as many jobs as there are slots
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		jobs, err := q.Dequeue(ctx, queue, 1+concurrency-len(slots))
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Error dequeueing jobs", slog.String("queue", queue), slog.String("error", err.Error()))
+		}
+		if len(jobs) == 0 {
+			<-slots
+			if err := clock.Sleep(ctx, interval); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i, job := range jobs {
+			if i > 0 {
+				slots <- struct{}{}
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				q.process(ctx, job, handle)
+			}()
+		}
+	}
+}
+
+func (q *Queue) process(ctx context.Context, job Job, handle func(ctx context.Context, job Job) error) {
+	err := func() (err error) {
+		defer recoverTo(&err, nil)
+		return handle(ctx, job)
+	}()
+
+	// Record the outcome even when shutting down
+	done := context.WithoutCancel(ctx)
+	switch {
+	case err == nil:
+		err = q.Complete(done, job)
+	case ctx.Err() != nil:
+		err = q.release(done, job)
+	default:
+		slog.Warn("Job failed", slog.String("queue", job.Queue), slog.Int64("id", job.ID),
+			slog.Int("attempts", job.Attempts), slog.String("error", err.Error()))
+		err = q.Fail(done, job, err)
+	}
+	if err != nil {
+		slog.Error("Error recording job outcome", slog.String("queue", job.Queue), slog.Int64("id", job.ID), slog.String("error", err.Error()))
+	}
+}
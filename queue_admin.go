@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// JobInfo is a pending or dead-lettered job as operators see it
+type JobInfo struct {
+	ID         int64           `json:"id"`
+	Queue      string          `json:"queue"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	RunAt      *time.Time      `json:"run_at,omitempty"` // Next delivery, or the lease end of a job being handled; nil when dead-lettered
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+	FailedAt   *time.Time      `json:"failed_at,omitempty"` // When it was dead-lettered
+	LastError  *string         `json:"last_error,omitempty"`
+}
+
+// List returns up to limit jobs of queue, or of every queue when empty,
+// oldest first. With dead it lists the dead-letter table instead.
+func (q *Queue) List(ctx context.Context, queue string, dead bool, limit int) ([]JobInfo, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	sql := `SELECT id, queue, payload, attempts, run_at, created_at, NULL::timestamptz, last_error FROM ` + sanitizeTable(q.Table)
+	if dead {
+		sql = `SELECT id, queue, payload, attempts, NULL::timestamptz, created_at, failed_at, last_error FROM ` + sanitizeTable(q.Table+"_dead")
+	}
+	rows, err := q.Active.Or(q.DB).Query(ctx, sql+` WHERE $1 = '' OR queue = $1 ORDER BY id LIMIT $2`, queue, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing jobs: %w", err)
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (JobInfo, error) {
+		var job JobInfo
+		err := row.Scan(&job.ID, &job.Queue, &job.Payload, &job.Attempts, &job.RunAt, &job.EnqueuedAt, &job.FailedAt, &job.LastError)
+		return job, err
+	})
+}
+
+// Retry makes a pending job due now, skipping the rest of its backoff. A
+// job being handled is redelivered too, so retry only jobs that are stuck.
+func (q *Queue) Retry(ctx context.Context, id int64) error {
+	tag, err := q.Active.Or(q.DB).Exec(ctx, `UPDATE `+sanitizeTable(q.Table)+` SET run_at = now() WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error retrying job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("job %d is not pending", id)
+	}
+	return nil
+}
+
+// Purge deletes the jobs of queue, or of every queue when empty, returning
+// how many went. With dead it empties the dead-letter table instead.
+func (q *Queue) Purge(ctx context.Context, queue string, dead bool) (int64, error) {
+	table := q.Table
+	if dead {
+		table += "_dead"
+	}
+	tag, err := q.Active.Or(q.DB).Exec(ctx, `DELETE FROM `+sanitizeTable(table)+` WHERE $1 = '' OR queue = $1`, queue)
+	if err != nil {
+		return 0, fmt.Errorf("error purging jobs: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// AdminHandler serves the queue's operator endpoints under prefix:
+//
+//	GET  prefix?queue=&dead=1&limit=  List as JSON
+//	POST prefix/retry?id=             Retry
+//	POST prefix/requeue?id=           Requeue a dead-lettered job
+//	POST prefix/purge?queue=&dead=1   Purge one queue, or every queue with all=1, replying with the count
+func (q *Queue) AdminHandler(prefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+prefix, func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			var err error
+			if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		jobs, err := q.List(r.Context(), r.URL.Query().Get("queue"), queryBool(r, "dead"), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(jobs)
+	})
+	for action, fn := range map[string]func(context.Context, int64) error{"retry": q.Retry, "requeue": q.Requeue} {
+		mux.HandleFunc("POST "+prefix+"/"+action, func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "id must be a job id", http.StatusBadRequest)
+				return
+			}
+			if err := fn(r.Context(), id); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("POST "+prefix+"/purge", func(w http.ResponseWriter, r *http.Request) {
+		queue := r.URL.Query().Get("queue")
+		if (queue == "") == !queryBool(r, "all") {
+			http.Error(w, "purge needs queue or all=1", http.StatusBadRequest)
+			return
+		}
+		n, err := q.Purge(r.Context(), queue, queryBool(r, "dead"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int64{"purged": n})
+	})
+	return mux
+}
+
+func queryBool(r *http.Request, name string) bool {
+	v, _ := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get(name)))
+	return v
+}
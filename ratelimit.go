@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RateLimiter is a token bucket in front of the pool's Query and Exec, so
+// one misbehaving caller cannot saturate MaxConns with a flood of
+// statements. Statements over the rate wait for a token, or with Reject
+// fail straight away with an *OverloadError carrying a retry hint.
+type RateLimiter struct {
+	DB      *pgxpool.Pool
+	Active  *ActivePool // Optional, used instead of DB once set
+	Limit   float64     // Statements per second
+	Burst   int         // Statements allowed at once above the rate, default 1
+	Reject  bool        // Fail over-rate statements instead of waiting
+	Metrics *PoolMetrics
+	Clock   Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing limit statements per second
+// with bursts of burst
+func NewRateLimiter(db *pgxpool.Pool, limit float64, burst int) *RateLimiter {
+	return &RateLimiter{DB: db, Limit: limit, Burst: burst}
+}
+
+// reserve takes a token, returning how long to wait until it is usable
+func (l *RateLimiter) reserve() time.Duration {
+	burst := float64(max(l.Burst, 1))
+	now := clockOr(l.Clock).Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*l.Limit)
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.Limit * float64(time.Second))
+}
+
+// unreserve returns a token taken by reserve that was not used
+func (l *RateLimiter) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// Wait blocks until a statement may run, or fails with an *OverloadError
+// in Reject mode
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l.Limit <= 0 {
+		return nil
+	}
+	delay := l.reserve()
+	if delay == 0 {
+		return nil
+	}
+	l.Metrics.addThrottled()
+	if l.Reject {
+		l.unreserve()
+		return &OverloadError{Reason: fmt.Sprintf("over %g statements per second", l.Limit), RetryAfter: delay}
+	}
+	if err := clockOr(l.Clock).Sleep(ctx, delay); err != nil {
+		l.unreserve()
+		return err
+	}
+	return nil
+}
+
+// Exec runs a statement once the rate allows
+func (l *RateLimiter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if err := l.Wait(ctx); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return l.Active.Or(l.DB).Exec(ctx, sql, args...)
+}
+
+// Query runs a query once the rate allows
+func (l *RateLimiter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if err := l.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return l.Active.Or(l.DB).Query(ctx, sql, args...)
+}
+
+// QueryRow runs a single-row query once the rate allows
+func (l *RateLimiter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if err := l.Wait(ctx); err != nil {
+		return errRow{err}
+	}
+	return l.Active.Or(l.DB).QueryRow(ctx, sql, args...)
+}
+
+// rateLimiter builds a limiter from PG_RATE_LIMIT, or returns nil when
+// statements are not limited
+func (c *DBConfig) rateLimiter(db *pgxpool.Pool, metrics *PoolMetrics) (*RateLimiter, error) {
+	if c.RateLimit <= 0 {
+		return nil, nil
+	}
+	l := NewRateLimiter(db, c.RateLimit, c.RateBurst)
+	l.Metrics = metrics
+	switch c.RateLimitMode {
+	case "", "wait":
+	case "reject":
+		l.Reject = true
+	default:
+		return nil, fmt.Errorf("invalid rate limit mode %q: expected wait or reject", c.RateLimitMode)
+	}
+	return l, nil
+}
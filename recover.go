@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrPanicked is matched by errors.Is on every *PanicError
+var ErrPanicked = errors.New("panic in database callback")
+
+// PanicError is a panic recovered from a scan function, a custom Scanner
+// or a transaction callback
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrPanicked, e.Value)
+}
+
+func (e *PanicError) Is(target error) bool { return target == ErrPanicked }
+
+// recoverTo turns a panic into a *PanicError in *err and runs cleanup.
+// Deferred directly, so recover sees the panic.
+func recoverTo(err *error, cleanup func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	pe := &PanicError{Value: r, Stack: debug.Stack()}
+	slog.Error("Recovered panic in database callback", slog.Any("panic", r), slog.String("stack", string(pe.Stack)))
+	if cleanup != nil {
+		cleanup()
+	}
+	*err = pe
+}
+
+// SafeCollectRows is pgx.CollectRows returning a panic in scan, or in a
+// Scanner it calls, as a *PanicError. The rows are closed either way.
+func SafeCollectRows[T any](rows pgx.Rows, scan pgx.RowToFunc[T]) (out []T, err error) {
+	defer recoverTo(&err, rows.Close)
+	return pgx.CollectRows(rows, scan)
+}
+
+// SafeForEachRow is pgx.ForEachRow returning a panic in fn or a Scanner as
+// a *PanicError
+func SafeForEachRow(rows pgx.Rows, scans []any, fn func() error) (tag pgconn.CommandTag, err error) {
+	defer recoverTo(&err, rows.Close)
+	return pgx.ForEachRow(rows, scans, fn)
+}
+
+// SafeTx runs fn in a transaction, committing when it returns nil. A panic
+// in fn rolls back and is returned as a *PanicError.
+func SafeTx(ctx context.Context, db *pgxpool.Pool, fn func(tx pgx.Tx) error) (err error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	defer recoverTo(&err, nil)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SafeConn runs fn on an acquired connection. After a panic in fn the
+// connection may be mid-query, so it is closed rather than returned to the
+// pool, and the panic is returned as a *PanicError.
+func SafeConn(ctx context.Context, db *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) (err error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	defer recoverTo(&err, func() {
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+		defer cancel()
+		_ = conn.Conn().Close(closeCtx)
+	})
+	return fn(conn)
+}
+
+// RecoverRows wraps rows so a panic in a Scanner during Scan or Values
+// closes them and comes back as a *PanicError, from the call and from Err
+func RecoverRows(rows pgx.Rows) pgx.Rows {
+	return &recoveringRows{Rows: rows}
+}
+
+type recoveringRows struct {
+	pgx.Rows
+	err error
+}
+
+func (r *recoveringRows) Scan(dest ...any) (err error) {
+	defer r.remember(&err)
+	defer recoverTo(&err, r.Rows.Close)
+	return r.Rows.Scan(dest...)
+}
+
+func (r *recoveringRows) Values() (values []any, err error) {
+	defer r.remember(&err)
+	defer recoverTo(&err, r.Rows.Close)
+	return r.Rows.Values()
+}
+
+func (r *recoveringRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Rows.Err()
+}
+
+// remember keeps a recovered panic for Err
+func (r *recoveringRows) remember(err *error) {
+	if errors.Is(*err, ErrPanicked) {
+		r.err = *err
+	}
+}
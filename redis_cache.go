@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache is a read-through cache of query results shared between
+// instances. Each cached query is declared with NewRedisQuery under a
+// name, which keys its results and selects its TTL.
+type RedisCache struct {
+	Client redis.Cmdable
+	Prefix string                   // Prepended to every key, default "pgxpool:"
+	TTL    time.Duration            // TTL of queries not in TTLs, default 5 minutes
+	TTLs   map[string]time.Duration // TTL by query name
+}
+
+// NewRedisCache creates a cache on client
+func NewRedisCache(client redis.Cmdable) *RedisCache {
+	return &RedisCache{Client: client}
+}
+
+func (c *RedisCache) prefix() string {
+	if c.Prefix == "" {
+		return "pgxpool:"
+	}
+	return c.Prefix
+}
+
+func (c *RedisCache) ttl(name string) time.Duration {
+	if ttl, ok := c.TTLs[name]; ok && ttl > 0 {
+		return ttl
+	}
+	if c.TTL <= 0 {
+		return 5 * time.Minute
+	}
+	return c.TTL
+}
+
+// Invalidate deletes every cached result of the named query
+func (c *RedisCache) Invalidate(ctx context.Context, name string) error {
+	iter := c.Client.Scan(ctx, 0, c.prefix()+name+":*", 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error listing cached %s results: %w", name, err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := c.Client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("error deleting cached %s results: %w", name, err)
+	}
+	return nil
+}
+
+// RedisQuery is one query whose results are looked up in Redis first and
+// stored there on a miss. Results are stored as JSON, so T must survive a
+// round trip through encoding/json. Redis being unavailable is logged and
+// the query runs against the database as if uncached.
+//
+//	userCount := NewRedisQuery(app.Cache, app.DBClient, "user_count", "SELECT count(*) FROM users", pgx.RowTo[int])
+//	n, err := userCount.QueryOne(ctx)
+type RedisQuery[T any] struct {
+	Cache *RedisCache
+	DB    DBTX
+	Name  string
+	SQL   string
+	Scan  pgx.RowToFunc[T]
+}
+
+// NewRedisQuery declares a cached query. A nil cache runs it uncached.
+func NewRedisQuery[T any](cache *RedisCache, db DBTX, name, sql string, scan pgx.RowToFunc[T]) *RedisQuery[T] {
+	return &RedisQuery[T]{Cache: cache, DB: db, Name: name, SQL: sql, Scan: scan}
+}
+
+// key identifies the query's result for args. Arguments are keyed by
+// their printed values, so pass plain values rather than pointers.
+func (q *RedisQuery[T]) key(args []any) string {
+	sum := sha256.Sum256([]byte(cacheKey(q.SQL, args)))
+	return q.Cache.prefix() + q.Name + ":" + hex.EncodeToString(sum[:16])
+}
+
+// Query returns every row for args
+func (q *RedisQuery[T]) Query(ctx context.Context, args ...any) ([]T, error) {
+	if q.Cache == nil {
+		return q.query(ctx, args)
+	}
+
+	key := q.key(args)
+	data, err := q.Cache.Client.Get(ctx, key).Bytes()
+	switch {
+	case err == nil:
+		var out []T
+		if err := json.Unmarshal(data, &out); err == nil {
+			return out, nil
+		}
+		slog.Warn("Discarding unreadable cached result", slog.String("query", q.Name), slog.String("error", err.Error()))
+	case !errors.Is(err, redis.Nil):
+		slog.Warn("Redis cache lookup failed", slog.String("query", q.Name), slog.String("error", err.Error()))
+	}
+
+	out, err := q.query(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if data, err := json.Marshal(out); err != nil {
+		slog.Warn("Error encoding result for cache", slog.String("query", q.Name), slog.String("error", err.Error()))
+	} else if err := q.Cache.Client.Set(ctx, key, data, q.Cache.ttl(q.Name)).Err(); err != nil {
+		slog.Warn("Redis cache write failed", slog.String("query", q.Name), slog.String("error", err.Error()))
+	}
+	return out, nil
+}
+
+// QueryOne returns the single row for args, or pgx.ErrNoRows or
+// pgx.ErrTooManyRows
+func (q *RedisQuery[T]) QueryOne(ctx context.Context, args ...any) (T, error) {
+	var zero T
+	rows, err := q.Query(ctx, args...)
+	switch {
+	case err != nil:
+		return zero, err
+	case len(rows) == 0:
+		return zero, pgx.ErrNoRows
+	case len(rows) > 1:
+		return zero, pgx.ErrTooManyRows
+	}
+	return rows[0], nil
+}
+
+// Invalidate deletes the cached result for args
+func (q *RedisQuery[T]) Invalidate(ctx context.Context, args ...any) error {
+	if q.Cache == nil {
+		return nil
+	}
+	if err := q.Cache.Client.Del(ctx, q.key(args)).Err(); err != nil {
+		return fmt.Errorf("error deleting cached %s result: %w", q.Name, err)
+	}
+	return nil
+}
+
+// InvalidateAll deletes every cached result of the query
+func (q *RedisQuery[T]) InvalidateAll(ctx context.Context) error {
+	if q.Cache == nil {
+		return nil
+	}
+	return q.Cache.Invalidate(ctx, q.Name)
+}
+
+// InvalidateTable deletes every cached result of the query when it reads
+// table or table is empty. Results are keyed by a hash of their
+// arguments, so key cannot narrow the eviction.
+func (q *RedisQuery[T]) InvalidateTable(ctx context.Context, table, _ string) error {
+	if table != "" && !slices.ContainsFunc(ParseStatement(q.SQL).Tables, func(t string) bool { return sameTable(t, table) }) {
+		return nil
+	}
+	return q.InvalidateAll(ctx)
+}
+
+func (q *RedisQuery[T]) query(ctx context.Context, args []any) ([]T, error) {
+	rows, err := q.DB.Query(ctx, q.SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, q.Scan)
+}
+
+// parseCacheTTLs parses "name=30s,name=5m"
+func parseCacheTTLs(s string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, d, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache ttl %q: expected name=duration", item)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid cache ttl %q: expected a positive duration", item)
+		}
+		ttls[strings.TrimSpace(name)] = ttl
+	}
+	return ttls, nil
+}
+
+// redisCache builds the cache from PG_CACHE_REDIS_URL, or returns nil
+// when it is not set. The caller closes the client.
+func (c *DBConfig) redisCache() (*RedisCache, *redis.Client, error) {
+	if c.CacheRedisURL == "" {
+		return nil, nil, nil
+	}
+	opts, err := redis.ParseURL(c.CacheRedisURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cache redis url: %w", err)
+	}
+	ttls, err := parseCacheTTLs(c.CacheTTLs)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := redis.NewClient(opts)
+	cache := NewRedisCache(client)
+	cache.TTL = c.CacheTTL
+	cache.TTLs = ttls
+	return cache, client, nil
+}
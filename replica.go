@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNotReplica is returned when a replica pool connects to a node that
+// accepts writes
+var ErrNotReplica = errors.New("node is not a replica")
+
+// WithReplica builds the pool for reading from a standby. Sessions start
+// with default_transaction_read_only on, so a write fails even if the node
+// is later promoted, and each new connection must find the node in
+// recovery: a primary, or a standby already promoted, is refused with
+// ErrNotReplica instead of silently taking writes meant to be reads.
+func WithReplica() PoolOption {
+	return func(s *poolSettings) {
+		// A startup parameter is also what RESET ALL and DISCARD ALL return to
+		s.config.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+
+		prev := s.config.AfterConnect
+		s.config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			if prev != nil {
+				if err := prev(ctx, conn); err != nil {
+					return err
+				}
+			}
+			var inRecovery bool
+			if err := conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+				return fmt.Errorf("error checking replica: %w", err)
+			}
+			if !inRecovery {
+				return fmt.Errorf("%w: %s is not in recovery", ErrNotReplica, conn.PgConn().Conn().RemoteAddr())
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DBTX is what *pgxpool.Pool, *pgxpool.Conn, *pgx.Conn, pgx.Tx and
+// *NamedPool have in common, so data access code can run on any of them
+type DBTX interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Repository is the basic CRUD statements for one table, mapped to the
+// entity struct T. Columns come from the fields' db tags, as read by
+// pgx.RowToStructByName, with options after a comma:
+//
+//	type User struct {
+//		ID        int       `db:"id,pk" table:"users"`
+//		Name      string    `db:"name"`
+//		CreatedAt time.Time `db:"created_at,readonly"`
+//	}
+//	users := NewRepository[User](app.DBClient)
+//
+// pk marks the primary key, which Create leaves to the database while it
+// is the zero value; readonly columns are read but never written. The
+// table tag may sit on any field, and CreateTableFor reads the same tags.
+// Statements run in the ambient transaction of ctx when there is one
+// (dbctx.WithTx), otherwise on DB.
+type Repository[T any] struct {
+	DB DBTX
+
+	table   string // Sanitized
+	columns []repoColumn
+	pk      int // Index into columns
+	list    string
+}
+
+type repoColumn struct {
+	name     string // Sanitized
+	index    []int
+	readonly bool
+}
+
+// NewRepository creates a repository for T on db. Like regexp.MustCompile
+// it panics when T's tags are unusable, which is a programming error.
+func NewRepository[T any](db DBTX) *Repository[T] {
+	r, err := newRepository[T](db)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func newRepository[T any](db DBTX) (*Repository[T], error) {
+	t := reflect.TypeFor[T]()
+	e, err := parseEntity(t)
+	if err != nil {
+		return nil, err
+	}
+	if e.table == "" {
+		return nil, fmt.Errorf("repository entity %s has no table tag", t)
+	}
+	if e.pk < 0 {
+		return nil, fmt.Errorf("repository entity %s has no pk field", t)
+	}
+
+	r := &Repository[T]{DB: db, table: e.sanitizedTable(), pk: e.pk}
+	names := make([]string, len(e.columns))
+	for i, col := range e.columns {
+		names[i] = pgx.Identifier{col.name}.Sanitize()
+		r.columns = append(r.columns, repoColumn{name: names[i], index: col.field.Index, readonly: col.readonly})
+	}
+	r.list = strings.Join(names, ", ")
+	return r, nil
+}
+
+// entity is the table mapping read from a struct's tags
+type entity struct {
+	table   string // As tagged, possibly schema-qualified
+	columns []entityColumn
+	pk      int // Index into columns, -1 when there is none
+}
+
+type entityColumn struct {
+	name     string
+	field    reflect.StructField
+	pk       bool
+	readonly bool
+	null     bool   // Nullable even if the Go type is not
+	unique   bool   // Gets a unique constraint
+	indexed  bool   // Gets an index
+	sqlType  string // From the sqltype tag, overriding the type derived from Go
+}
+
+// parseEntity reads the db tags of struct t and its table tag. Options
+// after the column name are pk, readonly, null, unique and index.
+func parseEntity(t reflect.Type) (*entity, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("entity %s is not a struct", t)
+	}
+	e := &entity{pk: -1}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if table, ok := f.Tag.Lookup("table"); ok {
+			e.table = table
+		}
+		if !f.IsExported() {
+			continue
+		}
+		tag, _ := f.Tag.Lookup("db")
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		col := entityColumn{name: name, field: f, sqlType: f.Tag.Get("sqltype")}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "pk":
+				if e.pk >= 0 {
+					return nil, fmt.Errorf("entity %s has more than one pk field", t)
+				}
+				e.pk = len(e.columns)
+				col.pk = true
+			case "readonly":
+				col.readonly = true
+			case "null":
+				col.null = true
+			case "unique":
+				col.unique = true
+			case "index":
+				col.indexed = true
+			}
+		}
+		e.columns = append(e.columns, col)
+	}
+	return e, nil
+}
+
+func (e *entity) sanitizedTable() string {
+	return sanitizeTable(e.table)
+}
+
+// sanitizeTable quotes a table name, optionally schema-qualified, for use
+// in SQL
+func sanitizeTable(table string) string {
+	return pgx.Identifier(strings.Split(table, ".")).Sanitize()
+}
+
+// db returns the ambient transaction or the repository's DB
+func (r *Repository[T]) db(ctx context.Context) DBTX {
+	if tx, ok := dbctx.Tx(ctx); ok {
+		return tx
+	}
+	return r.DB
+}
+
+// With returns a copy of the repository running on db, e.g. a transaction
+func (r *Repository[T]) With(db DBTX) *Repository[T] {
+	c := *r
+	c.DB = db
+	return &c
+}
+
+// Get returns the row whose primary key is id, or pgx.ErrNoRows
+func (r *Repository[T]) Get(ctx context.Context, id any) (T, error) {
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", r.list, r.table, r.columns[r.pk].name)
+	return r.one(ctx, sql, id)
+}
+
+// List returns every row, by primary key
+func (r *Repository[T]) List(ctx context.Context) ([]T, error) {
+	return r.query(ctx, fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", r.list, r.table, r.columns[r.pk].name))
+}
+
+// Where returns the rows matching cond, by primary key. cond is written
+// as given, with $1... referring to args.
+//
+//	active, err := users.Where(ctx, "last_login > $1", since)
+func (r *Repository[T]) Where(ctx context.Context, cond string, args ...any) ([]T, error) {
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s", r.list, r.table, cond, r.columns[r.pk].name)
+	return r.query(ctx, sql, args...)
+}
+
+// Create inserts v and updates it from the inserted row, so generated keys
+// and column defaults are filled in
+func (r *Repository[T]) Create(ctx context.Context, v *T) error {
+	val := reflect.ValueOf(v).Elem()
+	var (
+		cols, params []string
+		args         []any
+	)
+	for i, col := range r.columns {
+		field := val.FieldByIndex(col.index)
+		if col.readonly || (i == r.pk && field.IsZero()) {
+			continue
+		}
+		args = append(args, field.Interface())
+		cols = append(cols, col.name)
+		params = append(params, fmt.Sprintf("$%d", len(args)))
+	}
+
+	var sql string
+	if len(cols) == 0 {
+		sql = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES RETURNING %s", r.table, r.list)
+	} else {
+		sql = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING %s",
+			r.table, strings.Join(cols, ", "), strings.Join(params, ", "), r.list)
+	}
+	return r.into(ctx, v, sql, args...)
+}
+
+// Update writes v over the row with its primary key and updates it from
+// the result. It returns pgx.ErrNoRows when there is no such row.
+func (r *Repository[T]) Update(ctx context.Context, v *T) error {
+	val := reflect.ValueOf(v).Elem()
+	var (
+		sets []string
+		args []any
+	)
+	for i, col := range r.columns {
+		if col.readonly || i == r.pk {
+			continue
+		}
+		args = append(args, val.FieldByIndex(col.index).Interface())
+		sets = append(sets, fmt.Sprintf("%s = $%d", col.name, len(args)))
+	}
+	if len(sets) == 0 {
+		return fmt.Errorf("repository for %s has no writable columns", r.table)
+	}
+	args = append(args, val.FieldByIndex(r.columns[r.pk].index).Interface())
+	sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s = $%d RETURNING %s",
+		r.table, strings.Join(sets, ", "), r.columns[r.pk].name, len(args), r.list)
+	return r.into(ctx, v, sql, args...)
+}
+
+// Delete removes the row whose primary key is id. It returns
+// pgx.ErrNoRows when there is no such row.
+func (r *Repository[T]) Delete(ctx context.Context, id any) error {
+	tag, err := r.db(ctx).Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = $1", r.table, r.columns[r.pk].name), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *Repository[T]) query(ctx context.Context, sql string, args ...any) ([]T, error) {
+	rows, err := r.db(ctx).Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[T])
+}
+
+func (r *Repository[T]) one(ctx context.Context, sql string, args ...any) (T, error) {
+	rows, err := r.db(ctx).Query(ctx, sql, args...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[T])
+}
+
+func (r *Repository[T]) into(ctx context.Context, v *T, sql string, args ...any) error {
+	got, err := r.one(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	*v = got
+	return nil
+}
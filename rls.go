@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WithRLSContext runs fn in a transaction with the given settings (e.g.
+// app.current_user_id) applied as SET LOCAL, so row-level security policies
+// can read them with current_setting. The settings end with the
+// transaction and never leak onto the pooled connection. It commits when fn
+// returns nil and rolls back otherwise.
+func WithRLSContext(ctx context.Context, db *pgxpool.Pool, settings map[string]string, fn func(tx pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if len(settings) > 0 {
+			sql, args := setLocalQuery(settings)
+			if _, err := tx.Exec(ctx, sql, args...); err != nil {
+				return fmt.Errorf("error applying rls settings: %w", err)
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// setLocalQuery applies every setting in one round trip. set_config takes
+// the name as a parameter, so names and values need no quoting.
+func setLocalQuery(settings map[string]string) (string, []any) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	calls := make([]string, len(names))
+	args := make([]any, 0, 2*len(names))
+	for i, name := range names {
+		calls[i] = fmt.Sprintf("set_config($%d, $%d, true)", 2*i+1, 2*i+2)
+		args = append(args, name, settings[name])
+	}
+	return "SELECT " + strings.Join(calls, ", "), args
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrRoleDrift is returned by the roles diff command when the database does
+// not match the spec
+var ErrRoleDrift = errors.New("roles have drifted from the spec")
+
+// RolesSpec declares the application's roles and what they may access
+type RolesSpec struct {
+	Roles    []RoleSpec `json:"roles"`
+	DiffOnly bool       `json:"-"` // Report drift without applying it
+}
+
+// RoleSpec is one role. Memberships are only ever added. Privileges on the
+// tables named are kept exactly as listed, revoking any others.
+type RoleSpec struct {
+	Name     string   `json:"name"`
+	Login    bool     `json:"login"`
+	Password string   `json:"password,omitempty"` // Set when the role is created, never compared
+	MemberOf []string `json:"member_of,omitempty"`
+
+	Grants            []TableGrant       `json:"grants,omitempty"`
+	DefaultPrivileges []DefaultPrivilege `json:"default_privileges,omitempty"`
+}
+
+// TableGrant lists the privileges a role has on a table, or on every
+// existing table in the schema when Table is "*"
+type TableGrant struct {
+	Schema     string   `json:"schema,omitempty"` // Default public
+	Table      string   `json:"table"`
+	Privileges []string `json:"privileges"` // e.g. SELECT, INSERT or ALL
+}
+
+// DefaultPrivilege lists the privileges a role gets on tables Owner creates
+// in Schema from now on
+type DefaultPrivilege struct {
+	Schema     string   `json:"schema,omitempty"` // Default public
+	Owner      string   `json:"owner,omitempty"`  // Default the connecting user
+	Privileges []string `json:"privileges"`
+}
+
+// RoleDrift is a difference between the spec and the database, with the
+// statement that fixes it
+type RoleDrift struct {
+	Role   string
+	Change string
+	SQL    string
+}
+
+var tablePrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"}
+
+// normalizePrivileges upper-cases privileges and expands ALL
+func normalizePrivileges(privs []string) ([]string, error) {
+	var out []string
+	for _, p := range privs {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		switch {
+		case p == "ALL" || p == "ALL PRIVILEGES":
+			out = append(out, tablePrivileges...)
+		case slices.Contains(tablePrivileges, p):
+			out = append(out, p)
+		default:
+			return nil, fmt.Errorf("unknown table privilege %q", p)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// EnsureRoles creates the roles in spec, adds their memberships, and grants
+// and revokes table and default privileges until the database matches it,
+// all in one transaction. It returns what it changed, or with DiffOnly what
+// it would change.
+func EnsureRoles(ctx context.Context, db *pgxpool.Pool, spec RolesSpec) ([]RoleDrift, error) {
+	// Roles are all created before anything is granted to or from them
+	var drift, changes []RoleDrift
+	for _, role := range spec.Roles {
+		d, err := roleDrift(ctx, db, role)
+		if err != nil {
+			return nil, fmt.Errorf("error checking role %s: %w", role.Name, err)
+		}
+		for _, c := range d {
+			if c.Change == "create role" {
+				drift = append(drift, c)
+			} else {
+				changes = append(changes, c)
+			}
+		}
+	}
+	drift = append(drift, changes...)
+	if spec.DiffOnly || len(drift) == 0 {
+		return drift, nil
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	for _, d := range drift {
+		if _, err := tx.Exec(ctx, d.SQL); err != nil {
+			return nil, fmt.Errorf("error applying %q to role %s: %w", d.Change, d.Role, err)
+		}
+		slog.Info("Applied role change", slog.String("role", d.Role), slog.String("change", d.Change))
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return drift, nil
+}
+
+// roleDrift compares one role with the database
+func roleDrift(ctx context.Context, db *pgxpool.Pool, role RoleSpec) ([]RoleDrift, error) {
+	if role.Name == "" {
+		return nil, errors.New("role name is required")
+	}
+	name := pgx.Identifier{role.Name}.Sanitize()
+	var drift []RoleDrift
+	add := func(change, sql string) {
+		drift = append(drift, RoleDrift{Role: role.Name, Change: change, SQL: sql})
+	}
+
+	login := "NOLOGIN"
+	if role.Login {
+		login = "LOGIN"
+	}
+	var canLogin bool
+	err := db.QueryRow(ctx, "SELECT rolcanlogin FROM pg_roles WHERE rolname = $1", role.Name).Scan(&canLogin)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		sql := "CREATE ROLE " + name + " " + login
+		if role.Password != "" {
+			sql += " PASSWORD " + quoteLiteral(role.Password)
+		}
+		add("create role", sql)
+	case err != nil:
+		return nil, err
+	case canLogin != role.Login:
+		add("set "+strings.ToLower(login), "ALTER ROLE "+name+" "+login)
+	}
+
+	var memberOf []string
+	err = db.QueryRow(ctx, `
+		SELECT coalesce(array_agg(r.rolname::text), '{}')
+		FROM pg_auth_members m
+		JOIN pg_roles r ON r.oid = m.roleid
+		JOIN pg_roles u ON u.oid = m.member
+		WHERE u.rolname = $1`, role.Name).Scan(&memberOf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading memberships: %w", err)
+	}
+	for _, parent := range role.MemberOf {
+		if !slices.Contains(memberOf, parent) {
+			add("add to "+parent, "GRANT "+pgx.Identifier{parent}.Sanitize()+" TO "+name)
+		}
+	}
+
+	schemas := map[string]bool{}
+	for _, g := range role.Grants {
+		schema := cmp.Or(g.Schema, "public")
+		if !schemas[schema] {
+			schemas[schema] = true
+			var usage bool
+			err := db.QueryRow(ctx, `
+				SELECT CASE WHEN EXISTS (SELECT FROM pg_roles WHERE rolname = $1)
+					THEN has_schema_privilege($1::text, $2::text, 'USAGE') ELSE false END`, role.Name, schema).Scan(&usage)
+			if err != nil {
+				return nil, fmt.Errorf("error checking usage on schema %s: %w", schema, err)
+			}
+			if !usage {
+				add("grant usage on schema "+schema, "GRANT USAGE ON SCHEMA "+pgx.Identifier{schema}.Sanitize()+" TO "+name)
+			}
+		}
+
+		want, err := normalizePrivileges(g.Privileges)
+		if err != nil {
+			return nil, err
+		}
+		tables, err := tableGrants(ctx, db, role.Name, schema, g.Table)
+		if err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 && g.Table != "*" {
+			return nil, fmt.Errorf("table %s.%s does not exist", schema, g.Table)
+		}
+		for _, table := range slices.Sorted(maps.Keys(tables)) {
+			have := tables[table]
+			ident := pgx.Identifier{schema, table}.Sanitize()
+			if missing := privilegeDiff(want, have); len(missing) > 0 {
+				add(fmt.Sprintf("grant %s on %s.%s", strings.Join(missing, ", "), schema, table),
+					"GRANT "+strings.Join(missing, ", ")+" ON TABLE "+ident+" TO "+name)
+			}
+			if extra := privilegeDiff(have, want); len(extra) > 0 {
+				add(fmt.Sprintf("revoke %s on %s.%s", strings.Join(extra, ", "), schema, table),
+					"REVOKE "+strings.Join(extra, ", ")+" ON TABLE "+ident+" FROM "+name)
+			}
+		}
+	}
+
+	for _, dp := range role.DefaultPrivileges {
+		schema := cmp.Or(dp.Schema, "public")
+		want, err := normalizePrivileges(dp.Privileges)
+		if err != nil {
+			return nil, err
+		}
+		var have []string
+		err = db.QueryRow(ctx, `
+			SELECT coalesce(array_agg(a.privilege_type) FILTER (
+				WHERE a.grantee = (SELECT oid FROM pg_roles WHERE rolname = $1)), '{}')
+			FROM pg_default_acl d
+			JOIN pg_namespace n ON n.oid = d.defaclnamespace
+			LEFT JOIN LATERAL aclexplode(d.defaclacl) a ON true
+			WHERE d.defaclobjtype = 'r' AND n.nspname = $2
+				AND d.defaclrole = (SELECT oid FROM pg_roles WHERE rolname = coalesce(nullif($3::text, ''), current_user))`,
+			role.Name, schema, dp.Owner).Scan(&have)
+		if err != nil {
+			return nil, fmt.Errorf("error reading default privileges in %s: %w", schema, err)
+		}
+
+		prefix := "ALTER DEFAULT PRIVILEGES"
+		if dp.Owner != "" {
+			prefix += " FOR ROLE " + pgx.Identifier{dp.Owner}.Sanitize()
+		}
+		prefix += " IN SCHEMA " + pgx.Identifier{schema}.Sanitize()
+		if missing := privilegeDiff(want, have); len(missing) > 0 {
+			add(fmt.Sprintf("default grant %s in %s", strings.Join(missing, ", "), schema),
+				prefix+" GRANT "+strings.Join(missing, ", ")+" ON TABLES TO "+name)
+		}
+		if extra := privilegeDiff(have, want); len(extra) > 0 {
+			add(fmt.Sprintf("default revoke %s in %s", strings.Join(extra, ", "), schema),
+				prefix+" REVOKE "+strings.Join(extra, ", ")+" ON TABLES FROM "+name)
+		}
+	}
+	return drift, nil
+}
+
+// tableGrants returns the privileges role holds on each matching table
+func tableGrants(ctx context.Context, db *pgxpool.Pool, role, schema, table string) (map[string][]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.relname::text, coalesce(array_agg(a.privilege_type) FILTER (
+			WHERE a.grantee = (SELECT oid FROM pg_roles WHERE rolname = $1)), '{}')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN LATERAL aclexplode(c.relacl) a ON true
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f') AND n.nspname = $2 AND ($3::text = '*' OR c.relname = $3::text)
+		GROUP BY c.relname`, role, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("error reading table privileges in %s: %w", schema, err)
+	}
+	out := map[string][]string{}
+	var name string
+	var privs []string
+	_, err = pgx.ForEachRow(rows, []any{&name, &privs}, func() error {
+		out[name] = privs
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading table privileges in %s: %w", schema, err)
+	}
+	return out, nil
+}
+
+// privilegeDiff returns the privileges in a that are not in b
+func privilegeDiff(a, b []string) []string {
+	var out []string
+	for _, p := range a {
+		if slices.Contains(tablePrivileges, p) && !slices.Contains(b, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
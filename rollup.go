@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MetricRollup writes application metrics and event counts to Postgres
+// already aggregated into minute and hour buckets, for teams using the
+// database as a lightweight metrics sink. Recorded values are combined in
+// memory and flushed every FlushInterval as additive upserts, so a hot
+// metric costs one row update per bucket per flush rather than a row per
+// event. Unflushed values are lost if the process dies.
+//
+// Buckets live in <Table>_minute and <Table>_hour as (name, bucket, count,
+// sum, min, max) rows; averages are sum / count.
+type MetricRollup struct {
+	DB            *pgxpool.Pool
+	Table         string
+	FlushInterval time.Duration // How often Run flushes, default 10s
+	Clock         Clock
+
+	mu      sync.Mutex
+	pending map[rollupKey]*rollupAgg
+}
+
+type rollupKey struct {
+	name   string
+	bucket time.Time // Start of the minute
+}
+
+type rollupAgg struct {
+	count         int64
+	sum, min, max float64
+}
+
+func (a *rollupAgg) merge(b *rollupAgg) {
+	a.count += b.count
+	a.sum += b.sum
+	a.min = math.Min(a.min, b.min)
+	a.max = math.Max(a.max, b.max)
+}
+
+// NewMetricRollup creates a rollup writer and its tables
+func NewMetricRollup(ctx context.Context, db *pgxpool.Pool, table string) (*MetricRollup, error) {
+	r := &MetricRollup{DB: db, Table: table, FlushInterval: 10 * time.Second}
+	for _, t := range r.tables() {
+		_, err := db.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(t)+` (
+			name text NOT NULL,
+			bucket timestamptz NOT NULL,
+			count bigint NOT NULL,
+			sum double precision NOT NULL,
+			min double precision NOT NULL,
+			max double precision NOT NULL,
+			PRIMARY KEY (name, bucket)
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s: %w", t, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *MetricRollup) tables() [2]string {
+	return [2]string{r.Table + "_minute", r.Table + "_hour"}
+}
+
+// Record adds a value to the metric's current buckets
+func (r *MetricRollup) Record(name string, value float64) {
+	r.RecordAt(name, clockOr(r.Clock).Now(), value)
+}
+
+// Count records one occurrence of an event, as a value of 1
+func (r *MetricRollup) Count(name string) {
+	r.Record(name, 1)
+}
+
+// RecordAt adds a value to the buckets containing at, for events reported
+// after the fact
+func (r *MetricRollup) RecordAt(name string, at time.Time, value float64) {
+	key := rollupKey{name: name, bucket: at.UTC().Truncate(time.Minute)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[rollupKey]*rollupAgg)
+	}
+	if agg, ok := r.pending[key]; ok {
+		agg.merge(&rollupAgg{count: 1, sum: value, min: value, max: value})
+	} else {
+		r.pending[key] = &rollupAgg{count: 1, sum: value, min: value, max: value}
+	}
+}
+
+// Flush writes the pending buckets to both tables in one transaction.
+// Buckets that fail to write are kept for the next flush.
+func (r *MetricRollup) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	hours := make(map[rollupKey]*rollupAgg)
+	for key, agg := range pending {
+		hour := rollupKey{name: key.name, bucket: key.bucket.Truncate(time.Hour)}
+		if h, ok := hours[hour]; ok {
+			h.merge(agg)
+		} else {
+			c := *agg
+			hours[hour] = &c
+		}
+	}
+
+	err := pgx.BeginFunc(ctx, r.DB, func(tx pgx.Tx) error {
+		for i, buckets := range []map[rollupKey]*rollupAgg{pending, hours} {
+			if err := r.upsert(ctx, tx, r.tables()[i], buckets); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.mu.Lock()
+		if r.pending == nil {
+			r.pending = make(map[rollupKey]*rollupAgg)
+		}
+		for key, agg := range pending {
+			if p, ok := r.pending[key]; ok {
+				p.merge(agg)
+			} else {
+				r.pending[key] = agg
+			}
+		}
+		r.mu.Unlock()
+		return fmt.Errorf("error flushing metric rollups: %w", err)
+	}
+	return nil
+}
+
+func (r *MetricRollup) upsert(ctx context.Context, tx pgx.Tx, table string, buckets map[rollupKey]*rollupAgg) error {
+	var (
+		names    = make([]string, 0, len(buckets))
+		times    = make([]time.Time, 0, len(buckets))
+		counts   = make([]int64, 0, len(buckets))
+		sums     = make([]float64, 0, len(buckets))
+		min, max = make([]float64, 0, len(buckets)), make([]float64, 0, len(buckets))
+	)
+	for key, agg := range buckets {
+		names = append(names, key.name)
+		times = append(times, key.bucket)
+		counts = append(counts, agg.count)
+		sums = append(sums, agg.sum)
+		min = append(min, agg.min)
+		max = append(max, agg.max)
+	}
+	_, err := tx.Exec(ctx, `INSERT INTO `+sanitizeTable(table)+` AS t (name, bucket, count, sum, min, max)
+		SELECT * FROM unnest($1::text[], $2::timestamptz[], $3::bigint[], $4::float8[], $5::float8[], $6::float8[])
+		ON CONFLICT (name, bucket) DO UPDATE SET
+			count = t.count + EXCLUDED.count,
+			sum = t.sum + EXCLUDED.sum,
+			min = LEAST(t.min, EXCLUDED.min),
+			max = GREATEST(t.max, EXCLUDED.max)`,
+		names, times, counts, sums, min, max)
+	return err
+}
+
+// Run flushes every FlushInterval until ctx is cancelled, then flushes
+// once more
+func (r *MetricRollup) Run(ctx context.Context) error {
+	interval := r.FlushInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	clock := clockOr(r.Clock)
+	for {
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return r.Flush(context.WithoutCancel(ctx))
+		}
+		if err := r.Flush(ctx); err != nil {
+			slog.Error("Error flushing metric rollups", slog.String("error", err.Error()))
+		}
+	}
+}
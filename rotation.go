@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CredentialRotator swaps the credentials used for new connections while the
+// pool keeps running. Connections opened with older credentials are recycled
+// at random points within Window, so the pool reconnects gradually instead of
+// all at once.
+type CredentialRotator struct {
+	Window time.Duration // Spread for recycling old connections, default 1 minute
+	Clock  Clock         // Default SystemClock
+
+	mu        sync.RWMutex
+	creds     Credentials
+	gen       int64
+	rotatedAt time.Time
+	conns     map[*pgx.Conn]*rotatedConn
+}
+
+// rotatedConn tracks which credentials generation a connection was opened with
+type rotatedConn struct {
+	gen       int64
+	recycleAt time.Time // Set once the connection is found to be stale
+}
+
+// NewCredentialRotator creates a rotator that leaves the configured
+// credentials in place until the first rotation
+func NewCredentialRotator() *CredentialRotator {
+	return &CredentialRotator{
+		Window: time.Minute,
+		conns:  make(map[*pgx.Conn]*rotatedConn),
+	}
+}
+
+// RotateCredentials makes new connections use user and password. An empty
+// user keeps the current one. Existing connections keep working and are
+// replaced as they are acquired or released over the rotation window; idle
+// connections that are never used are replaced by MaxConnLifetime.
+func (r *CredentialRotator) RotateCredentials(user, password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user != "" {
+		r.creds.UserName = user
+	}
+	r.creds.Password = password
+	r.gen++
+	r.rotatedAt = clockOr(r.Clock).Now()
+
+	slog.Info("Rotated database credentials",
+		slog.Int64("generation", r.gen),
+		slog.Int("connections_to_recycle", len(r.conns)),
+		slog.Duration("window", r.Window))
+}
+
+func (r *CredentialRotator) current() (Credentials, int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.creds, r.gen
+}
+
+// track records the generation a new connection authenticated with. A
+// connection whose password no longer matches raced with a rotation and is
+// treated as stale.
+func (r *CredentialRotator) track(conn *pgx.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	gen := r.gen
+	if gen > 0 && conn.Config().Password != r.creds.Password {
+		gen--
+	}
+	r.conns[conn] = &rotatedConn{gen: gen}
+}
+
+func (r *CredentialRotator) forget(conn *pgx.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, conn)
+}
+
+// due reports whether conn was opened with old credentials and its recycle
+// time has passed
+func (r *CredentialRotator) due(conn *pgx.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.conns[conn]
+	if !ok || c.gen == r.gen {
+		return false
+	}
+	if c.recycleAt.IsZero() {
+		c.recycleAt = r.rotatedAt
+		if r.Window > 0 {
+			c.recycleAt = c.recycleAt.Add(rand.N(r.Window))
+		}
+	}
+	return !clockOr(r.Clock).Now().Before(c.recycleAt)
+}
+
+// WithCredentialRotation lets r replace the credentials of a running pool.
+// Its BeforeConnect hook runs after the config-implied ones, so a rotated
+// password takes precedence.
+func WithCredentialRotation(r *CredentialRotator) PoolOption {
+	return func(s *poolSettings) {
+		prevConnect := s.config.BeforeConnect
+		s.config.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+			if prevConnect != nil {
+				if err := prevConnect(ctx, cc); err != nil {
+					return err
+				}
+			}
+
+			creds, gen := r.current()
+			if gen == 0 {
+				return nil
+			}
+			if creds.UserName != "" {
+				cc.User = creds.UserName
+			}
+			cc.Password = creds.Password
+			return nil
+		}
+
+		prevAfterConnect := s.config.AfterConnect
+		s.config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			if prevAfterConnect != nil {
+				if err := prevAfterConnect(ctx, conn); err != nil {
+					return err
+				}
+			}
+			r.track(conn)
+			return nil
+		}
+
+		prevAcquire := s.config.BeforeAcquire
+		s.config.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+			if prevAcquire != nil && !prevAcquire(ctx, conn) {
+				return false
+			}
+			if r.due(conn) {
+				s.metrics.addRotationRecycled()
+				return false
+			}
+			return true
+		}
+
+		prevRelease := s.config.AfterRelease
+		s.config.AfterRelease = func(conn *pgx.Conn) bool {
+			if prevRelease != nil && !prevRelease(conn) {
+				return false
+			}
+			if r.due(conn) {
+				s.metrics.addRotationRecycled()
+				return false
+			}
+			return true
+		}
+
+		prevClose := s.config.BeforeClose
+		s.config.BeforeClose = func(conn *pgx.Conn) {
+			if prevClose != nil {
+				prevClose(conn)
+			}
+			r.forget(conn)
+		}
+	}
+}
+
+// RotateCredentials switches the pool to new credentials without a restart.
+// The pool must have been created with WithCredentialRotation(app.Rotator).
+func (app *App) RotateCredentials(user, password string) error {
+	if app.Rotator == nil {
+		return errors.New("credential rotation is not enabled for this pool")
+	}
+	app.Rotator.RotateCredentials(user, password)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Pool names understood by dbctx.WithPool
+const (
+	PoolPrimary   = "primary"
+	PoolReplica   = "replica"
+	PoolAnalytics = "analytics"
+)
+
+// Pool returns the pool for the queries run with ctx: the primary under
+// dbctx.ForcePrimary, otherwise the pool named by dbctx.WithPool, otherwise
+// the primary. App helpers that run caller work, such as ScopedPool and
+// AsRole, and App.Workload choose their pool this way. A name the app has
+// no pool for falls back to the primary.
+func (app *App) Pool(ctx context.Context) *pgxpool.Pool {
+	if dbctx.PrimaryForced(ctx) {
+		return app.primary()
+	}
+	switch name := dbctx.Pool(ctx); name {
+	case "", PoolPrimary:
+	case PoolReplica:
+		if app.Replica != nil {
+			return app.Replica
+		}
+	case PoolAnalytics:
+		return app.Analytics()
+	default:
+		slog.Warn("Unknown pool override, using the primary", slog.String("pool", name))
+	}
+	return app.primary()
+}
+
+// primary returns the primary pool: the one Supervisor last swapped in, or
+// DBClient when unsupervised
+func (app *App) primary() *pgxpool.Pool {
+	return app.active().Or(app.DBClient)
+}
+
+// active returns the supervised primary, nil when unsupervised
+func (app *App) active() *ActivePool {
+	if app.Supervisor == nil {
+		return nil
+	}
+	return app.Supervisor.Active
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/pflag"
+)
+
+//go:embed scaffold/service
+var serviceTemplates embed.FS
+
+const scaffoldUsage = `usage: go-pgxpool scaffold service <name> [--dir path] [--module path] [--force]`
+
+var serviceNameRe = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// ServiceScaffold describes the example service generated by the scaffold
+// command
+type ServiceScaffold struct {
+	Name       string // Service name, also its application_name
+	Module     string // Go module path, default Name
+	Dir        string // Output directory, default ./Name
+	Force      bool   // Write into a directory that is not empty
+	PgxVersion string // pgx version required by go.mod, default this build's
+}
+
+// Generate writes the service: config loading, pool bootstrap with a
+// startup retry, health endpoints, a users repository and HTTP handlers,
+// embedded migrations with a runner, and tests that run against a
+// throwaway schema through its internal/pgtest package. It returns the
+// files written, relative to Dir.
+func (s ServiceScaffold) Generate() ([]string, error) {
+	if !serviceNameRe.MatchString(s.Name) {
+		return nil, fmt.Errorf("invalid service name %q: use lower-case letters, digits and dashes", s.Name)
+	}
+	s.Module = cmp.Or(s.Module, s.Name)
+	s.Dir = cmp.Or(s.Dir, s.Name)
+	s.PgxVersion = cmp.Or(s.PgxVersion, pgxVersion())
+
+	if entries, err := os.ReadDir(s.Dir); err == nil && len(entries) > 0 && !s.Force {
+		return nil, fmt.Errorf("%s is not empty; use --force to write into it", s.Dir)
+	}
+
+	data := struct {
+		Name, Module, PgxVersion string
+		LockKey                  int64
+	}{s.Name, s.Module, s.PgxVersion, AdvisoryKey(s.Name + " migrations")}
+
+	const root = "scaffold/service"
+	var written []string
+	err := fs.WalkDir(serviceTemplates, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		text, err := serviceTemplates.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(path).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return fmt.Errorf("error parsing template %s: %w", path, err)
+		}
+
+		rel := strings.TrimSuffix(strings.TrimPrefix(path, root+"/"), ".tmpl")
+		if rel == "env.example" {
+			rel = ".env.example" // Dot files are left out of embeds by default
+		}
+		out := filepath.Join(s.Dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+			return err
+		}
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(f, data); err != nil {
+			f.Close()
+			return fmt.Errorf("error generating %s: %w", rel, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		written = append(written, rel)
+		return nil
+	})
+	return written, err
+}
+
+// pgxVersion is the pgx version this binary was built with, so generated
+// services start on a version these patterns were written against
+func pgxVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/jackc/pgx/v5" && dep.Version != "" && dep.Version != "(devel)" {
+				return dep.Version
+			}
+		}
+	}
+	return "v5.7.2"
+}
+
+// runScaffold implements the scaffold command
+func runScaffold(_ context.Context, args []string) error {
+	if len(args) < 2 || args[0] != "service" || strings.HasPrefix(args[1], "-") {
+		return errors.New(scaffoldUsage)
+	}
+	flags := pflag.NewFlagSet("scaffold", pflag.ContinueOnError)
+	s := ServiceScaffold{Name: args[1]}
+	flags.StringVar(&s.Dir, "dir", "", "output directory, default ./<name>")
+	flags.StringVar(&s.Module, "module", "", "Go module path, default <name>")
+	flags.BoolVar(&s.Force, "force", false, "write into a directory that is not empty")
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+
+	files, err := s.Generate()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Println(filepath.Join(cmp.Or(s.Dir, s.Name), f))
+	}
+	fmt.Printf("\nNext: cd %s && go mod tidy && go run . migrate && go run .\n", cmp.Or(s.Dir, s.Name))
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/pgerrors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ScheduledJob is a job registered with a Scheduler
+type ScheduledJob struct {
+	Name     string
+	Schedule *CronSchedule
+	Run      func(ctx context.Context) error
+}
+
+// Scheduler runs registered jobs on cron schedules, once per due time
+// across every instance running the same jobs. Each job's schedule, next
+// run and last outcome live in a row of Table, created on first use, so
+// a restart neither repeats nor forgets a run; a job missed while every
+// instance was down runs once when one comes back.
+//
+// A due job runs under TryAdvisoryLock, and its row is checked again once
+// the lock is held, so the instance that loses the race skips it and a job
+// never overlaps itself. The lock's connection stays pinned while the job
+// runs.
+type Scheduler struct {
+	DB           *pgxpool.Pool
+	Active       *ActivePool // Optional, used instead of DB once set
+	Table        string
+	PollInterval time.Duration // How often due jobs are checked, default 15s
+	Clock        Clock
+
+	mu      sync.Mutex
+	jobs    map[string]*ScheduledJob
+	version int // Bumped by Register
+	synced  int // Version last written to Table
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+// NewScheduler creates a scheduler keeping its bookkeeping in table
+func NewScheduler(db *pgxpool.Pool, table string) *Scheduler {
+	return &Scheduler{DB: db, Table: table, PollInterval: 15 * time.Second}
+}
+
+// Register adds a job running fn on the cron expression expr, replacing
+// one of the same name. A changed expression reschedules the job on the
+// next check.
+func (s *Scheduler) Register(name, expr string, fn func(ctx context.Context) error) error {
+	schedule, err := ParseCron(expr)
+	if err != nil {
+		return fmt.Errorf("error scheduling %s: %w", name, err)
+	}
+	job := &ScheduledJob{Name: name, Schedule: schedule, Run: fn}
+	if _, err := job.next(clockOr(s.Clock).Now()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs == nil {
+		s.jobs = make(map[string]*ScheduledJob)
+		s.running = make(map[string]bool)
+	}
+	s.jobs[name] = job
+	s.version++
+	return nil
+}
+
+// Schedule registers fn to run on the cron expression expr on one
+// instance at a time
+func (app *App) Schedule(name, expr string, fn func(ctx context.Context) error) error {
+	return app.Scheduler.Register(name, expr, fn)
+}
+
+// Run checks for due jobs every PollInterval until ctx is cancelled, then
+// waits for running jobs to return
+func (s *Scheduler) Run(ctx context.Context) error {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	defer s.wg.Wait()
+
+	clock := clockOr(s.Clock)
+	for {
+		if err := s.Tick(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Error checking scheduled jobs", slog.String("table", s.Table), slog.String("error", err.Error()))
+		}
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Tick starts every due job that is not already running here
+func (s *Scheduler) Tick(ctx context.Context) error {
+	s.mu.Lock()
+	version, synced := s.version, s.synced
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	names := make([]string, 0, len(s.jobs))
+	for name, job := range s.jobs {
+		jobs = append(jobs, job)
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	if synced != version {
+		if err := s.sync(ctx, jobs, version); err != nil {
+			return err
+		}
+	}
+
+	rows, err := s.Active.Or(s.DB).Query(ctx, `SELECT name FROM `+sanitizeTable(s.Table)+` WHERE next_run <= $1 AND name = ANY($2)`, clockOr(s.Clock).Now(), names)
+	if err != nil {
+		return err
+	}
+	dueNames, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	due := make(map[string]bool, len(dueNames))
+	for _, name := range dueNames {
+		due[name] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range jobs {
+		if !due[job.Name] || s.running[job.Name] {
+			continue
+		}
+		s.running[job.Name] = true
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.running, job.Name)
+				s.mu.Unlock()
+			}()
+			s.run(ctx, job)
+		}()
+	}
+	return nil
+}
+
+// sync creates Table and writes registered schedules to it, computing the
+// next run of new jobs and of those whose expression changed
+func (s *Scheduler) sync(ctx context.Context, jobs []*ScheduledJob, version int) error {
+	_, err := s.Active.Or(s.DB).Exec(ctx, `CREATE TABLE IF NOT EXISTS `+sanitizeTable(s.Table)+` (
+		name text PRIMARY KEY,
+		schedule text NOT NULL,
+		next_run timestamptz NOT NULL,
+		last_run timestamptz,
+		last_duration interval,
+		last_error text
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", s.Table, err)
+	}
+
+	now := clockOr(s.Clock).Now()
+	for _, job := range jobs {
+		next, err := job.next(now)
+		if err != nil {
+			return err
+		}
+		_, err = s.Active.Or(s.DB).Exec(ctx, `INSERT INTO `+sanitizeTable(s.Table)+` AS t (name, schedule, next_run) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET schedule = excluded.schedule, next_run = excluded.next_run
+			WHERE t.schedule IS DISTINCT FROM excluded.schedule`,
+			job.Name, job.Schedule.String(), next)
+		if err != nil {
+			return fmt.Errorf("error registering %s: %w", job.Name, err)
+		}
+	}
+
+	s.mu.Lock()
+	// A job registered meanwhile is written on the next tick
+	s.synced = max(s.synced, version)
+	s.mu.Unlock()
+	return nil
+}
+
+// run runs job under its advisory lock if it is still due, and records the
+// outcome and the next run
+func (s *Scheduler) run(ctx context.Context, job *ScheduledJob) {
+	clock := clockOr(s.Clock)
+	_, err := TryAdvisoryLock(ctx, s.Active.Or(s.DB), AdvisoryKey(s.Table+":"+job.Name), func(ctx context.Context) error {
+		// Another instance may have run it between the check and the lock
+		start := clock.Now()
+		var due bool
+		if err := s.Active.Or(s.DB).QueryRow(ctx, `SELECT next_run <= $2 FROM `+sanitizeTable(s.Table)+` WHERE name = $1`, job.Name, start).Scan(&due); err != nil || !due {
+			return err
+		}
+		// Checked up front so a job is never run without a next run to record
+		if _, err := job.next(start); err != nil {
+			return err
+		}
+
+		runErr := func() (err error) {
+			defer recoverTo(&err, nil)
+			return job.Run(ctx)
+		}()
+		finished := clock.Now()
+		next, err := job.next(finished)
+		if err != nil {
+			return err
+		}
+
+		var lastError any
+		if runErr != nil {
+			slog.Error("Scheduled job failed", slog.String("job", job.Name), slog.String("error", runErr.Error()))
+			lastError = runErr.Error()
+		}
+		_, err = s.Active.Or(s.DB).Exec(context.WithoutCancel(ctx), `UPDATE `+sanitizeTable(s.Table)+`
+			SET last_run = $2, last_duration = make_interval(secs => $3), last_error = $4, next_run = $5 WHERE name = $1`,
+			job.Name, start, finished.Sub(start).Seconds(), lastError, next)
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		slog.Error("Error running scheduled job", slog.String("job", job.Name), slog.String("error", err.Error()))
+	}
+}
+
+// next returns the job's first run after t. A zero time would read as
+// always due, so a schedule without one is refused.
+func (job *ScheduledJob) next(t time.Time) (time.Time, error) {
+	next := job.Schedule.Next(t)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("error scheduling %s: %q has no run after %s", job.Name, job.Schedule, t.Format(time.RFC3339))
+	}
+	return next, nil
+}
+
+// ScheduledJobStatus is a registered job's bookkeeping and its next runs
+type ScheduledJobStatus struct {
+	Name      string      `json:"name"`
+	Schedule  string      `json:"schedule"`
+	NextRun   time.Time   `json:"next_run"`
+	LastRun   *time.Time  `json:"last_run,omitempty"`
+	LastError *string     `json:"last_error,omitempty"`
+	Upcoming  []time.Time `json:"upcoming"`
+}
+
+// Status returns every registered job, by name, with its next n run times.
+// Jobs not yet written to Table report the run they would be given.
+func (s *Scheduler) Status(ctx context.Context, n int) ([]ScheduledJobStatus, error) {
+	s.mu.Lock()
+	jobs := make(map[string]*ScheduledJob, len(s.jobs))
+	names := make([]string, 0, len(s.jobs))
+	for name, job := range s.jobs {
+		jobs[name] = job
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	rows, err := s.Active.Or(s.DB).Query(ctx, `SELECT name, next_run, last_run, last_error FROM `+sanitizeTable(s.Table)+` WHERE name = ANY($1)`, names)
+	if err != nil && pgerrors.Code(err) != "42P01" { // undefined_table before the first check
+		return nil, err
+	}
+	stored := make(map[string]ScheduledJobStatus)
+	if err == nil {
+		statuses, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ScheduledJobStatus, error) {
+			var st ScheduledJobStatus
+			err := row.Scan(&st.Name, &st.NextRun, &st.LastRun, &st.LastError)
+			return st, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range statuses {
+			stored[st.Name] = st
+		}
+	}
+
+	now := clockOr(s.Clock).Now()
+	slices.Sort(names)
+	out := make([]ScheduledJobStatus, 0, len(names))
+	for _, name := range names {
+		job := jobs[name]
+		st, ok := stored[name]
+		if !ok {
+			st = ScheduledJobStatus{Name: name, NextRun: job.Schedule.Next(now)}
+		}
+		st.Schedule = job.Schedule.String()
+		st.Upcoming = job.Schedule.Upcoming(now, n)
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// ServeHTTP writes Status as JSON, with ?n= upcoming runs per job,
+// default 5
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := 5
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		var err error
+		if n, err = strconv.Atoi(strings.TrimSpace(raw)); err != nil || n < 0 || n > 100 {
+			http.Error(w, "n must be a number from 0 to 100", http.StatusBadRequest)
+			return
+		}
+	}
+	statuses, err := s.Status(r.Context(), n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrSchemaVersion is wrapped by SchemaVersionError
+var ErrSchemaVersion = errors.New("unsupported schema version")
+
+// SchemaVersionError reports a database schema outside the range the binary
+// supports
+type SchemaVersionError struct {
+	Actual     int64
+	MinVersion int64
+	MaxVersion int64 // 0 when there is no upper bound
+}
+
+func (e *SchemaVersionError) Error() string {
+	expected := fmt.Sprintf(">= %d", e.MinVersion)
+	if e.MaxVersion > 0 {
+		expected = fmt.Sprintf("%d..%d", e.MinVersion, e.MaxVersion)
+	}
+	return fmt.Sprintf("%s: database is at %d, expected %s", ErrSchemaVersion, e.Actual, expected)
+}
+
+func (e *SchemaVersionError) Unwrap() error {
+	return ErrSchemaVersion
+}
+
+// SchemaGate is the range of migration versions a binary works with. An
+// older schema means migrations have not run yet; a newer one means the
+// binary is behind, e.g. after a partial deploy or a rollback.
+type SchemaGate struct {
+	Table      string // Version table, default schema_migrations
+	MinVersion int64
+	MaxVersion int64 // 0 for no upper bound
+	Degraded   bool  // Start anyway with App.SchemaErr set instead of failing
+}
+
+// SchemaVersion returns the latest applied migration version, or 0 when the
+// version table does not exist
+func SchemaVersion(ctx context.Context, db *pgxpool.Pool, table string) (int64, error) {
+	if table == "" {
+		table = "schema_migrations"
+	}
+
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("error checking %s: %w", table, err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int64
+	if err := db.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM "+table).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// CheckSchema compares the database schema version against gate. Outside
+// the range it returns a *SchemaVersionError, or in degraded mode logs it,
+// records it in app.SchemaErr and returns nil.
+func (app *App) CheckSchema(ctx context.Context, gate SchemaGate) error {
+	version, err := SchemaVersion(ctx, app.primary(), gate.Table)
+	if err != nil {
+		return err
+	}
+
+	if version >= gate.MinVersion && (gate.MaxVersion == 0 || version <= gate.MaxVersion) {
+		app.SchemaErr = nil
+		return nil
+	}
+
+	verr := &SchemaVersionError{Actual: version, MinVersion: gate.MinVersion, MaxVersion: gate.MaxVersion}
+	if !gate.Degraded {
+		return verr
+	}
+
+	slog.Warn("Starting degraded, schema version not supported",
+		slog.Int64("actual", version),
+		slog.Int64("min_version", gate.MinVersion),
+		slog.Int64("max_version", gate.MaxVersion))
+	app.SchemaErr = verr
+	return nil
+}
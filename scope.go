@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrScopeClosed is returned for work started on a closed Scope
+var ErrScopeClosed = errors.New("pool scope is closed")
+
+// Scope is a view of the shared pool for one batch job: at most
+// maxConcurrent connections are held through it at once, so the job cannot
+// crowd out the rest of the app. Workers started with Go share an
+// errgroup; Close waits for them and for every connection and result set
+// still open.
+type Scope struct {
+	db    *pgxpool.Pool
+	sem   chan struct{}
+	group *errgroup.Group
+
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// ScopedPool creates a Scope on the app's pool, or the one ctx selects with
+// dbctx.WithPool. The returned context is cancelled when a worker started
+// with Go fails, as with errgroup.
+func (app *App) ScopedPool(ctx context.Context, maxConcurrent int) (*Scope, context.Context) {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	db := app.Pool(ctx)
+	group, ctx := errgroup.WithContext(ctx)
+	return &Scope{db: db, sem: make(chan struct{}, maxConcurrent), group: group}, ctx
+}
+
+// Go runs fn in the scope's errgroup
+func (s *Scope) Go(fn func() error) {
+	s.group.Go(fn)
+}
+
+// begin waits for a slot and registers outstanding work, returning the
+// function that ends it
+func (s *Scope) begin(ctx context.Context) (func(), error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrScopeClosed
+	}
+	s.pending.Add(1)
+	s.mu.Unlock()
+
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		s.pending.Done()
+		return nil, ctx.Err()
+	}
+	return sync.OnceFunc(func() {
+		<-s.sem
+		s.pending.Done()
+	}), nil
+}
+
+// ScopedConn is a connection counted against its Scope until released
+type ScopedConn struct {
+	*pgxpool.Conn
+	end func()
+}
+
+// Release returns the connection to the pool and frees its slot
+func (c *ScopedConn) Release() {
+	c.Conn.Release()
+	c.end()
+}
+
+// Acquire gets a connection once the scope has a free slot
+func (s *Scope) Acquire(ctx context.Context) (*ScopedConn, error) {
+	end, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	return &ScopedConn{Conn: conn, end: end}, nil
+}
+
+// Exec runs a statement within the scope's limit
+func (s *Scope) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	end, err := s.begin(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer end()
+	return s.db.Exec(ctx, sql, args...)
+}
+
+// Query runs a query within the scope's limit. Its slot is held until the
+// rows are closed or read to the end.
+func (s *Scope) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	end, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(ctx, sql, args...)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	return &limitedRows{Rows: rows, release: end}, nil
+}
+
+// QueryRow runs a single-row query within the scope's limit. Its slot is
+// held until Scan is called.
+func (s *Scope) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	end, err := s.begin(ctx)
+	if err != nil {
+		return errRow{err}
+	}
+	return limitedRow{Row: s.db.QueryRow(ctx, sql, args...), release: end}
+}
+
+// Close stops new work, waits for the workers and for every connection and
+// result set still held, and returns the first worker error
+func (s *Scope) Close() error {
+	err := s.group.Wait()
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.pending.Wait()
+	return err
+}
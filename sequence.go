@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// NextIDs reserves n values of a sequence in one round trip, for assigning
+// IDs client-side before a bulk insert. Values are increasing but need not
+// be contiguous when other sessions use the sequence concurrently.
+func NextIDs(ctx context.Context, db *pgxpool.Pool, seq string, n int) ([]int64, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	rows, err := db.Query(ctx, "SELECT nextval($1::regclass) FROM generate_series(1, $2)", seq, n)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", seq, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", seq, err)
+	}
+	return ids, nil
+}
+
+// SequenceStatus compares a column's sequence with the values in the column
+type SequenceStatus struct {
+	Sequence  string
+	LastValue int64 // Last value handed out, or the start value if none yet
+	Called    bool  // False until the first nextval
+	MaxID     int64 // Largest value in the column, 0 for an empty table
+}
+
+// Drifted reports whether the next nextval could return an ID already in
+// the column, as happens after rows are loaded with explicit IDs
+func (s SequenceStatus) Drifted() bool {
+	if s.Called {
+		return s.LastValue < s.MaxID
+	}
+	return s.LastValue <= s.MaxID
+}
+
+// ErrNoSequence is returned when a column is not backed by a sequence
+var ErrNoSequence = errors.New("column has no sequence")
+
+// CheckSequence reads the sequence behind a serial or identity column and
+// the column's current maximum
+func CheckSequence(ctx context.Context, db *pgxpool.Pool, table, column string) (SequenceStatus, error) {
+	var st SequenceStatus
+	ident, col := pgx.Identifier(strings.Split(table, ".")).Sanitize(), pgx.Identifier{column}.Sanitize()
+	var seq *string
+	if err := db.QueryRow(ctx, "SELECT pg_get_serial_sequence($1, $2)", ident, column).Scan(&seq); err != nil {
+		return st, fmt.Errorf("error finding sequence of %s.%s: %w", table, column, err)
+	}
+	if seq == nil {
+		return st, fmt.Errorf("%w: %s.%s", ErrNoSequence, table, column)
+	}
+	st.Sequence = *seq
+
+	if err := db.QueryRow(ctx, "SELECT last_value, is_called FROM "+st.Sequence).Scan(&st.LastValue, &st.Called); err != nil {
+		return st, fmt.Errorf("error reading %s: %w", st.Sequence, err)
+	}
+	if err := db.QueryRow(ctx, "SELECT COALESCE(max("+col+"), 0) FROM "+ident).Scan(&st.MaxID); err != nil {
+		return st, fmt.Errorf("error reading max(%s) of %s: %w", column, table, err)
+	}
+	return st, nil
+}
+
+// RepairSequence moves a drifted sequence so the next nextval returns the
+// column's maximum plus one. It never moves a sequence backwards. The table
+// is locked against writes while the maximum is read.
+func RepairSequence(ctx context.Context, db *pgxpool.Pool, table, column string) (SequenceStatus, error) {
+	var st SequenceStatus
+	ident, col := pgx.Identifier(strings.Split(table, ".")).Sanitize(), pgx.Identifier{column}.Sanitize()
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		var seq *string
+		if err := tx.QueryRow(ctx, "SELECT pg_get_serial_sequence($1, $2)", ident, column).Scan(&seq); err != nil {
+			return fmt.Errorf("error finding sequence of %s.%s: %w", table, column, err)
+		}
+		if seq == nil {
+			return fmt.Errorf("%w: %s.%s", ErrNoSequence, table, column)
+		}
+		st.Sequence = *seq
+
+		if _, err := tx.Exec(ctx, "LOCK TABLE "+ident+" IN EXCLUSIVE MODE"); err != nil {
+			return fmt.Errorf("error locking %s: %w", table, err)
+		}
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(max("+col+"), 0) FROM "+ident).Scan(&st.MaxID); err != nil {
+			return fmt.Errorf("error reading max(%s) of %s: %w", column, table, err)
+		}
+		if err := tx.QueryRow(ctx, "SELECT last_value, is_called FROM "+st.Sequence).Scan(&st.LastValue, &st.Called); err != nil {
+			return fmt.Errorf("error reading %s: %w", st.Sequence, err)
+		}
+		if !st.Drifted() {
+			return nil
+		}
+
+		// setval with is_called makes the next nextval return MaxID+1
+		if err := tx.QueryRow(ctx, "SELECT setval($1::regclass, $2, true)", st.Sequence, st.MaxID).Scan(&st.LastValue); err != nil {
+			return fmt.Errorf("error setting %s: %w", st.Sequence, err)
+		}
+		st.Called = true
+		return nil
+	})
+	return st, err
+}
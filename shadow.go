@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ShadowMismatch describes a shadow read that disagreed with the primary
+type ShadowMismatch struct {
+	SQL             string
+	PrimaryRows     int
+	ShadowRows      int
+	PrimaryDuration time.Duration
+	ShadowDuration  time.Duration
+	Err             error      // Set when the shadow query failed
+	Diff            *QueryDiff // Keyed row diff, when DiffMismatches is set
+}
+
+// ShadowReader mirrors a sample of reads to a second pool, such as a new
+// cluster or schema being migrated to, and compares the results in the
+// background. Callers always get the primary's result; the shadow never
+// slows down or fails a request.
+type ShadowReader struct {
+	Primary *pgxpool.Pool
+	Shadow  *pgxpool.Pool
+
+	SampleRate  float64       // Fraction of reads mirrored, 0 to 1
+	Timeout     time.Duration // Budget for each shadow query, default 5 seconds
+	MaxInFlight int64         // Shadow queries running at once before sampling is skipped, default 16
+	IgnoreOrder bool          // Compare rows as a set, for queries without ORDER BY
+	Clock       Clock         // Default SystemClock
+
+	// DiffMismatches reruns mismatched queries on both pools with
+	// DiffQueries to report which rows differ, keyed on the first column
+	DiffMismatches bool
+
+	OnMismatch func(ShadowMismatch)
+
+	inflight   atomic.Int64
+	sampled    atomic.Int64
+	skipped    atomic.Int64
+	mismatches atomic.Int64
+	shadowTime atomic.Int64
+	primTime   atomic.Int64
+}
+
+// ShadowStats summarizes shadow reads so far
+type ShadowStats struct {
+	Sampled    int64
+	Skipped    int64 // Sampled reads dropped because MaxInFlight was reached
+	Mismatches int64
+
+	// Mean latency of sampled reads on each side
+	PrimaryMean time.Duration
+	ShadowMean  time.Duration
+}
+
+// Stats returns the shadow read counters
+func (r *ShadowReader) Stats() ShadowStats {
+	st := ShadowStats{
+		Sampled:    r.sampled.Load(),
+		Skipped:    r.skipped.Load(),
+		Mismatches: r.mismatches.Load(),
+	}
+	if st.Sampled > 0 {
+		st.PrimaryMean = time.Duration(r.primTime.Load() / st.Sampled)
+		st.ShadowMean = time.Duration(r.shadowTime.Load() / st.Sampled)
+	}
+	return st
+}
+
+// ShadowQuery runs sql on the primary and collects rows like
+// pgx.CollectRows. A sample of calls also runs on the shadow pool in the
+// background and reports differences. args must not be modified after the
+// call returns.
+func ShadowQuery[T any](ctx context.Context, r *ShadowReader, sql string, scan pgx.RowToFunc[T], args ...any) ([]T, error) {
+	start := clockOr(r.Clock).Now()
+	rows, err := r.Primary.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pgx.CollectRows(rows, scan)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := clockOr(r.Clock).Now().Sub(start)
+
+	if !r.sample() {
+		return result, nil
+	}
+	go func() {
+		defer r.inflight.Add(-1)
+		r.compare(sql, args, result, elapsed, func(ctx context.Context) (any, int, error) {
+			rows, err := r.Shadow.Query(ctx, sql, args...)
+			if err != nil {
+				return nil, 0, err
+			}
+			shadow, err := pgx.CollectRows(rows, scan)
+			return shadow, len(shadow), err
+		})
+	}()
+	return result, nil
+}
+
+// sample decides whether to mirror a read and reserves an in-flight slot
+func (r *ShadowReader) sample() bool {
+	if r.Shadow == nil || r.SampleRate <= 0 || rand.Float64() >= r.SampleRate {
+		return false
+	}
+	limit := r.MaxInFlight
+	if limit <= 0 {
+		limit = 16
+	}
+	if r.inflight.Add(1) > limit {
+		r.inflight.Add(-1)
+		r.skipped.Add(1)
+		return false
+	}
+	return true
+}
+
+func (r *ShadowReader) compare(sql string, args []any, primary any, primaryDuration time.Duration, query func(ctx context.Context) (any, int, error)) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := clockOr(r.Clock).Now()
+	shadow, n, err := query(ctx)
+	mm := ShadowMismatch{
+		SQL:             sql,
+		PrimaryRows:     reflect.ValueOf(primary).Len(),
+		ShadowRows:      n,
+		PrimaryDuration: primaryDuration,
+		ShadowDuration:  clockOr(r.Clock).Now().Sub(start),
+		Err:             err,
+	}
+
+	r.sampled.Add(1)
+	r.primTime.Add(int64(mm.PrimaryDuration))
+	r.shadowTime.Add(int64(mm.ShadowDuration))
+	if err == nil && r.equal(primary, shadow) {
+		return
+	}
+
+	r.mismatches.Add(1)
+	if err == nil && r.DiffMismatches {
+		diff, err := DiffQueries(ctx, r.Primary, r.Shadow, sql, args...)
+		if err != nil {
+			slog.Warn("Error diffing shadow read", slog.String("error", err.Error()))
+		}
+		mm.Diff = diff
+	}
+	attrs := []any{
+		slog.String("sql", summarizeSQL(sql, 120)),
+		slog.Int("primary_rows", mm.PrimaryRows),
+		slog.Int("shadow_rows", mm.ShadowRows),
+		slog.Duration("primary_duration", mm.PrimaryDuration),
+		slog.Duration("shadow_duration", mm.ShadowDuration),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	if mm.Diff != nil {
+		attrs = append(attrs, slog.Int("rows_differing", len(mm.Diff.Rows)))
+	}
+	slog.Warn("Shadow read mismatch", attrs...)
+	if r.OnMismatch != nil {
+		r.OnMismatch(mm)
+	}
+}
+
+// equal compares two result slices, ignoring row order when configured
+func (r *ShadowReader) equal(a, b any) bool {
+	if !r.IgnoreOrder {
+		return reflect.DeepEqual(a, b)
+	}
+	return reflect.DeepEqual(sortedRows(a), sortedRows(b))
+}
+
+// sortedRows renders each row and sorts them so results can be compared as
+// a multiset
+func sortedRows(rows any) []string {
+	v := reflect.ValueOf(rows)
+	out := make([]string, v.Len())
+	for i := range out {
+		row := v.Index(i)
+		if row.Kind() == reflect.Pointer && !row.IsNil() {
+			row = row.Elem() // e.g. RowToAddrOfStructByName
+		}
+		out[i] = fmt.Sprintf("%#v", row.Interface())
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrOverloaded is matched by errors.Is on every *OverloadError
+var ErrOverloaded = errors.New("database overloaded")
+
+// OverloadError is returned for a shed query
+type OverloadError struct {
+	Reason     string
+	RetryAfter time.Duration // Hint for a Retry-After header
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %s", ErrOverloaded, e.Reason, e.RetryAfter)
+}
+
+func (e *OverloadError) Is(target error) bool { return target == ErrOverloaded }
+
+// LoadShedder rejects queries straight away when the pool is saturated
+// instead of queueing them, so critical traffic keeps its latency. Low
+// priority queries are shed once acquires queue past MaxQueue or wait
+// longer than MaxWait on average; normal ones at twice those limits;
+// critical ones never.
+type LoadShedder struct {
+	DB       *pgxpool.Pool
+	MaxQueue int64         // Acquires waiting through the shedder, default MaxConns
+	MaxWait  time.Duration // Average acquire wait, default 50ms
+	Clock    Clock         // Default SystemClock
+
+	waiting atomic.Int64
+	shed    atomic.Int64
+
+	mu      sync.Mutex
+	avgWait time.Duration // Exponentially weighted
+	updated time.Time
+}
+
+// Shed returns how many queries were rejected
+func (s *LoadShedder) Shed() int64 {
+	return s.shed.Load()
+}
+
+func (s *LoadShedder) limits() (int64, time.Duration) {
+	maxQueue := s.MaxQueue
+	if maxQueue <= 0 {
+		maxQueue = int64(s.DB.Config().MaxConns)
+	}
+	maxWait := s.MaxWait
+	if maxWait <= 0 {
+		maxWait = 50 * time.Millisecond
+	}
+	return maxQueue, maxWait
+}
+
+// admit decides whether a query of priority p may queue for a connection
+func (s *LoadShedder) admit(p dbctx.Priority) error {
+	if p >= dbctx.PriorityCritical {
+		return nil
+	}
+	maxQueue, maxWait := s.limits()
+	if p == dbctx.PriorityNormal {
+		maxQueue, maxWait = maxQueue*2, maxWait*2
+	}
+
+	// Halve the average for every idle second so a past spike does not
+	// shed low priority queries forever when nothing else acquires
+	s.mu.Lock()
+	avg := s.avgWait
+	if idle := clockOr(s.Clock).Now().Sub(s.updated); idle > time.Second {
+		avg >>= min(int(idle/time.Second), 62)
+	}
+	s.mu.Unlock()
+	retryAfter := max(2*avg, 100*time.Millisecond)
+
+	if queued := s.waiting.Load(); queued >= maxQueue {
+		s.shed.Add(1)
+		return &OverloadError{Reason: fmt.Sprintf("%d acquires queued", queued), RetryAfter: retryAfter}
+	}
+	if avg > maxWait {
+		s.shed.Add(1)
+		return &OverloadError{Reason: fmt.Sprintf("acquires waiting %s on average", avg.Round(time.Millisecond)), RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// Acquire gets a connection unless the query would be shed
+func (s *LoadShedder) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if err := s.admit(dbctx.QueryPriority(ctx)); err != nil {
+		return nil, err
+	}
+
+	clock := clockOr(s.Clock)
+	s.waiting.Add(1)
+	start := clock.Now()
+	conn, err := s.DB.Acquire(ctx)
+	now := clock.Now()
+	wait := now.Sub(start)
+	s.waiting.Add(-1)
+
+	s.mu.Lock()
+	s.avgWait += (wait - s.avgWait) / 8
+	s.updated = now
+	s.mu.Unlock()
+	return conn, err
+}
+
+// Exec runs a statement unless it is shed
+func (s *LoadShedder) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	conn, err := s.Acquire(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer conn.Release()
+	return conn.Exec(ctx, sql, args...)
+}
+
+// Query runs a query unless it is shed. The connection is released when
+// the rows are closed or read to the end.
+func (s *LoadShedder) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	conn, err := s.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return &limitedRows{Rows: rows, release: sync.OnceFunc(conn.Release)}, nil
+}
+
+// QueryRow runs a single-row query unless it is shed
+func (s *LoadShedder) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	conn, err := s.Acquire(ctx)
+	if err != nil {
+		return errRow{err}
+	}
+	return limitedRow{Row: conn.QueryRow(ctx, sql, args...), release: conn.Release}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const shellHelp = `  \q          quit
+  \timing     toggle printing how long each statement took
+  \conninfo   show the connection
+  \?          this help
+Statements run when a line ends with ";". Several statements may be sent at once.
+On a terminal the arrow keys edit the line and recall earlier statements,
+and Ctrl-C discards the statement being typed.
+`
+
+// Shell is a minimal interactive SQL prompt on one connection. When In is
+// a terminal, lines are edited with readline and statements are kept in
+// HistoryFile; other input is read line by line.
+type Shell struct {
+	Conn        *pgconn.PgConn
+	Database    string // For the prompt and \conninfo
+	User        string
+	In          io.Reader
+	Out         io.Writer
+	Timing      bool
+	HistoryFile string // Optional, history is kept in memory only without it
+}
+
+// shellInput reads the prompt's lines, returning io.EOF at the end of input
+// and readline.ErrInterrupt on Ctrl-C
+type shellInput interface {
+	ReadLine(prompt string) (string, error)
+	SaveHistory(entry string)
+	Close() error
+}
+
+func (s *Shell) input() (shellInput, error) {
+	if f, ok := s.In.(*os.File); ok && readline.IsTerminal(int(f.Fd())) {
+		rl, err := readline.NewEx(&readline.Config{
+			Stdin:                  f,
+			Stdout:                 s.Out,
+			HistoryFile:            s.HistoryFile,
+			DisableAutoSaveHistory: true, // Statements are saved whole, not per line
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error starting line editor: %w", err)
+		}
+		return terminalInput{rl}, nil
+	}
+	in := bufio.NewScanner(s.In)
+	in.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &scannerInput{in: in, out: s.Out}, nil
+}
+
+type terminalInput struct{ rl *readline.Instance }
+
+func (t terminalInput) ReadLine(prompt string) (string, error) {
+	t.rl.SetPrompt(prompt)
+	return t.rl.Readline()
+}
+
+func (t terminalInput) SaveHistory(entry string) { _ = t.rl.SaveHistory(entry) }
+func (t terminalInput) Close() error             { return t.rl.Close() }
+
+type scannerInput struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+func (si *scannerInput) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(si.out, prompt)
+	if !si.in.Scan() {
+		fmt.Fprintln(si.out)
+		if err := si.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return si.in.Text(), nil
+}
+
+func (si *scannerInput) SaveHistory(string) {}
+func (si *scannerInput) Close() error       { return nil }
+
+// Run reads statements until \q, EOF or ctx is cancelled
+func (s *Shell) Run(ctx context.Context) error {
+	db := s.Database
+	if db == "" {
+		db = "postgres"
+	}
+	fmt.Fprintf(s.Out, "Connected to PostgreSQL %s. Type \\? for help.\n", s.Conn.ParameterStatus("server_version"))
+
+	in, err := s.input()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var buf strings.Builder
+	for {
+		prompt := db + "=> "
+		if buf.Len() > 0 {
+			prompt = db + "-> "
+		}
+		line, err := in.ReadLine(prompt)
+		switch {
+		case errors.Is(err, readline.ErrInterrupt):
+			buf.Reset()
+			continue
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+
+		// Meta-commands only start a statement
+		if trimmed := strings.TrimSpace(line); buf.Len() == 0 && strings.HasPrefix(trimmed, `\`) {
+			in.SaveHistory(trimmed)
+			if quit := s.meta(trimmed); quit {
+				return nil
+			}
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		if !strings.HasSuffix(strings.TrimSpace(line), ";") {
+			continue
+		}
+
+		sql := buf.String()
+		buf.Reset()
+		in.SaveHistory(strings.TrimSpace(sql))
+		if err := s.exec(ctx, sql); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Fprintf(s.Out, "ERROR: %v\n", err)
+		}
+	}
+}
+
+// meta runs a backslash command and reports whether to quit
+func (s *Shell) meta(cmd string) bool {
+	switch strings.Fields(cmd)[0] {
+	case `\q`:
+		return true
+	case `\timing`:
+		s.Timing = !s.Timing
+		state := "off"
+		if s.Timing {
+			state = "on"
+		}
+		fmt.Fprintf(s.Out, "Timing is %s.\n", state)
+	case `\conninfo`:
+		fmt.Fprintf(s.Out, "Connected to database %q as user %q on %s (backend pid %d).\n",
+			s.Database, s.User, s.Conn.Conn().RemoteAddr(), s.Conn.PID())
+	case `\?`:
+		fmt.Fprint(s.Out, shellHelp)
+	default:
+		fmt.Fprintf(s.Out, "invalid command %s, try \\?\n", cmd)
+	}
+	return false
+}
+
+// exec sends sql with the simple protocol and prints every result
+func (s *Shell) exec(ctx context.Context, sql string) error {
+	start := time.Now()
+	results, err := s.Conn.Exec(ctx, sql).ReadAll()
+	elapsed := time.Since(start)
+
+	for _, r := range results {
+		if len(r.FieldDescriptions) > 0 {
+			s.printRows(r)
+		} else {
+			fmt.Fprintln(s.Out, r.CommandTag.String())
+		}
+		if r.Err != nil && err == nil {
+			err = r.Err
+		}
+	}
+	if s.Timing {
+		fmt.Fprintf(s.Out, "Time: %.3f ms\n", float64(elapsed.Microseconds())/1000)
+	}
+	return err
+}
+
+func (s *Shell) printRows(r *pgconn.Result) {
+	tw := tabwriter.NewWriter(s.Out, 0, 4, 1, ' ', tabwriter.Debug)
+	names := make([]string, len(r.FieldDescriptions))
+	rules := make([]string, len(r.FieldDescriptions))
+	for i, fd := range r.FieldDescriptions {
+		names[i] = " " + fd.Name
+		rules[i] = strings.Repeat("-", len(fd.Name)+1)
+	}
+	fmt.Fprintln(tw, strings.Join(names, "\t"))
+	fmt.Fprintln(tw, strings.Join(rules, "\t"))
+	for _, row := range r.Rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			if v == nil {
+				cells[i] = " "
+			} else {
+				cells[i] = " " + strings.ReplaceAll(string(v), "\n", `\n`)
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	_ = tw.Flush()
+
+	noun := "rows"
+	if len(r.Rows) == 1 {
+		noun = "row"
+	}
+	fmt.Fprintf(s.Out, "(%d %s)\n\n", len(r.Rows), noun)
+}
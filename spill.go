@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SpillStats is the temp file usage attributed to one normalized statement
+type SpillStats struct {
+	SQL       string
+	Spills    int64 // Samples in which the statement ran while temp files were written
+	TempFiles int64
+	TempBytes int64
+}
+
+type spillKey struct{}
+
+type spillCandidate struct {
+	sql     string
+	elapsed time.Duration
+}
+
+// SpillMonitor flags statements that spill sorts and hashes to disk, to
+// guide work_mem tuning. Postgres only counts temp files per database, so
+// the monitor samples pg_stat_database every Interval and splits any growth
+// in temp_files/temp_bytes between the statements slower than Threshold
+// that finished in that window, weighted by their duration. Attribution is
+// approximate: other clients of the database count too.
+type SpillMonitor struct {
+	Threshold     time.Duration // Statements faster than this are not candidates, default 100ms
+	Interval      time.Duration // Sample period, default 10s
+	MaxCandidates int           // Slow statements kept per sample, default 1000
+	Clock         Clock         // Default SystemClock
+	Active        *ActivePool   // Optional, sampled instead of the pool given to Run
+
+	mu         sync.Mutex
+	candidates []spillCandidate
+	stats      map[string]*SpillStats
+	unmatched  SpillStats // Temp usage seen with no slow statement to blame
+}
+
+// NewSpillMonitor creates a monitor. It must be added to the pool with
+// WithTracer and sampled with Run.
+func NewSpillMonitor() *SpillMonitor {
+	return &SpillMonitor{
+		Threshold:     100 * time.Millisecond,
+		Interval:      10 * time.Second,
+		MaxCandidates: 1000,
+		stats:         make(map[string]*SpillStats),
+	}
+}
+
+func (m *SpillMonitor) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, spillKey{}, statementStart{sql: data.SQL, start: clockOr(m.Clock).Now()})
+}
+
+func (m *SpillMonitor) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryEndData) {
+	q, ok := ctx.Value(spillKey{}).(statementStart)
+	if !ok {
+		return
+	}
+	elapsed := clockOr(m.Clock).Now().Sub(q.start)
+	if elapsed < m.Threshold {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.MaxCandidates > 0 && len(m.candidates) >= m.MaxCandidates {
+		return
+	}
+	m.candidates = append(m.candidates, spillCandidate{sql: q.sql, elapsed: elapsed})
+}
+
+// Run samples pg_stat_database until ctx is cancelled
+func (m *SpillMonitor) Run(ctx context.Context, db *pgxpool.Pool) error {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	clock := clockOr(m.Clock)
+	var prevFiles, prevBytes int64
+	sampled := false // No baseline until a sample succeeds, so a failed first one is retried
+	for {
+		files, bytes, err := tempUsage(ctx, m.Active.Or(db))
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				slog.Error("Error sampling temp file usage", slog.String("error", err.Error()))
+			}
+		case !sampled || files < prevFiles || bytes < prevBytes:
+			// First sample, or statistics were reset
+			prevFiles, prevBytes, sampled = files, bytes, true
+			m.takeCandidates()
+		default:
+			m.attribute(files-prevFiles, bytes-prevBytes)
+			prevFiles, prevBytes = files, bytes
+		}
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+func tempUsage(ctx context.Context, db *pgxpool.Pool) (files, bytes int64, err error) {
+	err = db.QueryRow(ctx,
+		"SELECT temp_files, temp_bytes FROM pg_stat_database WHERE datname = current_database()").Scan(&files, &bytes)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading pg_stat_database: %w", err)
+	}
+	return files, bytes, nil
+}
+
+func (m *SpillMonitor) takeCandidates() []spillCandidate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.candidates
+	m.candidates = nil
+	return c
+}
+
+// attribute splits one sample's temp usage between its candidates
+func (m *SpillMonitor) attribute(files, bytes int64) {
+	candidates := m.takeCandidates()
+	if files == 0 && bytes == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(candidates) == 0 {
+		m.unmatched.Spills++
+		m.unmatched.TempFiles += files
+		m.unmatched.TempBytes += bytes
+		return
+	}
+
+	var total time.Duration
+	for _, c := range candidates {
+		total += c.elapsed
+	}
+	for _, c := range candidates {
+		sql := NormalizeSQL(c.sql)
+		share := float64(c.elapsed) / float64(total)
+		st, ok := m.stats[sql]
+		if !ok {
+			st = &SpillStats{SQL: sql}
+			m.stats[sql] = st
+		}
+		st.Spills++
+		st.TempFiles += int64(share * float64(files))
+		st.TempBytes += int64(share * float64(bytes))
+
+		slog.Warn("Query may have spilled to temp files",
+			slog.String("sql", summarizeSQL(sql, 200)),
+			slog.Duration("duration", c.elapsed),
+			slog.Int64("sample_temp_bytes", bytes),
+			slog.Int("sample_candidates", len(candidates)),
+		)
+	}
+}
+
+// Snapshot returns the spill stats of every flagged statement, most temp
+// bytes first, followed by usage no statement could be blamed for
+func (m *SpillMonitor) Snapshot() []SpillStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make([]SpillStats, 0, len(m.stats)+1)
+	for _, st := range m.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].TempBytes > stats[j].TempBytes })
+	if m.unmatched.Spills > 0 {
+		unmatched := m.unmatched
+		unmatched.SQL = "unattributed"
+		stats = append(stats, unmatched)
+	}
+	return stats
+}
+
+// Reset drops all recorded spills
+func (m *SpillMonitor) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats = make(map[string]*SpillStats)
+	m.unmatched = SpillStats{}
+}
+
+// ServeHTTP writes the spill stats as Prometheus counters
+func (m *SpillMonitor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	stats := m.Snapshot()
+	var b strings.Builder
+	for _, metric := range []struct {
+		name, help string
+		value      func(SpillStats) int64
+	}{
+		{"pgx_statement_temp_spills_total", "Samples in which the statement ran while temp files were written.", func(st SpillStats) int64 { return st.Spills }},
+		{"pgx_statement_temp_files_total", "Temp files attributed to the statement.", func(st SpillStats) int64 { return st.TempFiles }},
+		{"pgx_statement_temp_bytes_total", "Temp file bytes attributed to the statement.", func(st SpillStats) int64 { return st.TempBytes }},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, st := range stats {
+			fmt.Fprintf(&b, "%s{statement=%s} %d\n", metric.name, promLabel(st.SQL), metric.value(st))
+		}
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
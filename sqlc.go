@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Queries runs sqlc-generated queries (see sqlc.yaml) on the app's pool
+// next to hand-written ones. Q is the generated *Queries and D the
+// generated DBTX, both inferred from the generated New:
+//
+//	users := NewQueries(app.DBClient, sqlcdb.New)
+//	user, err := users.On(ctx).GetUser(ctx, id)
+//
+// Generated queries join the ambient transaction like Repository does, so
+// both kinds of code can share one transaction.
+type Queries[D DBTX, Q any] struct {
+	DB  *pgxpool.Pool
+	New func(D) Q
+}
+
+// NewQueries creates an adapter building Q with newQueries
+func NewQueries[D DBTX, Q any](db *pgxpool.Pool, newQueries func(D) Q) *Queries[D, Q] {
+	return &Queries[D, Q]{DB: db, New: newQueries}
+}
+
+// On returns queries running in the ambient transaction of ctx
+// (dbctx.WithTx), or on the pool
+func (q *Queries[D, Q]) On(ctx context.Context) Q {
+	if tx, ok := dbctx.Tx(ctx); ok {
+		return q.with(tx)
+	}
+	return q.with(q.DB)
+}
+
+// Tx runs fn in a transaction, committing when it returns nil. fn's ctx
+// carries the transaction, so Repository and further On calls made with
+// it join in. A panic in fn rolls back and is returned as a *PanicError.
+func (q *Queries[D, Q]) Tx(ctx context.Context, fn func(ctx context.Context, queries Q) error) error {
+	return SafeTx(ctx, q.DB, func(tx pgx.Tx) error {
+		return fn(dbctx.WithTx(ctx, tx), q.with(tx))
+	})
+}
+
+// with builds Q on db. The generated DBTX has the same methods as DBTX, so
+// every DBTX satisfies it.
+func (q *Queries[D, Q]) with(db DBTX) Q {
+	return q.New(any(db).(D))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SQLCommenter appends a sqlcommenter comment to each statement, such as
+//
+//	SELECT ... /*application='billing',route='%2Fusers%2F%7Bid%7D',traceparent='00-...'*/
+//
+// so DBAs can trace load in pg_stat_activity, pg_stat_statements and the
+// server log back to the endpoint that caused it. The comment holds
+// Application, the caller label, the request ID and every dbctx tag of
+// the statement's context; Middleware adds the route and W3C traceparent.
+//
+// Statements differing only in their comment are different to the
+// statement cache, so per-request tags such as traceparent cost a Parse
+// each; pgx_statement metrics and pg_stat_statements ignore comments.
+type SQLCommenter struct {
+	DB          DBTX
+	Application string
+}
+
+// NewSQLCommenter creates a commenter naming application in each statement
+func NewSQLCommenter(db DBTX, application string) *SQLCommenter {
+	return &SQLCommenter{DB: db, Application: application}
+}
+
+var traceparentRe = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// Middleware tags the queries of each request with its route pattern, or
+// its path when it was not routed by a ServeMux, and its traceparent
+// header when the request carries a valid one
+func (c *SQLCommenter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(dbctx.WithTags(r.Context(), requestTags(r))))
+	})
+}
+
+// requestTags are the route and traceparent of r. The pattern is only
+// known once a ServeMux has matched r, so a middleware in front of the mux
+// tags the path instead.
+func requestTags(r *http.Request) map[string]string {
+	tags := map[string]string{"route": r.URL.Path}
+	if r.Pattern != "" {
+		tags["route"] = r.Pattern
+	}
+	if tp := strings.ToLower(r.Header.Get("traceparent")); traceparentRe.MatchString(tp) {
+		tags["traceparent"] = tp
+	}
+	return tags
+}
+
+// comment returns the sqlcommenter comment for ctx, or "" when there is
+// nothing to say
+func (c *SQLCommenter) comment(ctx context.Context) string {
+	tags := make(map[string]string, len(dbctx.Tags(ctx))+3)
+	if c.Application != "" {
+		tags["application"] = c.Application
+	}
+	if caller := dbctx.Caller(ctx); caller != "" {
+		tags["caller"] = caller
+	}
+	if id := dbctx.RequestID(ctx); id != "" {
+		tags["request_id"] = id
+	}
+	for k, v := range dbctx.Tags(ctx) {
+		tags[k] = v
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+
+	// Keys sorted and both sides percent-encoded, as the spec requires; the
+	// encoding also keeps quotes and */ out of the comment
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = commentEscape(k) + "='" + commentEscape(tags[k]) + "'"
+	}
+	return "/*" + strings.Join(pairs, ",") + "*/"
+}
+
+func commentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// annotate appends the comment for ctx to sql, before a trailing semicolon
+func (c *SQLCommenter) annotate(ctx context.Context, sql string) string {
+	comment := c.comment(ctx)
+	if comment == "" {
+		return sql
+	}
+	trimmed := strings.TrimRight(sql, " \t\r\n")
+	if strings.HasSuffix(trimmed, ";") {
+		return strings.TrimRight(trimmed[:len(trimmed)-1], " \t\r\n") + " " + comment + ";"
+	}
+	if strings.Contains(trimmed[strings.LastIndex(trimmed, "\n")+1:], "--") {
+		return trimmed + "\n" + comment // Keep it out of a trailing line comment
+	}
+	return trimmed + " " + comment
+}
+
+// Exec runs a statement with its comment
+func (c *SQLCommenter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return c.DB.Exec(ctx, c.annotate(ctx, sql), args...)
+}
+
+// Query runs a query with its comment
+func (c *SQLCommenter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return c.DB.Query(ctx, c.annotate(ctx, sql), args...)
+}
+
+// QueryRow runs a single-row query with its comment
+func (c *SQLCommenter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return c.DB.QueryRow(ctx, c.annotate(ctx, sql), args...)
+}
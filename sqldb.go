@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// SQLDB returns the app's pool as a *sql.DB for libraries that need
+// database/sql, such as sqlx, ORMs and migration tools. Its connections
+// are acquired from the pool, so they share its limits, hooks and
+// tracers; database/sql keeps no idle connections of its own. The same
+// *sql.DB is returned on every call and does not need closing before the
+// pool is closed. Each connection comes from the current primary, so it
+// follows Supervisor's rebuilds.
+func (app *App) SQLDB() *sql.DB {
+	app.sqlDBOnce.Do(func() {
+		app.sqlDB = sql.OpenDB(primaryConnector{app})
+		app.sqlDB.SetMaxIdleConns(0) // Idle connections belong to the pool
+	})
+	return app.sqlDB
+}
+
+// primaryConnector acquires database/sql connections from app.primary()
+type primaryConnector struct{ app *App }
+
+func (c primaryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return stdlib.GetPoolConnector(c.app.primary()).Connect(ctx)
+}
+
+func (c primaryConnector) Driver() driver.Driver { return stdlib.GetDefaultDriver() }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// queryFiles are the named queries shipped with the application, also the
+// input to sqlc (see sqlc.yaml)
+//
+//go:embed queries/*.sql
+var queryFiles embed.FS
+
+// SQLQueries holds the named queries of queries/*.sql, for use with the
+// query helpers:
+//
+//	rows, err := app.DBClient.Query(ctx, SQLQueries.SQL("ListUsers"))
+var SQLQueries = MustLoadQueries(queryFiles, "queries")
+
+// NamedQuery is one query from a .sql file, introduced by a line like
+// "-- name: GetUser :one"
+type NamedQuery struct {
+	Name string
+	Kind string // What follows the colon, e.g. one, many or exec; may be empty
+	SQL  string
+	File string
+}
+
+// QuerySet is the named queries loaded from a set of .sql files
+type QuerySet struct {
+	queries map[string]NamedQuery
+}
+
+var queryNameRe = regexp.MustCompile(`^--\s*name:\s*(\w+)\s*(?::(\w+))?\s*$`)
+
+// LoadQueries reads the named queries of every .sql file in dir. Text
+// before the first name line is ignored, so files may start with comments.
+// Names must be unique across the files.
+func LoadQueries(fsys fs.FS, dir string) (*QuerySet, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading query files: %w", err)
+	}
+	set := &QuerySet{queries: make(map[string]NamedQuery)}
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".sql" {
+			continue
+		}
+		file := path.Join(dir, e.Name())
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading query files: %w", err)
+		}
+		if err := set.parse(file, string(data)); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// MustLoadQueries is LoadQueries panicking on error, for package-level
+// variables over embedded files
+func MustLoadQueries(fsys fs.FS, dir string) *QuerySet {
+	set, err := LoadQueries(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+func (s *QuerySet) parse(file, data string) error {
+	var (
+		current *NamedQuery
+		body    strings.Builder
+	)
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		current.SQL = strings.TrimSuffix(strings.TrimSpace(body.String()), ";")
+		if current.SQL == "" {
+			return fmt.Errorf("query %s in %s is empty", current.Name, file)
+		}
+		if prev, ok := s.queries[current.Name]; ok {
+			return fmt.Errorf("query %s in %s is already defined in %s", current.Name, file, prev.File)
+		}
+		s.queries[current.Name] = *current
+		return nil
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		if m := queryNameRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			if err := finish(); err != nil {
+				return err
+			}
+			current = &NamedQuery{Name: m[1], Kind: m[2], File: file}
+			body.Reset()
+			continue
+		}
+		if current != nil {
+			body.WriteString(line + "\n")
+		}
+	}
+	return finish()
+}
+
+// Lookup returns the named query
+func (s *QuerySet) Lookup(name string) (NamedQuery, bool) {
+	q, ok := s.queries[name]
+	return q, ok
+}
+
+// SQL returns the named query's SQL. It panics for unknown names, which
+// are programming errors like a typo in a string literal.
+func (s *QuerySet) SQL(name string) string {
+	q, ok := s.queries[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown query %q", name))
+	}
+	return q.SQL
+}
+
+// Names returns the names of every query, sorted
+func (s *QuerySet) Names() []string {
+	names := make([]string, 0, len(s.queries))
+	for name := range s.queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
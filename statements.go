@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Latency histogram buckets grow by sqrt(2) from 100µs to about 74s, so
+// percentiles are accurate to within roughly 20%
+const (
+	histogramBuckets = 40
+	histogramBase    = 100 * time.Microsecond
+)
+
+var bucketBounds = func() [histogramBuckets]time.Duration {
+	var b [histogramBuckets]time.Duration
+	for i := range b {
+		b[i] = time.Duration(float64(histogramBase) * math.Pow(math.Sqrt2, float64(i)))
+	}
+	return b
+}()
+
+// StatementStats summarizes one normalized statement
+type StatementStats struct {
+	SQL    string
+	Count  int64
+	Errors int64
+	Total  time.Duration
+	P50    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+}
+
+type statementHistogram struct {
+	mu      sync.Mutex
+	count   int64
+	errors  int64
+	total   time.Duration
+	buckets [histogramBuckets + 1]int64 // Last bucket holds everything slower
+}
+
+func (h *statementHistogram) observe(d time.Duration, failed bool) {
+	i := sort.Search(histogramBuckets, func(i int) bool { return bucketBounds[i] >= d })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.total += d
+	h.buckets[i]++
+	if failed {
+		h.errors++
+	}
+}
+
+// quantile interpolates within the bucket holding the q-th observation.
+// Callers hold h.mu.
+func (h *statementHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var seen int64
+	for i, n := range h.buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = bucketBounds[i-1]
+		}
+		if i == histogramBuckets {
+			return lower
+		}
+		frac := (rank - float64(seen)) / float64(n)
+		return lower + time.Duration(frac*float64(bucketBounds[i]-lower))
+	}
+	return bucketBounds[histogramBuckets-1]
+}
+
+type statementMetricsKey struct{}
+
+type statementStart struct {
+	sql   string
+	start time.Time
+}
+
+// StatementMetrics is a query tracer that keeps latency histograms per
+// normalized statement, so hot queries can be found without
+// pg_stat_statements. It serves its stats in the Prometheus text format.
+type StatementMetrics struct {
+	MaxStatements int   // Distinct statements tracked before new ones are grouped as "other", default 500
+	Clock         Clock // Default SystemClock
+
+	mu    sync.RWMutex
+	stmts map[string]*statementHistogram
+}
+
+// NewStatementMetrics creates an empty registry
+func NewStatementMetrics() *StatementMetrics {
+	return &StatementMetrics{
+		MaxStatements: 500,
+		stmts:         make(map[string]*statementHistogram),
+	}
+}
+
+func (m *StatementMetrics) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, statementMetricsKey{}, statementStart{sql: data.SQL, start: clockOr(m.Clock).Now()})
+}
+
+func (m *StatementMetrics) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	q, ok := ctx.Value(statementMetricsKey{}).(statementStart)
+	if !ok {
+		return
+	}
+	m.histogram(NormalizeSQL(q.sql)).observe(clockOr(m.Clock).Now().Sub(q.start), data.Err != nil)
+}
+
+func (m *StatementMetrics) histogram(sql string) *statementHistogram {
+	m.mu.RLock()
+	h, ok := m.stmts[sql]
+	m.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.stmts[sql]; ok {
+		return h
+	}
+	if m.MaxStatements > 0 && len(m.stmts) >= m.MaxStatements {
+		sql = "other"
+		if h, ok := m.stmts[sql]; ok {
+			return h
+		}
+	}
+	h = &statementHistogram{}
+	m.stmts[sql] = h
+	return h
+}
+
+// Snapshot returns the stats of every statement, most total time first
+func (m *StatementMetrics) Snapshot() []StatementStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := make([]StatementStats, 0, len(m.stmts))
+	for sql, h := range m.stmts {
+		h.mu.Lock()
+		stats = append(stats, StatementStats{
+			SQL:    sql,
+			Count:  h.count,
+			Errors: h.errors,
+			Total:  h.total,
+			P50:    h.quantile(0.50),
+			P95:    h.quantile(0.95),
+			P99:    h.quantile(0.99),
+		})
+		h.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Total > stats[j].Total })
+	return stats
+}
+
+// Reset drops all recorded statements
+func (m *StatementMetrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stmts = make(map[string]*statementHistogram)
+}
+
+// ServeHTTP writes the stats as Prometheus summaries
+func (m *StatementMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var b strings.Builder
+	b.WriteString("# HELP pgx_statement_duration_seconds Statement latency by normalized SQL.\n")
+	b.WriteString("# TYPE pgx_statement_duration_seconds summary\n")
+	stats := m.Snapshot()
+	for _, st := range stats {
+		label := promLabel(st.SQL)
+		for _, q := range []struct {
+			q string
+			d time.Duration
+		}{{"0.5", st.P50}, {"0.95", st.P95}, {"0.99", st.P99}} {
+			fmt.Fprintf(&b, "pgx_statement_duration_seconds{statement=%s,quantile=%q} %g\n", label, q.q, q.d.Seconds())
+		}
+		fmt.Fprintf(&b, "pgx_statement_duration_seconds_sum{statement=%s} %g\n", label, st.Total.Seconds())
+		fmt.Fprintf(&b, "pgx_statement_duration_seconds_count{statement=%s} %d\n", label, st.Count)
+	}
+	b.WriteString("# HELP pgx_statement_errors_total Failed statements by normalized SQL.\n")
+	b.WriteString("# TYPE pgx_statement_errors_total counter\n")
+	for _, st := range stats {
+		fmt.Fprintf(&b, "pgx_statement_errors_total{statement=%s} %d\n", promLabel(st.SQL), st.Errors)
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// promLabel quotes a label value per the Prometheus text format
+func promLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+var (
+	normStringRe = regexp.MustCompile(`'(?:[^']|'')*'`)
+	normNumberRe = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	normListRe   = regexp.MustCompile(`\(\s*(?:\?|\$n)(?:\s*,\s*(?:\?|\$n))+\s*\)`)
+)
+
+// NormalizeSQL replaces literals with ?, placeholders with $n, and
+// collapses whitespace and IN lists, so statements differing only in their
+// values are grouped together
+func NormalizeSQL(sql string) string {
+	sql = lineCommentRe.ReplaceAllString(sql, "")
+	sql = blockCommentRe.ReplaceAllString(sql, "")
+	sql = normStringRe.ReplaceAllString(sql, "?")
+	sql = normNumberRe.ReplaceAllString(sql, "?")
+	sql = strings.ReplaceAll(sql, "$?", "$n")
+	sql = normListRe.ReplaceAllString(sql, "(...)")
+	return strings.Join(strings.Fields(sql), " ")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SupervisorState is the health of a supervised pool
+type SupervisorState string
+
+const (
+	SupervisorHealthy      SupervisorState = "healthy"
+	SupervisorFailing      SupervisorState = "failing"      // Checks are failing, below the threshold
+	SupervisorReconnecting SupervisorState = "reconnecting" // Rebuilding the pool
+	SupervisorReconnected  SupervisorState = "reconnected"  // A rebuilt pool is serving
+)
+
+// SupervisorEvent is reported to PoolSupervisor.OnEvent when the state
+// changes and on every failed reconnect attempt
+type SupervisorEvent struct {
+	State   SupervisorState
+	At      time.Time
+	Attempt int   // Reconnect attempt, for SupervisorReconnecting
+	Err     error // The failure that caused the state
+}
+
+// PoolSupervisor pings the active pool and, once the database has been
+// unreachable for FailureThreshold checks in a row, closes the pool and
+// builds a new one with Connect, backing off between attempts. The
+// application reads the pool from Active so it picks up the new one.
+type PoolSupervisor struct {
+	Active  *ActivePool
+	Connect func(ctx context.Context) (*pgxpool.Pool, error) // Usually NewPg with the app's config and options
+
+	CheckInterval    time.Duration // Default 5s
+	CheckTimeout     time.Duration // Default 2s
+	FailureThreshold int           // Consecutive failed checks before rebuilding, default 3
+	MinBackoff       time.Duration // Default 1s
+	MaxBackoff       time.Duration // Default 1m
+
+	OnEvent func(SupervisorEvent)
+	Clock   Clock // Default SystemClock
+}
+
+// Run supervises the pool until ctx is cancelled
+func (s *PoolSupervisor) Run(ctx context.Context) error {
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	threshold := s.FailureThreshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+
+	failures := 0
+	for {
+		if err := clockOr(s.Clock).Sleep(ctx, interval); err != nil {
+			return err
+		}
+
+		err := s.check(ctx)
+		switch {
+		case err == nil && failures > 0:
+			failures = 0
+			s.emit(SupervisorEvent{State: SupervisorHealthy})
+			continue
+		case err == nil:
+			continue
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+
+		failures++
+		if failures == 1 {
+			s.emit(SupervisorEvent{State: SupervisorFailing, Err: err})
+		}
+		if failures < threshold {
+			continue
+		}
+		if err := s.reconnect(ctx, err); err != nil {
+			return err
+		}
+		failures = 0
+	}
+}
+
+func (s *PoolSupervisor) check(ctx context.Context) error {
+	return s.ping(ctx, s.Active.Pool())
+}
+
+func (s *PoolSupervisor) ping(ctx context.Context, db *pgxpool.Pool) error {
+	timeout := s.CheckTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return db.Ping(ctx)
+}
+
+// reconnect builds pools until one answers a Ping, then swaps it in and
+// closes the old one. It returns only when ctx is cancelled or a pool is
+// serving.
+func (s *PoolSupervisor) reconnect(ctx context.Context, cause error) error {
+	backoff := s.MinBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := s.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+
+	err := cause
+	for attempt := 1; ; attempt++ {
+		s.emit(SupervisorEvent{State: SupervisorReconnecting, Attempt: attempt, Err: err})
+
+		var db *pgxpool.Pool
+		db, err = s.Connect(ctx)
+		if err == nil {
+			if err = s.ping(ctx, db); err != nil {
+				db.Close()
+			}
+		}
+		if err == nil {
+			old := s.Active.Pool()
+			s.Active.current.Store(db)
+			// Close waits for acquired connections to be released
+			go old.Close()
+			s.emit(SupervisorEvent{State: SupervisorReconnected, Attempt: attempt})
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := clockOr(s.Clock).Sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (s *PoolSupervisor) emit(ev SupervisorEvent) {
+	ev.At = clockOr(s.Clock).Now()
+	attrs := []any{slog.String("state", string(ev.State))}
+	if ev.Attempt > 0 {
+		attrs = append(attrs, slog.Int("attempt", ev.Attempt))
+	}
+	if ev.Err != nil {
+		attrs = append(attrs, slog.String("error", ev.Err.Error()))
+		slog.Warn("Database connection", attrs...)
+	} else {
+		slog.Info("Database connection", attrs...)
+	}
+
+	if s.OnEvent != nil {
+		s.OnEvent(ev)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TableLimiter caps how many statements touching each hot table run at
+// once. Statements over the cap queue before acquiring a connection, so a
+// lock convoy on one hot row (a counter, say) cannot take the whole pool.
+// Tables are read from the SQL, so statements built dynamically or hidden
+// in functions are not seen.
+type TableLimiter struct {
+	DB     *pgxpool.Pool
+	Active *ActivePool // Optional, used instead of DB once set
+
+	slots map[string]chan struct{} // By lower-case table name, schema-qualified or not
+
+	mu     sync.Mutex
+	tables map[string][]string // Limited tables by SQL text
+}
+
+// NewTableLimiter creates a limiter allowing limits[table] concurrent
+// statements per table. Names may be schema-qualified.
+func NewTableLimiter(db *pgxpool.Pool, limits map[string]int) *TableLimiter {
+	l := &TableLimiter{
+		DB:     db,
+		slots:  make(map[string]chan struct{}, len(limits)),
+		tables: make(map[string][]string),
+	}
+	for table, n := range limits {
+		if n > 0 {
+			l.slots[strings.ToLower(table)] = make(chan struct{}, n)
+		}
+	}
+	return l
+}
+
+// Wait blocks until a slot is free for every table given; unlimited tables
+// are ignored. Call the returned function to release them. Use it to hold
+// slots across a transaction.
+func (l *TableLimiter) Wait(ctx context.Context, tables ...string) (func(), error) {
+	var held []chan struct{}
+	release := func() {
+		for _, s := range held {
+			<-s
+		}
+	}
+
+	// A fixed order keeps statements on overlapping tables from deadlocking
+	names := make([]string, 0, len(tables))
+	for _, t := range tables {
+		if _, ok := l.slots[strings.ToLower(t)]; ok {
+			names = append(names, strings.ToLower(t))
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		s := l.slots[name]
+		select {
+		case s <- struct{}{}:
+			held = append(held, s)
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// InFlight returns how many statements hold a slot for table
+func (l *TableLimiter) InFlight(table string) int {
+	return len(l.slots[strings.ToLower(table)])
+}
+
+func (l *TableLimiter) wait(ctx context.Context, sql string) (func(), error) {
+	if len(l.slots) == 0 {
+		return func() {}, nil
+	}
+	return l.Wait(ctx, l.limitedTables(sql)...)
+}
+
+// limitedTables returns the limited tables sql touches, caching the result
+// for statements seen before
+func (l *TableLimiter) limitedTables(sql string) []string {
+	l.mu.Lock()
+	tables, ok := l.tables[sql]
+	l.mu.Unlock()
+	if ok {
+		return tables
+	}
+
+	for _, t := range StatementTables(sql) {
+		t = strings.ToLower(t)
+		if _, ok := l.slots[t]; ok {
+			tables = append(tables, t)
+		} else if i := strings.LastIndexByte(t, '.'); i >= 0 {
+			if _, ok := l.slots[t[i+1:]]; ok {
+				tables = append(tables, t[i+1:])
+			}
+		}
+	}
+
+	l.mu.Lock()
+	if len(l.tables) < 10000 {
+		l.tables[sql] = tables
+	}
+	l.mu.Unlock()
+	return tables
+}
+
+// Exec runs a statement once its tables have a free slot
+func (l *TableLimiter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	release, err := l.wait(ctx, sql)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer release()
+	return l.Active.Or(l.DB).Exec(ctx, sql, args...)
+}
+
+// Query runs a query once its tables have a free slot. The slots are held
+// until the rows are closed or read to the end.
+func (l *TableLimiter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	release, err := l.wait(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := l.Active.Or(l.DB).Query(ctx, sql, args...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &limitedRows{Rows: rows, release: sync.OnceFunc(release)}, nil
+}
+
+// QueryRow runs a single-row query once its tables have a free slot. The
+// slots are held until Scan is called.
+func (l *TableLimiter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	release, err := l.wait(ctx, sql)
+	if err != nil {
+		return errRow{err}
+	}
+	return limitedRow{Row: l.Active.Or(l.DB).QueryRow(ctx, sql, args...), release: release}
+}
+
+type limitedRows struct {
+	pgx.Rows
+	release func()
+}
+
+func (r *limitedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.release()
+	return false
+}
+
+func (r *limitedRows) Close() {
+	r.Rows.Close()
+	r.release()
+}
+
+type limitedRow struct {
+	pgx.Row
+	release func()
+}
+
+func (r limitedRow) Scan(dest ...any) error {
+	defer r.release()
+	return r.Row.Scan(dest...)
+}
+
+type errRow struct{ err error }
+
+func (r errRow) Scan(...any) error { return r.err }
+
+// StatementTables returns the tables sql reads or writes, lower-cased
+// unless quoted, schema-qualified when the SQL qualifies them. See
+// ParseStatement for how they are found.
+func StatementTables(sql string) []string {
+	return ParseStatement(sql).Tables
+}
+
+// parseTableLimits parses "table=n,schema.table=n"
+func parseTableLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		table, n, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid table limit %q: expected table=n", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid table limit %q: expected a positive count", item)
+		}
+		limits[strings.TrimSpace(table)] = limit
+	}
+	return limits, nil
+}
+
+// tableLimiter builds a limiter from PG_TABLE_CONCURRENCY, or returns nil
+// when no tables are limited
+func (c *DBConfig) tableLimiter(db *pgxpool.Pool) (*TableLimiter, error) {
+	limits, err := parseTableLimits(c.TableConcurrency)
+	if err != nil || len(limits) == 0 {
+		return nil, err
+	}
+	return NewTableLimiter(db, limits), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TenantMode selects how a connection is scoped to a tenant
+type TenantMode int
+
+const (
+	TenantSchema  TenantMode = iota // search_path set to the tenant's schema (default)
+	TenantSetting                   // A custom setting such as app.tenant_id, for row-level security
+)
+
+// TenantPool hands out connections scoped to one tenant on top of a shared
+// pool. The scope is session-level, so it needs session pooling rather than
+// PgBouncer transaction pooling.
+type TenantPool struct {
+	DB   *pgxpool.Pool
+	Mode TenantMode
+
+	Schema  func(tenantID string) string // Tenant schema name, default "tenant_" + ID
+	Shared  []string                     // Schemas searched after the tenant's, default public
+	Setting string                       // Setting name for TenantSetting, default app.tenant_id
+}
+
+// TenantConn is a pooled connection scoped to a tenant. Release it with
+// Release, which clears the scope before returning it to the pool.
+type TenantConn struct {
+	*pgxpool.Conn
+	TenantID string
+	pool     *TenantPool
+}
+
+// Acquire returns a connection scoped to tenantID, or when it is empty to
+// the tenant set with dbctx.WithTenant
+func (p *TenantPool) Acquire(ctx context.Context, tenantID string) (*TenantConn, error) {
+	if tenantID == "" {
+		id, ok := dbctx.Tenant(ctx)
+		if !ok {
+			return nil, errors.New("tenant id is required")
+		}
+		tenantID = id
+	}
+
+	conn, err := p.DB.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error acquiring connection: %w", err)
+	}
+
+	name, value := p.scope(tenantID)
+	if _, err := conn.Exec(ctx, "SELECT set_config($1, $2, false)", name, value); err != nil {
+		conn.Conn().Close(ctx) // Never return a half-scoped connection to the pool
+		conn.Release()
+		return nil, fmt.Errorf("error scoping connection to tenant %s: %w", tenantID, err)
+	}
+	return &TenantConn{Conn: conn, TenantID: tenantID, pool: p}, nil
+}
+
+// WithTenant runs fn on a connection scoped to tenantID
+func (p *TenantPool) WithTenant(ctx context.Context, tenantID string, fn func(conn *TenantConn) error) error {
+	conn, err := p.Acquire(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return fn(conn)
+}
+
+// Release clears the tenant scope and returns the connection to the pool.
+// A connection that cannot be reset is closed instead.
+func (c *TenantConn) Release() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	name, _ := c.pool.scope(c.TenantID)
+	if _, err := c.Exec(ctx, "RESET "+name); err != nil {
+		slog.Warn("Tenant reset failed, destroying connection",
+			slog.String("tenant", c.TenantID),
+			slog.String("error", err.Error()))
+		c.Conn.Conn().Close(ctx)
+	}
+	c.Conn.Release()
+}
+
+// scope returns the setting and value that scope a session to tenantID
+func (p *TenantPool) scope(tenantID string) (string, string) {
+	if p.Mode == TenantSetting {
+		setting := p.Setting
+		if setting == "" {
+			setting = "app.tenant_id"
+		}
+		return setting, tenantID
+	}
+
+	schema := "tenant_" + tenantID
+	if p.Schema != nil {
+		schema = p.Schema(tenantID)
+	}
+	shared := p.Shared
+	if shared == nil {
+		shared = []string{"public"}
+	}
+
+	path := []string{pgx.Identifier{schema}.Sanitize()}
+	for _, s := range shared {
+		path = append(path, pgx.Identifier{s}.Sanitize())
+	}
+	return "search_path", strings.Join(path, ", ")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/pgerrors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TimeoutLadder retries a read with a longer timeout on each attempt, e.g.
+// 250ms, 1s, 3s, so most reads fail fast while slow ones still get a
+// chance to finish. The last attempt can go to a different pool, such as
+// the primary or a larger replica.
+type TimeoutLadder struct {
+	DB       *pgxpool.Pool
+	Timeouts []time.Duration // One per attempt
+	Final    *pgxpool.Pool   // Optional pool for the last attempt
+
+	// Retryable decides whether a failed attempt is tried again. The
+	// default retries attempt timeouts and errors pgerrors.IsRetryable
+	// accepts.
+	Retryable func(error) bool
+}
+
+// DefaultTimeoutLadder is 250ms, 1s then 3s
+var DefaultTimeoutLadder = []time.Duration{250 * time.Millisecond, time.Second, 3 * time.Second}
+
+func (l *TimeoutLadder) retryable(err error) bool {
+	if l.Retryable != nil {
+		return l.Retryable(err)
+	}
+	return errors.Is(err, context.DeadlineExceeded) || pgerrors.Code(err) == "57014" || pgerrors.IsRetryable(err)
+}
+
+// LadderQuery runs a read through the ladder. Attempts stop early when ctx
+// is done or an error is not retryable.
+func LadderQuery[T any](ctx context.Context, l *TimeoutLadder, sql string, scan pgx.RowToFunc[T], args ...any) ([]T, error) {
+	timeouts := l.Timeouts
+	if len(timeouts) == 0 {
+		timeouts = DefaultTimeoutLadder
+	}
+
+	var err error
+	for attempt, timeout := range timeouts {
+		db := l.DB
+		if attempt == len(timeouts)-1 && l.Final != nil {
+			db = l.Final
+		}
+
+		var result []T
+		result, err = ladderAttempt(ctx, db, timeout, sql, scan, args)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil || !l.retryable(err) || attempt == len(timeouts)-1 {
+			break
+		}
+		slog.Warn("Retrying query with a longer timeout",
+			slog.String("sql", summarizeSQL(sql, 120)),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("timeout", timeout),
+			slog.Duration("next_timeout", timeouts[attempt+1]),
+			slog.String("error", err.Error()))
+	}
+	return nil, err
+}
+
+func ladderAttempt[T any](ctx context.Context, db *pgxpool.Pool, timeout time.Duration, sql string, scan pgx.RowToFunc[T], args []any) ([]T, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scan)
+}
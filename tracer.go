@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WithTracer adds a query tracer to the pool. Tracers already configured are
+// kept and run first.
+func WithTracer(t pgx.QueryTracer) PoolOption {
+	return func(s *poolSettings) {
+		cc := s.config.ConnConfig
+		switch prev := cc.Tracer.(type) {
+		case nil:
+			cc.Tracer = t
+		case *multitracer.Tracer:
+			cc.Tracer = multitracer.New(append(prev.QueryTracers, t)...)
+		default:
+			cc.Tracer = multitracer.New(prev, t)
+		}
+	}
+}
+
+type slowQueryKey struct{}
+
+type slowQueryStart struct {
+	sql   string
+	args  []any
+	start time.Time
+}
+
+// SlowQueryTracer logs statements that take longer than Threshold
+type SlowQueryTracer struct {
+	Threshold time.Duration
+	MaxSQL    int   // SQL is truncated to this many characters, default 200
+	Clock     Clock // Default SystemClock
+
+	explain    atomic.Pointer[pgxpool.Pool]
+	explaining atomic.Bool
+}
+
+// explainableVerbs are the statements EXPLAIN accepts
+var explainableVerbs = map[string]bool{"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "VALUES": true, "TABLE": true}
+
+// ExplainOn attaches the plan of each slow statement to its log entry,
+// from EXPLAIN without ANALYZE on db, so nothing runs twice. One statement
+// is explained at a time; others slow meanwhile are logged without a
+// plan, as are statements EXPLAIN cannot plan outside their session.
+func (t *SlowQueryTracer) ExplainOn(db *pgxpool.Pool) {
+	t.explain.Store(db)
+}
+
+func (t *SlowQueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, slowQueryKey{}, slowQueryStart{sql: data.SQL, args: data.Args, start: clockOr(t.Clock).Now()})
+}
+
+func (t *SlowQueryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	q, ok := ctx.Value(slowQueryKey{}).(slowQueryStart)
+	if !ok {
+		return
+	}
+	elapsed := clockOr(t.Clock).Now().Sub(q.start)
+	if elapsed < t.Threshold {
+		return
+	}
+
+	maxSQL := t.MaxSQL
+	if maxSQL <= 0 {
+		maxSQL = 200
+	}
+	attrs := []any{
+		slog.Duration("duration", elapsed),
+		slog.String("sql", summarizeSQL(q.sql, maxSQL)),
+		slog.Int64("rows", data.CommandTag.RowsAffected()),
+		slog.Uint64("pid", uint64(conn.PgConn().PID())),
+	}
+	if caller := dbctx.Caller(ctx); caller != "" {
+		attrs = append(attrs, slog.String("caller", caller))
+	}
+	if id := dbctx.RequestID(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	if tenant, ok := dbctx.Tenant(ctx); ok {
+		attrs = append(attrs, slog.String("tenant", tenant))
+	}
+	if data.Err != nil {
+		attrs = append(attrs, slog.String("error", data.Err.Error()))
+	}
+
+	db := t.explain.Load()
+	if db == nil || data.Err != nil || !explainableVerbs[ParseStatement(q.sql).Verb] || !t.explaining.CompareAndSwap(false, true) {
+		slog.Warn("Slow query", attrs...)
+		return
+	}
+	go func() {
+		defer t.explaining.Store(false)
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if plan, err := Explain(ctx, db, q.sql, q.args...); err != nil {
+			attrs = append(attrs, slog.String("plan_error", err.Error()))
+		} else {
+			attrs = append(attrs, slog.String("plan", plan.String()))
+		}
+		slog.Warn("Slow query", attrs...)
+	}()
+}
+
+// WithSlowQueryPlans logs slow statements like WithTracer(&SlowQueryTracer{})
+// with their plans attached, explained on the pool being built
+func WithSlowQueryPlans(threshold time.Duration) PoolOption {
+	t := &SlowQueryTracer{Threshold: threshold}
+	return func(s *poolSettings) {
+		WithTracer(t)(s)
+		s.created = append(s.created, t.ExplainOn)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TTLTable expires rows of a cache- or session-like table: rows carry an
+// expires_at column, a partial index finds the expired ones, and a batched
+// deleter removes them through Backfill, so it backs off when the pool or a
+// replica is under pressure. Rows with a NULL expiry are kept.
+type TTLTable struct {
+	DB      *pgxpool.Pool
+	Active  *ActivePool   // Optional, used instead of DB once set
+	Replica *pgxpool.Pool // Optional, deletes pause while its lag is high
+	Metrics *PoolMetrics  // Optional, deleted rows are added to Expired
+	Table   string
+	Column  string // Default expires_at
+
+	BatchSize int           // Rows deleted per statement, default 1000
+	Interval  time.Duration // Time between sweeps in Run, default 1m
+	Clock     Clock         // Default SystemClock
+
+	mu    sync.Mutex
+	stats TTLStats
+}
+
+// TTLStats counts what a TTLTable has expired
+type TTLStats struct {
+	Expired   int64     // Rows deleted since start
+	Sweeps    int64     // Completed sweeps
+	LastSweep time.Time // When the last sweep finished
+	LastRate  float64   // Rows per second deleted by the last sweep, pauses excluded
+}
+
+func (t *TTLTable) column() string {
+	if t.Column == "" {
+		return "expires_at"
+	}
+	return t.Column
+}
+
+// Setup adds the expiry column and its partial index if they are missing.
+// The index is built concurrently so the table stays writable.
+func (t *TTLTable) Setup(ctx context.Context) error {
+	col := pgx.Identifier{t.column()}.Sanitize()
+	if _, err := t.Active.Or(t.DB).Exec(ctx, "ALTER TABLE "+sanitizeTable(t.Table)+" ADD COLUMN IF NOT EXISTS "+col+" timestamptz"); err != nil {
+		return fmt.Errorf("error adding %s to %s: %w", t.column(), t.Table, err)
+	}
+
+	name := pgx.Identifier{t.Table[strings.LastIndexByte(t.Table, '.')+1:] + "_" + t.column() + "_idx"}.Sanitize()
+	app := &App{DBClient: t.Active.Or(t.DB)}
+	return app.CreateIndexConcurrently(ctx,
+		"CREATE INDEX IF NOT EXISTS "+name+" ON "+sanitizeTable(t.Table)+" ("+col+") WHERE "+col+" IS NOT NULL")
+}
+
+// deleteBatch removes one batch of expired rows. SKIP LOCKED keeps
+// concurrent sweepers and writers from waiting on each other.
+func (t *TTLTable) deleteBatch(ctx context.Context, db *pgxpool.Pool) (int64, error) {
+	batch := t.BatchSize
+	if batch <= 0 {
+		batch = 1000
+	}
+	col := pgx.Identifier{t.column()}.Sanitize()
+	tag, err := db.Exec(ctx, `DELETE FROM `+sanitizeTable(t.Table)+` WHERE ctid = ANY (ARRAY(
+		SELECT ctid FROM `+sanitizeTable(t.Table)+` WHERE `+col+` < now() LIMIT $1 FOR UPDATE SKIP LOCKED))`, batch)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired rows from %s: %w", t.Table, err)
+	}
+
+	t.mu.Lock()
+	t.stats.Expired += tag.RowsAffected()
+	t.mu.Unlock()
+	t.Metrics.addExpired(tag.RowsAffected())
+	return tag.RowsAffected(), nil
+}
+
+// Sweep deletes expired rows until none are left
+func (t *TTLTable) Sweep(ctx context.Context) (BackfillStats, error) {
+	b := &Backfill{
+		Name:    "ttl " + t.Table,
+		DB:      t.Active.Or(t.DB),
+		Replica: t.Replica,
+		Batch:   t.deleteBatch,
+		Clock:   t.Clock,
+	}
+	stats, err := b.Run(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Sweeps++
+	t.stats.LastSweep = clockOr(t.Clock).Now()
+	t.stats.LastRate = 0
+	if active := stats.Duration - stats.Paused; active > 0 {
+		t.stats.LastRate = float64(stats.Rows) / active.Seconds()
+	}
+	return stats, nil
+}
+
+// Run sweeps every Interval until ctx is cancelled
+func (t *TTLTable) Run(ctx context.Context) error {
+	interval := t.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	for {
+		if _, err := t.Sweep(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("TTL sweep failed", slog.String("table", t.Table), slog.String("error", err.Error()))
+		}
+		if err := clockOr(t.Clock).Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Stats returns expiry counters for monitoring
+func (t *TTLTable) Stats() TTLStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// TTLTables are the tables an App sweeps
+type TTLTables []*TTLTable
+
+// ServeHTTP writes the expiry counters of every table in the Prometheus
+// text format
+func (ts TTLTables) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	stats := make([]TTLStats, len(ts))
+	for i, t := range ts {
+		stats[i] = t.Stats()
+	}
+	var b strings.Builder
+	for _, metric := range []struct {
+		name, kind, help string
+		value            func(TTLStats) string
+	}{
+		{"pgx_ttl_expired_rows_total", "counter", "Expired rows deleted by table.", func(st TTLStats) string { return fmt.Sprint(st.Expired) }},
+		{"pgx_ttl_sweeps_total", "counter", "Completed sweeps by table.", func(st TTLStats) string { return fmt.Sprint(st.Sweeps) }},
+		{"pgx_ttl_last_sweep_rows_per_second", "gauge", "Delete rate of the last sweep by table, pauses excluded.", func(st TTLStats) string { return fmt.Sprint(st.LastRate) }},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, st := range stats {
+			fmt.Fprintf(&b, "%s{table=%s} %s\n", metric.name, promLabel(ts[i].Table), metric.value(st))
+		}
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// parseTTLTables parses "table,schema.table=column"
+func parseTTLTables(s string) (TTLTables, error) {
+	var tables TTLTables
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		table, column, _ := strings.Cut(item, "=")
+		if table = strings.TrimSpace(table); table == "" {
+			return nil, fmt.Errorf("invalid TTL table %q: expected table or table=column", item)
+		}
+		tables = append(tables, &TTLTable{Table: table, Column: strings.TrimSpace(column)})
+	}
+	return tables, nil
+}
+
+// ttlTables builds the sweepers of PG_TTL_TABLES, counting into metrics.
+// The tables must already have their expiry column; see Setup.
+func (c *DBConfig) ttlTables(db, replica *pgxpool.Pool, active *ActivePool, metrics *PoolMetrics) (TTLTables, error) {
+	tables, err := parseTTLTables(c.TTLTables)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	for _, t := range tables {
+		t.DB, t.Active, t.Replica, t.Metrics = db, active, replica, metrics
+	}
+	return tables, nil
+}
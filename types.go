@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	pgxdecimal "github.com/jackc/pgx-shopspring-decimal"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// withTypes registers extra types on every new connection's type map
+func withTypes(register func(m *pgtype.Map)) PoolOption {
+	return withConnTypes(func(_ context.Context, conn *pgx.Conn) error {
+		register(conn.TypeMap())
+		return nil
+	})
+}
+
+// withConnTypes runs register on every new connection, after any
+// AfterConnect hook already installed, for types that must be looked up
+// on the server first
+func withConnTypes(register func(ctx context.Context, conn *pgx.Conn) error) PoolOption {
+	return func(s *poolSettings) {
+		prev := s.config.AfterConnect
+		s.config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			if prev != nil {
+				if err := prev(ctx, conn); err != nil {
+					return err
+				}
+			}
+			return register(ctx, conn)
+		}
+	}
+}
+
+// WithUUIDCodec makes uuid and uuid[] columns scan into uuid.UUID and
+// []uuid.UUID, and encode them as parameters, in their binary form.
+// Values() and scanning into any return uuid.UUID too.
+func WithUUIDCodec() PoolOption {
+	return withTypes(func(m *pgtype.Map) {
+		t := &pgtype.Type{Name: "uuid", OID: pgtype.UUIDOID, Codec: uuidCodec{}}
+		m.RegisterType(t)
+		m.RegisterType(&pgtype.Type{Name: "_uuid", OID: pgtype.UUIDArrayOID, Codec: &pgtype.ArrayCodec{ElementType: t}})
+	})
+}
+
+// WithDecimalCodec makes numeric columns scan into decimal.Decimal and
+// decimal.NullDecimal, and encode them as parameters, without going through
+// float64. Values() and scanning into any return decimal.Decimal too.
+func WithDecimalCodec() PoolOption {
+	return withTypes(pgxdecimal.Register)
+}
+
+// uuidCodec is pgtype.UUIDCodec with plans for uuid.UUID, which would
+// otherwise go through its sql.Scanner and driver.Valuer text forms
+type uuidCodec struct {
+	pgtype.UUIDCodec
+}
+
+func (c uuidCodec) PlanEncode(m *pgtype.Map, oid uint32, format int16, value any) pgtype.EncodePlan {
+	if _, ok := value.(uuid.UUID); ok {
+		if next := c.UUIDCodec.PlanEncode(m, oid, format, pgtype.UUID{}); next != nil {
+			return encodePlanUUID{next: next}
+		}
+	}
+	return c.UUIDCodec.PlanEncode(m, oid, format, value)
+}
+
+func (c uuidCodec) PlanScan(m *pgtype.Map, oid uint32, format int16, target any) pgtype.ScanPlan {
+	if _, ok := target.(*uuid.UUID); ok {
+		if next := c.UUIDCodec.PlanScan(m, oid, format, &pgtype.UUID{}); next != nil {
+			return scanPlanUUID{next: next}
+		}
+	}
+	return c.UUIDCodec.PlanScan(m, oid, format, target)
+}
+
+func (c uuidCodec) DecodeValue(m *pgtype.Map, oid uint32, format int16, src []byte) (any, error) {
+	if src == nil {
+		return nil, nil
+	}
+	var u uuid.UUID
+	if err := c.PlanScan(m, oid, format, &u).Scan(src, &u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+type encodePlanUUID struct {
+	next pgtype.EncodePlan
+}
+
+func (p encodePlanUUID) Encode(value any, buf []byte) ([]byte, error) {
+	return p.next.Encode(pgtype.UUID{Bytes: value.(uuid.UUID), Valid: true}, buf)
+}
+
+type scanPlanUUID struct {
+	next pgtype.ScanPlan
+}
+
+func (p scanPlanUUID) Scan(src []byte, dst any) error {
+	var v pgtype.UUID
+	if err := p.next.Scan(src, &v); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return errors.New("cannot scan NULL into *uuid.UUID")
+	}
+	*dst.(*uuid.UUID) = v.Bytes
+	return nil
+}
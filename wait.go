@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WaitForDB blocks until the database accepts TCP connections and answers a
+// Ping, retrying with backoff until timeout. Run it before NewPg when the
+// database may still be starting, e.g. next to it in docker compose.
+func WaitForDB(ctx context.Context, cfg *DBConfig, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	db, pgxConfig, err := newLazyPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	clock := clockOr(cfg.Clock)
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = dialDB(ctx, pgxConfig)
+		if err == nil {
+			attemptCtx, cancelAttempt := context.WithTimeout(ctx, 5*time.Second)
+			err = db.Ping(attemptCtx)
+			cancelAttempt()
+		}
+		if err == nil {
+			slog.Info("Database is ready", slog.Int("attempts", attempt))
+			return nil
+		}
+
+		slog.Info("Waiting for database", slog.Int("attempt", attempt), slog.String("error", err.Error()))
+		if clock.Sleep(ctx, backoff) != nil {
+			return fmt.Errorf("database not ready after %s: %w", timeout, err)
+		}
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
+// newLazyPool builds a pool that connects on first use, through the same
+// hooks (IAM tokens, secret stores) the application's pool uses
+func newLazyPool(ctx context.Context, cfg *DBConfig) (*pgxpool.Pool, *pgx.ConnConfig, error) {
+	lazy := *cfg
+	lazy.LazyConnect = true
+	lazy.MinConns = 0
+	pgxConfig, err := WithPgxConfig(&lazy)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := NewPg(ctx, &lazy, pgxConfig)
+	return db, pgxConfig, err
+}
+
+// dialDB checks that some configured host accepts TCP connections. Unix
+// sockets are left to Ping.
+func dialDB(ctx context.Context, config *pgx.ConnConfig) error {
+	addrs := []string{net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))}
+	for _, fb := range config.Fallbacks {
+		if addr := net.JoinHostPort(fb.Host, strconv.Itoa(int(fb.Port))); !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	var errs []error
+	var dialer net.Dialer
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "/") {
+			return nil
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+		cancel()
+		if err == nil {
+			return conn.Close()
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/adityapatel-00/go-pgxpool/dbctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WorkloadTag is the dbctx tag that routes a context's queries explicitly:
+// "olap" sends reads to the analytics pool and "oltp" keeps them on the
+// main one, skipping classification
+const WorkloadTag = "workload"
+
+// WorkloadRouter sends analytical reads to a smaller pool with longer
+// timeouts, such as App.Analytics, so report queries never exhaust the
+// OLTP pool. A read-only statement is analytical when its context is tagged
+// with WorkloadTag "olap", when it aggregates heavily (GROUP BY, window
+// functions or several aggregate calls), or, with CostThreshold set, when
+// the planner estimates its cost above the threshold. Writes and row locks
+// always stay on OLTP.
+//
+// Decisions are cached per normalized statement, so EXPLAIN runs once per
+// statement shape rather than per call. dbctx.ForcePrimary and
+// dbctx.WithPool with PoolPrimary keep a context's queries on OLTP, and
+// PoolAnalytics sends them to OLAP, writes included.
+type WorkloadRouter struct {
+	OLTP          *pgxpool.Pool
+	OLAP          *pgxpool.Pool
+	Active        *ActivePool // Optional, used instead of OLTP, and of OLAP when they are the same pool
+	CostThreshold float64     // Planner total cost above which a read is analytical, zero skips EXPLAIN
+	MaxCached     int         // Statement decisions kept, default 1000
+
+	olap atomic.Int64
+	oltp atomic.Int64
+
+	mu        sync.Mutex
+	decisions map[string]bool
+}
+
+// NewWorkloadRouter creates a router between the two pools
+func NewWorkloadRouter(oltp, olap *pgxpool.Pool) *WorkloadRouter {
+	return &WorkloadRouter{OLTP: oltp, OLAP: olap}
+}
+
+// Routed returns how many statements went to each pool
+func (r *WorkloadRouter) Routed() (oltp, olap int64) {
+	return r.oltp.Load(), r.olap.Load()
+}
+
+// aggregateFuncs are the calls counted as aggregation
+var aggregateFuncs = map[string]bool{
+	"count": true, "sum": true, "avg": true, "min": true, "max": true,
+	"array_agg": true, "string_agg": true, "json_agg": true, "jsonb_agg": true, "json_object_agg": true, "jsonb_object_agg": true,
+	"stddev": true, "stddev_pop": true, "stddev_samp": true, "variance": true, "var_pop": true, "var_samp": true,
+	"percentile_cont": true, "percentile_disc": true, "mode": true, "bool_and": true, "bool_or": true, "every": true,
+}
+
+// aggregateHeavy reports whether sql groups, uses window functions or
+// calls several aggregates
+func aggregateHeavy(sql string) bool {
+	tokens := tokenizeSQL(sql)
+	aggregates := 0
+	for i, t := range tokens {
+		if t.kind != tokWord || i+1 >= len(tokens) {
+			continue
+		}
+		next := tokens[i+1]
+		switch {
+		case t.text == "group" && next.is("by"):
+			return true
+		case t.text == "over" && (next.kind == tokOther && next.text == "(" || next.kind == tokWord):
+			return true
+		case aggregateFuncs[t.text] && next.kind == tokOther && next.text == "(":
+			aggregates++
+		}
+	}
+	return aggregates >= 2
+}
+
+// analytical decides where a statement runs, caching the decision
+func (r *WorkloadRouter) analytical(ctx context.Context, sql string, args []any) bool {
+	switch dbctx.Tags(ctx)[WorkloadTag] {
+	case "olap":
+		return ParseStatement(sql).ReadOnly
+	case "oltp":
+		return false
+	}
+
+	key := NormalizeSQL(sql)
+	r.mu.Lock()
+	olap, ok := r.decisions[key]
+	r.mu.Unlock()
+	if ok {
+		return olap
+	}
+
+	olap = ParseStatement(sql).ReadOnly && (aggregateHeavy(sql) || r.costly(ctx, sql, args))
+
+	maxCached := r.MaxCached
+	if maxCached <= 0 {
+		maxCached = 1000
+	}
+	r.mu.Lock()
+	if r.decisions == nil || len(r.decisions) >= maxCached {
+		r.decisions = make(map[string]bool)
+	}
+	r.decisions[key] = olap
+	r.mu.Unlock()
+	return olap
+}
+
+// costly reports whether the planner estimates sql above CostThreshold.
+// A failed EXPLAIN counts as cheap, leaving the statement on OLTP.
+func (r *WorkloadRouter) costly(ctx context.Context, sql string, args []any) bool {
+	if r.CostThreshold <= 0 {
+		return false
+	}
+	plan, err := Explain(ctx, r.Active.Or(r.OLTP), sql, args...)
+	if err != nil {
+		return false
+	}
+	return plan.Plan.TotalCost > r.CostThreshold
+}
+
+// Pool returns the pool sql runs on
+func (r *WorkloadRouter) Pool(ctx context.Context, sql string, args ...any) *pgxpool.Pool {
+	switch name := dbctx.Pool(ctx); {
+	case dbctx.PrimaryForced(ctx) || name == PoolPrimary:
+	case r.OLAP != nil && (name == PoolAnalytics || r.OLAP != r.OLTP && r.analytical(ctx, sql, args)):
+		r.olap.Add(1)
+		if r.OLAP == r.OLTP {
+			return r.Active.Or(r.OLTP)
+		}
+		return r.OLAP
+	}
+	r.oltp.Add(1)
+	return r.Active.Or(r.OLTP)
+}
+
+// Exec runs a statement on the pool for its workload
+func (r *WorkloadRouter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return r.Pool(ctx, sql, args...).Exec(ctx, sql, args...)
+}
+
+// Query runs a query on the pool for its workload
+func (r *WorkloadRouter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return r.Pool(ctx, sql, args...).Query(ctx, sql, args...)
+}
+
+// QueryRow runs a single-row query on the pool for its workload
+func (r *WorkloadRouter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return r.Pool(ctx, sql, args...).QueryRow(ctx, sql, args...)
+}